@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrOrderNotFound   = fmt.Errorf("order %w", ErrNotFound)
+	ErrOutOfStock      = errors.New("out of stock")
+	ErrPaymentDeclined = errors.New("payment declined")
+	ErrDuplicateOrder  = errors.New("order already exists")
+	ErrVersionConflict = errors.New("order was changed concurrently")
+	// ErrStaleVersion is a conditional change of an order that is no longer at the version the
+	// caller expected, see WithExpectedVersion
+	ErrStaleVersion = fmt.Errorf("%w: not at the expected version", ErrVersionConflict)
+	// ErrInvalidRequest is an order request that fails Validate
+	ErrInvalidRequest = errors.New("invalid request")
+)
+
+// StockError lists the products that aren't available, it matches ErrOutOfStock
+type StockError struct {
+	Products []string
+}
+
+func (e *StockError) Error() string {
+	return fmt.Sprintf("out of stock: %s", strings.Join(e.Products, ", "))
+}
+
+func (e *StockError) Is(target error) bool {
+	return target == ErrOutOfStock
+}
+
+// PaymentError is a payment the provider refused, it matches ErrPaymentDeclined
+type PaymentError struct {
+	OrderID string
+	Reason  string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment for order %s declined: %s", e.OrderID, e.Reason)
+}
+
+func (e *PaymentError) Is(target error) bool {
+	return target == ErrPaymentDeclined
+}
+
+// VersionConflictError is an update based on a stale version, it matches ErrVersionConflict.
+// Read the order again and retry.
+type VersionConflictError struct {
+	OrderID  string
+	Expected int
+	Actual   int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("order %s is at version %d, not %d", e.OrderID, e.Actual, e.Expected)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
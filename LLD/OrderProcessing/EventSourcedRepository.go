@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// defaultSnapshotEvery keeps loading an order to a snapshot and at most a few events
+const defaultSnapshotEvery = 5
+
+// EventSourcedOrderRepository keeps every change of an order as an event. Writes load the
+// aggregate from its latest snapshot and the events after it, and append what changed; reads
+// come from the order-by-id and orders-by-user projections, which catch up with the store first.
+// A snapshot is taken every snapshotEvery events of a stream.
+type EventSourcedOrderRepository struct {
+	store         EventStore
+	snapshots     SnapshotStore
+	snapshotEvery int
+	byID          *OrderByIDProjection
+	byUser        *OrdersByUserProjection
+	projector     *Projector
+}
+
+func NewEventSourcedOrderRepository(store EventStore, snapshots SnapshotStore, snapshotEvery int) *EventSourcedOrderRepository {
+	repo := &EventSourcedOrderRepository{
+		store:         store,
+		snapshots:     snapshots,
+		snapshotEvery: max(snapshotEvery, 1),
+		byID:          NewOrderByIDProjection(),
+		byUser:        NewOrdersByUserProjection(),
+	}
+	repo.projector = NewProjector(store, repo.byID, repo.byUser)
+	return repo
+}
+
+// load rebuilds an aggregate, a stream that doesn't exist is an empty aggregate
+func (repo *EventSourcedOrderRepository) load(ctx context.Context, orderID string) (*OrderAggregate, error) {
+	aggregate := &OrderAggregate{}
+	snapshot, exists, err := repo.snapshots.LoadSnapshot(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		aggregate.Order, aggregate.Deleted, aggregate.Version = snapshot.Order, snapshot.Deleted, snapshot.Version
+	}
+	events, err := repo.store.Load(ctx, orderID, aggregate.Version)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if err := aggregate.Apply(event); err != nil {
+			return nil, err
+		}
+	}
+	return aggregate, nil
+}
+
+// commit appends what the aggregate recorded and snapshots it when it crossed a multiple of
+// snapshotEvery. Once the events are appended the write has happened, so the projections are
+// left to catch up on the next read rather than fail it.
+func (repo *EventSourcedOrderRepository) commit(ctx context.Context, aggregate *OrderAggregate, outbox []OrderEvent) error {
+	expected := aggregate.Version - len(aggregate.changes)
+	if err := repo.store.Append(ctx, aggregate.Order.OrderID, expected, aggregate.changes, outbox); err != nil {
+		return err
+	}
+	aggregate.changes = nil
+
+	if aggregate.Version/repo.snapshotEvery > expected/repo.snapshotEvery {
+		snapshot := OrderSnapshot{Order: clone(aggregate.Order), Deleted: aggregate.Deleted, Version: aggregate.Version}
+		// The events are safe, a missing snapshot only makes the next load replay more of them
+		if err := repo.snapshots.SaveSnapshot(ctx, snapshot); err != nil {
+			fmt.Printf("Snapshot of order %s failed: %v\n", aggregate.Order.OrderID, err)
+		}
+	}
+	return nil
+}
+
+func (repo *EventSourcedOrderRepository) Save(ctx context.Context, order *Order, events ...OrderEvent) error {
+	aggregate, err := repo.load(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	if err := aggregate.Create(*order); err != nil {
+		return err
+	}
+	err = repo.commit(ctx, aggregate, events)
+	if errors.Is(err, ErrVersionConflict) {
+		// Someone else wrote the stream since the load, i.e. created the order first
+		return fmt.Errorf("order %s: %w", order.OrderID, ErrDuplicateOrder)
+	}
+	if err != nil {
+		return err
+	}
+	order.Version = 1
+	return nil
+}
+
+func (repo *EventSourcedOrderRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
+	aggregate, err := repo.load(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	if err := aggregate.Change(*order); err != nil {
+		return err
+	}
+	err = repo.commit(ctx, aggregate, events)
+	if errors.Is(err, ErrVersionConflict) {
+		// Report the order version that won, not the stream's
+		if current, loadErr := repo.load(ctx, order.OrderID); loadErr == nil {
+			return &VersionConflictError{OrderID: order.OrderID, Expected: order.Version, Actual: current.Order.Version}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	order.Version++
+	return nil
+}
+
+// Delete appends OrderDeleted, the order's history stays in the store
+func (repo *EventSourcedOrderRepository) Delete(ctx context.Context, orderID string) error {
+	aggregate, err := repo.load(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if err := aggregate.Delete(time.Now()); err != nil {
+		return err
+	}
+	return repo.commit(ctx, aggregate, nil)
+}
+
+func (repo *EventSourcedOrderRepository) FindByID(ctx context.Context, orderID string) (Order, error) {
+	if err := repo.projector.CatchUp(ctx); err != nil {
+		return Order{}, err
+	}
+	order, exists := repo.byID.Get(orderID)
+	if !exists {
+		return Order{}, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+func (repo *EventSourcedOrderRepository) FindByUser(ctx context.Context, userID int) ([]Order, error) {
+	if err := repo.projector.CatchUp(ctx); err != nil {
+		return nil, err
+	}
+	var orders []Order
+	for _, orderID := range repo.byUser.OrderIDs(userID) {
+		if order, exists := repo.byID.Get(orderID); exists {
+			orders = append(orders, order)
+		}
+	}
+	var filter OrderFilter
+	sort.Slice(orders, func(i, j int) bool {
+		return filter.before(filter.key(orders[i]), filter.key(orders[j]))
+	})
+	return orders, nil
+}
+
+// List sorts the matching orders of the projection, it is meant for the sizes an in-process
+// projection holds
+func (repo *EventSourcedOrderRepository) List(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error) {
+	if err := filter.validate(); err != nil {
+		return OrderPage{}, err
+	}
+	after, err := filter.decodeCursor(cursor)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	limit = pageSize(limit)
+	if err := repo.projector.CatchUp(ctx); err != nil {
+		return OrderPage{}, err
+	}
+
+	var candidates []Order
+	if filter.UserID == 0 {
+		candidates = repo.byID.All()
+	} else {
+		for _, orderID := range repo.byUser.OrderIDs(filter.UserID) {
+			if order, exists := repo.byID.Get(orderID); exists {
+				candidates = append(candidates, order)
+			}
+		}
+	}
+	var matches []Order
+	for _, order := range candidates {
+		if filter.matches(order) && (after == nil || filter.before(*after, filter.key(order))) {
+			matches = append(matches, order)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return filter.before(filter.key(matches[i]), filter.key(matches[j]))
+	})
+	return filter.page(matches[:min(len(matches), limit+1)], limit), nil
+}
+
+func (repo *EventSourcedOrderRepository) Count(ctx context.Context) (int, error) {
+	if err := repo.projector.CatchUp(ctx); err != nil {
+		return 0, err
+	}
+	return repo.byID.Len(), nil
+}
+
+// History returns every event of the order, including those before a deletion
+func (repo *EventSourcedOrderRepository) History(ctx context.Context, orderID string) ([]StoredEvent, error) {
+	events, err := repo.store.Load(ctx, orderID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	return events, nil
+}
+
+// RebuildProjections replays the whole store into the read models
+func (repo *EventSourcedOrderRepository) RebuildProjections(ctx context.Context) error {
+	return repo.projector.Rebuild(ctx)
+}
+
+func (repo *EventSourcedOrderRepository) PendingEvents(ctx context.Context, limit int) ([]OrderEvent, error) {
+	return repo.store.PendingEvents(ctx, limit)
+}
+
+func (repo *EventSourcedOrderRepository) MarkPublished(ctx context.Context, eventIDs ...string) error {
+	return repo.store.MarkPublished(ctx, eventIDs...)
+}
+
+func (repo *EventSourcedOrderRepository) MarkFailed(ctx context.Context, eventID string, retryAt time.Time, park bool) error {
+	return repo.store.MarkFailed(ctx, eventID, retryAt, park)
+}
+
+func (repo *EventSourcedOrderRepository) ParkedEvents(ctx context.Context) ([]OrderEvent, error) {
+	return repo.store.ParkedEvents(ctx)
+}
+
+func (repo *EventSourcedOrderRepository) Unpark(ctx context.Context, eventIDs ...string) error {
+	return repo.store.Unpark(ctx, eventIDs...)
+}
+
+// demoEvents takes an order through its lifecycle and shows what the event store kept of it
+func demoEvents(ctx context.Context, service IOrderService, repo *EventSourcedOrderRepository) {
+	order, err := service.CreateOrder(ctx, OrderRequest{UserID: 9, Items: []OrderItem{{SKU: "item1", Qty: 1}, {SKU: "item2", Qty: 1}}})
+	if err != nil {
+		fmt.Println("Create failed:", err)
+		return
+	}
+	for _, status := range []OrderStatus{StatusFulfilling, StatusShipped, StatusDelivered} {
+		if _, err := service.UpdateOrder(ctx, order.OrderID, status); err != nil {
+			fmt.Println("Update failed:", err)
+			return
+		}
+	}
+	if err := repo.Delete(ctx, order.OrderID); err != nil {
+		fmt.Println("Delete failed:", err)
+		return
+	}
+	if _, err := service.GetOrder(ctx, order.OrderID); errors.Is(err, ErrNotFound) {
+		fmt.Println("After deleting the order, get failed:", err)
+	}
+
+	history, err := repo.History(ctx, order.OrderID)
+	if err != nil {
+		fmt.Println("History failed:", err)
+		return
+	}
+	fmt.Printf("History of order %s:\n", order.OrderID)
+	for _, event := range history {
+		fmt.Printf("  %d %s %s\n", event.Version, event.Type, event.Data)
+	}
+	if snapshot, exists, err := repo.snapshots.LoadSnapshot(ctx, order.OrderID); err == nil && exists {
+		fmt.Printf("Snapshot at event %d: %s, deleted: %t\n", snapshot.Version, snapshot.Order.OrderStatus, snapshot.Deleted)
+	}
+
+	// A second order, then the read models are thrown away and replayed from the store
+	if _, err := service.CreateOrder(ctx, OrderRequest{UserID: 9, Items: []OrderItem{{SKU: "item3", Qty: 1}}}); err != nil {
+		fmt.Println("Create failed:", err)
+		return
+	}
+	if err := repo.RebuildProjections(ctx); err != nil {
+		fmt.Println("Rebuild failed:", err)
+		return
+	}
+	orders, err := service.ListOrders(ctx, 9)
+	if err != nil {
+		fmt.Println("List failed:", err)
+		return
+	}
+	for _, order := range orders {
+		fmt.Printf("After the rebuild user 9 has order %s: %s, version %d\n", order.OrderID, order.OrderStatus, order.Version)
+	}
+}
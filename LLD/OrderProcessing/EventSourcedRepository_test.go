@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// projectedState is everything the projections of repo hold, in a comparable order
+type projectedState struct {
+	orders []Order
+	byUser map[int][]string
+}
+
+func projected(repo *EventSourcedOrderRepository) projectedState {
+	state := projectedState{orders: repo.byID.All(), byUser: make(map[int][]string)}
+	sort.Slice(state.orders, func(i, j int) bool { return state.orders[i].OrderID < state.orders[j].OrderID })
+	for _, order := range state.orders {
+		state.byUser[order.UserID] = repo.byUser.OrderIDs(order.UserID)
+		sort.Strings(state.byUser[order.UserID])
+	}
+	return state
+}
+
+// writeHistory gives repo a few orders of two users, with updates, a move to another user and a deletion
+func writeHistory(t *testing.T, repo *EventSourcedOrderRepository) {
+	t.Helper()
+	ctx := t.Context()
+	orders := []Order{
+		contractOrder("order-1", 1, contractTime),
+		contractOrder("order-2", 1, contractTime.Add(1)),
+		contractOrder("order-3", 2, contractTime.Add(2)),
+	}
+	for i := range orders {
+		if err := repo.Save(ctx, &orders[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, status := range []OrderStatus{StatusPaymentPending, StatusPaid, StatusFulfilling, StatusShipped} {
+		orders[0].OrderStatus = status
+		if err := repo.Update(ctx, &orders[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orders[2].UserID = 3
+	if err := repo.Update(ctx, &orders[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, "order-2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildProjectionsMatchesIncrementalProjections(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewEventSourcedOrderRepository(store, NewInMemorySnapshotStore(), 2)
+	writeHistory(t, repo)
+	if _, err := repo.Count(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	incremental := projected(repo)
+	if len(incremental.orders) != 2 || len(incremental.byUser[3]) != 1 || len(incremental.byUser[2]) != 0 {
+		t.Fatalf("incremental projections %+v, want order-1 of user 1 and order-3 moved to user 3", incremental)
+	}
+
+	// lose the read models, then rebuild them from the store
+	repo.byID.Reset()
+	repo.byUser.Reset()
+	if err := repo.RebuildProjections(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := projected(repo); !reflect.DeepEqual(rebuilt, incremental) {
+		t.Errorf("rebuilt projections %+v, want the incremental %+v", rebuilt, incremental)
+	}
+
+	// a new repository over the same store builds the same read models from scratch
+	fresh := NewEventSourcedOrderRepository(store, NewInMemorySnapshotStore(), 2)
+	if _, err := fresh.Count(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := projected(fresh); !reflect.DeepEqual(rebuilt, incremental) {
+		t.Errorf("projections of a new repository %+v, want the incremental %+v", rebuilt, incremental)
+	}
+
+	history, err := repo.History(t.Context(), "order-2")
+	if err != nil || len(history) != 2 || history[1].Type != OrderDeleted {
+		t.Errorf("history of the deleted order %+v, %v, want its creation and deletion", history, err)
+	}
+}
+
+func TestLoadFromSnapshotMatchesFullReplay(t *testing.T) {
+	ctx := t.Context()
+	store := NewInMemoryEventStore()
+	snapshots := NewInMemorySnapshotStore()
+	repo := NewEventSourcedOrderRepository(store, snapshots, 2)
+	writeHistory(t, repo)
+
+	snapshot, exists, err := snapshots.LoadSnapshot(ctx, "order-1")
+	if err != nil || !exists || snapshot.Version != 4 {
+		t.Fatalf("snapshot of order-1 at version %d, exists %v, %v, want one at 4 of its 5 events", snapshot.Version, exists, err)
+	}
+
+	// without snapshots every load replays the whole stream
+	replaying := NewEventSourcedOrderRepository(store, NewInMemorySnapshotStore(), 1000)
+	for _, orderID := range []string{"order-1", "order-2", "order-3"} {
+		fromSnapshot, err := repo.load(ctx, orderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := replaying.load(ctx, orderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sameOrder(fromSnapshot.Order, replayed.Order); err != nil {
+			t.Errorf("%s: %v", orderID, err)
+		}
+		if fromSnapshot.Version != replayed.Version || fromSnapshot.Deleted != replayed.Deleted {
+			t.Errorf("%s: version %d, deleted %v from the snapshot, want %d, %v",
+				orderID, fromSnapshot.Version, fromSnapshot.Deleted, replayed.Version, replayed.Deleted)
+		}
+	}
+}
+
+// failingProjection refuses every event
+type failingProjection struct{}
+
+func (failingProjection) Reset() {}
+
+func (failingProjection) Apply(event StoredEvent) error {
+	return fmt.Errorf("projection can't apply %s", event.Type)
+}
+
+func TestWriteSucceedsWhenAProjectionFails(t *testing.T) {
+	ctx := t.Context()
+	store := NewInMemoryEventStore()
+	repo := NewEventSourcedOrderRepository(store, NewInMemorySnapshotStore(), 2)
+	repo.projector = NewProjector(store, repo.byID, failingProjection{})
+
+	order := contractOrder("order-1", 1, contractTime)
+	// the events are stored, a retry would be a duplicate
+	if err := repo.Save(ctx, &order); err != nil || order.Version != 1 {
+		t.Fatalf("Save with a failing projection: version %d, %v, want it saved", order.Version, err)
+	}
+	if history, err := repo.History(ctx, "order-1"); err != nil || len(history) != 1 {
+		t.Fatalf("history %+v, %v, want the created event", history, err)
+	}
+	if err := repo.Save(ctx, &order); !errors.Is(err, ErrDuplicateOrder) {
+		t.Errorf("saving again: %v, want ErrDuplicateOrder", err)
+	}
+	// reads are the ones that need the projections
+	if _, err := repo.FindByID(ctx, "order-1"); err == nil {
+		t.Error("FindByID with a failing projection succeeded")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// EventStore is an append-only log of order streams. It also keeps the outbox, so the events of
+// an order and the messages about them are written together.
+type EventStore interface {
+	// Append adds events to the stream if it is still at expectedVersion, 0 for a new stream, and
+	// returns a *VersionConflictError when it isn't
+	Append(ctx context.Context, streamID string, expectedVersion int, events []StoredEvent, outbox []OrderEvent) error
+	// Load returns the events of a stream after version after
+	Load(ctx context.Context, streamID string, after int) ([]StoredEvent, error)
+	// ReadAll returns up to limit events of all streams after position after, in the order they were appended
+	ReadAll(ctx context.Context, after int64, limit int) ([]StoredEvent, error)
+	OrderOutbox
+}
+
+// InMemoryEventStore keeps the log for the lifetime of the process
+type InMemoryEventStore struct {
+	mu      sync.Mutex
+	log     []StoredEvent      // Position is the index plus one
+	streams map[string][]int64 // positions of each stream's events
+	outbox  memoryOutbox
+}
+
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{
+		streams: make(map[string][]int64),
+	}
+}
+
+// copyEvent copies the data, so callers can't change a stored event through it
+func copyEvent(event StoredEvent) StoredEvent {
+	event.Data = append(json.RawMessage(nil), event.Data...)
+	return event
+}
+
+func (store *InMemoryEventStore) Append(ctx context.Context, streamID string, expectedVersion int, events []StoredEvent, outbox []OrderEvent) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if actual := len(store.streams[streamID]); actual != expectedVersion {
+		return &VersionConflictError{OrderID: streamID, Expected: expectedVersion, Actual: actual}
+	}
+	for i, event := range events {
+		event = copyEvent(event)
+		event.StreamID = streamID
+		event.Version = expectedVersion + i + 1
+		event.Position = int64(len(store.log) + 1)
+		store.log = append(store.log, event)
+		store.streams[streamID] = append(store.streams[streamID], event.Position)
+	}
+	store.outbox.add(outbox)
+	return nil
+}
+
+func (store *InMemoryEventStore) Load(ctx context.Context, streamID string, after int) ([]StoredEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	positions := store.streams[streamID]
+	var events []StoredEvent
+	for _, position := range positions[min(max(after, 0), len(positions)):] {
+		events = append(events, copyEvent(store.log[position-1]))
+	}
+	return events, nil
+}
+
+func (store *InMemoryEventStore) ReadAll(ctx context.Context, after int64, limit int) ([]StoredEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	from := min(max(after, 0), int64(len(store.log)))
+	until := min(from+int64(max(limit, 0)), int64(len(store.log)))
+	var events []StoredEvent
+	for _, event := range store.log[from:until] {
+		events = append(events, copyEvent(event))
+	}
+	return events, nil
+}
+
+func (store *InMemoryEventStore) PendingEvents(ctx context.Context, limit int) ([]OrderEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.outbox.pending(limit, time.Now()), nil
+}
+
+func (store *InMemoryEventStore) MarkPublished(ctx context.Context, eventIDs ...string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.outbox.markPublished(eventIDs)
+	return nil
+}
+
+func (store *InMemoryEventStore) MarkFailed(ctx context.Context, eventID string, retryAt time.Time, park bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.outbox.markFailed(eventID, retryAt, park)
+	return nil
+}
+
+func (store *InMemoryEventStore) ParkedEvents(ctx context.Context) ([]OrderEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.outbox.parkedEvents(), nil
+}
+
+func (store *InMemoryEventStore) Unpark(ctx context.Context, eventIDs ...string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.outbox.unpark(eventIDs)
+	return nil
+}
+
+// OrderSnapshot is an aggregate as of stream version Version, loading starts from it
+type OrderSnapshot struct {
+	Order   Order `json:"order"`
+	Deleted bool  `json:"deleted"`
+	Version int   `json:"version"`
+}
+
+// SnapshotStore keeps the latest snapshot of each order
+type SnapshotStore interface {
+	SaveSnapshot(ctx context.Context, snapshot OrderSnapshot) error
+	LoadSnapshot(ctx context.Context, orderID string) (OrderSnapshot, bool, error)
+}
+
+type InMemorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[string]OrderSnapshot
+}
+
+func NewInMemorySnapshotStore() *InMemorySnapshotStore {
+	return &InMemorySnapshotStore{
+		snapshots: make(map[string]OrderSnapshot),
+	}
+}
+
+// SaveSnapshot ignores a snapshot older than the one it has
+func (store *InMemorySnapshotStore) SaveSnapshot(ctx context.Context, snapshot OrderSnapshot) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if stored, exists := store.snapshots[snapshot.Order.OrderID]; exists && stored.Version >= snapshot.Version {
+		return nil
+	}
+	snapshot.Order = clone(snapshot.Order)
+	store.snapshots[snapshot.Order.OrderID] = snapshot
+	return nil
+}
+
+func (store *InMemorySnapshotStore) LoadSnapshot(ctx context.Context, orderID string) (OrderSnapshot, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	snapshot, exists := store.snapshots[orderID]
+	snapshot.Order = clone(snapshot.Order)
+	return snapshot, exists, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// OrderEventType names what happened to an order
+type OrderEventType string
+
+const (
+	OrderCreated       OrderEventType = "OrderCreated"
+	OrderStatusChanged OrderEventType = "OrderStatusChanged"
+	OrderCancelled     OrderEventType = "OrderCancelled"
+)
+
+const (
+	defaultRelayInterval = 100 * time.Millisecond
+	relayBatchSize       = 100
+)
+
+// OrderEvent is a change to an order as other services see it. Delivery is at least once, so
+// consumers skip EventIDs they have already handled; each write of an order makes one event
+// and the ID is the order ID and the version the write produced.
+type OrderEvent struct {
+	EventID    string         `json:"eventId"`
+	Type       OrderEventType `json:"type"`
+	OrderID    string         `json:"orderId"`
+	Version    int            `json:"version"`
+	From       OrderStatus    `json:"from,omitempty"`
+	Order      Order          `json:"order"`
+	OccurredAt time.Time      `json:"occurredAt"`
+	// Attempts is how often publishing the event failed, the outbox keeps it and it isn't published
+	Attempts int `json:"-"`
+}
+
+// OrderOutbox is the read side of the events the repository wrote with the orders. The events
+// of an order are published in the order they were written, so an event that failed holds the
+// later events of its order until it is retried or, once parked, until it is unparked; the
+// events of the other orders carry on.
+type OrderOutbox interface {
+	// PendingEvents returns up to limit events to publish now, in the order they were written,
+	// leaving out the orders held by a failed event
+	PendingEvents(ctx context.Context, limit int) ([]OrderEvent, error)
+	MarkPublished(ctx context.Context, eventIDs ...string) error
+	// MarkFailed counts a failed attempt to publish eventID and holds its order until retryAt,
+	// or until it is unparked when park is set
+	MarkFailed(ctx context.Context, eventID string, retryAt time.Time, park bool) error
+	// ParkedEvents returns the events that failed for good, in the order they were written
+	ParkedEvents(ctx context.Context) ([]OrderEvent, error)
+	// Unpark gives parked events a fresh set of attempts, e.g. after their consumer was fixed
+	Unpark(ctx context.Context, eventIDs ...string) error
+}
+
+// memoryOutbox holds the unpublished events of an in-memory store in the order they were
+// written, its owner does the locking
+type memoryOutbox struct {
+	events []outboxEntry
+}
+
+// outboxEntry is an event with its delivery state, a zero retryAt means it is due
+type outboxEntry struct {
+	event   OrderEvent
+	retryAt time.Time
+	parked  bool
+}
+
+// held tells whether the entry holds its order at now
+func (entry outboxEntry) held(now time.Time) bool {
+	return entry.parked || now.Before(entry.retryAt)
+}
+
+func (outbox *memoryOutbox) add(events []OrderEvent) {
+	for _, event := range events {
+		event.Order = clone(event.Order)
+		outbox.events = append(outbox.events, outboxEntry{event: event})
+	}
+}
+
+func (outbox *memoryOutbox) pending(limit int, now time.Time) []OrderEvent {
+	var events []OrderEvent
+	held := make(map[string]bool)
+	for _, entry := range outbox.events {
+		if len(events) >= limit {
+			break
+		}
+		if held[entry.event.OrderID] || entry.held(now) {
+			held[entry.event.OrderID] = true
+			continue
+		}
+		event := entry.event
+		event.Order = clone(event.Order)
+		events = append(events, event)
+	}
+	return events
+}
+
+// markPublished drops the events, the relay never needs them again
+func (outbox *memoryOutbox) markPublished(eventIDs []string) {
+	published := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		published[eventID] = true
+	}
+	pending := outbox.events[:0]
+	for _, entry := range outbox.events {
+		if !published[entry.event.EventID] {
+			pending = append(pending, entry)
+		}
+	}
+	clear(outbox.events[len(pending):])
+	outbox.events = pending
+}
+
+// markFailed ignores events that are no longer pending
+func (outbox *memoryOutbox) markFailed(eventID string, retryAt time.Time, park bool) {
+	for i := range outbox.events {
+		if entry := &outbox.events[i]; entry.event.EventID == eventID {
+			entry.event.Attempts++
+			entry.retryAt, entry.parked = retryAt, park
+			return
+		}
+	}
+}
+
+func (outbox *memoryOutbox) parkedEvents() []OrderEvent {
+	var events []OrderEvent
+	for _, entry := range outbox.events {
+		if entry.parked {
+			event := entry.event
+			event.Order = clone(event.Order)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (outbox *memoryOutbox) unpark(eventIDs []string) {
+	for i := range outbox.events {
+		if entry := &outbox.events[i]; entry.parked && slices.Contains(eventIDs, entry.event.EventID) {
+			*entry = outboxEntry{event: entry.event}
+			entry.event.Attempts = 0
+		}
+	}
+}
+
+func newOrderEvent(eventType OrderEventType, order Order, version int, from OrderStatus) OrderEvent {
+	order = clone(order)
+	order.Version = version
+	return OrderEvent{
+		EventID:    fmt.Sprintf("%s/%d", order.OrderID, version),
+		Type:       eventType,
+		OrderID:    order.OrderID,
+		Version:    version,
+		From:       from,
+		Order:      order,
+		OccurredAt: order.UpdatedAt,
+	}
+}
+
+// eventRecordingRepository hands the repository the event of every write, so the order and its
+// event are stored in the same transaction whether the service or the saga made the change
+type eventRecordingRepository struct {
+	IOrderRepository
+}
+
+func (repo *eventRecordingRepository) Save(ctx context.Context, order *Order, events ...OrderEvent) error {
+	events = append(events, newOrderEvent(OrderCreated, *order, 1, ""))
+	return repo.IOrderRepository.Save(ctx, order, events...)
+}
+
+func (repo *eventRecordingRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
+	previous, err := repo.IOrderRepository.FindByID(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	// A stale order fails the update anyway, only a current one says what changed
+	if previous.Version == order.Version && previous.OrderStatus != order.OrderStatus {
+		eventType := OrderStatusChanged
+		if order.OrderStatus == StatusCancelled {
+			eventType = OrderCancelled
+		}
+		events = append(events, newOrderEvent(eventType, *order, order.Version+1, previous.OrderStatus))
+	}
+	return repo.IOrderRepository.Update(ctx, order, events...)
+}
+
+// EventBus carries order events to whoever subscribed. Publish returns nil only once the
+// event was handed over; an error makes the relay try it again later.
+type EventBus interface {
+	Publish(ctx context.Context, event OrderEvent) error
+}
+
+// EventHandler handles an event on an InMemoryEventBus. Handlers must be idempotent: delivery is
+// at least once, a crash between handling an event and marking it published delivers it again.
+type EventHandler func(ctx context.Context, event OrderEvent) error
+
+// InMemoryEventBus calls its handlers in the publishing goroutine. When some handlers fail, a
+// retry of the event only calls those again.
+type InMemoryEventBus struct {
+	mu       sync.Mutex
+	handlers []EventHandler
+	// handled has the handlers that are done with a failed event by event ID, until all are
+	handled map[string][]bool
+}
+
+func NewInMemoryEventBus() *InMemoryEventBus {
+	return &InMemoryEventBus{handled: make(map[string][]bool)}
+}
+
+func (bus *InMemoryEventBus) Subscribe(handler EventHandler) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.handlers = append(bus.handlers, handler)
+}
+
+func (bus *InMemoryEventBus) Publish(ctx context.Context, event OrderEvent) error {
+	bus.mu.Lock()
+	handlers := bus.handlers
+	handled := make([]bool, len(handlers))
+	copy(handled, bus.handled[event.EventID])
+	bus.mu.Unlock()
+
+	var errs []error
+	for i, handler := range handlers {
+		if handled[i] {
+			continue
+		}
+		if err := handler(ctx, event); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		handled[i] = true
+	}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if len(errs) == 0 {
+		delete(bus.handled, event.EventID)
+		return nil
+	}
+	bus.handled[event.EventID] = handled
+	return errors.Join(errs...)
+}
+
+// RelayRetry is how the relay retries events the bus refused: after Base, doubling up to Max,
+// and an event that failed MaxAttempts times is parked
+type RelayRetry struct {
+	Base        time.Duration
+	Max         time.Duration
+	MaxAttempts int
+}
+
+var DefaultRelayRetry = RelayRetry{Base: 100 * time.Millisecond, Max: time.Minute, MaxAttempts: 10}
+
+// backoff is the wait after the attempts-th failure
+func (retry RelayRetry) backoff(attempts int) time.Duration {
+	wait := retry.Base
+	for i := 1; i < attempts && wait < retry.Max; i++ {
+		wait *= 2
+	}
+	return min(wait, retry.Max)
+}
+
+// OutboxRelay moves events from the outbox to the bus. An event is marked published only after
+// the bus took it, so a crash in between publishes it again. An event the bus refuses is retried
+// with backoff and parked after too many attempts; meanwhile the later events of its order wait
+// and those of other orders are published.
+type OutboxRelay struct {
+	outbox   OrderOutbox
+	bus      EventBus
+	interval time.Duration
+	retry    RelayRetry
+	now      func() time.Time
+	logger   *slog.Logger
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+func NewOutboxRelay(outbox OrderOutbox, bus EventBus, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:   outbox,
+		bus:      bus,
+		interval: interval,
+		retry:    DefaultRelayRetry,
+		now:      time.Now,
+		logger:   slog.Default(),
+	}
+}
+
+// SetRetry replaces DefaultRelayRetry, call it before Start
+func (relay *OutboxRelay) SetRetry(retry RelayRetry) {
+	relay.retry = retry
+}
+
+// SetLogger logs the polls that fail, slog.Default() until it is called, call it before Start
+func (relay *OutboxRelay) SetLogger(logger *slog.Logger) {
+	relay.logger = logger
+}
+
+// Start polls the outbox every interval until Stop
+func (relay *OutboxRelay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	relay.stop = cancel
+	relay.done = make(chan struct{})
+	go func() {
+		defer close(relay.done)
+		ticker := time.NewTicker(relay.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := relay.Drain(ctx); err != nil && ctx.Err() == nil {
+				relay.logger.ErrorContext(ctx, "relaying order events failed", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the polling and publishes what is still pending
+func (relay *OutboxRelay) Stop(ctx context.Context) error {
+	if relay.stop != nil {
+		relay.stop()
+		<-relay.done
+	}
+	_, err := relay.Drain(ctx)
+	return err
+}
+
+// Drain publishes the pending events that are due until there are none left and returns how
+// many it published, the error has the events the bus refused
+func (relay *OutboxRelay) Drain(ctx context.Context) (int, error) {
+	published := 0
+	var refused []error
+	for {
+		events, err := relay.outbox.PendingEvents(ctx, relayBatchSize)
+		if err != nil || len(events) == 0 {
+			return published, errors.Join(append(refused, err)...)
+		}
+		progress := false
+		// An order whose event failed in this batch is held, its later events wait
+		held := make(map[string]bool)
+		for _, event := range events {
+			if held[event.OrderID] {
+				continue
+			}
+			if err := relay.bus.Publish(ctx, event); err != nil {
+				held[event.OrderID] = true
+				parked, markErr := relay.markFailed(ctx, event)
+				if markErr != nil {
+					return published, errors.Join(append(refused, markErr)...)
+				}
+				if parked {
+					err = fmt.Errorf("parked after %d attempts: %w", event.Attempts+1, err)
+				}
+				refused = append(refused, fmt.Errorf("publishing %s %s: %w", event.Type, event.EventID, err))
+				progress = true
+				continue
+			}
+			if err := relay.outbox.MarkPublished(ctx, event.EventID); err != nil {
+				return published, errors.Join(append(refused, err)...)
+			}
+			published++
+			progress = true
+		}
+		if !progress {
+			return published, errors.Join(refused...)
+		}
+	}
+}
+
+// markFailed schedules the retry of an event the bus refused, or parks it after its last attempt
+func (relay *OutboxRelay) markFailed(ctx context.Context, event OrderEvent) (parked bool, err error) {
+	attempts := event.Attempts + 1
+	parked = relay.retry.MaxAttempts > 0 && attempts >= relay.retry.MaxAttempts
+	retryAt := relay.now().Add(relay.retry.backoff(attempts))
+	return parked, relay.outbox.MarkFailed(ctx, event.EventID, retryAt, parked)
+}
+
+// NotifyOnEvent tells users their order was created, cancelled or changed. The status changes of
+// paying for it are left out, a failed payment cancels the order.
+func NotifyOnEvent(notificationSvc INotificationService, logger *slog.Logger) EventHandler {
+	return func(ctx context.Context, event OrderEvent) error {
+		var message string
+		switch {
+		case event.Type == OrderCreated:
+			message = fmt.Sprintf("Your order %s has been created.", event.OrderID)
+		case event.Type == OrderCancelled:
+			message = fmt.Sprintf("Your order %s has been cancelled.", event.OrderID)
+		case event.Type == OrderStatusChanged && event.Order.OrderStatus != StatusPaymentPending && event.Order.OrderStatus != StatusPaid:
+			message = fmt.Sprintf("Your order %s status has been updated to %s.", event.OrderID, event.Order.OrderStatus)
+		default:
+			return nil
+		}
+		err := notificationSvc.SendNotification(ctx, NotificationRequest{UserID: event.Order.UserID, Message: message})
+		if errors.Is(err, ErrNotFound) {
+			// No such user, trying again won't change that
+			logger.WarnContext(ctx, "notifying an unknown user", "user", event.Order.UserID, "order", event.OrderID, "error", err)
+			return nil
+		}
+		return err
+	}
+}
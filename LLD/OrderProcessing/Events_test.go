@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := t.Context()
+	repo := NewOrderRepository()
+	a := Order{OrderID: "order-a", UserID: 1, OrderStatus: StatusCreated, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	b := Order{OrderID: "order-b", UserID: 2, OrderStatus: StatusCreated, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	for _, order := range []*Order{&a, &b} {
+		if err := repo.Save(ctx, order, newOrderEvent(OrderCreated, *order, 1, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.OrderStatus = StatusCancelled
+	if err := repo.Update(ctx, &a, newOrderEvent(OrderCancelled, a, 2, StatusCreated)); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	failing := true
+	calls := make(map[string]int)
+	var delivered []string
+	bus := NewInMemoryEventBus()
+	bus.Subscribe(func(ctx context.Context, event OrderEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[event.EventID]++
+		return nil
+	})
+	bus.Subscribe(func(ctx context.Context, event OrderEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing && event.OrderID == "order-a" {
+			return errors.New("consumer down")
+		}
+		delivered = append(delivered, event.EventID)
+		return nil
+	})
+
+	relay := NewOutboxRelay(repo, bus, time.Hour)
+	relay.SetRetry(RelayRetry{Base: 20 * time.Millisecond, Max: time.Second, MaxAttempts: 2})
+
+	// order-a/1 fails and holds order-a/2, order-b carries on
+	published, err := relay.Drain(ctx)
+	if published != 1 || err == nil {
+		t.Fatalf("first drain published %d, %v, want 1 and the refused event", published, err)
+	}
+	if ids, _ := pendingIDs(ctx, repo, 10); len(ids) != 0 {
+		t.Fatalf("pending during the backoff %v, want none", ids)
+	}
+
+	// The second attempt is the last, the event is parked
+	time.Sleep(30 * time.Millisecond)
+	if published, err := relay.Drain(ctx); published != 0 || err == nil {
+		t.Fatalf("second drain published %d, %v, want 0 and the refused event", published, err)
+	}
+	parked, err := repo.ParkedEvents(ctx)
+	if err != nil || len(parked) != 1 || parked[0].EventID != "order-a/1" {
+		t.Fatalf("parked %+v, %v, want order-a/1", parked, err)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := repo.Unpark(ctx, "order-a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if published, err := relay.Drain(ctx); published != 2 || err != nil {
+		t.Fatalf("drain after unparking published %d, %v, want 2", published, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"order-b/1", "order-a/1", "order-a/2"}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+	// The handler that took order-a/1 the first time isn't called again on the retries
+	if want := map[string]int{"order-a/1": 1, "order-a/2": 1, "order-b/1": 1}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("handler calls %v, want %v", calls, want)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	retry := RelayRetry{Base: time.Second, Max: 10 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 60: 10 * time.Second} {
+		if got := retry.backoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// recordingNotifier keeps the messages it is asked to send
+type recordingNotifier struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (n *recordingNotifier) SendNotification(ctx context.Context, request NotificationRequest) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, request.Message)
+	return nil
+}
+
+func TestOrderCreatedIsNotifiedThroughTheRelay(t *testing.T) {
+	ctx := t.Context()
+	repo := NewOrderRepository()
+	payments := NewPaymentService(NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit}))
+	notifier := &recordingNotifier{}
+	service := NewOrderService(repo, NewULIDGenerator(), newDemoPricer(), payments,
+		newStockedInventory(t, time.Minute, 10, "item1"), notifier, NewInMemorySagaStore(), nil)
+
+	order, err := service.CreateOrder(ctx, OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the saga doesn't notify, the user hears about the order once its events are relayed
+	if len(notifier.messages) != 0 {
+		t.Fatalf("notified %v before relaying, want nothing", notifier.messages)
+	}
+
+	bus := NewInMemoryEventBus()
+	bus.Subscribe(NotifyOnEvent(notifier, slog.Default()))
+	if _, err := NewOutboxRelay(repo, bus, time.Hour).Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Your order " + order.OrderID + " has been created."}
+	if !reflect.DeepEqual(notifier.messages, want) {
+		t.Errorf("notified %v, want %v", notifier.messages, want)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakePaymentConfig is what the fake provider simulates
+type FakePaymentConfig struct {
+	// DeclineOver declines authorizations of more than this, zero declines nothing
+	DeclineOver Money
+	// WebhookDelay makes authorizations pending, they are decided and reported by webhook after it
+	WebhookDelay time.Duration
+}
+
+// FakePaymentProvider is an in-memory PaymentProvider for demos and tests. It keeps the responses
+// of idempotency keys like a real gateway, and TimeoutNext loses responses on the way back.
+type FakePaymentProvider struct {
+	mu        sync.Mutex
+	config    FakePaymentConfig
+	payments  map[string]*Payment
+	responses map[string]fakeResponse
+	nextID    int
+	timeouts  int
+	webhooks  func(PaymentWebhook)
+	events    int
+}
+
+// fakeResponse is the result of a call, kept under its idempotency key
+type fakeResponse struct {
+	request string
+	payment Payment
+	err     error
+}
+
+func NewFakePaymentProvider(config FakePaymentConfig) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		config:    config,
+		payments:  make(map[string]*Payment),
+		responses: make(map[string]fakeResponse),
+	}
+}
+
+// OnWebhook sets where webhooks go, a real provider would post them to an endpoint instead.
+// Webhooks sent before a handler is set are dropped.
+func (f *FakePaymentProvider) OnWebhook(handler func(PaymentWebhook)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.webhooks = handler
+}
+
+// TimeoutNext makes the next calls time out after the provider did their work, as if the
+// responses were lost
+func (f *FakePaymentProvider) TimeoutNext(calls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timeouts = calls
+}
+
+// Payments returns what the provider holds, by payment ID
+func (f *FakePaymentProvider) Payments() []Payment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var payments []Payment
+	for _, payment := range f.payments {
+		payments = append(payments, *payment)
+	}
+	sort.Slice(payments, func(i, j int) bool { return payments[i].ID < payments[j].ID })
+	return payments
+}
+
+// do runs fn once per idempotency key, a repeat gets the first response and a different request
+// under the same key ErrIdempotencyKeyReused
+func (f *FakePaymentProvider) do(ctx context.Context, key, request string, fn func() (Payment, error)) (Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return Payment{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	response, seen := f.responses[key]
+	if seen && response.request != request {
+		return Payment{}, fmt.Errorf("%w: %s", ErrIdempotencyKeyReused, key)
+	}
+	if !seen {
+		payment, err := fn()
+		response = fakeResponse{request: request, payment: payment, err: err}
+		f.responses[key] = response
+	}
+	if f.timeouts > 0 {
+		f.timeouts--
+		return Payment{}, ErrPaymentTimeout
+	}
+	return response.payment, response.err
+}
+
+// payment finds a payment by ID, callers hold mu
+func (f *FakePaymentProvider) payment(paymentID string) (*Payment, error) {
+	payment, exists := f.payments[paymentID]
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", paymentID, ErrPaymentNotFound)
+	}
+	return payment, nil
+}
+
+// decide authorizes or declines a pending payment, callers hold mu
+func (f *FakePaymentProvider) decide(payment *Payment) {
+	payment.Status = PaymentAuthorized
+	if f.config.DeclineOver > 0 && payment.Amount > f.config.DeclineOver {
+		payment.Status = PaymentFailed
+		payment.Reason = "over the limit of " + f.config.DeclineOver.String()
+	}
+	payment.UpdatedAt = time.Now()
+}
+
+func (f *FakePaymentProvider) Authorize(ctx context.Context, key, orderID string, amount Money) (Payment, error) {
+	return f.do(ctx, key, fmt.Sprintf("authorize %s %d", orderID, amount), func() (Payment, error) {
+		if amount < 0 {
+			return Payment{}, &PaymentError{OrderID: orderID, Reason: "invalid amount"}
+		}
+		// Simulate the card network
+		fmt.Printf("Authorizing payment for Order ID: %s, Amount: %s\n", orderID, amount)
+		f.nextID++
+		payment := &Payment{
+			ID:        fmt.Sprintf("pay_%d", f.nextID),
+			OrderID:   orderID,
+			Status:    PaymentPending,
+			Amount:    amount,
+			UpdatedAt: time.Now(),
+		}
+		f.payments[payment.ID] = payment
+		if f.config.WebhookDelay > 0 {
+			time.AfterFunc(f.config.WebhookDelay, func() { f.decideLater(payment.ID) })
+			return *payment, nil
+		}
+		f.decide(payment)
+		if payment.Status == PaymentFailed {
+			return Payment{}, &PaymentError{OrderID: orderID, Reason: payment.Reason}
+		}
+		return *payment, nil
+	})
+}
+
+// decideLater decides a pending payment and sends the webhook, unless it was voided meanwhile
+func (f *FakePaymentProvider) decideLater(paymentID string) {
+	f.mu.Lock()
+	payment := f.payments[paymentID]
+	if payment.Status != PaymentPending {
+		f.mu.Unlock()
+		return
+	}
+	f.decide(payment)
+	f.events++
+	webhook := PaymentWebhook{EventID: fmt.Sprintf("evt_%d", f.events), Payment: *payment}
+	handler := f.webhooks
+	f.mu.Unlock()
+
+	if handler != nil {
+		handler(webhook)
+	}
+}
+
+func (f *FakePaymentProvider) Capture(ctx context.Context, key, paymentID string, amount Money) (Payment, error) {
+	return f.do(ctx, key, fmt.Sprintf("capture %s %d", paymentID, amount), func() (Payment, error) {
+		payment, err := f.payment(paymentID)
+		if err != nil {
+			return Payment{}, err
+		}
+		if payment.Status != PaymentAuthorized || amount < 0 || amount > payment.Amount {
+			return Payment{}, fmt.Errorf("%w: capture of %s from the %s payment %s", ErrPaymentState, amount, payment.Status, paymentID)
+		}
+		fmt.Printf("Capturing payment for Order ID: %s, Amount: %s\n", payment.OrderID, amount)
+		payment.Status = PaymentCaptured
+		payment.Captured = amount
+		payment.UpdatedAt = time.Now()
+		return *payment, nil
+	})
+}
+
+func (f *FakePaymentProvider) Void(ctx context.Context, key, paymentID string) (Payment, error) {
+	return f.do(ctx, key, "void "+paymentID, func() (Payment, error) {
+		payment, err := f.payment(paymentID)
+		if err != nil {
+			return Payment{}, err
+		}
+		if payment.Status != PaymentPending && payment.Status != PaymentAuthorized {
+			return Payment{}, fmt.Errorf("%w: void of the %s payment %s", ErrPaymentState, payment.Status, paymentID)
+		}
+		fmt.Printf("Voiding payment for Order ID: %s, Amount: %s\n", payment.OrderID, payment.Amount)
+		payment.Status = PaymentVoided
+		payment.UpdatedAt = time.Now()
+		return *payment, nil
+	})
+}
+
+func (f *FakePaymentProvider) Refund(ctx context.Context, key, paymentID string, amount Money) (Payment, error) {
+	return f.do(ctx, key, fmt.Sprintf("refund %s %d", paymentID, amount), func() (Payment, error) {
+		payment, err := f.payment(paymentID)
+		if err != nil {
+			return Payment{}, err
+		}
+		if payment.Status != PaymentCaptured || amount <= 0 || amount > payment.Captured-payment.Refunded {
+			return Payment{}, fmt.Errorf("%w: refund of %s from the %s payment %s", ErrPaymentState, amount, payment.Status, paymentID)
+		}
+		fmt.Printf("Refunding payment for Order ID: %s, Amount: %s\n", payment.OrderID, amount)
+		payment.Refunded += amount
+		if payment.Refunded == payment.Captured {
+			payment.Status = PaymentRefunded
+		}
+		payment.UpdatedAt = time.Now()
+		return *payment, nil
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator hands out order IDs, no two calls return the same ID
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+var (
+	ErrClockMovedBackwards = errors.New("clock moved backwards")
+	ErrIDSpaceExhausted    = errors.New("id space exhausted")
+)
+
+// AtomicIDGenerator counts up from 1, IDs are only unique within one process
+type AtomicIDGenerator struct {
+	last atomic.Int64
+}
+
+func NewAtomicIDGenerator() *AtomicIDGenerator {
+	return &AtomicIDGenerator{}
+}
+
+func (g *AtomicIDGenerator) NewID() (string, error) {
+	return strconv.FormatInt(g.last.Add(1), 10), nil
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+// snowflakeEpoch keeps the 41 bit millisecond timestamp good until 2089
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SnowflakeIDGenerator packs milliseconds since snowflakeEpoch, a node ID and a per millisecond
+// sequence into a 63 bit number, so nodes generate unique, roughly time ordered IDs without
+// talking to each other. Up to 4096 IDs per millisecond per node, after that it waits for the next one.
+type SnowflakeIDGenerator struct {
+	mu       sync.Mutex
+	node     int64
+	lastMs   int64
+	sequence int64
+	now      func() time.Time
+}
+
+func NewSnowflakeIDGenerator(node int) (*SnowflakeIDGenerator, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, fmt.Errorf("snowflake node %d is outside 0-%d", node, snowflakeMaxNode)
+	}
+	return &SnowflakeIDGenerator{
+		node: int64(node),
+		now:  time.Now,
+	}, nil
+}
+
+func (g *SnowflakeIDGenerator) NewID() (string, error) {
+	id, err := g.Next()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// Next returns the ID as a number, it fails rather than risk a duplicate if the clock goes back
+func (g *SnowflakeIDGenerator) Next() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().Sub(snowflakeEpoch).Milliseconds()
+	if ms < g.lastMs {
+		return 0, fmt.Errorf("%w by %dms", ErrClockMovedBackwards, g.lastMs-ms)
+	}
+	if ms == g.lastMs {
+		g.sequence = (g.sequence + 1) & snowflakeMaxSequence
+		if g.sequence == 0 {
+			// This millisecond is used up
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = g.now().Sub(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = ms
+
+	return ms<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence, nil
+}
+
+// crockford is the base32 alphabet of ULIDs, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator makes 26 character ULIDs: a 48 bit millisecond timestamp and 80 random bits.
+// Within one millisecond the random part is incremented, so IDs from one generator sort in the
+// order they were made.
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	entropy [10]byte
+	random  io.Reader
+	now     func() time.Time
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{
+		random: rand.Reader,
+		now:    time.Now,
+	}
+}
+
+func (g *ULIDGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().UnixMilli()
+	if ms <= g.lastMs {
+		// Same millisecond, or the clock went back: stay on lastMs and count up
+		ms = g.lastMs
+		if !increment(g.entropy[:]) {
+			return "", fmt.Errorf("%w: more than 2^80 ULIDs in one millisecond", ErrIDSpaceExhausted)
+		}
+	} else {
+		if _, err := io.ReadFull(g.random, g.entropy[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var data [16]byte
+	for i := 0; i < 6; i++ {
+		data[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(data[6:], g.entropy[:])
+	return encodeULID(data), nil
+}
+
+// increment adds one to a big endian number, it reports false when it wraps around
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes 128 bits as 26 base32 characters, the first one only carries 3 bits
+func encodeULID(data [16]byte) string {
+	var out [26]byte
+	var acc uint64
+	bits := 2 // 130 bits of output, the top 2 are zero
+	pos := 0
+	for _, b := range data {
+		acc = acc<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>uint(bits))&31]
+			pos++
+		}
+	}
+	return string(out[:])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSnowflake(t *testing.T, node int) *SnowflakeIDGenerator {
+	t.Helper()
+	generator, err := NewSnowflakeIDGenerator(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return generator
+}
+
+func TestIDGeneratorsAreUniqueUnderConcurrency(t *testing.T) {
+	generators := map[string]IDGenerator{
+		"atomic":    NewAtomicIDGenerator(),
+		"snowflake": newSnowflake(t, 1),
+		"ulid":      NewULIDGenerator(),
+	}
+	const goroutines, perGoroutine = 8, 2000
+	for name, generator := range generators {
+		var mu sync.Mutex
+		seen := make(map[string]bool)
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perGoroutine; i++ {
+					id, err := generator.NewID()
+					if err != nil {
+						t.Errorf("%s: %v", name, err)
+						return
+					}
+					mu.Lock()
+					if seen[id] {
+						t.Errorf("%s: duplicate ID %s", name, id)
+					}
+					seen[id] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(seen) != goroutines*perGoroutine {
+			t.Errorf("%s: %d unique IDs, want %d", name, len(seen), goroutines*perGoroutine)
+		}
+	}
+}
+
+func TestSnowflakeWaitsForTheNextMillisecond(t *testing.T) {
+	generator := newSnowflake(t, 3)
+	start := snowflakeEpoch.Add(time.Hour)
+	// the clock stays on start until the sequence has run out and the generator asked a few more times
+	calls := 0
+	generator.now = func() time.Time {
+		calls++
+		if calls <= snowflakeMaxSequence+1+3 {
+			return start
+		}
+		return start.Add(time.Millisecond)
+	}
+
+	var last int64 = -1
+	for i := 0; i <= snowflakeMaxSequence+1; i++ {
+		id, err := generator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("ID %d after %d, want them increasing", id, last)
+		}
+		last = id
+	}
+
+	ms := last >> (snowflakeNodeBits + snowflakeSequenceBits)
+	node := last >> snowflakeSequenceBits & snowflakeMaxNode
+	sequence := last & snowflakeMaxSequence
+	if ms != time.Hour.Milliseconds()+1 || node != 3 || sequence != 0 {
+		t.Errorf("ID %d past the sequence is ms %d, node %d, sequence %d, want the next millisecond's first on node 3",
+			last, ms, node, sequence)
+	}
+}
+
+func TestSnowflakeClockMovedBackwards(t *testing.T) {
+	generator := newSnowflake(t, 0)
+	now := snowflakeEpoch.Add(time.Hour)
+	generator.now = func() time.Time { return now }
+
+	first, err := generator.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(-5 * time.Millisecond)
+	if _, err := generator.Next(); !errors.Is(err, ErrClockMovedBackwards) {
+		t.Fatalf("Next with the clock 5ms back: %v, want ErrClockMovedBackwards", err)
+	}
+	now = now.Add(5 * time.Millisecond)
+	if id, err := generator.Next(); err != nil || id <= first {
+		t.Errorf("Next once the clock caught up: %d, %v, want an ID after %d", id, err, first)
+	}
+}
+
+func TestULIDStaysMonotonic(t *testing.T) {
+	generator := NewULIDGenerator()
+	now := time.UnixMilli(1_700_000_000_000)
+	generator.now = func() time.Time { return now }
+
+	last := ""
+	next := func(when string) string {
+		t.Helper()
+		id, err := generator.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 26 || id <= last {
+			t.Fatalf("%s: ULID %s after %s, want 26 characters sorting after it", when, id, last)
+		}
+		last = id
+		return id
+	}
+
+	first := next("first")
+	for i := 0; i < 1000; i++ {
+		next("clock stalled")
+	}
+	now = now.Add(-time.Second)
+	if id := next("clock went back"); id[:10] != first[:10] {
+		t.Errorf("ULID %s after the clock went back, want it to keep the timestamp of %s", id, first)
+	}
+	now = now.Add(2 * time.Second)
+	if id := next("clock moved on"); id[:10] == first[:10] {
+		t.Errorf("ULID %s once the clock moved on, want a later timestamp than %s", id, first)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIdempotencyRetention is how long a key is remembered unless the factory says otherwise
+	DefaultIdempotencyRetention = 24 * time.Hour
+	maxIdempotencyKeyLength     = 255
+)
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+	ErrRequestInProgress    = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotencyRecord is what a key stands for. OrderID is empty while the first request is
+// still creating the order, ErrorClass and Error are set when the order it created failed.
+type IdempotencyRecord struct {
+	Fingerprint string
+	OrderID     string
+	ErrorClass  string
+	Error       string
+	ExpiresAt   time.Time
+}
+
+// errorClasses are the errors a replay can give back, by the name IdempotencyRecord.ErrorClass
+// keeps, so a retry gets the status code of the first request. The first match wins.
+var errorClasses = []struct {
+	name string
+	err  error
+}{
+	{"invalid request", ErrInvalidRequest},
+	{"out of stock", ErrOutOfStock},
+	{"payment declined", ErrPaymentDeclined},
+	{"payment timeout", ErrPaymentTimeout},
+	{"payment state", ErrPaymentState},
+	{"deadline exceeded", context.DeadlineExceeded},
+	{"canceled", context.Canceled},
+}
+
+// errorClass names the class of err, "" for errors without one
+func errorClass(err error) string {
+	for _, class := range errorClasses {
+		if errors.Is(err, class.err) {
+			return class.name
+		}
+	}
+	return ""
+}
+
+// replayedError is the error the first request with a key got, given back to its retries
+type replayedError struct {
+	class   string
+	message string
+}
+
+func (e *replayedError) Error() string {
+	return e.message
+}
+
+func (e *replayedError) Is(target error) bool {
+	for _, class := range errorClasses {
+		if class.name == e.class {
+			return errors.Is(class.err, target)
+		}
+	}
+	return false
+}
+
+// replayError is the error of the first request of record, nil when it succeeded
+func (record IdempotencyRecord) replayError() error {
+	if record.ErrorClass == "" && record.Error == "" {
+		return nil
+	}
+	return &replayedError{class: record.ErrorClass, message: record.Error}
+}
+
+// IdempotencyStore remembers idempotency keys and the orders they created
+type IdempotencyStore interface {
+	// Claim takes key for a request with fingerprint. When the key is already taken it returns
+	// the record and claimed is false, a different fingerprint is ErrIdempotencyKeyReused.
+	Claim(key, fingerprint string) (record IdempotencyRecord, claimed bool, err error)
+	// Complete records the order a claimed key created
+	Complete(key, orderID string) error
+	// Fail records that the order of a completed key failed with an error of errorClass
+	Fail(key, errorClass, message string) error
+	// Release frees a claimed key whose request failed before creating an order
+	Release(key string) error
+}
+
+// idempotencyScope keys by user as well, two users that pick the same key don't collide
+func idempotencyScope(request OrderRequest) string {
+	return fmt.Sprintf("%d/%s", request.UserID, request.IdempotencyKey)
+}
+
+// fingerprint identifies the payload of a request, without its idempotency key. The items are
+// sorted, the same cart in another order is the same request; coupons are applied in the order
+// given, so their order counts.
+func (request OrderRequest) fingerprint() string {
+	items := slices.Clone(request.Items)
+	slices.SortFunc(items, func(a, b OrderItem) int {
+		return cmp.Or(cmp.Compare(a.SKU, b.SKU), cmp.Compare(a.Qty, b.Qty))
+	})
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%v|%q", request.UserID, items, request.CouponCodes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// InMemoryIdempotencyStore forgets a key retention after it was claimed. Keys expire in the
+// order they were claimed, so expired ones are dropped from the front of a queue.
+type InMemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]IdempotencyRecord
+	queue     []queuedKey
+	retention time.Duration
+	now       func() time.Time
+}
+
+type queuedKey struct {
+	key       string
+	expiresAt time.Time
+}
+
+func NewInMemoryIdempotencyStore(retention time.Duration) *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{
+		records:   make(map[string]IdempotencyRecord),
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// SetClock replaces time.Now, e.g. to expire keys without waiting
+func (store *InMemoryIdempotencyStore) SetClock(now func() time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.now = now
+}
+
+// expire drops the keys past their retention, callers hold mu
+func (store *InMemoryIdempotencyStore) expire() {
+	now := store.now()
+	for len(store.queue) > 0 && !now.Before(store.queue[0].expiresAt) {
+		// A key released and claimed again has a later entry, this one is stale
+		if record, exists := store.records[store.queue[0].key]; exists && record.ExpiresAt.Equal(store.queue[0].expiresAt) {
+			delete(store.records, store.queue[0].key)
+		}
+		store.queue = store.queue[1:]
+	}
+}
+
+func (store *InMemoryIdempotencyStore) Claim(key, fingerprint string) (IdempotencyRecord, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.expire()
+
+	if record, exists := store.records[key]; exists {
+		if record.Fingerprint != fingerprint {
+			return record, false, ErrIdempotencyKeyReused
+		}
+		return record, false, nil
+	}
+	record := IdempotencyRecord{Fingerprint: fingerprint, ExpiresAt: store.now().Add(store.retention)}
+	store.records[key] = record
+	store.queue = append(store.queue, queuedKey{key: key, expiresAt: record.ExpiresAt})
+	return record, true, nil
+}
+
+func (store *InMemoryIdempotencyStore) Complete(key, orderID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record, exists := store.records[key]
+	if !exists {
+		return fmt.Errorf("idempotency key %q: %w", key, ErrNotFound)
+	}
+	record.OrderID = orderID
+	store.records[key] = record
+	return nil
+}
+
+func (store *InMemoryIdempotencyStore) Fail(key, errorClass, message string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record, exists := store.records[key]
+	if !exists {
+		return fmt.Errorf("idempotency key %q: %w", key, ErrNotFound)
+	}
+	record.ErrorClass = errorClass
+	record.Error = message
+	store.records[key] = record
+	return nil
+}
+
+func (store *InMemoryIdempotencyStore) Release(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.records, key)
+	return nil
+}
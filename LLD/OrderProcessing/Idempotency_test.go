@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// failingIDGenerator fails its first fails calls
+type failingIDGenerator struct {
+	IDGenerator
+	fails int
+}
+
+func (g *failingIDGenerator) NewID() (string, error) {
+	if g.fails > 0 {
+		g.fails--
+		return "", errors.New("no IDs left")
+	}
+	return g.IDGenerator.NewID()
+}
+
+// failingSaveRepository fails its first fails saves
+type failingSaveRepository struct {
+	IOrderRepository
+	fails int
+}
+
+func (repo *failingSaveRepository) Save(ctx context.Context, order *Order, events ...OrderEvent) error {
+	if repo.fails > 0 {
+		repo.fails--
+		return errors.New("disk full")
+	}
+	return repo.IOrderRepository.Save(ctx, order, events...)
+}
+
+// brokenIdempotencyStore claims keys but fails to record anything about them
+type brokenIdempotencyStore struct {
+	IdempotencyStore
+}
+
+func (brokenIdempotencyStore) Complete(key, orderID string) error {
+	return errors.New("store unavailable")
+}
+
+func (brokenIdempotencyStore) Release(key string) error {
+	return errors.New("store unavailable")
+}
+
+func TestIdempotencyRetryAfterFailureBeforeSave(t *testing.T) {
+	request := OrderRequest{
+		UserID:         8,
+		Items:          []OrderItem{{SKU: "item2", Qty: 1}},
+		CouponCodes:    []string{"LATE5"},
+		IdempotencyKey: "cart-8",
+	}
+	late5 := PercentOff{Label: "5% off", BasisPoints: 500}
+	withCoupon := func() *Pricer {
+		pricer := newDemoPricer()
+		pricer.AddCoupon("LATE5", late5)
+		return pricer
+	}
+	withoutCoupon := newDemoPricer()
+	cases := []struct {
+		name    string
+		factory *ServiceFactory
+		// fix makes the retry succeed where the first request failed
+		fix func()
+	}{
+		{"pricing", &ServiceFactory{Pricer: withoutCoupon}, func() { withoutCoupon.AddCoupon("LATE5", late5) }},
+		{"order ID", &ServiceFactory{Pricer: withCoupon(), IDGenerator: &failingIDGenerator{IDGenerator: NewULIDGenerator(), fails: 1}}, nil},
+		{"saving", &ServiceFactory{Pricer: withCoupon(), Repository: &failingSaveRepository{IOrderRepository: NewOrderRepository(), fails: 1}}, nil},
+	}
+	for _, c := range cases {
+		factory := c.factory
+		service := factory.CreateOrderService(t.Context())
+
+		if _, err := service.CreateOrder(t.Context(), request); err == nil {
+			t.Fatalf("%s: first request succeeded, want it to fail before saving", c.name)
+		}
+		if c.fix != nil {
+			c.fix()
+		}
+		order, err := service.CreateOrder(t.Context(), request)
+		if err != nil || order.OrderID == "" {
+			t.Errorf("%s: retry with the same key: %+v, %v, want the order created", c.name, order, err)
+		}
+		if again, err := service.CreateOrder(t.Context(), request); err != nil || again.OrderID != order.OrderID {
+			t.Errorf("%s: second retry: order %s, %v, want %s again", c.name, again.OrderID, err, order.OrderID)
+		}
+		factory.Close(t.Context())
+	}
+}
+
+func TestIdempotencyStoreFailures(t *testing.T) {
+	var logs bytes.Buffer
+	factory := &ServiceFactory{
+		IdempotencyStore: brokenIdempotencyStore{NewInMemoryIdempotencyStore(DefaultIdempotencyRetention)},
+		Logger:           slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	defer factory.Close(t.Context())
+	service := factory.CreateOrderService(t.Context())
+
+	// the key can't be released, so the caller hears that retries will find it taken
+	_, err := service.CreateOrder(t.Context(), OrderRequest{UserID: 8, Items: []OrderItem{{SKU: "nope", Qty: 1}}, IdempotencyKey: "cart-a"})
+	if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), "releasing idempotency key") {
+		t.Errorf("failed order with a key that can't be released: %v, want both errors", err)
+	}
+
+	// the order exists, so not recording it is logged rather than failing the request
+	order, err := service.CreateOrder(t.Context(), OrderRequest{UserID: 8, Items: []OrderItem{{SKU: "item2", Qty: 1}}, IdempotencyKey: "cart-b"})
+	if err != nil || order.OrderID == "" {
+		t.Fatalf("order with a key that can't be completed: %+v, %v, want it created", order, err)
+	}
+	if !strings.Contains(logs.String(), "recording the order of an idempotency key failed") || !strings.Contains(logs.String(), order.OrderID) {
+		t.Errorf("logged %q, want the failure to record order %s", logs.String(), order.OrderID)
+	}
+}
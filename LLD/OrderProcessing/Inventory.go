@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReservationNotFound = fmt.Errorf("reservation %w", ErrNotFound)
+	ErrInvalidQuantity     = errors.New("quantity must be positive")
+)
+
+// InventoryItem is a quantity of one SKU
+type InventoryItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// itemsFor adds up the lines of an order, a SKU on two lines is reserved once for both
+func itemsFor(lines []LineItem) []InventoryItem {
+	items := make([]InventoryItem, 0, len(lines))
+	for _, line := range lines {
+		items = append(items, InventoryItem{SKU: line.SKU, Quantity: line.Qty})
+	}
+	return mergeItems(items)
+}
+
+// mergeItems adds up the quantities of a SKU that appears more than once, so that availability is
+// checked against what a request takes in total
+func mergeItems(items []InventoryItem) []InventoryItem {
+	merged := make([]InventoryItem, 0, len(items))
+	index := make(map[string]int)
+	for _, item := range items {
+		if i, exists := index[item.SKU]; exists {
+			merged[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.SKU] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+type stockLevel struct {
+	onHand   int
+	reserved int
+}
+
+func (level *stockLevel) available() int {
+	return level.onHand - level.reserved
+}
+
+// reservation holds stock for one order until it expires or is committed, a committed one is kept
+// until the order ships so that a cancel can still put its items back
+type reservation struct {
+	items     []InventoryItem
+	expiresAt time.Time
+	committed bool
+}
+
+// InventoryService tracks on-hand and reserved quantities per SKU. Reserving holds stock for an
+// order for ttl; committing takes it off the shelf, releasing puts it back, and a reservation
+// that is neither committed nor released in time expires on its own. Shipping forgets a committed
+// reservation, so reservations only live as long as their order can still be cancelled. Every operation covers all
+// items of a request or none of them, so two orders can't both get the last unit.
+type InventoryService struct {
+	mu           sync.Mutex
+	stock        map[string]*stockLevel
+	reservations map[string]*reservation // by order ID
+	ttl          time.Duration
+	now          func() time.Time
+}
+
+func NewInventoryService(ttl time.Duration) *InventoryService {
+	return &InventoryService{
+		stock:        make(map[string]*stockLevel),
+		reservations: make(map[string]*reservation),
+		ttl:          ttl,
+		now:          time.Now,
+	}
+}
+
+// SetClock replaces time.Now, e.g. to expire reservations without waiting
+func (i *InventoryService) SetClock(now func() time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.now = now
+}
+
+// Available is what can still be reserved of sku
+func (i *InventoryService) Available(sku string) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	if level, exists := i.stock[sku]; exists {
+		return level.available()
+	}
+	return 0
+}
+
+// expire returns the stock of lapsed reservations, callers hold mu
+func (i *InventoryService) expire() {
+	now := i.now()
+	for orderID, held := range i.reservations {
+		if held.committed || now.Before(held.expiresAt) {
+			continue
+		}
+		for _, item := range held.items {
+			i.stock[item.SKU].reserved -= item.Quantity
+		}
+		delete(i.reservations, orderID)
+	}
+}
+
+func (i *InventoryService) level(sku string) *stockLevel {
+	level, exists := i.stock[sku]
+	if !exists {
+		level = &stockLevel{}
+		i.stock[sku] = level
+	}
+	return level
+}
+
+// shortages lists the items that can't be reserved in full, callers hold mu and pass merged items
+func (i *InventoryService) shortages(items []InventoryItem) error {
+	var missing []string
+	for _, item := range items {
+		if level, exists := i.stock[item.SKU]; !exists || level.available() < item.Quantity {
+			missing = append(missing, item.SKU)
+		}
+	}
+	if len(missing) > 0 {
+		return &StockError{Products: missing}
+	}
+	return nil
+}
+
+func (i *InventoryService) CheckStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	items, err := positiveItems(request.Items)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+	return i.shortages(items)
+}
+
+// positiveItems rejects lines without a positive quantity and merges the rest per SKU
+func positiveItems(items []InventoryItem) ([]InventoryItem, error) {
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("%s: %w", item.SKU, ErrInvalidQuantity)
+		}
+	}
+	return mergeItems(items), nil
+}
+
+// UpdateStock adds the quantities to what is on hand, negative quantities take stock away
+// but never more than is available
+func (i *InventoryService) UpdateStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	items := mergeItems(request.Items)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	var missing []string
+	for _, item := range items {
+		if level, exists := i.stock[item.SKU]; item.Quantity < 0 && (!exists || level.available() < -item.Quantity) {
+			missing = append(missing, item.SKU)
+		}
+	}
+	if len(missing) > 0 {
+		return &StockError{Products: missing}
+	}
+	for _, item := range items {
+		i.level(item.SKU).onHand += item.Quantity
+	}
+	return nil
+}
+
+// ReserveStock holds all items for request.OrderID or none, reserving again for the same order is a no-op
+func (i *InventoryService) ReserveStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	items, err := positiveItems(request.Items)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	if _, exists := i.reservations[request.OrderID]; exists {
+		return nil
+	}
+	if err := i.shortages(items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		i.stock[item.SKU].reserved += item.Quantity
+	}
+	i.reservations[request.OrderID] = &reservation{
+		items:     items,
+		expiresAt: i.now().Add(i.ttl),
+	}
+	return nil
+}
+
+// CommitStock takes the reserved items of request.OrderID off the shelf. It fails with
+// ErrReservationNotFound when the reservation has expired, committing twice is a no-op.
+func (i *InventoryService) CommitStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	held, exists := i.reservations[request.OrderID]
+	if !exists {
+		return fmt.Errorf("order %s: %w", request.OrderID, ErrReservationNotFound)
+	}
+	if held.committed {
+		return nil
+	}
+	for _, item := range held.items {
+		level := i.stock[item.SKU]
+		level.reserved -= item.Quantity
+		level.onHand -= item.Quantity
+	}
+	held.committed = true
+	return nil
+}
+
+// ReleaseStock gives back what request.OrderID holds, committed items go back on the shelf.
+// Releasing an order that holds nothing is a no-op.
+func (i *InventoryService) ReleaseStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	held, exists := i.reservations[request.OrderID]
+	if !exists {
+		return nil
+	}
+	for _, item := range held.items {
+		if held.committed {
+			i.stock[item.SKU].onHand += item.Quantity
+		} else {
+			i.stock[item.SKU].reserved -= item.Quantity
+		}
+	}
+	delete(i.reservations, request.OrderID)
+	return nil
+}
+
+// ShipStock forgets the committed reservation of request.OrderID, its items left with the order
+// and can't go back on the shelf. It fails with ErrReservationNotFound for an uncommitted
+// reservation, shipping an order that holds nothing is a no-op.
+func (i *InventoryService) ShipStock(ctx context.Context, request InventoryRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expire()
+
+	held, exists := i.reservations[request.OrderID]
+	if !exists {
+		return nil
+	}
+	if !held.committed {
+		return fmt.Errorf("order %s isn't committed: %w", request.OrderID, ErrReservationNotFound)
+	}
+	delete(i.reservations, request.OrderID)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStockedInventory holds reservations for ttl and has quantity of every sku on hand
+func newStockedInventory(t *testing.T, ttl time.Duration, quantity int, skus ...string) *InventoryService {
+	t.Helper()
+	inventory := NewInventoryService(ttl)
+	request := InventoryRequest{}
+	for _, sku := range skus {
+		request.Items = append(request.Items, InventoryItem{SKU: sku, Quantity: quantity})
+	}
+	if err := inventory.UpdateStock(t.Context(), request); err != nil {
+		t.Fatal(err)
+	}
+	return inventory
+}
+
+func TestReserveStockAddsUpRepeatedSKUs(t *testing.T) {
+	inventory := newStockedInventory(t, time.Minute, 5, "A")
+
+	request := InventoryRequest{OrderID: "order-1", Items: []InventoryItem{{SKU: "A", Quantity: 3}, {SKU: "A", Quantity: 3}}}
+	if err := inventory.CheckStock(t.Context(), request); !errors.Is(err, ErrOutOfStock) {
+		t.Errorf("CheckStock of 3+3 with 5 available = %v, want ErrOutOfStock", err)
+	}
+	if err := inventory.ReserveStock(t.Context(), request); !errors.Is(err, ErrOutOfStock) {
+		t.Errorf("ReserveStock of 3+3 with 5 available = %v, want ErrOutOfStock", err)
+	}
+	if available := inventory.Available("A"); available != 5 {
+		t.Errorf("%d available after a refused reservation, want 5", available)
+	}
+
+	request.Items = []InventoryItem{{SKU: "A", Quantity: 2}, {SKU: "A", Quantity: 3}}
+	if err := inventory.ReserveStock(t.Context(), request); err != nil {
+		t.Fatalf("ReserveStock of 2+3 with 5 available = %v", err)
+	}
+	if available := inventory.Available("A"); available != 0 {
+		t.Errorf("%d available after reserving 2+3 of 5, want 0", available)
+	}
+
+	removal := InventoryRequest{Items: []InventoryItem{{SKU: "A", Quantity: 1}, {SKU: "A", Quantity: -2}}}
+	if err := inventory.UpdateStock(t.Context(), removal); !errors.Is(err, ErrOutOfStock) {
+		t.Errorf("taking away 1 more than available = %v, want ErrOutOfStock", err)
+	}
+}
+
+func TestConcurrentReservationsDontOversell(t *testing.T) {
+	const stock, orders = 10, 100
+	inventory := newStockedInventory(t, time.Minute, stock, "A", "B")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for n := 0; n < orders; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := InventoryRequest{
+				OrderID: fmt.Sprintf("order-%d", n),
+				Items:   []InventoryItem{{SKU: "A", Quantity: 1}, {SKU: "B", Quantity: 1}},
+			}
+			err := inventory.ReserveStock(t.Context(), request)
+			switch {
+			case err == nil:
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			case !errors.Is(err, ErrOutOfStock):
+				t.Errorf("order %d: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != stock {
+		t.Errorf("%d of %d concurrent orders reserved %d units, want %d", reserved, orders, stock, stock)
+	}
+	for _, sku := range []string{"A", "B"} {
+		if available := inventory.Available(sku); available != 0 {
+			t.Errorf("%d of %s available, want 0", available, sku)
+		}
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	inventory := newStockedInventory(t, time.Minute, 5, "A")
+	now := time.Now()
+	inventory.SetClock(func() time.Time { return now })
+
+	for _, orderID := range []string{"expires", "committed"} {
+		request := InventoryRequest{OrderID: orderID, Items: []InventoryItem{{SKU: "A", Quantity: 2}}}
+		if err := inventory.ReserveStock(t.Context(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inventory.CommitStock(t.Context(), InventoryRequest{OrderID: "committed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(59 * time.Second)
+	if available := inventory.Available("A"); available != 1 {
+		t.Errorf("%d available before the reservation expired, want 1", available)
+	}
+
+	now = now.Add(time.Second)
+	if available := inventory.Available("A"); available != 3 {
+		t.Errorf("%d available after the reservation expired, want 3", available)
+	}
+	if err := inventory.CommitStock(t.Context(), InventoryRequest{OrderID: "expires"}); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("committing an expired reservation = %v, want ErrReservationNotFound", err)
+	}
+	if err := inventory.ReleaseStock(t.Context(), InventoryRequest{OrderID: "committed"}); err != nil {
+		t.Fatal(err)
+	}
+	if available := inventory.Available("A"); available != 5 {
+		t.Errorf("%d available after releasing the committed order, want 5", available)
+	}
+}
+
+func TestFactoryLogsStockItCantSeed(t *testing.T) {
+	var logs bytes.Buffer
+	factory := &ServiceFactory{Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	defer factory.Close(t.Context())
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	factory.CreateOrderService(ctx)
+	if !strings.Contains(logs.String(), "seeding the demo stock failed") || !strings.Contains(logs.String(), context.Canceled.Error()) {
+		t.Errorf("logged %q, want the seeding error", logs.String())
+	}
+}
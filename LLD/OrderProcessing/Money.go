@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidMoney = errors.New("invalid amount of money")
+
+// Money is an amount in minor units, cents, so sums and comparisons are exact. It is written as a
+// decimal string like "19.99" in JSON.
+type Money int64
+
+// MaxMoney bounds parsed amounts, 100 billion leaves room to multiply by quantities and rates
+// without overflowing int64
+const MaxMoney Money = 100_000_000_000_00
+
+// basisPoints is a rate in hundredths of a percent, 825 is 8.25%
+const basisPoints = 10000
+
+// ParseMoney reads "19.99", "-0.5" or "3", more than two decimals or more than MaxMoney are an
+// error rather than rounded
+func ParseMoney(s string) (Money, error) {
+	text := strings.TrimSpace(s)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(text, "-")
+	units, cents, hasCents := strings.Cut(text, ".")
+	if units == "" || len(cents) > 2 || (hasCents && cents == "") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	cents += strings.Repeat("0", 2-len(cents))
+	whole, err := strconv.ParseUint(units, 10, 64)
+	if err != nil || whole > uint64(MaxMoney/100) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	fraction, err := strconv.ParseUint(cents, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	m := Money(whole*100 + fraction)
+	if m > MaxMoney {
+		return 0, fmt.Errorf("%w: %q is more than %s", ErrInvalidMoney, s, MaxMoney)
+	}
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+// Times is the amount of qty units
+func (m Money) Times(qty int) Money {
+	return m * Money(qty)
+}
+
+// Rate is m times rate basis points, rounded half away from zero
+func (m Money) Rate(rate int64) Money {
+	product := int64(m) * rate
+	if product < 0 {
+		return -Money((-product + basisPoints/2) / basisPoints)
+	}
+	return Money((product + basisPoints/2) / basisPoints)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON takes the decimal as a string or a plain JSON number, both without going through float64
+func (m *Money) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	parsed, err := ParseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
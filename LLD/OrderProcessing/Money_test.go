@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		text string
+		want Money
+	}{
+		{"19.99", 19_99},
+		{"3", 3_00},
+		{"0.05", 5},
+		{"-0.5", -50},
+		{"-12.34", -12_34},
+		{" 7.10 ", 7_10},
+		{"100000000000", MaxMoney},
+		{"-100000000000.00", -MaxMoney},
+	}
+	for _, c := range cases {
+		if got, err := ParseMoney(c.text); err != nil || got != c.want {
+			t.Errorf("ParseMoney(%q) = %s, %v, want %s", c.text, got, err, c.want)
+		}
+	}
+
+	for _, text := range []string{
+		"", "abc", "1.999", "0.001", "1.", ".5", "1e3", "--1", "+1", "1.-5", "1,000.00",
+		"100000000000.01", "92233720368547758.07", "184467440737095516.16",
+	} {
+		if got, err := ParseMoney(text); !errors.Is(err, ErrInvalidMoney) {
+			t.Errorf("ParseMoney(%q) = %s, %v, want ErrInvalidMoney", text, got, err)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var line struct {
+		Price Money `json:"price"`
+	}
+	for _, data := range []string{`{"price":"19.99"}`, `{"price":19.99}`} {
+		if err := json.Unmarshal([]byte(data), &line); err != nil || line.Price != 19_99 {
+			t.Errorf("%s: got %s, %v, want 19.99", data, line.Price, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"price":-4.5}`), &line); err != nil || line.Price != -4_50 {
+		t.Errorf("a negative number: got %s, %v, want -4.50", line.Price, err)
+	}
+	for _, data := range []string{`{"price":"19.999"}`, `{"price":1e3}`, `{"price":"1000000000000"}`} {
+		if err := json.Unmarshal([]byte(data), &line); !errors.Is(err, ErrInvalidMoney) {
+			t.Errorf("%s: got %v, want ErrInvalidMoney", data, err)
+		}
+	}
+
+	data, err := json.Marshal(struct{ Price Money }{-5})
+	if err != nil || string(data) != `{"Price":"-0.05"}` {
+		t.Errorf("marshalled %s, %v, want the amount as a decimal string", data, err)
+	}
+}
+
+func TestMoneyRate(t *testing.T) {
+	cases := []struct {
+		amount Money
+		rate   int64
+		want   Money
+	}{
+		{19_99, 825, 1_65}, // 1.649175
+		{10_00, 250, 25},
+		{1, 5000, 1},   // half a cent rounds away from zero
+		{-1, 5000, -1}, // on both sides
+		{3, 1666, 0},   // 0.4998 of a cent
+		{-3, 1666, 0},
+		{MaxMoney, basisPoints, MaxMoney},
+	}
+	for _, c := range cases {
+		if got := c.amount.Rate(c.rate); got != c.want {
+			t.Errorf("%s.Rate(%d) = %s, want %s", c.amount, c.rate, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// The event sourced order also records these, next to OrderCreated, OrderStatusChanged and OrderCancelled
+const (
+	OrderUpdated OrderEventType = "OrderUpdated"
+	OrderDeleted OrderEventType = "OrderDeleted"
+)
+
+var ErrUnknownEvent = errors.New("unknown event type")
+
+// StoredEvent is one entry of an order's stream in the event store. Version is the position in
+// the stream, 1 for the first event; Position is the position in the whole store and is set by
+// the store when the event is appended.
+type StoredEvent struct {
+	StreamID   string          `json:"streamId"`
+	Version    int             `json:"version"`
+	Position   int64           `json:"position"`
+	Type       OrderEventType  `json:"type"`
+	Data       json.RawMessage `json:"data"`
+	RecordedAt time.Time       `json:"recordedAt"`
+}
+
+// orderDetails is the data of OrderCreated and OrderUpdated, everything about the order at that point
+type orderDetails struct {
+	UserID      int         `json:"userId"`
+	Items       []LineItem  `json:"items"`
+	OrderStatus OrderStatus `json:"orderStatus"`
+	Subtotal    Money       `json:"subtotal"`
+	Discount    Money       `json:"discount"`
+	Tax         Money       `json:"tax"`
+	TotalPrice  Money       `json:"totalPrice"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	UpdatedAt   time.Time   `json:"updatedAt"`
+}
+
+// statusChange is the data of OrderStatusChanged and OrderCancelled
+type statusChange struct {
+	From OrderStatus `json:"from"`
+	To   OrderStatus `json:"to"`
+	At   time.Time   `json:"at"`
+}
+
+type deletion struct {
+	At time.Time `json:"at"`
+}
+
+func detailsOf(order Order) orderDetails {
+	return orderDetails{
+		UserID:      order.UserID,
+		Items:       order.Items,
+		OrderStatus: order.OrderStatus,
+		Subtotal:    order.Subtotal,
+		Discount:    order.Discount,
+		Tax:         order.Tax,
+		TotalPrice:  order.TotalPrice,
+		CreatedAt:   order.CreatedAt,
+		UpdatedAt:   order.UpdatedAt,
+	}
+}
+
+// OrderAggregate is an order rebuilt from its events. Version counts the events of the stream,
+// Order.Version the writes since the order was created, which is the version callers see. A
+// deleted order keeps its stream, and creating it again continues that stream.
+type OrderAggregate struct {
+	Order   Order
+	Deleted bool
+	Version int
+	changes []StoredEvent
+}
+
+// Exists reports whether the order was created and not deleted since
+func (a *OrderAggregate) Exists() bool {
+	return a.Version > 0 && !a.Deleted
+}
+
+// Apply moves the aggregate past event, it doesn't record anything
+func (a *OrderAggregate) Apply(event StoredEvent) error {
+	switch event.Type {
+	case OrderCreated, OrderUpdated:
+		var details orderDetails
+		if err := json.Unmarshal(event.Data, &details); err != nil {
+			return fmt.Errorf("%s %s/%d: %w", event.Type, event.StreamID, event.Version, err)
+		}
+		version := a.Order.Version + 1
+		if event.Type == OrderCreated {
+			version = 1
+		}
+		a.Order = Order{
+			OrderID:     event.StreamID,
+			UserID:      details.UserID,
+			Items:       details.Items,
+			OrderStatus: details.OrderStatus,
+			Subtotal:    details.Subtotal,
+			Discount:    details.Discount,
+			Tax:         details.Tax,
+			TotalPrice:  details.TotalPrice,
+			CreatedAt:   details.CreatedAt,
+			UpdatedAt:   details.UpdatedAt,
+			Version:     version,
+		}
+		a.Deleted = false
+	case OrderStatusChanged, OrderCancelled:
+		var change statusChange
+		if err := json.Unmarshal(event.Data, &change); err != nil {
+			return fmt.Errorf("%s %s/%d: %w", event.Type, event.StreamID, event.Version, err)
+		}
+		a.Order.OrderStatus = change.To
+		a.Order.UpdatedAt = change.At
+		a.Order.Version++
+	case OrderDeleted:
+		a.Deleted = true
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownEvent, event.Type)
+	}
+	a.Version = event.Version
+	return nil
+}
+
+// record applies a new event and keeps it for the next append
+func (a *OrderAggregate) record(orderID string, eventType OrderEventType, at time.Time, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	event := StoredEvent{StreamID: orderID, Version: a.Version + 1, Type: eventType, Data: raw, RecordedAt: at}
+	if err := a.Apply(event); err != nil {
+		return err
+	}
+	a.changes = append(a.changes, event)
+	return nil
+}
+
+// Create starts the order, or starts it again after it was deleted
+func (a *OrderAggregate) Create(order Order) error {
+	if a.Exists() {
+		return fmt.Errorf("order %s: %w", order.OrderID, ErrDuplicateOrder)
+	}
+	return a.record(order.OrderID, OrderCreated, order.UpdatedAt, detailsOf(order))
+}
+
+// Change records what is different in next, which must be at the aggregate's order version. A
+// change of status alone is an OrderStatusChanged or OrderCancelled, anything else an OrderUpdated.
+func (a *OrderAggregate) Change(next Order) error {
+	if !a.Exists() {
+		return ErrOrderNotFound
+	}
+	if next.Version != a.Order.Version {
+		return &VersionConflictError{OrderID: next.OrderID, Expected: next.Version, Actual: a.Order.Version}
+	}
+
+	current := a.Order
+	samePrice := next.Subtotal == current.Subtotal && next.Discount == current.Discount && next.Tax == current.Tax &&
+		next.TotalPrice == current.TotalPrice
+	if next.OrderStatus != current.OrderStatus && next.UserID == current.UserID && samePrice &&
+		next.CreatedAt.Equal(current.CreatedAt) && slices.Equal(next.Items, current.Items) {
+		eventType := OrderStatusChanged
+		if next.OrderStatus == StatusCancelled {
+			eventType = OrderCancelled
+		}
+		return a.record(next.OrderID, eventType, next.UpdatedAt, statusChange{From: current.OrderStatus, To: next.OrderStatus, At: next.UpdatedAt})
+	}
+	return a.record(next.OrderID, OrderUpdated, next.UpdatedAt, detailsOf(next))
+}
+
+// Delete ends the order, its events stay in the store
+func (a *OrderAggregate) Delete(at time.Time) error {
+	if !a.Exists() {
+		return ErrOrderNotFound
+	}
+	return a.record(a.Order.OrderID, OrderDeleted, at, deletion{At: at})
+}
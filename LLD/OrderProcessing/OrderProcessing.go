@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,29 +17,38 @@ import (
 // Models
 
 type Order struct {
-	OrderID     int       `json:"orderId"`
-	UserID      int       `json:"userId"`
-	ProductList []string  `json:"productList"`
-	OrderStatus string    `json:"orderStatus"`
-	TotalPrice  float64   `json:"totalPrice"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
-}
-
+	OrderID     string      `json:"orderId"`
+	UserID      int         `json:"userId"`
+	Items       []LineItem  `json:"items"`
+	OrderStatus OrderStatus `json:"orderStatus"`
+	// TotalPrice is Subtotal - Discount + Tax, priced on the server when the order was created
+	Subtotal   Money     `json:"subtotal"`
+	Discount   Money     `json:"discount"`
+	Tax        Money     `json:"tax"`
+	TotalPrice Money     `json:"totalPrice"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Version counts the writes to the order, an update based on an older version is rejected
+	Version int `json:"version"`
+}
+
+// OrderRequest carries no prices, the service prices the items from its catalog
 type OrderRequest struct {
-	UserID      int      `json:"userId"`
-	ProductList []string `json:"productList"`
-	TotalPrice  float64  `json:"totalPrice"`
+	UserID      int         `json:"userId"`
+	Items       []OrderItem `json:"items"`
+	CouponCodes []string    `json:"couponCodes,omitempty"`
+	// IdempotencyKey makes retries safe, repeating it with the same payload returns the first order
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type PaymentRequest struct {
-	OrderID int     `json:"orderId"`
-	Amount  float64 `json:"amount"`
+	OrderID string `json:"orderId"`
+	Amount  Money  `json:"amount"`
 }
 
 type InventoryRequest struct {
-	ProductList []string `json:"productList"`
-	Quantity    int      `json:"quantity"`
+	OrderID string          `json:"orderId"`
+	Items   []InventoryItem `json:"items"`
 }
 
 type NotificationRequest struct {
@@ -41,198 +58,597 @@ type NotificationRequest struct {
 
 // Interfaces
 
+// IOrderRepository stores orders with optimistic concurrency: Save starts an order at version 1,
+// Update only succeeds if order.Version is still the stored one and then increments it. The
+// events given to Save and Update go into the outbox in the same transaction as the order.
 type IOrderRepository interface {
-	Save(order Order)
-	FindByID(orderID int) (Order, bool)
-	Update(order Order)
-	Delete(orderID int)
-	Count() int
+	Save(ctx context.Context, order *Order, events ...OrderEvent) error
+	FindByID(ctx context.Context, orderID string) (Order, error)
+	// FindByUser returns the orders of a user, oldest first
+	FindByUser(ctx context.Context, userID int) ([]Order, error)
+	// List returns a page of the orders matching filter, in the filter's order. Pass the
+	// NextCursor of a page to get the next one, limit is capped at maxPageSize.
+	List(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error)
+	Update(ctx context.Context, order *Order, events ...OrderEvent) error
+	Delete(ctx context.Context, orderID string) error
+	Count(ctx context.Context) (int, error)
+	OrderOutbox
 }
 
 type IOrderService interface {
-	CreateOrder(request OrderRequest) Order
-	GetOrder(orderID int) (Order, bool)
-	UpdateOrder(orderID int, status string) (Order, bool)
-	CancelOrder(orderID int) bool
-}
-
+	// CreateOrder returns the order even when it fails, with status Cancelled, together with the error
+	CreateOrder(ctx context.Context, request OrderRequest) (Order, error)
+	GetOrder(ctx context.Context, orderID string) (Order, error)
+	ListOrders(ctx context.Context, userID int) ([]Order, error)
+	// QueryOrders returns a page of the orders matching filter, see IOrderRepository.List
+	QueryOrders(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error)
+	UpdateOrder(ctx context.Context, orderID string, status OrderStatus) (Order, error)
+	CancelOrder(ctx context.Context, orderID string) error
+	// RefundOrder gives back amount of a shipped or delivered order, all of the rest when it is
+	// zero; the order is Refunded once everything is back
+	RefundOrder(ctx context.Context, orderID string, amount Money) (Order, error)
+	// WatchOrder sends the order now and on every status change, the channel is closed
+	// after a terminal status or when ctx is done
+	WatchOrder(ctx context.Context, orderID string) (<-chan Order, error)
+}
+
+// IPaymentService moves the money of an order: it is authorized when the order is placed,
+// captured when it ships and voided or refunded when it is cancelled. A refused payment is a
+// *PaymentError (ErrPaymentDeclined).
 type IPaymentService interface {
-	ProcessPayment(request PaymentRequest) (bool, string)
-}
-
+	// AuthorizePayment holds request.Amount for the order, authorizing it again is a no-op
+	AuthorizePayment(ctx context.Context, request PaymentRequest) error
+	CapturePayment(ctx context.Context, orderID string) error
+	// VoidPayment releases an authorization that wasn't captured
+	VoidPayment(ctx context.Context, orderID string) error
+	// RefundPayment gives back request.Amount of what was captured, all of the rest when it is zero
+	RefundPayment(ctx context.Context, request PaymentRequest) error
+	// Payment returns ErrPaymentNotFound for an order that has none
+	Payment(ctx context.Context, orderID string) (Payment, error)
+}
+
+// IInventoryService returns a *StockError (ErrOutOfStock) for products that aren't available
 type IInventoryService interface {
-	CheckStock(request InventoryRequest) (bool, string)
-	UpdateStock(request InventoryRequest) string
+	CheckStock(ctx context.Context, request InventoryRequest) error
+	UpdateStock(ctx context.Context, request InventoryRequest) error
+	// ReserveStock holds the items for request.OrderID, reserving again for the same order is a no-op
+	ReserveStock(ctx context.Context, request InventoryRequest) error
+	// CommitStock turns the reservation of request.OrderID into a sale
+	CommitStock(ctx context.Context, request InventoryRequest) error
+	// ReleaseStock puts what request.OrderID holds back, committed items go back on the shelf
+	ReleaseStock(ctx context.Context, request InventoryRequest) error
+	// ShipStock forgets the committed reservation of request.OrderID once its items left the shelf
+	ShipStock(ctx context.Context, request InventoryRequest) error
 }
 
 type INotificationService interface {
-	SendNotification(request NotificationRequest) string
+	SendNotification(ctx context.Context, request NotificationRequest) error
 }
 
 // Repositories
 
+// OrderRepository keeps orders in memory, they are gone after a restart
 type OrderRepository struct {
-	mu     sync.Mutex
-	orders map[int]Order
+	mu      sync.Mutex
+	orders  map[string]Order
+	indexes orderIndexes
+	outbox  memoryOutbox
 }
 
 func NewOrderRepository() *OrderRepository {
 	return &OrderRepository{
-		orders: make(map[int]Order),
+		orders:  make(map[string]Order),
+		indexes: newOrderIndexes(),
 	}
 }
 
-func (repo *OrderRepository) Save(order Order) {
+// clone copies the line items, so callers can't change a stored order through them
+func clone(order Order) Order {
+	order.Items = append([]LineItem(nil), order.Items...)
+	return order
+}
+
+func (repo *OrderRepository) Save(ctx context.Context, order *Order, events ...OrderEvent) error {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	repo.orders[order.OrderID] = order
+	if _, exists := repo.orders[order.OrderID]; exists {
+		return fmt.Errorf("order %s: %w", order.OrderID, ErrDuplicateOrder)
+	}
+	order.Version = 1
+	repo.orders[order.OrderID] = clone(*order)
+	repo.indexes.add(*order)
+	repo.outbox.add(events)
+	return nil
 }
 
-func (repo *OrderRepository) FindByID(orderID int) (Order, bool) {
+func (repo *OrderRepository) FindByID(ctx context.Context, orderID string) (Order, error) {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
 	order, exists := repo.orders[orderID]
-	return order, exists
+	if !exists {
+		return Order{}, ErrOrderNotFound
+	}
+	return clone(order), nil
+}
+
+func (repo *OrderRepository) FindByUser(ctx context.Context, userID int) ([]Order, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	var orders []Order
+	for orderID := range repo.indexes.byUser[userID] {
+		orders = append(orders, clone(repo.orders[orderID]))
+	}
+	var filter OrderFilter
+	sort.Slice(orders, func(i, j int) bool { return filter.before(filter.key(orders[i]), filter.key(orders[j])) })
+	return orders, nil
+}
+
+// List sorts the orders of a user when the filter names one, a user has few orders. Otherwise it
+// walks the time index of the sort field from the cursor, which also narrows a range on that field.
+func (repo *OrderRepository) List(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error) {
+	if err := filter.validate(); err != nil {
+		return OrderPage{}, err
+	}
+	after, err := filter.decodeCursor(cursor)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	limit = pageSize(limit)
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var matches []Order
+	if filter.UserID != 0 {
+		for orderID := range repo.indexes.byUser[filter.UserID] {
+			order := repo.orders[orderID]
+			if filter.matches(order) && (after == nil || filter.before(*after, filter.key(order))) {
+				matches = append(matches, clone(order))
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool { return filter.before(filter.key(matches[i]), filter.key(matches[j])) })
+		if len(matches) > limit+1 {
+			matches = matches[:limit+1]
+		}
+		return filter.page(matches, limit), nil
+	}
+
+	index, from, until := repo.indexes.byCreated, filter.CreatedFrom, filter.CreatedUntil
+	if filter.sortField() == SortByUpdatedAt {
+		index, from, until = repo.indexes.byUpdated, filter.UpdatedFrom, filter.UpdatedUntil
+	}
+	lo, hi := index.bounds(from, until, after, filter.Descending)
+	for n := 0; n < hi-lo && len(matches) <= limit; n++ {
+		i := lo + n
+		if filter.Descending {
+			i = hi - 1 - n
+		}
+		if order := repo.orders[index[i].OrderID]; filter.matches(order) {
+			matches = append(matches, clone(order))
+		}
+	}
+	return filter.page(matches, limit), nil
 }
 
-func (repo *OrderRepository) Update(order Order) {
+func (repo *OrderRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	repo.orders[order.OrderID] = order
+	stored, exists := repo.orders[order.OrderID]
+	if !exists {
+		return ErrOrderNotFound
+	}
+	if stored.Version != order.Version {
+		return &VersionConflictError{OrderID: order.OrderID, Expected: order.Version, Actual: stored.Version}
+	}
+	order.Version++
+	repo.indexes.remove(stored)
+	repo.orders[order.OrderID] = clone(*order)
+	repo.indexes.add(*order)
+	repo.outbox.add(events)
+	return nil
 }
 
-func (repo *OrderRepository) Delete(orderID int) {
+func (repo *OrderRepository) Delete(ctx context.Context, orderID string) error {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
+	order, exists := repo.orders[orderID]
+	if !exists {
+		return ErrOrderNotFound
+	}
+	repo.indexes.remove(order)
 	delete(repo.orders, orderID)
+	return nil
+}
+
+func (repo *OrderRepository) Count(ctx context.Context) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return len(repo.orders), nil
+}
+
+func (repo *OrderRepository) PendingEvents(ctx context.Context, limit int) ([]OrderEvent, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.outbox.pending(limit, time.Now()), nil
+}
+
+func (repo *OrderRepository) MarkPublished(ctx context.Context, eventIDs ...string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.outbox.markPublished(eventIDs)
+	return nil
 }
 
-func (repo *OrderRepository) Count() int {
+func (repo *OrderRepository) MarkFailed(ctx context.Context, eventID string, retryAt time.Time, park bool) error {
 	repo.mu.Lock()
 	defer repo.mu.Unlock()
-	return len(repo.orders)
+	repo.outbox.markFailed(eventID, retryAt, park)
+	return nil
+}
+
+func (repo *OrderRepository) ParkedEvents(ctx context.Context) ([]OrderEvent, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.outbox.parkedEvents(), nil
+}
+
+func (repo *OrderRepository) Unpark(ctx context.Context, eventIDs ...string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.outbox.unpark(eventIDs)
+	return nil
 }
 
 // Services
 
 type OrderService struct {
 	repo            IOrderRepository
+	idGen           IDGenerator
+	pricer          *Pricer
 	paymentSvc      IPaymentService
 	inventorySvc    IInventoryService
 	notificationSvc INotificationService
-}
-
-func NewOrderService(repo IOrderRepository, paymentSvc IPaymentService, inventorySvc IInventoryService, notificationSvc INotificationService) *OrderService {
+	saga            *CreateOrderSaga
+	broadcaster     *OrderBroadcaster
+	idempotency     IdempotencyStore
+	logger          *slog.Logger
+}
+
+// NewOrderService ignores idempotency keys when idempotency is nil, it logs to slog.Default()
+// until SetLogger is called
+func NewOrderService(repo IOrderRepository, idGen IDGenerator, pricer *Pricer, paymentSvc IPaymentService, inventorySvc IInventoryService, notificationSvc INotificationService, sagaStore SagaStore, idempotency IdempotencyStore) *OrderService {
+	broadcaster := NewOrderBroadcaster()
+	repo = &eventRecordingRepository{IOrderRepository: repo}
+	repo = &broadcastingRepository{IOrderRepository: repo, broadcaster: broadcaster}
 	return &OrderService{
 		repo:            repo,
+		idGen:           idGen,
+		pricer:          pricer,
 		paymentSvc:      paymentSvc,
 		inventorySvc:    inventorySvc,
 		notificationSvc: notificationSvc,
+		saga:            NewCreateOrderSaga(sagaStore, repo, paymentSvc, inventorySvc),
+		broadcaster:     broadcaster,
+		idempotency:     idempotency,
+		logger:          slog.Default(),
+	}
+}
+
+// SetLogger logs what goes wrong after an order is saved, when failing the request would
+// only make the client retry an order that exists, and what goes wrong in its sagas
+func (service *OrderService) SetLogger(logger *slog.Logger) {
+	service.logger = logger
+	service.saga.SetLogger(logger)
+}
+
+// ResumeSagas finishes the create order sagas a crash interrupted, run it before taking new orders.
+// It logs how many it resumed and the ones that failed.
+func (service *OrderService) ResumeSagas(ctx context.Context) ([]SagaState, error) {
+	resumed, err := service.saga.Resume(ctx)
+	if err != nil {
+		service.logger.ErrorContext(ctx, "resuming sagas failed", "error", err)
+	} else if len(resumed) > 0 {
+		service.logger.InfoContext(ctx, "resumed interrupted sagas", "count", len(resumed))
+	}
+	return resumed, err
+}
+
+// CreateOrder creates an order once per idempotency key. A retry with the same key and payload
+// gets the order the first request created in its current status, with the error of the first
+// request when its order failed; a retry with another payload gets ErrIdempotencyKeyReused and
+// one that overlaps the first request ErrRequestInProgress.
+func (service *OrderService) CreateOrder(ctx context.Context, request OrderRequest) (Order, error) {
+	if request.IdempotencyKey == "" || service.idempotency == nil {
+		return service.createOrder(ctx, request)
+	}
+	key := idempotencyScope(request)
+	record, claimed, err := service.idempotency.Claim(key, request.fingerprint())
+	if err != nil {
+		return Order{}, err
+	}
+	if !claimed {
+		if record.OrderID == "" {
+			return Order{}, ErrRequestInProgress
+		}
+		order, err := service.repo.FindByID(ctx, record.OrderID)
+		if err != nil {
+			return Order{}, err
+		}
+		return order, record.replayError()
+	}
+
+	order, err := service.createOrder(ctx, request)
+	if order.OrderID == "" {
+		// Nothing was saved, let a retry try again. If the key stays claimed retries get
+		// ErrRequestInProgress, the caller has to know that.
+		if releaseErr := service.idempotency.Release(key); releaseErr != nil {
+			err = errors.Join(err, fmt.Errorf("releasing idempotency key: %w", releaseErr))
+		}
 	}
+	return order, err
 }
 
-func (service *OrderService) CreateOrder(request OrderRequest) Order {
+func (service *OrderService) createOrder(ctx context.Context, request OrderRequest) (Order, error) {
+	quote, err := service.pricer.Price(ctx, request.Items, request.CouponCodes)
+	if err != nil {
+		return Order{}, err
+	}
+	orderID, err := service.idGen.NewID()
+	if err != nil {
+		return Order{}, fmt.Errorf("generating order ID: %w", err)
+	}
 	order := Order{
-		OrderID:     service.repo.Count() + 1,
+		OrderID:     orderID,
 		UserID:      request.UserID,
-		ProductList: request.ProductList,
-		OrderStatus: "Created",
-		TotalPrice:  request.TotalPrice,
+		OrderStatus: StatusCreated,
+		Subtotal:    quote.Subtotal,
+		Discount:    quote.Discount,
+		Tax:         quote.Tax,
+		TotalPrice:  quote.Total,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
+	for _, line := range quote.Lines {
+		order.Items = append(order.Items, line.LineItem)
+	}
 
-	// Check inventory before creating order
-	inventoryRequest := InventoryRequest{
-		ProductList: request.ProductList,
-		Quantity:    1, // Assuming 1 unit per product for simplicity
+	saga, err := service.saga.Begin(order, request)
+	if err != nil {
+		return Order{}, err
 	}
-	inStock, message := service.inventorySvc.CheckStock(inventoryRequest)
-	if !inStock {
-		fmt.Println("Inventory Check Failed:", message)
-		return order
+	if err := service.repo.Save(ctx, &order); err != nil {
+		service.saga.Abort(&saga, err)
+		return Order{}, err
+	}
+	if request.IdempotencyKey != "" && service.idempotency != nil {
+		// Before the saga runs, so a retry during it finds the order instead of waiting
+		if err := service.idempotency.Complete(idempotencyScope(request), order.OrderID); err != nil {
+			service.logger.ErrorContext(ctx, "recording the order of an idempotency key failed", "order", order.OrderID, "error", err)
+		}
 	}
 
-	service.repo.Save(order)
-
-	// Notify user about order creation
-	service.notificationSvc.SendNotification(NotificationRequest{
-		UserID:  request.UserID,
-		Message: fmt.Sprintf("Your order %d has been created.", order.OrderID),
-	})
+	// Reserve stock, take payment and confirm, a failed step cancels the order. OrderCreated notifies the user.
+	err = service.saga.Run(ctx, &saga)
+	if err != nil && request.IdempotencyKey != "" && service.idempotency != nil {
+		if failErr := service.idempotency.Fail(idempotencyScope(request), errorClass(err), err.Error()); failErr != nil {
+			service.logger.ErrorContext(ctx, "recording the error of an idempotency key failed", "order", order.OrderID, "error", failErr)
+		}
+	}
 
-	return order
+	if stored, findErr := service.repo.FindByID(ctx, order.OrderID); findErr == nil {
+		order = stored
+	}
+	return order, err
 }
 
-func (service *OrderService) GetOrder(orderID int) (Order, bool) {
-	return service.repo.FindByID(orderID)
+func (service *OrderService) GetOrder(ctx context.Context, orderID string) (Order, error) {
+	if err := ctx.Err(); err != nil {
+		return Order{}, err
+	}
+	return service.repo.FindByID(ctx, orderID)
 }
 
-func (service *OrderService) UpdateOrder(orderID int, status string) (Order, bool) {
-	order, exists := service.repo.FindByID(orderID)
-	if !exists {
-		return Order{}, false
+func (service *OrderService) ListOrders(ctx context.Context, userID int) ([]Order, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	order.OrderStatus = status
-	order.UpdatedAt = time.Now()
-	service.repo.Update(order)
-
-	// Notify user about order status update
-	service.notificationSvc.SendNotification(NotificationRequest{
-		UserID:  order.UserID,
-		Message: fmt.Sprintf("Your order %d status has been updated to %s.", order.OrderID, status),
-	})
-
-	return order, true
+	return service.repo.FindByUser(ctx, userID)
 }
 
-func (service *OrderService) CancelOrder(orderID int) bool {
-	order, exists := service.repo.FindByID(orderID)
-	if exists {
-		service.repo.Delete(orderID)
-
-		// Notify user about order cancellation
-		service.notificationSvc.SendNotification(NotificationRequest{
-			UserID:  order.UserID,
-			Message: fmt.Sprintf("Your order %d has been cancelled.", orderID),
-		})
+func (service *OrderService) QueryOrders(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error) {
+	if err := ctx.Err(); err != nil {
+		return OrderPage{}, err
 	}
-	return exists
+	return service.repo.List(ctx, filter, cursor, limit)
 }
 
-// PaymentService
+type expectedVersionKey struct{}
 
-type PaymentService struct{}
+// WithExpectedVersion makes UpdateOrder and CancelOrder change the order only while it is at
+// version, otherwise they fail with ErrStaleVersion. This is how HTTP's If-Match gets through.
+func WithExpectedVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, expectedVersionKey{}, version)
+}
 
-func NewPaymentService() *PaymentService {
-	return &PaymentService{}
+// findForChange loads the order and checks the version ctx expects, the repository's version check
+// on update covers a change in between
+func (service *OrderService) findForChange(ctx context.Context, orderID string) (Order, error) {
+	order, err := service.repo.FindByID(ctx, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	if version, ok := ctx.Value(expectedVersionKey{}).(int); ok && order.Version != version {
+		return Order{}, fmt.Errorf("%w: order %s is at version %d, not %d", ErrStaleVersion, orderID, order.Version, version)
+	}
+	return order, nil
 }
 
-func (p *PaymentService) ProcessPayment(request PaymentRequest) (bool, string) {
-	// Simulate payment processing logic
-	fmt.Printf("Processing payment for Order ID: %d, Amount: %.2f\n", request.OrderID, request.Amount)
-	return true, "Payment Successful"
+// UpdateOrder moves the order to status, illegal transitions return a *TransitionError. The status
+// is written before the payment and stock are settled, so a change that loses to a concurrent one
+// moves nothing; when settling fails the order keeps its new status and repeating the change
+// settles it again.
+func (service *OrderService) UpdateOrder(ctx context.Context, orderID string, status OrderStatus) (Order, error) {
+	if err := ctx.Err(); err != nil {
+		return Order{}, err
+	}
+	order, err := service.changeStatus(ctx, orderID, status)
+	if err != nil {
+		return Order{}, err
+	}
+	return order, service.settle(ctx, order)
 }
 
-// InventoryService
+// CancelOrder cancels an order that hasn't shipped, its payment is voided, its stock goes back
+// on the shelf and the order is kept with status Cancelled. Like UpdateOrder it settles after the
+// write, cancelling a cancelled order again settles what is left.
+func (service *OrderService) CancelOrder(ctx context.Context, orderID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	order, err := service.changeStatus(ctx, orderID, StatusCancelled)
+	if err != nil {
+		return err
+	}
+	return service.settle(ctx, order)
+}
 
-type InventoryService struct{}
+// changeStatus writes status to the order, an order already at status is returned as it is so
+// a repeated change only settles
+func (service *OrderService) changeStatus(ctx context.Context, orderID string, status OrderStatus) (Order, error) {
+	order, err := service.findForChange(ctx, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	if order.OrderStatus == status {
+		return order, nil
+	}
+	if err := order.transition(status); err != nil {
+		return Order{}, err
+	}
+	order.UpdatedAt = time.Now()
+	// The OrderStatusChanged or OrderCancelled event written with it notifies the user
+	if err := service.repo.Update(ctx, &order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
 
-func NewInventoryService() *InventoryService {
-	return &InventoryService{}
+// settle moves the money and the stock for the status the order was written with
+func (service *OrderService) settle(ctx context.Context, order Order) error {
+	if err := service.settlePayment(ctx, order); err != nil {
+		return fmt.Errorf("order %s is %s but settling its payment failed, repeat the change to retry: %w", order.OrderID, order.OrderStatus, err)
+	}
+	if err := service.settleStock(ctx, order); err != nil {
+		return fmt.Errorf("order %s is %s but settling its stock failed, repeat the change to retry: %w", order.OrderID, order.OrderStatus, err)
+	}
+	return nil
+}
+
+// settlePayment moves the money for the status the order went to: shipping captures the payment,
+// cancelling or refunding voids it, or refunds it once it was captured. The payment calls are
+// idempotent, so it can run again for the same status.
+func (service *OrderService) settlePayment(ctx context.Context, order Order) error {
+	switch order.OrderStatus {
+	case StatusShipped:
+		return service.paymentSvc.CapturePayment(ctx, order.OrderID)
+	case StatusCancelled, StatusRefunded:
+		payment, err := service.paymentSvc.Payment(ctx, order.OrderID)
+		if errors.Is(err, ErrPaymentNotFound) {
+			// Cancelled before the saga got to the payment
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if payment.Status == PaymentCaptured || payment.Status == PaymentRefunded {
+			return service.paymentSvc.RefundPayment(ctx, PaymentRequest{OrderID: order.OrderID})
+		}
+		return service.paymentSvc.VoidPayment(ctx, order.OrderID)
+	}
+	return nil
+}
+
+// settleStock moves the stock for the status the order went to: cancelling puts the items the
+// saga reserved or committed back on the shelf, and shipping ends the reservation, after which the
+// items are gone for good. Both are no-ops for an order that holds nothing, so they can be retried.
+func (service *OrderService) settleStock(ctx context.Context, order Order) error {
+	request := InventoryRequest{OrderID: order.OrderID, Items: itemsFor(order.Items)}
+	switch order.OrderStatus {
+	case StatusCancelled:
+		return service.inventorySvc.ReleaseStock(ctx, request)
+	case StatusShipped:
+		return service.inventorySvc.ShipStock(ctx, request)
+	}
+	return nil
 }
 
-func (i *InventoryService) CheckStock(request InventoryRequest) (bool, string) {
-	// Simulate inventory check logic
-	fmt.Printf("Checking stock for Products: %v\n", request.ProductList)
-	// Assume all products are in stock for simplicity
-	return true, "Stock Available"
+func (service *OrderService) RefundOrder(ctx context.Context, orderID string, amount Money) (Order, error) {
+	if err := ctx.Err(); err != nil {
+		return Order{}, err
+	}
+	order, err := service.repo.FindByID(ctx, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	if !order.OrderStatus.CanTransitionTo(StatusRefunded) {
+		return Order{}, &TransitionError{OrderID: orderID, From: order.OrderStatus, To: StatusRefunded}
+	}
+	if err := service.paymentSvc.RefundPayment(ctx, PaymentRequest{OrderID: orderID, Amount: amount}); err != nil {
+		return Order{}, err
+	}
+	payment, err := service.paymentSvc.Payment(ctx, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	if payment.Refunded < payment.Captured {
+		return order, nil
+	}
+	if err := order.transition(StatusRefunded); err != nil {
+		return Order{}, err
+	}
+	order.UpdatedAt = time.Now()
+	if err := service.repo.Update(ctx, &order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
 }
 
-func (i *InventoryService) UpdateStock(request InventoryRequest) string {
-	// Simulate stock update logic
-	fmt.Printf("Updating stock for Products: %v, Quantity: %d\n", request.ProductList, request.Quantity)
-	return "Stock Updated Successfully"
+func (service *OrderService) WatchOrder(ctx context.Context, orderID string) (<-chan Order, error) {
+	// Subscribe before reading, so no change can slip in between
+	updates, cancel := service.broadcaster.Subscribe(orderID)
+	order, err := service.repo.FindByID(ctx, orderID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan Order, 1)
+	out <- order
+	go func() {
+		defer close(out)
+		defer cancel()
+		last := order.OrderStatus
+		for !last.Terminal() {
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				if update.OrderStatus == last {
+					continue
+				}
+				select {
+				case out <- update:
+					last = update.OrderStatus
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
 }
 
 // NotificationService
@@ -243,77 +659,315 @@ func NewNotificationService() *NotificationService {
 	return &NotificationService{}
 }
 
-func (n *NotificationService) SendNotification(request NotificationRequest) string {
+func (n *NotificationService) SendNotification(ctx context.Context, request NotificationRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if request.UserID <= 0 {
+		return fmt.Errorf("user %d: %w", request.UserID, ErrNotFound)
+	}
 	// Simulate sending notification logic
 	fmt.Printf("Sending notification to User ID: %d, Message: %s\n", request.UserID, request.Message)
-	return "Notification Sent"
+	return nil
 }
 
 // Factory for Dependency Injection
 
-type ServiceFactory struct{}
-
-func (f *ServiceFactory) CreateOrderService() IOrderService {
-	repo := NewOrderRepository()
-	paymentSvc := NewPaymentService()
-	inventorySvc := NewInventoryService()
+// ServiceFactory keeps orders in Repository, sagas in SagaStore and idempotency keys in
+// IdempotencyStore, all in memory when nil, and makes order IDs with IDGenerator, ULIDs when it
+// is nil. Orders are priced by Pricer, the demo catalog and promotions when it is nil, and paid
+// through PaymentProvider, a fake one that declines over demoPaymentLimit when it is nil. The
+// in-memory IdempotencyStore keeps keys for IdempotencyRetention, DefaultIdempotencyRetention
+// when it is zero. Order events are relayed from the repository's outbox to EventBus, an
+// in-memory bus that notifies users when it is nil; call Close to stop the relay. The service
+// logs to Logger, slog.Default() when it is nil.
+type ServiceFactory struct {
+	Repository           IOrderRepository
+	Pricer               *Pricer
+	PaymentProvider      PaymentProvider
+	SagaStore            SagaStore
+	IDGenerator          IDGenerator
+	IdempotencyStore     IdempotencyStore
+	IdempotencyRetention time.Duration
+	EventBus             EventBus
+	Logger               *slog.Logger
+	relay                *OutboxRelay
+}
+
+// CreateOrderService resumes interrupted sagas before returning the service. The demo stock it
+// can't seed, e.g. because ctx is done, is logged and left out.
+func (f *ServiceFactory) CreateOrderService(ctx context.Context) IOrderService {
+	logger := f.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	repo := f.Repository
+	if repo == nil {
+		repo = NewOrderRepository()
+	}
+	pricer := f.Pricer
+	if pricer == nil {
+		pricer = newDemoPricer()
+	}
+	provider := f.PaymentProvider
+	if provider == nil {
+		provider = NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit})
+	}
+	paymentSvc := NewPaymentService(provider)
+	if fake, ok := provider.(*FakePaymentProvider); ok {
+		fake.OnWebhook(paymentSvc.HandleWebhook)
+	}
+	inventorySvc := NewInventoryService(15 * time.Minute)
+	if err := inventorySvc.UpdateStock(ctx, InventoryRequest{Items: []InventoryItem{
+		{SKU: "item1", Quantity: 10},
+		{SKU: "item2", Quantity: 10},
+		{SKU: "item3", Quantity: 5},
+		{SKU: "item5", Quantity: 1},
+	}}); err != nil {
+		logger.ErrorContext(ctx, "seeding the demo stock failed", "error", err)
+	}
 	notificationSvc := NewNotificationService()
-	return NewOrderService(repo, paymentSvc, inventorySvc, notificationSvc)
+	idGen := f.IDGenerator
+	if idGen == nil {
+		idGen = NewULIDGenerator()
+	}
+	sagaStore := f.SagaStore
+	if sagaStore == nil {
+		sagaStore = NewInMemorySagaStore()
+	}
+	idempotency := f.IdempotencyStore
+	if idempotency == nil {
+		retention := f.IdempotencyRetention
+		if retention <= 0 {
+			retention = DefaultIdempotencyRetention
+		}
+		idempotency = NewInMemoryIdempotencyStore(retention)
+	}
+	bus := f.EventBus
+	if bus == nil {
+		inMemory := NewInMemoryEventBus()
+		inMemory.Subscribe(NotifyOnEvent(notificationSvc, logger))
+		bus = inMemory
+	}
+	f.relay = NewOutboxRelay(repo, bus, defaultRelayInterval)
+	f.relay.SetLogger(logger)
+	f.relay.Start()
+	service := NewOrderService(repo, idGen, pricer, paymentSvc, inventorySvc, notificationSvc, sagaStore, idempotency)
+	service.SetLogger(logger)
+	// the service logs what it resumed and what failed
+	service.ResumeSagas(ctx)
+	return service
+}
+
+// demoPaymentLimit is where the fake payment provider starts declining
+const demoPaymentLimit Money = 500_00
+
+// newDemoPricer sells the items the factory stocks, with 8.25% tax and 2.5% on food
+func newDemoPricer() *Pricer {
+	catalog := NewInMemoryCatalog(
+		Product{SKU: "item1", Name: "Desk lamp", UnitPrice: 19_99},
+		Product{SKU: "item2", Name: "Coffee beans", UnitPrice: 5_49, TaxCategory: "food"},
+		Product{SKU: "item3", Name: "Office chair", UnitPrice: 129_00},
+		Product{SKU: "item4", Name: "Notebook", UnitPrice: 9_99},
+		Product{SKU: "item5", Name: "Headphones", UnitPrice: 49_50},
+	)
+	pricer := NewPricer(catalog, CategoryTax{Default: 825, Rates: map[string]int64{"food": 250}})
+	pricer.AddPromotion(BuyXGetY{Label: "coffee 3 for 2", SKU: "item2", Buy: 2, Get: 1})
+	pricer.AddCoupon("SAVE10", PercentOff{Label: "10% off", BasisPoints: 1000})
+	pricer.AddCoupon("FIVEOFF", AmountOff{Label: "5.00 off 50.00", Amount: 5_00, MinSubtotal: 50_00})
+	return pricer
+}
+
+// Close stops relaying events after publishing the pending ones
+func (f *ServiceFactory) Close(ctx context.Context) error {
+	if f.relay == nil {
+		return nil
+	}
+	return f.relay.Stop(ctx)
 }
 
-// Main function to demonstrate usage
+// Main function to demonstrate usage, the service is split across files in this directory: go run .
 
 func main() {
+	addr := flag.String("addr", "", "serve the REST API on this address, e.g. :8080")
+	rpcDemo := flag.Bool("demo-rpc", false, "call the RPC server in process, including WatchOrder")
+	dbDriver := flag.String("db-driver", "", "keep orders in SQL with this database/sql driver, the binary must link it in")
+	dsn := flag.String("db", "", "data source name for -db-driver")
+	numbered := flag.Bool("db-numbered", false, "the driver wants $1 placeholders instead of ?")
+	eventSourced := flag.Bool("event-sourced", false, "keep orders as events in memory, with snapshots and projections")
+	eventsDemo := flag.Bool("demo-events", false, "show the history, snapshots and projection rebuild of an event sourced order")
+	paymentsDemo := flag.Bool("demo-payments", false, "pay orders through a fake provider that answers by webhook and loses a response")
+	sagaDir := flag.String("saga-dir", "", "keep saga state in files in this directory and resume it on startup, use with -db")
+	flag.Parse()
+
+	ctx := context.Background()
 	factory := &ServiceFactory{}
-	orderService := factory.CreateOrderService()
+
+	var db *sql.DB
+	if *dbDriver != "" {
+		var err error
+		if db, err = sql.Open(*dbDriver, *dsn); err != nil {
+			fmt.Println("Opening the database failed:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		repo, err := NewSQLOrderRepository(ctx, db, *numbered)
+		if err != nil {
+			fmt.Println("Migrating the database failed:", err)
+			os.Exit(1)
+		}
+		factory.Repository = repo
+	}
+	var eventSourcedRepo *EventSourcedOrderRepository
+	if *eventSourced || *eventsDemo {
+		eventSourcedRepo = NewEventSourcedOrderRepository(NewInMemoryEventStore(), NewInMemorySnapshotStore(), defaultSnapshotEvery)
+		factory.Repository = eventSourcedRepo
+	}
+
+	if *sagaDir != "" {
+		store, err := NewFileSagaStore(*sagaDir)
+		if err != nil {
+			fmt.Println("Opening the saga directory failed:", err)
+			os.Exit(1)
+		}
+		factory.SagaStore = store
+	}
+
+	var fakeProvider *FakePaymentProvider
+	if *paymentsDemo {
+		fakeProvider = NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit, WebhookDelay: 20 * time.Millisecond})
+		factory.PaymentProvider = fakeProvider
+	}
+
+	orderService := factory.CreateOrderService(ctx)
+	defer factory.Close(ctx)
+
+	if *addr != "" {
+		fmt.Println("Serving orders on", *addr)
+		if err := http.ListenAndServe(*addr, NewOrderHandler(orderService)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *rpcDemo {
+		demoRPC(orderService)
+		return
+	}
+	if *eventsDemo {
+		demoEvents(ctx, orderService, eventSourcedRepo)
+		return
+	}
+	if *paymentsDemo {
+		demoPayments(ctx, orderService, fakeProvider)
+		return
+	}
 
 	// Create an order
 	orderRequest := OrderRequest{
 		UserID:      1,
-		ProductList: []string{"item1", "item2"},
-		TotalPrice:  100.0,
+		Items:       []OrderItem{{SKU: "item1", Qty: 2}, {SKU: "item2", Qty: 3}},
+		CouponCodes: []string{"FIVEOFF"},
+	}
+	newOrder, err := orderService.CreateOrder(ctx, orderRequest)
+	if err != nil {
+		fmt.Println("Create failed:", err)
+		return
 	}
-	newOrder := orderService.CreateOrder(orderRequest)
 	fmt.Printf("Created Order: %+v\n", newOrder)
+	fmt.Printf("Subtotal %s, discount %s, tax %s, total %s\n", newOrder.Subtotal, newOrder.Discount, newOrder.Tax, newOrder.TotalPrice)
 
-	// Process Payment
-	paymentRequest := PaymentRequest{
-		OrderID: newOrder.OrderID,
-		Amount:  newOrder.TotalPrice,
+	// Get an order
+	fetchedOrder, err := orderService.GetOrder(ctx, newOrder.OrderID)
+	if err != nil {
+		fmt.Println("Get failed:", err)
+	} else {
+		fmt.Printf("Fetched Order: %+v\n", fetchedOrder)
+	}
+	if _, err := orderService.GetOrder(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV"); errors.Is(err, ErrNotFound) {
+		fmt.Println("Get failed:", err)
 	}
-	paymentSvc := NewPaymentService()
-	paymentSuccess, message := paymentSvc.ProcessPayment(paymentRequest)
-	fmt.Printf("Payment Status: %v, Message: %s\n", paymentSuccess, message)
 
-	// Update Inventory
-	inventoryRequest := InventoryRequest{
-		ProductList: []string{"item1", "item2"},
-		Quantity:    1,
+	// The saga left the order Paid, move it through the rest of its lifecycle
+	for _, status := range []OrderStatus{StatusFulfilling, StatusShipped} {
+		updatedOrder, err := orderService.UpdateOrder(ctx, newOrder.OrderID, status)
+		if err != nil {
+			fmt.Println("Update failed:", err)
+			break
+		}
+		fmt.Printf("Updated Order: %+v\n", updatedOrder)
 	}
-	inventorySvc := NewInventoryService()
-	stockMessage := inventorySvc.UpdateStock(inventoryRequest)
-	fmt.Println(stockMessage)
 
-	// Get an order
-	fetchedOrder, exists := orderService.GetOrder(newOrder.OrderID)
-	if exists {
-		fmt.Printf("Fetched Order: %+v\n", fetchedOrder)
+	// A shipped order can't be cancelled any more
+	if err := orderService.CancelOrder(ctx, newOrder.OrderID); err != nil {
+		fmt.Println("Cancel failed:", err)
 	} else {
-		fmt.Println("Order not found")
+		fmt.Println("Order cancelled successfully")
 	}
 
-	// Update an order
-	updatedOrder, exists := orderService.UpdateOrder(newOrder.OrderID, "Shipped")
-	if exists {
-		fmt.Printf("Updated Order: %+v\n", updatedOrder)
-	} else {
-		fmt.Println("Order not found")
+	// item4 is sold out, that fails the order before any payment is taken
+	soldOutOrder, err := orderService.CreateOrder(ctx, OrderRequest{
+		UserID: 2,
+		Items:  []OrderItem{{SKU: "item3", Qty: 1}, {SKU: "item4", Qty: 1}},
+	})
+	if errors.Is(err, ErrOutOfStock) {
+		fmt.Printf("Order %s is %s: %v\n", soldOutOrder.OrderID, soldOutOrder.OrderStatus, err)
 	}
 
-	// Cancel an order
-	if orderService.CancelOrder(newOrder.OrderID) {
-		fmt.Println("Order cancelled successfully")
-	} else {
-		fmt.Println("Order not found")
+	// A declined payment releases the reserved stock and cancels the order
+	declinedOrder, err := orderService.CreateOrder(ctx, OrderRequest{
+		UserID: 2,
+		Items:  []OrderItem{{SKU: "item3", Qty: 4}},
+	})
+	if errors.Is(err, ErrPaymentDeclined) {
+		fmt.Printf("Order %s is %s: %v\n", declinedOrder.OrderID, declinedOrder.OrderStatus, err)
+	}
+
+	// Prices come from the catalog, an unknown product or coupon is rejected before anything is saved
+	if _, err := orderService.CreateOrder(ctx, OrderRequest{UserID: 2, Items: []OrderItem{{SKU: "item9", Qty: 1}}}); errors.Is(err, ErrInvalidRequest) {
+		fmt.Println("Create failed:", err)
+	}
+	if _, err := orderService.CreateOrder(ctx, OrderRequest{UserID: 2, Items: []OrderItem{{SKU: "item1", Qty: 1}}, CouponCodes: []string{"FREE"}}); errors.Is(err, ErrUnknownCoupon) {
+		fmt.Println("Create failed:", err)
+	}
+
+	// Two orders race for the last item5, only one of them gets it
+	var wg sync.WaitGroup
+	for userID := 3; userID <= 4; userID++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order, err := orderService.CreateOrder(ctx, OrderRequest{
+				UserID: userID,
+				Items:  []OrderItem{{SKU: "item5", Qty: 1}},
+			})
+			fmt.Printf("User %d: order %s is %s, err: %v\n", userID, order.OrderID, order.OrderStatus, err)
+		}()
+	}
+	wg.Wait()
+
+	// A client retrying after a timeout gets the same order back, not a second one
+	retried := OrderRequest{UserID: 5, Items: []OrderItem{{SKU: "item2", Qty: 1}}, IdempotencyKey: "checkout-5-1"}
+	first, err := orderService.CreateOrder(ctx, retried)
+	if err != nil {
+		fmt.Println("Create failed:", err)
+	}
+	second, err := orderService.CreateOrder(ctx, retried)
+	fmt.Printf("Retry with key %s: order %s, same order: %t, err: %v\n", retried.IdempotencyKey, second.OrderID, first.OrderID == second.OrderID, err)
+	retried.CouponCodes = []string{"SAVE10"}
+	if _, err := orderService.CreateOrder(ctx, retried); err != nil {
+		fmt.Println("Create failed:", err)
+	}
+
+	// The other ID generators, any of them can be set on the factory
+	snowflake, err := NewSnowflakeIDGenerator(1)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, idGen := range []IDGenerator{NewAtomicIDGenerator(), snowflake, NewULIDGenerator()} {
+		first, _ := idGen.NewID()
+		second, _ := idGen.NewID()
+		fmt.Printf("%T: %s, %s\n", idGen, first, second)
 	}
 }
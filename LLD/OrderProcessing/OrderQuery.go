@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// ErrInvalidCursor is an ErrInvalidRequest, the cursor is malformed or came from another query
+var ErrInvalidCursor = fmt.Errorf("%w: invalid cursor", ErrInvalidRequest)
+
+// OrderSortField is the timestamp a query is ordered by, ties are broken by order ID
+type OrderSortField string
+
+const (
+	SortByCreatedAt OrderSortField = "createdAt"
+	SortByUpdatedAt OrderSortField = "updatedAt"
+)
+
+// OrderFilter selects orders, zero fields don't filter. Time ranges include From and exclude Until.
+type OrderFilter struct {
+	UserID       int
+	Statuses     []OrderStatus
+	CreatedFrom  time.Time
+	CreatedUntil time.Time
+	UpdatedFrom  time.Time
+	UpdatedUntil time.Time
+	SortBy       OrderSortField // SortByCreatedAt when empty
+	Descending   bool
+}
+
+// OrderPage is one page of a query, NextCursor is empty on the last page
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+func (filter OrderFilter) sortField() OrderSortField {
+	if filter.SortBy == "" {
+		return SortByCreatedAt
+	}
+	return filter.SortBy
+}
+
+func (filter OrderFilter) validate() error {
+	if field := filter.sortField(); field != SortByCreatedAt && field != SortByUpdatedAt {
+		return fmt.Errorf("%w: can't sort by %q", ErrInvalidRequest, field)
+	}
+	for _, status := range filter.Statuses {
+		if !status.Valid() {
+			return fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+		}
+	}
+	return nil
+}
+
+func inRange(t, from, until time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (until.IsZero() || t.Before(until))
+}
+
+func (filter OrderFilter) matches(order Order) bool {
+	if filter.UserID != 0 && order.UserID != filter.UserID {
+		return false
+	}
+	if len(filter.Statuses) > 0 {
+		found := false
+		for _, status := range filter.Statuses {
+			if order.OrderStatus == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return inRange(order.CreatedAt, filter.CreatedFrom, filter.CreatedUntil) &&
+		inRange(order.UpdatedAt, filter.UpdatedFrom, filter.UpdatedUntil)
+}
+
+// sortKey is the position of an order in the query's order
+type sortKey struct {
+	At      time.Time
+	OrderID string
+}
+
+func (k sortKey) equal(other sortKey) bool {
+	return k.At.Equal(other.At) && k.OrderID == other.OrderID
+}
+
+func (k sortKey) less(other sortKey) bool {
+	if !k.At.Equal(other.At) {
+		return k.At.Before(other.At)
+	}
+	return k.OrderID < other.OrderID
+}
+
+func (filter OrderFilter) key(order Order) sortKey {
+	if filter.sortField() == SortByUpdatedAt {
+		return sortKey{At: order.UpdatedAt, OrderID: order.OrderID}
+	}
+	return sortKey{At: order.CreatedAt, OrderID: order.OrderID}
+}
+
+// before reports whether a comes before b in the query's order
+func (filter OrderFilter) before(a, b sortKey) bool {
+	if filter.Descending {
+		return b.less(a)
+	}
+	return a.less(b)
+}
+
+// fingerprint ties a cursor to the query it came from
+func (filter OrderFilter) fingerprint() uint32 {
+	statuses := make([]string, len(filter.Statuses))
+	for i, status := range filter.Statuses {
+		statuses[i] = string(status)
+	}
+	sort.Strings(statuses)
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d|%s|%d|%d|%d|%d|%s|%t", filter.UserID, strings.Join(statuses, ","),
+		filter.CreatedFrom.UnixNano(), filter.CreatedUntil.UnixNano(),
+		filter.UpdatedFrom.UnixNano(), filter.UpdatedUntil.UnixNano(),
+		filter.sortField(), filter.Descending)
+	return h.Sum32()
+}
+
+type cursorData struct {
+	At      int64  `json:"t"`
+	OrderID string `json:"id"`
+	Filter  uint32 `json:"f"`
+}
+
+// encodeCursor points just past order, the cursor is opaque to clients
+func (filter OrderFilter) encodeCursor(order Order) string {
+	key := filter.key(order)
+	data, _ := json.Marshal(cursorData{At: key.At.UnixNano(), OrderID: key.OrderID, Filter: filter.fingerprint()})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns nil for the first page
+func (filter OrderFilter) decodeCursor(cursor string) (*sortKey, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var data cursorData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if data.Filter != filter.fingerprint() {
+		return nil, fmt.Errorf("%w: it belongs to a different query", ErrInvalidCursor)
+	}
+	return &sortKey{At: time.Unix(0, data.At), OrderID: data.OrderID}, nil
+}
+
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	return min(limit, maxPageSize)
+}
+
+// page cuts sorted matches, which may hold one more than limit, into a page
+func (filter OrderFilter) page(orders []Order, limit int) OrderPage {
+	if len(orders) <= limit {
+		return OrderPage{Orders: orders}
+	}
+	orders = orders[:limit]
+	return OrderPage{Orders: orders, NextCursor: filter.encodeCursor(orders[limit-1])}
+}
+
+// timeIndex is a secondary index of order IDs sorted by a timestamp
+type timeIndex []sortKey
+
+func (index timeIndex) search(key sortKey) int {
+	return sort.Search(len(index), func(i int) bool { return !index[i].less(key) })
+}
+
+func (index *timeIndex) insert(key sortKey) {
+	i := index.search(key)
+	*index = append(*index, sortKey{})
+	copy((*index)[i+1:], (*index)[i:])
+	(*index)[i] = key
+}
+
+func (index *timeIndex) remove(key sortKey) {
+	i := index.search(key)
+	if i < len(*index) && (*index)[i].equal(key) {
+		*index = append((*index)[:i], (*index)[i+1:]...)
+	}
+}
+
+// bounds is the part of the index within [from, until) and after the cursor
+func (index timeIndex) bounds(from, until time.Time, cursor *sortKey, descending bool) (lo, hi int) {
+	lo, hi = 0, len(index)
+	if !from.IsZero() {
+		lo = index.search(sortKey{At: from})
+	}
+	if !until.IsZero() {
+		hi = index.search(sortKey{At: until})
+	}
+	if cursor != nil {
+		// An order ID sorts after "", so searching for the cursor itself and skipping it is exact
+		i := index.search(*cursor)
+		if descending {
+			hi = min(hi, i)
+		} else {
+			if i < len(index) && index[i].equal(*cursor) {
+				i++
+			}
+			lo = max(lo, i)
+		}
+	}
+	return lo, max(lo, hi)
+}
+
+// orderIndexes are the secondary indexes of the in-memory repository
+type orderIndexes struct {
+	byUser    map[int]map[string]struct{}
+	byCreated timeIndex
+	byUpdated timeIndex
+}
+
+func newOrderIndexes() orderIndexes {
+	return orderIndexes{byUser: make(map[int]map[string]struct{})}
+}
+
+func (indexes *orderIndexes) add(order Order) {
+	if indexes.byUser[order.UserID] == nil {
+		indexes.byUser[order.UserID] = make(map[string]struct{})
+	}
+	indexes.byUser[order.UserID][order.OrderID] = struct{}{}
+	indexes.byCreated.insert(sortKey{At: order.CreatedAt, OrderID: order.OrderID})
+	indexes.byUpdated.insert(sortKey{At: order.UpdatedAt, OrderID: order.OrderID})
+}
+
+func (indexes *orderIndexes) remove(order Order) {
+	delete(indexes.byUser[order.UserID], order.OrderID)
+	if len(indexes.byUser[order.UserID]) == 0 {
+		delete(indexes.byUser, order.UserID)
+	}
+	indexes.byCreated.remove(sortKey{At: order.CreatedAt, OrderID: order.OrderID})
+	indexes.byUpdated.remove(sortKey{At: order.UpdatedAt, OrderID: order.OrderID})
+}
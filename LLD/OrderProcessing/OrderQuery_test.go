@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// The list checks of repositoryContract
+
+// listAll follows the cursors to the last page and returns the order IDs in order
+func listAll(ctx context.Context, repo IOrderRepository, filter OrderFilter, limit int) ([]string, error) {
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			return nil, fmt.Errorf("still paging after %d pages", pages)
+		}
+		page, err := repo.List(ctx, filter, cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Orders) > limit {
+			return nil, fmt.Errorf("page of %d orders, limit %d", len(page.Orders), limit)
+		}
+		for _, order := range page.Orders {
+			ids = append(ids, order.OrderID)
+		}
+		if page.NextCursor == "" {
+			return ids, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// saveListOrders saves orders a to e, created a second apart and updated in reverse
+func saveListOrders(ctx context.Context, repo IOrderRepository) error {
+	statuses := []OrderStatus{StatusCreated, StatusPaid, StatusCreated, StatusPaid, StatusCancelled}
+	for i, orderID := range []string{"b", "a", "c", "d", "e"} {
+		order := contractOrder(orderID, 1+i%2, contractTime.Add(time.Duration(i/2*2)*time.Second))
+		order.UpdatedAt = contractTime.Add(time.Hour - time.Duration(i)*time.Second)
+		order.OrderStatus = statuses[i]
+		if err := repo.Save(ctx, &order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameIDs(got []string, want ...string) error {
+	if !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+		return fmt.Errorf("got %v, want %v", got, want)
+	}
+	return nil
+}
+
+func contractListPages(ctx context.Context, repo IOrderRepository) error {
+	if err := saveListOrders(ctx, repo); err != nil {
+		return err
+	}
+	// b and a share a creation time, ties go by order ID
+	for _, limit := range []int{1, 2, 5, 10} {
+		ids, err := listAll(ctx, repo, OrderFilter{}, limit)
+		if err != nil {
+			return err
+		}
+		if err := sameIDs(ids, "a", "b", "c", "d", "e"); err != nil {
+			return fmt.Errorf("limit %d: %w", limit, err)
+		}
+	}
+	ids, err := listAll(ctx, repo, OrderFilter{Descending: true}, 2)
+	if err != nil {
+		return err
+	}
+	if err := sameIDs(ids, "e", "d", "c", "b", "a"); err != nil {
+		return fmt.Errorf("descending: %w", err)
+	}
+	ids, err = listAll(ctx, repo, OrderFilter{SortBy: SortByUpdatedAt}, 2)
+	if err != nil {
+		return err
+	}
+	if err := sameIDs(ids, "e", "d", "c", "a", "b"); err != nil {
+		return fmt.Errorf("by updatedAt: %w", err)
+	}
+
+	page, err := repo.List(ctx, OrderFilter{}, "", 1)
+	if err != nil {
+		return err
+	}
+	want := contractOrder("a", 2, contractTime)
+	want.UpdatedAt = contractTime.Add(time.Hour - time.Second)
+	want.OrderStatus = StatusPaid
+	want.Version = 1
+	return sameOrder(page.Orders[0], want)
+}
+
+func contractListFilters(ctx context.Context, repo IOrderRepository) error {
+	if err := saveListOrders(ctx, repo); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name   string
+		filter OrderFilter
+		want   []string
+	}{
+		{"user", OrderFilter{UserID: 1}, []string{"b", "c", "e"}},
+		{"user descending", OrderFilter{UserID: 2, Descending: true}, []string{"d", "a"}},
+		{"status", OrderFilter{Statuses: []OrderStatus{StatusPaid, StatusCancelled}}, []string{"a", "d", "e"}},
+		{"user and status", OrderFilter{UserID: 1, Statuses: []OrderStatus{StatusCreated}}, []string{"b", "c"}},
+		{"created range", OrderFilter{CreatedFrom: contractTime.Add(2 * time.Second), CreatedUntil: contractTime.Add(4 * time.Second)}, []string{"c", "d"}},
+		{"updated range", OrderFilter{UpdatedFrom: contractTime.Add(time.Hour - 3*time.Second), UpdatedUntil: contractTime.Add(time.Hour - time.Second), SortBy: SortByUpdatedAt, Descending: true}, []string{"c", "d"}},
+		{"no match", OrderFilter{UserID: 3}, nil},
+	} {
+		ids, err := listAll(ctx, repo, c.filter, 1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		if err := sameIDs(ids, c.want...); err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func contractListCursor(ctx context.Context, repo IOrderRepository) error {
+	if err := saveListOrders(ctx, repo); err != nil {
+		return err
+	}
+	page, err := repo.List(ctx, OrderFilter{UserID: 1}, "", 1)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.List(ctx, OrderFilter{UserID: 2}, page.NextCursor, 1); !errors.Is(err, ErrInvalidCursor) {
+		return fmt.Errorf("cursor of another query returned %v, want ErrInvalidCursor", err)
+	}
+	if _, err := repo.List(ctx, OrderFilter{}, "not a cursor", 1); !errors.Is(err, ErrInvalidCursor) {
+		return fmt.Errorf("garbage cursor returned %v, want ErrInvalidCursor", err)
+	}
+	if _, err := repo.List(ctx, OrderFilter{Statuses: []OrderStatus{"Lost"}}, "", 1); !errors.Is(err, ErrUnknownStatus) {
+		return fmt.Errorf("unknown status returned %v, want ErrUnknownStatus", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OrderStatus is a state of the order lifecycle
+type OrderStatus string
+
+const (
+	StatusCreated        OrderStatus = "Created"
+	StatusPaymentPending OrderStatus = "PaymentPending"
+	StatusPaid           OrderStatus = "Paid"
+	StatusFulfilling     OrderStatus = "Fulfilling"
+	StatusShipped        OrderStatus = "Shipped"
+	StatusDelivered      OrderStatus = "Delivered"
+	StatusCancelled      OrderStatus = "Cancelled"
+	StatusRefunded       OrderStatus = "Refunded"
+)
+
+// orderTransitions is the lifecycle:
+// Created -> PaymentPending -> Paid -> Fulfilling -> Shipped -> Delivered.
+// Paid means authorized, the payment is captured when the order ships. Until then an order can be
+// cancelled and the authorization voided, after that the money has to go back, so it is refunded.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	StatusCreated:        {StatusPaymentPending, StatusCancelled},
+	StatusPaymentPending: {StatusPaid, StatusCancelled},
+	StatusPaid:           {StatusFulfilling, StatusCancelled},
+	StatusFulfilling:     {StatusShipped, StatusCancelled},
+	StatusShipped:        {StatusDelivered, StatusRefunded},
+	StatusDelivered:      {StatusRefunded},
+	StatusCancelled:      {},
+	StatusRefunded:       {},
+}
+
+// Valid reports whether s is a known status
+func (s OrderStatus) Valid() bool {
+	_, exists := orderTransitions[s]
+	return exists
+}
+
+// CanTransitionTo reports whether an order in status s may move to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether no further transition is possible
+func (s OrderStatus) Terminal() bool {
+	return s.Valid() && len(orderTransitions[s]) == 0
+}
+
+var (
+	ErrUnknownStatus     = errors.New("unknown order status")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+)
+
+// TransitionError is returned for an illegal status change, it matches ErrInvalidTransition
+type TransitionError struct {
+	OrderID string
+	From    OrderStatus
+	To      OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %s can't go from %s to %s", e.OrderID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// transition validates moving order to next and applies it
+func (order *Order) transition(next OrderStatus) error {
+	if !next.Valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownStatus, next)
+	}
+	if !order.OrderStatus.CanTransitionTo(next) {
+		return &TransitionError{OrderID: order.OrderID, From: order.OrderStatus, To: next}
+	}
+	order.OrderStatus = next
+	return nil
+}
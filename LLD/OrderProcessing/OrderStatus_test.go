@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var allStatuses = []OrderStatus{
+	StatusCreated, StatusPaymentPending, StatusPaid, StatusFulfilling,
+	StatusShipped, StatusDelivered, StatusCancelled, StatusRefunded,
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+	// the lifecycle, written out apart from orderTransitions: the happy path, cancelling until the
+	// order ships and refunding after
+	type edge struct{ from, to OrderStatus }
+	allowed := map[edge]bool{
+		{StatusCreated, StatusPaymentPending}:   true,
+		{StatusPaymentPending, StatusPaid}:      true,
+		{StatusPaid, StatusFulfilling}:          true,
+		{StatusFulfilling, StatusShipped}:       true,
+		{StatusShipped, StatusDelivered}:        true,
+		{StatusCreated, StatusCancelled}:        true,
+		{StatusPaymentPending, StatusCancelled}: true,
+		{StatusPaid, StatusCancelled}:           true,
+		{StatusFulfilling, StatusCancelled}:     true,
+		{StatusShipped, StatusRefunded}:         true,
+		{StatusDelivered, StatusRefunded}:       true,
+	}
+
+	for _, from := range allStatuses {
+		for _, to := range allStatuses {
+			want := allowed[edge{from, to}]
+			if got := from.CanTransitionTo(to); got != want {
+				t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", from, to, got, want)
+			}
+
+			order := Order{OrderID: "o1", OrderStatus: from}
+			err := order.transition(to)
+			if want {
+				if err != nil || order.OrderStatus != to {
+					t.Errorf("%s -> %s: status %s, %v, want the order moved", from, to, order.OrderStatus, err)
+				}
+				continue
+			}
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) || !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("%s -> %s: %v, want a TransitionError matching ErrInvalidTransition", from, to, err)
+				continue
+			}
+			if transitionErr.OrderID != "o1" || transitionErr.From != from || transitionErr.To != to {
+				t.Errorf("%s -> %s: error reports %+v", from, to, transitionErr)
+			}
+			if msg := err.Error(); !strings.Contains(msg, string(from)) || !strings.Contains(msg, string(to)) {
+				t.Errorf("%s -> %s: error %q doesn't name both states", from, to, msg)
+			}
+			if order.OrderStatus != from {
+				t.Errorf("%s -> %s: an illegal transition left the order %s", from, to, order.OrderStatus)
+			}
+		}
+	}
+}
+
+func TestUnknownOrderStatus(t *testing.T) {
+	for _, status := range allStatuses {
+		if !status.Valid() {
+			t.Errorf("%s isn't valid", status)
+		}
+		if status.CanTransitionTo("Lost") {
+			t.Errorf("%s can go to an unknown status", status)
+		}
+	}
+	if OrderStatus("Lost").Valid() || OrderStatus("Lost").Terminal() {
+		t.Error("an unknown status is valid or terminal")
+	}
+	order := Order{OrderID: "o1", OrderStatus: StatusCreated}
+	if err := order.transition("Lost"); !errors.Is(err, ErrUnknownStatus) || errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("transition to an unknown status: %v, want ErrUnknownStatus", err)
+	}
+}
+
+func TestOrderStatusTerminal(t *testing.T) {
+	cases := []struct {
+		status   OrderStatus
+		terminal bool
+	}{
+		{StatusCreated, false},
+		{StatusPaymentPending, false},
+		{StatusPaid, false},
+		{StatusFulfilling, false},
+		{StatusShipped, false},
+		// the end of the happy path, but a delivered order can still be refunded
+		{StatusDelivered, false},
+		{StatusCancelled, true},
+		{StatusRefunded, true},
+	}
+	for _, c := range cases {
+		if got := c.status.Terminal(); got != c.terminal {
+			t.Errorf("%s.Terminal() = %v, want %v", c.status, got, c.terminal)
+		}
+	}
+}
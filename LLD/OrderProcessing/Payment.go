@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPaymentNotFound = fmt.Errorf("payment %w", ErrNotFound)
+	ErrPaymentState    = errors.New("payment can't do that in its current state")
+	ErrPaymentTimeout  = errors.New("payment provider timed out")
+)
+
+// PaymentStatus is where a payment is at the provider
+type PaymentStatus string
+
+const (
+	PaymentPending    PaymentStatus = "Pending" // the provider decides later and sends a webhook
+	PaymentAuthorized PaymentStatus = "Authorized"
+	PaymentCaptured   PaymentStatus = "Captured"
+	PaymentVoided     PaymentStatus = "Voided"
+	PaymentRefunded   PaymentStatus = "Refunded" // all of the captured amount was given back
+	PaymentFailed     PaymentStatus = "Failed"
+)
+
+// Payment is an authorization at the provider and what happened to it since. Amount was
+// authorized, Captured taken and Refunded given back out of Captured.
+type Payment struct {
+	ID       string        `json:"id"`
+	OrderID  string        `json:"orderId"`
+	Status   PaymentStatus `json:"status"`
+	Amount   Money         `json:"amount"`
+	Captured Money         `json:"captured"`
+	Refunded Money         `json:"refunded"`
+	// Reason is why a payment failed
+	Reason    string    `json:"reason,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PaymentWebhook is the provider reporting a payment that changed after the call returned, e.g.
+// a pending authorization it decided. It may arrive late, twice or before the call's response.
+type PaymentWebhook struct {
+	EventID string  `json:"eventId"`
+	Payment Payment `json:"payment"`
+}
+
+// PaymentProvider is a payment gateway. Every call takes an idempotency key, repeating a call
+// with its key returns the first result instead of moving money again, so a call that timed out
+// with ErrPaymentTimeout can be retried. Declines are a *PaymentError.
+type PaymentProvider interface {
+	// Authorize holds amount on the customer's card. A provider that decides later returns a
+	// Pending payment and sends a webhook once it is Authorized or Failed.
+	Authorize(ctx context.Context, key, orderID string, amount Money) (Payment, error)
+	// Capture takes amount of an authorized payment and releases the rest of the hold
+	Capture(ctx context.Context, key, paymentID string, amount Money) (Payment, error)
+	// Void releases the hold of a payment that wasn't captured
+	Void(ctx context.Context, key, paymentID string) (Payment, error)
+	// Refund gives back amount of what was captured, until all of it is back
+	Refund(ctx context.Context, key, paymentID string, amount Money) (Payment, error)
+}
+
+// paymentAttempts is how often a call that timed out is made, with the same idempotency key
+const paymentAttempts = 3
+
+// PaymentService takes the payments of orders through a PaymentProvider, one authorization per
+// order, and keeps the latest state of each in memory. Calls for the same order are serialized,
+// so the idempotency keys derived from the payment's state can't collide.
+type PaymentService struct {
+	provider PaymentProvider
+	mu       sync.Mutex
+	payments map[string]Payment
+	settled  map[string]chan struct{}
+	locks    map[string]*orderLock
+}
+
+type orderLock struct {
+	sync.Mutex
+	holders int
+}
+
+func NewPaymentService(provider PaymentProvider) *PaymentService {
+	return &PaymentService{
+		provider: provider,
+		payments: make(map[string]Payment),
+		settled:  make(map[string]chan struct{}),
+		locks:    make(map[string]*orderLock),
+	}
+}
+
+// lock serializes the calls for orderID, call the returned func to unlock
+func (p *PaymentService) lock(orderID string) func() {
+	p.mu.Lock()
+	l := p.locks[orderID]
+	if l == nil {
+		l = &orderLock{}
+		p.locks[orderID] = l
+	}
+	l.holders++
+	p.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if l.holders--; l.holders == 0 {
+			delete(p.locks, orderID)
+		}
+	}
+}
+
+// call makes a provider call, again while it times out
+func (p *PaymentService) call(ctx context.Context, fn func() (Payment, error)) (Payment, error) {
+	var err error
+	for attempt := 1; attempt <= paymentAttempts; attempt++ {
+		var payment Payment
+		if payment, err = fn(); !errors.Is(err, ErrPaymentTimeout) {
+			return payment, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return Payment{}, errors.Join(err, ctx.Err())
+		}
+	}
+	return Payment{}, err
+}
+
+var settledAlready = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// record keeps payment unless a newer state of it is known, e.g. from a webhook that beat the
+// response. The channel is closed once the payment isn't pending.
+func (p *PaymentService) record(payment Payment) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, exists := p.payments[payment.OrderID]
+	if !exists || current.ID != payment.ID || !payment.UpdatedAt.Before(current.UpdatedAt) {
+		p.payments[payment.OrderID] = payment
+	}
+
+	orderID := payment.OrderID
+	if p.payments[orderID].Status == PaymentPending {
+		if p.settled[orderID] == nil {
+			p.settled[orderID] = make(chan struct{})
+		}
+		return p.settled[orderID]
+	}
+	if c := p.settled[orderID]; c != nil {
+		close(c)
+		delete(p.settled, orderID)
+	}
+	return settledAlready
+}
+
+func (p *PaymentService) Payment(ctx context.Context, orderID string) (Payment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payment, exists := p.payments[orderID]
+	if !exists {
+		return Payment{}, fmt.Errorf("order %s: %w", orderID, ErrPaymentNotFound)
+	}
+	return payment, nil
+}
+
+// AuthorizePayment returns once the provider decided, a pending authorization is waited for
+// until ctx is done
+func (p *PaymentService) AuthorizePayment(ctx context.Context, request PaymentRequest) error {
+	unlock := p.lock(request.OrderID)
+	payment, err := p.call(ctx, func() (Payment, error) {
+		return p.provider.Authorize(ctx, request.OrderID+"/authorize", request.OrderID, request.Amount)
+	})
+	if err != nil {
+		unlock()
+		return err
+	}
+	settled := p.record(payment)
+	unlock()
+
+	select {
+	case <-settled:
+	case <-ctx.Done():
+		// The saga treats the step as failed and won't compensate it, so the hold is released here
+		err := fmt.Errorf("waiting for the payment of order %s: %w", request.OrderID, ctx.Err())
+		if voidErr := p.VoidPayment(context.WithoutCancel(ctx), request.OrderID); voidErr != nil {
+			return errors.Join(err, voidErr)
+		}
+		return err
+	}
+	if payment, err = p.Payment(ctx, request.OrderID); err != nil {
+		return err
+	}
+	if payment.Status == PaymentFailed {
+		return &PaymentError{OrderID: request.OrderID, Reason: payment.Reason}
+	}
+	return nil
+}
+
+// CapturePayment takes all that was authorized, a captured payment is left alone
+func (p *PaymentService) CapturePayment(ctx context.Context, orderID string) error {
+	defer p.lock(orderID)()
+	payment, err := p.Payment(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	switch payment.Status {
+	case PaymentCaptured, PaymentRefunded:
+		return nil
+	case PaymentAuthorized:
+	default:
+		return fmt.Errorf("%w: can't capture the %s payment of order %s", ErrPaymentState, payment.Status, orderID)
+	}
+	payment, err = p.call(ctx, func() (Payment, error) {
+		return p.provider.Capture(ctx, orderID+"/capture", payment.ID, payment.Amount)
+	})
+	if err != nil {
+		return err
+	}
+	p.record(payment)
+	return nil
+}
+
+// VoidPayment releases an authorization, a voided or failed payment is left alone
+func (p *PaymentService) VoidPayment(ctx context.Context, orderID string) error {
+	defer p.lock(orderID)()
+	payment, err := p.Payment(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	switch payment.Status {
+	case PaymentVoided, PaymentFailed:
+		return nil
+	case PaymentPending, PaymentAuthorized:
+	default:
+		return fmt.Errorf("%w: can't void the %s payment of order %s", ErrPaymentState, payment.Status, orderID)
+	}
+	payment, err = p.call(ctx, func() (Payment, error) {
+		return p.provider.Void(ctx, orderID+"/void", payment.ID)
+	})
+	if err != nil {
+		return err
+	}
+	p.record(payment)
+	return nil
+}
+
+// RefundPayment gives back request.Amount, or all that is left of the captured amount when it is
+// zero. Each refund is keyed by what was refunded before it, so a retried refund isn't paid twice.
+func (p *PaymentService) RefundPayment(ctx context.Context, request PaymentRequest) error {
+	if request.Amount < 0 {
+		return fmt.Errorf("%w: refund of %s", ErrInvalidRequest, request.Amount)
+	}
+	defer p.lock(request.OrderID)()
+	payment, err := p.Payment(ctx, request.OrderID)
+	if err != nil {
+		return err
+	}
+	left := payment.Captured - payment.Refunded
+	amount := request.Amount
+	if amount == 0 {
+		amount = left
+	}
+	switch {
+	case (payment.Status == PaymentRefunded || payment.Status == PaymentCaptured) && amount == 0:
+		// Nothing left to give back
+		return nil
+	case payment.Status != PaymentCaptured:
+		return fmt.Errorf("%w: can't refund the %s payment of order %s", ErrPaymentState, payment.Status, request.OrderID)
+	case amount > left:
+		return fmt.Errorf("%w: can't refund %s of order %s, %s is left", ErrPaymentState, amount, request.OrderID, left)
+	}
+	key := fmt.Sprintf("%s/refund/%d", request.OrderID, payment.Refunded)
+	payment, err = p.call(ctx, func() (Payment, error) {
+		return p.provider.Refund(ctx, key, payment.ID, amount)
+	})
+	if err != nil {
+		return err
+	}
+	p.record(payment)
+	return nil
+}
+
+// HandleWebhook takes a payment update from the provider, repeated and stale ones change nothing
+func (p *PaymentService) HandleWebhook(webhook PaymentWebhook) {
+	p.record(webhook.Payment)
+}
+
+// demoPayments pays orders through a provider that decides by webhook and loses a response
+func demoPayments(ctx context.Context, service IOrderService, provider *FakePaymentProvider) {
+	// The authorization is pending until the webhook, the saga waits for it
+	order, err := service.CreateOrder(ctx, OrderRequest{UserID: 10, Items: []OrderItem{{SKU: "item1", Qty: 2}}})
+	if err != nil {
+		fmt.Println("Create failed:", err)
+		return
+	}
+	fmt.Printf("Order %s is %s after the webhook\n", order.OrderID, order.OrderStatus)
+
+	// The response to the capture is lost, the retry with the same key doesn't capture again
+	provider.TimeoutNext(1)
+	for _, status := range []OrderStatus{StatusFulfilling, StatusShipped} {
+		if order, err = service.UpdateOrder(ctx, order.OrderID, status); err != nil {
+			fmt.Println("Update failed:", err)
+			return
+		}
+	}
+	fmt.Printf("Order %s is %s\n", order.OrderID, order.OrderStatus)
+
+	// A partial refund keeps the order Shipped, refunding the rest makes it Refunded
+	for _, amount := range []Money{5_00, 0} {
+		if order, err = service.RefundOrder(ctx, order.OrderID, amount); err != nil {
+			fmt.Println("Refund failed:", err)
+			return
+		}
+		refunded := amount.String()
+		if amount == 0 {
+			refunded = "the rest"
+		}
+		fmt.Printf("After refunding %s order %s is %s\n", refunded, order.OrderID, order.OrderStatus)
+	}
+
+	// Cancelling before the order ships voids the authorization
+	cancelled, err := service.CreateOrder(ctx, OrderRequest{UserID: 10, Items: []OrderItem{{SKU: "item2", Qty: 1}}})
+	if err == nil {
+		err = service.CancelOrder(ctx, cancelled.OrderID)
+	}
+	if err != nil {
+		fmt.Println("Cancel failed:", err)
+	}
+
+	// The webhook declines this one, the saga cancels the order
+	declined, err := service.CreateOrder(ctx, OrderRequest{UserID: 10, Items: []OrderItem{{SKU: "item3", Qty: 4}}})
+	if errors.Is(err, ErrPaymentDeclined) {
+		fmt.Printf("Order %s is %s: %v\n", declined.OrderID, declined.OrderStatus, err)
+	}
+
+	for _, payment := range provider.Payments() {
+		fmt.Printf("Payment %s of order %s: %s, authorized %s, captured %s, refunded %s\n",
+			payment.ID, payment.OrderID, payment.Status, payment.Amount, payment.Captured, payment.Refunded)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// paymentStep is a call to the payment service and what the order's payment is after it
+type paymentStep struct {
+	call     string // authorize, capture, void or refund
+	amount   Money
+	timeouts int // responses the provider loses before the call
+	err      error
+	status   PaymentStatus // empty when the service has no payment for the order
+	captured Money
+	refunded Money
+}
+
+func (step paymentStep) run(ctx context.Context, service *PaymentService, orderID string) error {
+	switch step.call {
+	case "authorize":
+		return service.AuthorizePayment(ctx, PaymentRequest{OrderID: orderID, Amount: step.amount})
+	case "capture":
+		return service.CapturePayment(ctx, orderID)
+	case "void":
+		return service.VoidPayment(ctx, orderID)
+	case "refund":
+		return service.RefundPayment(ctx, PaymentRequest{OrderID: orderID, Amount: step.amount})
+	}
+	panic("unknown payment call " + step.call)
+}
+
+func TestPaymentService(t *testing.T) {
+	cases := []struct {
+		name   string
+		config FakePaymentConfig
+		steps  []paymentStep
+	}{
+		{
+			name: "authorize and capture",
+			steps: []paymentStep{
+				{call: "authorize", amount: 10_00, status: PaymentAuthorized},
+				{call: "capture", status: PaymentCaptured, captured: 10_00},
+				{call: "capture", status: PaymentCaptured, captured: 10_00},
+				{call: "void", err: ErrPaymentState, status: PaymentCaptured, captured: 10_00},
+			},
+		},
+		{
+			name: "void",
+			steps: []paymentStep{
+				{call: "authorize", amount: 10_00, status: PaymentAuthorized},
+				{call: "void", status: PaymentVoided},
+				{call: "void", status: PaymentVoided},
+				{call: "capture", err: ErrPaymentState, status: PaymentVoided},
+			},
+		},
+		{
+			name: "partial refunds",
+			steps: []paymentStep{
+				{call: "authorize", amount: 10_00, status: PaymentAuthorized},
+				{call: "refund", amount: 1_00, err: ErrPaymentState, status: PaymentAuthorized},
+				{call: "capture", status: PaymentCaptured, captured: 10_00},
+				{call: "refund", amount: 3_00, status: PaymentCaptured, captured: 10_00, refunded: 3_00},
+				{call: "refund", amount: 8_00, err: ErrPaymentState, status: PaymentCaptured, captured: 10_00, refunded: 3_00},
+				{call: "refund", status: PaymentRefunded, captured: 10_00, refunded: 10_00},
+				{call: "refund", status: PaymentRefunded, captured: 10_00, refunded: 10_00},
+			},
+		},
+		{
+			name: "retries with the same key after timeouts",
+			steps: []paymentStep{
+				{call: "authorize", amount: 10_00, timeouts: 2, status: PaymentAuthorized},
+				{call: "capture", timeouts: 2, status: PaymentCaptured, captured: 10_00},
+				{call: "refund", amount: 3_00, timeouts: 2, status: PaymentCaptured, captured: 10_00, refunded: 3_00},
+				// every attempt times out, the provider refunded anyway and the service doesn't know
+				{call: "refund", amount: 2_00, timeouts: paymentAttempts, err: ErrPaymentTimeout, status: PaymentCaptured, captured: 10_00, refunded: 3_00},
+				// so the retry has the same key and gets that refund back instead of a second one
+				{call: "refund", amount: 2_00, status: PaymentCaptured, captured: 10_00, refunded: 5_00},
+			},
+		},
+		{
+			name:   "declined",
+			config: FakePaymentConfig{DeclineOver: 5_00},
+			steps: []paymentStep{
+				{call: "authorize", amount: 6_00, err: ErrPaymentDeclined},
+				{call: "capture", err: ErrPaymentNotFound},
+				{call: "authorize", amount: 6_00, err: ErrPaymentDeclined},
+			},
+		},
+		{
+			name:   "declined by webhook",
+			config: FakePaymentConfig{DeclineOver: 5_00, WebhookDelay: time.Millisecond},
+			steps: []paymentStep{
+				{call: "authorize", amount: 6_00, err: ErrPaymentDeclined, status: PaymentFailed},
+				{call: "void", status: PaymentFailed},
+				{call: "capture", err: ErrPaymentState, status: PaymentFailed},
+			},
+		},
+		{
+			name:   "authorized by webhook",
+			config: FakePaymentConfig{WebhookDelay: time.Millisecond},
+			steps: []paymentStep{
+				{call: "authorize", amount: 10_00, status: PaymentAuthorized},
+				{call: "capture", status: PaymentCaptured, captured: 10_00},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			provider := NewFakePaymentProvider(c.config)
+			service := NewPaymentService(provider)
+			provider.OnWebhook(service.HandleWebhook)
+
+			for i, step := range c.steps {
+				provider.TimeoutNext(step.timeouts)
+				if err := step.run(t.Context(), service, "order-1"); !errors.Is(err, step.err) || (err != nil) != (step.err != nil) {
+					t.Fatalf("step %d, %s: %v, want %v", i, step.call, err, step.err)
+				}
+				payment, err := service.Payment(t.Context(), "order-1")
+				if step.status == "" {
+					if !errors.Is(err, ErrPaymentNotFound) {
+						t.Errorf("step %d, %s: payment %+v, want none", i, step.call, payment)
+					}
+					continue
+				}
+				if payment.Status != step.status || payment.Captured != step.captured || payment.Refunded != step.refunded {
+					t.Errorf("step %d, %s: payment %s captured %s refunded %s, want %s captured %s refunded %s", i, step.call,
+						payment.Status, payment.Captured, payment.Refunded, step.status, step.captured, step.refunded)
+				}
+			}
+
+			// however often calls were retried, the provider holds one payment per authorization
+			if held := provider.Payments(); len(held) > 1 {
+				t.Errorf("provider holds %d payments, want at most 1", len(held))
+			}
+		})
+	}
+}
+
+// webhookFirst delivers the webhook of a pending authorization before the authorization's
+// response gets back, as if the response was slow
+type webhookFirst struct {
+	*FakePaymentProvider
+	webhooks chan PaymentWebhook
+	deliver  func(PaymentWebhook)
+}
+
+func (w *webhookFirst) Authorize(ctx context.Context, key, orderID string, amount Money) (Payment, error) {
+	payment, err := w.FakePaymentProvider.Authorize(ctx, key, orderID, amount)
+	if err != nil {
+		return payment, err
+	}
+	select {
+	case webhook := <-w.webhooks:
+		w.deliver(webhook)
+	case <-ctx.Done():
+		return Payment{}, ctx.Err()
+	}
+	return payment, nil
+}
+
+func TestLateWebhooks(t *testing.T) {
+	for _, first := range []string{"response", "webhook"} {
+		t.Run(first+" first", func(t *testing.T) {
+			provider := NewFakePaymentProvider(FakePaymentConfig{WebhookDelay: time.Millisecond})
+			webhooks := make(chan PaymentWebhook, 1)
+			provider.OnWebhook(func(webhook PaymentWebhook) { webhooks <- webhook })
+
+			var service *PaymentService
+			if first == "webhook" {
+				slow := &webhookFirst{FakePaymentProvider: provider, webhooks: webhooks}
+				service = NewPaymentService(slow)
+				slow.deliver = service.HandleWebhook
+			} else {
+				service = NewPaymentService(provider)
+				go func() { service.HandleWebhook(<-webhooks) }()
+			}
+
+			// a stale pending response must not undo the webhook, or this waits forever
+			ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+			defer cancel()
+			if err := service.AuthorizePayment(ctx, PaymentRequest{OrderID: "order-1", Amount: 10_00}); err != nil {
+				t.Fatal(err)
+			}
+			payment, _ := service.Payment(t.Context(), "order-1")
+			if payment.Status != PaymentAuthorized {
+				t.Fatalf("payment %s, want Authorized", payment.Status)
+			}
+
+			// the webhook again, after the payment moved on, changes nothing
+			authorized := PaymentWebhook{EventID: "evt_1", Payment: payment}
+			if err := service.CapturePayment(t.Context(), "order-1"); err != nil {
+				t.Fatal(err)
+			}
+			service.HandleWebhook(authorized)
+			if payment, _ := service.Payment(t.Context(), "order-1"); payment.Status != PaymentCaptured {
+				t.Errorf("payment %s after a repeated webhook, want Captured", payment.Status)
+			}
+		})
+	}
+}
+
+// paymentOf is what provider holds for orderID
+func paymentOf(t *testing.T, provider *FakePaymentProvider, orderID string) Payment {
+	t.Helper()
+	for _, payment := range provider.Payments() {
+		if payment.OrderID == orderID {
+			return payment
+		}
+	}
+	t.Fatalf("no payment for order %s", orderID)
+	return Payment{}
+}
+
+func TestOrderPayments(t *testing.T) {
+	provider := NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit})
+	factory := &ServiceFactory{PaymentProvider: provider}
+	service := factory.CreateOrderService(t.Context())
+	defer factory.Close(t.Context())
+
+	newOrder := func() Order {
+		t.Helper()
+		order, err := service.CreateOrder(t.Context(), OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payment := paymentOf(t, provider, order.OrderID); order.OrderStatus != StatusPaid || payment.Status != PaymentAuthorized {
+			t.Fatalf("new order %s with a %s payment, want Paid and Authorized", order.OrderStatus, payment.Status)
+		}
+		return order
+	}
+	update := func(orderID string, statuses ...OrderStatus) {
+		t.Helper()
+		for _, status := range statuses {
+			if _, err := service.UpdateOrder(t.Context(), orderID, status); err != nil {
+				t.Fatalf("%s: %v", status, err)
+			}
+		}
+	}
+
+	t.Run("shipping captures and refunds give back", func(t *testing.T) {
+		order := newOrder()
+		update(order.OrderID, StatusFulfilling)
+		// the capture times out on every attempt, the order is shipped and shipping again captures
+		provider.TimeoutNext(paymentAttempts)
+		if _, err := service.UpdateOrder(t.Context(), order.OrderID, StatusShipped); !errors.Is(err, ErrPaymentTimeout) {
+			t.Fatalf("shipping while the provider times out = %v, want ErrPaymentTimeout", err)
+		}
+		stored, _ := service.GetOrder(t.Context(), order.OrderID)
+		if stored.OrderStatus != StatusShipped {
+			t.Fatalf("order %s after a failed capture, want Shipped", stored.OrderStatus)
+		}
+		update(order.OrderID, StatusShipped)
+		if again, _ := service.GetOrder(t.Context(), order.OrderID); again.Version != stored.Version {
+			t.Errorf("shipping again wrote version %d, want it left at %d", again.Version, stored.Version)
+		}
+		if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentCaptured || payment.Captured != order.TotalPrice {
+			t.Fatalf("payment %s of %s after shipping, want %s captured", payment.Status, payment.Captured, order.TotalPrice)
+		}
+
+		refunded, err := service.RefundOrder(t.Context(), order.OrderID, 10_00)
+		if err != nil || refunded.OrderStatus != StatusShipped {
+			t.Fatalf("partial refund: order %s, %v, want still Shipped", refunded.OrderStatus, err)
+		}
+		if refunded, err = service.RefundOrder(t.Context(), order.OrderID, 0); err != nil || refunded.OrderStatus != StatusRefunded {
+			t.Fatalf("refund of the rest: order %s, %v, want Refunded", refunded.OrderStatus, err)
+		}
+		if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentRefunded || payment.Refunded != order.TotalPrice {
+			t.Errorf("payment %s with %s refunded, want all %s back", payment.Status, payment.Refunded, order.TotalPrice)
+		}
+	})
+
+	t.Run("cancelling voids", func(t *testing.T) {
+		for _, before := range [][]OrderStatus{nil, {StatusFulfilling}} {
+			order := newOrder()
+			update(order.OrderID, before...)
+			if err := service.CancelOrder(t.Context(), order.OrderID); err != nil {
+				t.Fatal(err)
+			}
+			if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentVoided || payment.Captured != 0 {
+				t.Errorf("payment %s with %s captured after cancelling, want Voided", payment.Status, payment.Captured)
+			}
+		}
+	})
+}
+
+// conflictingRepository fails its next conflicts updates as if another change won the race
+type conflictingRepository struct {
+	IOrderRepository
+	conflicts int
+}
+
+func (repo *conflictingRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
+	if repo.conflicts > 0 {
+		repo.conflicts--
+		return &VersionConflictError{OrderID: order.OrderID, Expected: order.Version, Actual: order.Version + 1}
+	}
+	return repo.IOrderRepository.Update(ctx, order, events...)
+}
+
+func TestStatusChangeLosingARaceSettlesNothing(t *testing.T) {
+	provider := NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit})
+	repo := &conflictingRepository{IOrderRepository: NewOrderRepository()}
+	factory := &ServiceFactory{PaymentProvider: provider, Repository: repo}
+	service := factory.CreateOrderService(t.Context())
+	defer factory.Close(t.Context())
+
+	order, err := service.CreateOrder(t.Context(), OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateOrder(t.Context(), order.OrderID, StatusFulfilling); err != nil {
+		t.Fatal(err)
+	}
+
+	// shipping and cancelling lose to a concurrent change, the payment stays authorized
+	repo.conflicts = 1
+	if _, err := service.UpdateOrder(t.Context(), order.OrderID, StatusShipped); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("shipping against a conflict = %v, want ErrVersionConflict", err)
+	}
+	if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentAuthorized || payment.Captured != 0 {
+		t.Fatalf("payment %s with %s captured after shipping lost a race, want Authorized", payment.Status, payment.Captured)
+	}
+	repo.conflicts = 1
+	if err := service.CancelOrder(t.Context(), order.OrderID); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("cancelling against a conflict = %v, want ErrVersionConflict", err)
+	}
+	if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentAuthorized {
+		t.Fatalf("payment %s after cancelling lost a race, want Authorized", payment.Status)
+	}
+	if stored, _ := service.GetOrder(t.Context(), order.OrderID); stored.OrderStatus != StatusFulfilling {
+		t.Fatalf("order %s after both changes lost, want Fulfilling", stored.OrderStatus)
+	}
+
+	// the retry wins and settles
+	if _, err := service.UpdateOrder(t.Context(), order.OrderID, StatusShipped); err != nil {
+		t.Fatal(err)
+	}
+	if payment := paymentOf(t, provider, order.OrderID); payment.Status != PaymentCaptured || payment.Captured != order.TotalPrice {
+		t.Errorf("payment %s of %s after shipping, want %s captured", payment.Status, payment.Captured, order.TotalPrice)
+	}
+}
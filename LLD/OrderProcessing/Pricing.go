@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrProductNotFound = fmt.Errorf("product %w", ErrNotFound)
+	ErrUnknownCoupon   = fmt.Errorf("%w: unknown coupon", ErrInvalidRequest)
+)
+
+// OrderItem is what a client orders, the price comes from the catalog
+type OrderItem struct {
+	SKU string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+// LineItem is a line of an order at the unit price it was sold for
+type LineItem struct {
+	SKU       string `json:"sku"`
+	Qty       int    `json:"qty"`
+	UnitPrice Money  `json:"unitPrice"`
+}
+
+func (item LineItem) Total() Money {
+	return item.UnitPrice.Times(item.Qty)
+}
+
+// Product is a catalog entry, TaxCategory picks the tax rate
+type Product struct {
+	SKU         string `json:"sku"`
+	Name        string `json:"name"`
+	UnitPrice   Money  `json:"unitPrice"`
+	TaxCategory string `json:"taxCategory,omitempty"`
+}
+
+// Catalog returns ErrProductNotFound for a SKU it doesn't sell
+type Catalog interface {
+	Product(ctx context.Context, sku string) (Product, error)
+}
+
+type InMemoryCatalog struct {
+	mu       sync.RWMutex
+	products map[string]Product
+}
+
+func NewInMemoryCatalog(products ...Product) *InMemoryCatalog {
+	catalog := &InMemoryCatalog{products: make(map[string]Product)}
+	for _, product := range products {
+		catalog.Add(product)
+	}
+	return catalog
+}
+
+// Add puts product in the catalog or replaces the product with its SKU
+func (c *InMemoryCatalog) Add(product Product) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.products[product.SKU] = product
+}
+
+func (c *InMemoryCatalog) Product(ctx context.Context, sku string) (Product, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	product, exists := c.products[sku]
+	if !exists {
+		return Product{}, fmt.Errorf("%s: %w", sku, ErrProductNotFound)
+	}
+	return product, nil
+}
+
+// PricedLine is a line while an order is priced, Discount and Tax are the line's share
+type PricedLine struct {
+	LineItem
+	TaxCategory string `json:"taxCategory,omitempty"`
+	Discount    Money  `json:"discount"`
+	Tax         Money  `json:"tax"`
+}
+
+// Net is what is left of the line after discounts
+func (line PricedLine) Net() Money {
+	return line.Total() - line.Discount
+}
+
+// Promotion is a discount strategy. Promotions are applied one after the other, each sees the
+// discounts of the ones before it, and a line is never discounted below zero.
+type Promotion interface {
+	Name() string
+	// Discounts returns the discount of each line
+	Discounts(lines []PricedLine) []Money
+}
+
+// PercentOff takes BasisPoints off the lines of SKUs, or off every line when SKUs is empty
+type PercentOff struct {
+	Label       string
+	BasisPoints int64
+	SKUs        []string
+}
+
+func (p PercentOff) Name() string { return p.Label }
+
+func (p PercentOff) Discounts(lines []PricedLine) []Money {
+	discounts := make([]Money, len(lines))
+	for i, line := range lines {
+		if len(p.SKUs) == 0 || slices.Contains(p.SKUs, line.SKU) {
+			discounts[i] = line.Net().Rate(p.BasisPoints)
+		}
+	}
+	return discounts
+}
+
+// AmountOff takes Amount off an order whose subtotal is at least MinSubtotal, spread over the
+// lines by what is left of them
+type AmountOff struct {
+	Label       string
+	Amount      Money
+	MinSubtotal Money
+}
+
+func (p AmountOff) Name() string { return p.Label }
+
+func (p AmountOff) Discounts(lines []PricedLine) []Money {
+	discounts := make([]Money, len(lines))
+	var subtotal, net Money
+	last := -1
+	for i, line := range lines {
+		subtotal += line.Total()
+		net += line.Net()
+		if line.Net() > 0 {
+			last = i
+		}
+	}
+	if subtotal < p.MinSubtotal || last < 0 {
+		return discounts
+	}
+	amount := min(p.Amount, net)
+	left := amount
+	for i, line := range lines {
+		if i == last {
+			// The rounding remainder goes to the last line
+			discounts[i] = left
+			break
+		}
+		discounts[i] = amount * line.Net() / net
+		left -= discounts[i]
+	}
+	return discounts
+}
+
+// BuyXGetY makes Get of every Buy+Get units of SKU free
+type BuyXGetY struct {
+	Label string
+	SKU   string
+	Buy   int
+	Get   int
+}
+
+func (p BuyXGetY) Name() string { return p.Label }
+
+func (p BuyXGetY) Discounts(lines []PricedLine) []Money {
+	discounts := make([]Money, len(lines))
+	if p.Buy <= 0 || p.Get <= 0 {
+		return discounts
+	}
+	units := 0
+	for _, line := range lines {
+		if line.SKU == p.SKU {
+			units += line.Qty
+		}
+	}
+	free := units / (p.Buy + p.Get) * p.Get
+	for i, line := range lines {
+		if line.SKU != p.SKU || free == 0 {
+			continue
+		}
+		n := min(free, line.Qty)
+		discounts[i] = line.UnitPrice.Times(n)
+		free -= n
+	}
+	return discounts
+}
+
+// TaxRule is the tax of a line after its discounts
+type TaxRule interface {
+	Tax(line PricedLine) Money
+}
+
+// CategoryTax charges Rates[category] basis points, and Default for categories without a rate
+type CategoryTax struct {
+	Default int64
+	Rates   map[string]int64
+}
+
+func (t CategoryTax) Tax(line PricedLine) Money {
+	rate, exists := t.Rates[line.TaxCategory]
+	if !exists {
+		rate = t.Default
+	}
+	return line.Net().Rate(rate)
+}
+
+// AppliedPromotion is what a promotion took off an order
+type AppliedPromotion struct {
+	Name   string `json:"name"`
+	Amount Money  `json:"amount"`
+}
+
+// PriceQuote is an order priced on the server, Total is Subtotal - Discount + Tax
+type PriceQuote struct {
+	Lines      []PricedLine       `json:"lines"`
+	Promotions []AppliedPromotion `json:"promotions,omitempty"`
+	Subtotal   Money              `json:"subtotal"`
+	Discount   Money              `json:"discount"`
+	Tax        Money              `json:"tax"`
+	Total      Money              `json:"total"`
+}
+
+// Pricer prices orders from the catalog, applies the promotions every order gets and then the
+// coupons the client gave, and adds tax on what is left
+type Pricer struct {
+	mu         sync.RWMutex
+	catalog    Catalog
+	tax        TaxRule
+	promotions []Promotion
+	coupons    map[string]Promotion
+}
+
+func NewPricer(catalog Catalog, tax TaxRule) *Pricer {
+	return &Pricer{
+		catalog: catalog,
+		tax:     tax,
+		coupons: make(map[string]Promotion),
+	}
+}
+
+// AddPromotion applies promotion to every order
+func (p *Pricer) AddPromotion(promotion Promotion) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.promotions = append(p.promotions, promotion)
+}
+
+// AddCoupon applies promotion to the orders that give code
+func (p *Pricer) AddCoupon(code string, promotion Promotion) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.coupons[code] = promotion
+}
+
+func (p *Pricer) Price(ctx context.Context, items []OrderItem, couponCodes []string) (PriceQuote, error) {
+	var quote PriceQuote
+	for _, item := range items {
+		if item.Qty <= 0 {
+			return PriceQuote{}, fmt.Errorf("%w: %s: qty must be positive", ErrInvalidRequest, item.SKU)
+		}
+		product, err := p.catalog.Product(ctx, item.SKU)
+		if errors.Is(err, ErrNotFound) {
+			return PriceQuote{}, fmt.Errorf("%w: unknown product %q", ErrInvalidRequest, item.SKU)
+		}
+		if err != nil {
+			return PriceQuote{}, err
+		}
+		quote.Lines = append(quote.Lines, PricedLine{
+			LineItem:    LineItem{SKU: item.SKU, Qty: item.Qty, UnitPrice: product.UnitPrice},
+			TaxCategory: product.TaxCategory,
+		})
+	}
+
+	p.mu.RLock()
+	promotions := slices.Clone(p.promotions)
+	for i, code := range couponCodes {
+		if slices.Contains(couponCodes[:i], code) {
+			continue
+		}
+		coupon, exists := p.coupons[code]
+		if !exists {
+			p.mu.RUnlock()
+			return PriceQuote{}, fmt.Errorf("%w %q", ErrUnknownCoupon, code)
+		}
+		promotions = append(promotions, coupon)
+	}
+	p.mu.RUnlock()
+
+	for _, promotion := range promotions {
+		var amount Money
+		for i, discount := range promotion.Discounts(quote.Lines) {
+			discount = max(0, min(discount, quote.Lines[i].Net()))
+			quote.Lines[i].Discount += discount
+			amount += discount
+		}
+		if amount > 0 {
+			quote.Promotions = append(quote.Promotions, AppliedPromotion{Name: promotion.Name(), Amount: amount})
+		}
+	}
+
+	for i := range quote.Lines {
+		quote.Lines[i].Tax = max(0, p.tax.Tax(quote.Lines[i]))
+		quote.Subtotal += quote.Lines[i].Total()
+		quote.Discount += quote.Lines[i].Discount
+		quote.Tax += quote.Lines[i].Tax
+	}
+	quote.Total = quote.Subtotal - quote.Discount + quote.Tax
+	return quote, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// newTestPricer sells a 10.00 lamp, 1.00 pens and 4.00 coffee, taxed at 8.25% and food at 2.5%
+func newTestPricer() *Pricer {
+	catalog := NewInMemoryCatalog(
+		Product{SKU: "lamp", UnitPrice: 10_00},
+		Product{SKU: "pen-red", UnitPrice: 1_00},
+		Product{SKU: "pen-blue", UnitPrice: 1_00},
+		Product{SKU: "pen-black", UnitPrice: 1_00},
+		Product{SKU: "coffee", UnitPrice: 4_00, TaxCategory: "food"},
+	)
+	return NewPricer(catalog, CategoryTax{Default: 825, Rates: map[string]int64{"food": 250}})
+}
+
+// lineDiscounts are the discounts of the lines of quote
+func lineDiscounts(quote PriceQuote) []Money {
+	discounts := make([]Money, len(quote.Lines))
+	for i, line := range quote.Lines {
+		discounts[i] = line.Discount
+	}
+	return discounts
+}
+
+func TestAmountOffRemainder(t *testing.T) {
+	pricer := newTestPricer()
+	pricer.AddPromotion(AmountOff{Label: "1.00 off", Amount: 1_00})
+	items := []OrderItem{{SKU: "pen-red", Qty: 1}, {SKU: "pen-blue", Qty: 1}, {SKU: "pen-black", Qty: 1}}
+	quote, err := pricer.Price(t.Context(), items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 33.33 cents each, the cent left over goes to the last line
+	if got, want := lineDiscounts(quote), []Money{33, 33, 34}; !slices.Equal(got, want) {
+		t.Errorf("discounts %v, want %v", got, want)
+	}
+
+	// more than the order is worth takes it down to zero, not below
+	pricer = newTestPricer()
+	pricer.AddPromotion(AmountOff{Label: "50.00 off", Amount: 50_00})
+	quote, err = pricer.Price(t.Context(), items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Discount != 3_00 || quote.Total != 0 {
+		t.Errorf("discount %s and total %s, want 3.00 and 0.00", quote.Discount, quote.Total)
+	}
+}
+
+func TestBuyXGetYAcrossLines(t *testing.T) {
+	pricer := newTestPricer()
+	pricer.AddPromotion(BuyXGetY{Label: "3 for 2", SKU: "coffee", Buy: 2, Get: 1})
+	items := []OrderItem{{SKU: "coffee", Qty: 1}, {SKU: "lamp", Qty: 1}, {SKU: "coffee", Qty: 2}, {SKU: "coffee", Qty: 4}}
+	quote, err := pricer.Price(t.Context(), items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 7 coffees on three lines make 2 free, taken from the first coffee lines
+	if got, want := lineDiscounts(quote), []Money{4_00, 0, 4_00, 0}; !slices.Equal(got, want) {
+		t.Errorf("discounts %v, want %v", got, want)
+	}
+}
+
+func TestStackedPromotionsAndCoupons(t *testing.T) {
+	pricer := newTestPricer()
+	pricer.AddPromotion(PercentOff{Label: "10% off lamps", BasisPoints: 1000, SKUs: []string{"lamp"}})
+	pricer.AddCoupon("FIVEOFF", AmountOff{Label: "5.00 off 50.00", Amount: 5_00, MinSubtotal: 50_00})
+	pricer.AddCoupon("HALF", PercentOff{Label: "50% off", BasisPoints: 5000})
+	items := []OrderItem{{SKU: "lamp", Qty: 5}, {SKU: "coffee", Qty: 1}}
+
+	// the coupons are applied after the promotion, in the order given and once each, and every
+	// one sees what is left after the ones before it: 54.00 - 5.00 = 49.00 still gets FIVEOFF,
+	// which counts the subtotal
+	quote, err := pricer.Price(t.Context(), items, []string{"FIVEOFF", "HALF", "FIVEOFF"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half of 40.41 and 3.59 is rounded on each line
+	want := []AppliedPromotion{{"10% off lamps", 5_00}, {"5.00 off 50.00", 5_00}, {"50% off", 22_01}}
+	if !slices.Equal(quote.Promotions, want) {
+		t.Errorf("promotions %+v, want %+v", quote.Promotions, want)
+	}
+	if quote.Subtotal != 54_00 || quote.Discount != 32_01 {
+		t.Errorf("subtotal %s and discount %s, want 54.00 and 32.01", quote.Subtotal, quote.Discount)
+	}
+
+	if _, err := pricer.Price(t.Context(), items, []string{"NOPE"}); !errors.Is(err, ErrUnknownCoupon) {
+		t.Errorf("an unknown coupon = %v, want ErrUnknownCoupon", err)
+	}
+}
+
+func TestTaxAfterDiscounts(t *testing.T) {
+	pricer := newTestPricer()
+	pricer.AddCoupon("SAVE10", PercentOff{Label: "10% off", BasisPoints: 1000})
+	quote, err := pricer.Price(t.Context(), []OrderItem{{SKU: "lamp", Qty: 1}, {SKU: "coffee", Qty: 3}}, []string{"SAVE10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 8.25% of 9.00 and 2.5% of 10.80
+	if quote.Lines[0].Tax != 74 || quote.Lines[1].Tax != 27 {
+		t.Errorf("taxes %s and %s, want 0.74 on the lamp and 0.27 on the coffee", quote.Lines[0].Tax, quote.Lines[1].Tax)
+	}
+	if quote.Total != quote.Subtotal-quote.Discount+quote.Tax || quote.Total != 20_81 {
+		t.Errorf("total %s, want 22.00 - 2.20 + 1.01 = 20.81", quote.Total)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// projectionBatchSize is how many events a projector reads from the store at a time
+const projectionBatchSize = 500
+
+// Projection is a read model built from the events of all orders, in the order they were appended
+type Projection interface {
+	// Reset empties the read model before it is rebuilt from the first event
+	Reset()
+	Apply(event StoredEvent) error
+}
+
+// OrderByIDProjection is the current state of every order that isn't deleted
+type OrderByIDProjection struct {
+	mu     sync.RWMutex
+	orders map[string]*OrderAggregate
+}
+
+func NewOrderByIDProjection() *OrderByIDProjection {
+	return &OrderByIDProjection{
+		orders: make(map[string]*OrderAggregate),
+	}
+}
+
+func (p *OrderByIDProjection) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.orders = make(map[string]*OrderAggregate)
+}
+
+func (p *OrderByIDProjection) Apply(event StoredEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	aggregate := p.orders[event.StreamID]
+	if aggregate == nil {
+		aggregate = &OrderAggregate{}
+		p.orders[event.StreamID] = aggregate
+	}
+	return aggregate.Apply(event)
+}
+
+func (p *OrderByIDProjection) Get(orderID string) (Order, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	aggregate, exists := p.orders[orderID]
+	if !exists || !aggregate.Exists() {
+		return Order{}, false
+	}
+	return clone(aggregate.Order), true
+}
+
+// All returns the orders in no particular order
+func (p *OrderByIDProjection) All() []Order {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var orders []Order
+	for _, aggregate := range p.orders {
+		if aggregate.Exists() {
+			orders = append(orders, clone(aggregate.Order))
+		}
+	}
+	return orders
+}
+
+func (p *OrderByIDProjection) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := 0
+	for _, aggregate := range p.orders {
+		if aggregate.Exists() {
+			n++
+		}
+	}
+	return n
+}
+
+// OrdersByUserProjection is the IDs of each user's orders
+type OrdersByUserProjection struct {
+	mu     sync.RWMutex
+	users  map[int]map[string]struct{}
+	userOf map[string]int
+}
+
+func NewOrdersByUserProjection() *OrdersByUserProjection {
+	return &OrdersByUserProjection{
+		users:  make(map[int]map[string]struct{}),
+		userOf: make(map[string]int),
+	}
+}
+
+func (p *OrdersByUserProjection) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users = make(map[int]map[string]struct{})
+	p.userOf = make(map[string]int)
+}
+
+// remove forgets the order's user, callers hold mu
+func (p *OrdersByUserProjection) remove(orderID string) {
+	userID, exists := p.userOf[orderID]
+	if !exists {
+		return
+	}
+	delete(p.users[userID], orderID)
+	if len(p.users[userID]) == 0 {
+		delete(p.users, userID)
+	}
+	delete(p.userOf, orderID)
+}
+
+func (p *OrdersByUserProjection) Apply(event StoredEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch event.Type {
+	case OrderCreated, OrderUpdated:
+		var details orderDetails
+		if err := json.Unmarshal(event.Data, &details); err != nil {
+			return fmt.Errorf("%s %s/%d: %w", event.Type, event.StreamID, event.Version, err)
+		}
+		p.remove(event.StreamID)
+		if p.users[details.UserID] == nil {
+			p.users[details.UserID] = make(map[string]struct{})
+		}
+		p.users[details.UserID][event.StreamID] = struct{}{}
+		p.userOf[event.StreamID] = details.UserID
+	case OrderDeleted:
+		p.remove(event.StreamID)
+	}
+	return nil
+}
+
+func (p *OrdersByUserProjection) OrderIDs(userID int) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var orderIDs []string
+	for orderID := range p.users[userID] {
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs
+}
+
+// Projector feeds the events of a store to projections and remembers how far it got
+type Projector struct {
+	mu          sync.Mutex
+	store       EventStore
+	projections []Projection
+	position    int64
+}
+
+func NewProjector(store EventStore, projections ...Projection) *Projector {
+	return &Projector{
+		store:       store,
+		projections: projections,
+	}
+}
+
+// CatchUp applies the events appended since the last call
+func (p *Projector) CatchUp(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.catchUp(ctx)
+}
+
+// catchUp is CatchUp for callers holding mu
+func (p *Projector) catchUp(ctx context.Context) error {
+	for {
+		events, err := p.store.ReadAll(ctx, p.position, projectionBatchSize)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		for _, event := range events {
+			for _, projection := range p.projections {
+				if err := projection.Apply(event); err != nil {
+					return err
+				}
+			}
+			p.position = event.Position
+		}
+	}
+}
+
+// Rebuild empties the projections and replays every event into them, e.g. after a projection
+// changed or lost its state
+func (p *Projector) Rebuild(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, projection := range p.projections {
+		projection.Reset()
+	}
+	p.position = 0
+	return p.catchUp(ctx)
+}
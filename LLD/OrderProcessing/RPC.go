@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	orderspb "orderprocessing/proto"
+)
+
+// RPC server for proto/orders.proto on the generated stubs in proto/
+
+// rpcError maps the service errors to status errors
+func rpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrUnknownStatus):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrStaleVersion), errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrOutOfStock), errors.Is(err, ErrPaymentDeclined),
+		errors.Is(err, ErrIdempotencyKeyReused), errors.Is(err, ErrPaymentState):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrVersionConflict), errors.Is(err, ErrRequestInProgress):
+		code = codes.Aborted
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPaymentTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
+
+// rpcErrorWithOrder is rpcError with the order the failed call left behind in the status details
+func rpcErrorWithOrder(err error, order Order) error {
+	st := status.Convert(rpcError(err))
+	if order.OrderID == "" {
+		return st.Err()
+	}
+	if withOrder, detailsErr := st.WithDetails(orderReply(order)); detailsErr == nil {
+		st = withOrder
+	}
+	return st.Err()
+}
+
+func orderReply(order Order) *orderspb.OrderReply {
+	reply := &orderspb.OrderReply{
+		OrderId:       order.OrderID,
+		UserId:        int64(order.UserID),
+		OrderStatus:   string(order.OrderStatus),
+		SubtotalMinor: int64(order.Subtotal),
+		DiscountMinor: int64(order.Discount),
+		TaxMinor:      int64(order.Tax),
+		TotalMinor:    int64(order.TotalPrice),
+		CreatedAt:     timestamppb.New(order.CreatedAt),
+		UpdatedAt:     timestamppb.New(order.UpdatedAt),
+	}
+	for _, item := range order.Items {
+		reply.Items = append(reply.Items, &orderspb.OrderLineReply{Sku: item.SKU, Qty: int64(item.Qty), UnitPriceMinor: int64(item.UnitPrice)})
+	}
+	return reply
+}
+
+// OrderRPCServer serves IOrderService. The caller's deadline arrives in ctx and bounds everything
+// the call does downstream, payment and inventory included; unary calls without one get defaultTimeout.
+type OrderRPCServer struct {
+	orderspb.UnimplementedOrderServiceServer
+	service        IOrderService
+	defaultTimeout time.Duration
+}
+
+func NewOrderRPCServer(service IOrderService, defaultTimeout time.Duration) *OrderRPCServer {
+	return &OrderRPCServer{
+		service:        service,
+		defaultTimeout: defaultTimeout,
+	}
+}
+
+func (s *OrderRPCServer) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || s.defaultTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.defaultTimeout)
+}
+
+func (s *OrderRPCServer) CreateOrder(ctx context.Context, req *orderspb.CreateOrderRequest) (*orderspb.OrderReply, error) {
+	ctx, cancel := s.withDeadline(ctx)
+	defer cancel()
+
+	request := OrderRequest{
+		UserID:         int(req.UserId),
+		CouponCodes:    req.CouponCodes,
+		IdempotencyKey: req.IdempotencyKey,
+	}
+	for _, item := range req.Items {
+		request.Items = append(request.Items, OrderItem{SKU: item.Sku, Qty: int(item.Qty)})
+	}
+	if err := request.Validate(); err != nil {
+		return nil, rpcError(err)
+	}
+	order, err := s.service.CreateOrder(ctx, request)
+	if err != nil {
+		return nil, rpcErrorWithOrder(err, order)
+	}
+	return orderReply(order), nil
+}
+
+func (s *OrderRPCServer) GetOrder(ctx context.Context, req *orderspb.GetOrderRequest) (*orderspb.OrderReply, error) {
+	ctx, cancel := s.withDeadline(ctx)
+	defer cancel()
+
+	order, err := s.service.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return orderReply(order), nil
+}
+
+func (s *OrderRPCServer) ListOrders(ctx context.Context, req *orderspb.ListOrdersRequest) (*orderspb.ListOrdersReply, error) {
+	ctx, cancel := s.withDeadline(ctx)
+	defer cancel()
+
+	orders, err := s.service.ListOrders(ctx, int(req.UserId))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	reply := &orderspb.ListOrdersReply{}
+	for _, order := range orders {
+		reply.Orders = append(reply.Orders, orderReply(order))
+	}
+	return reply, nil
+}
+
+func (s *OrderRPCServer) UpdateOrderStatus(ctx context.Context, req *orderspb.UpdateOrderStatusRequest) (*orderspb.OrderReply, error) {
+	ctx, cancel := s.withDeadline(ctx)
+	defer cancel()
+
+	order, err := s.service.UpdateOrder(ctx, req.OrderId, OrderStatus(req.Status))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return orderReply(order), nil
+}
+
+func (s *OrderRPCServer) CancelOrder(ctx context.Context, req *orderspb.CancelOrderRequest) (*orderspb.OrderReply, error) {
+	ctx, cancel := s.withDeadline(ctx)
+	defer cancel()
+
+	if err := s.service.CancelOrder(ctx, req.OrderId); err != nil {
+		return nil, rpcError(err)
+	}
+	order, err := s.service.GetOrder(ctx, req.OrderId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return orderReply(order), nil
+}
+
+// WatchOrder streams until the order is terminal or the client goes away, it has no default deadline
+func (s *OrderRPCServer) WatchOrder(req *orderspb.WatchOrderRequest, stream orderspb.OrderService_WatchOrderServer) error {
+	ctx := stream.Context()
+	updates, err := s.service.WatchOrder(ctx, req.OrderId)
+	if err != nil {
+		return rpcError(err)
+	}
+	for order := range updates {
+		if err := stream.Send(orderReply(order)); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return rpcError(err)
+	}
+	return nil
+}
+
+// demoRPC registers the RPC server on a grpc.Server listening on a loopback port and calls it
+// through the generated client: a deadline bound create, and a watch following the order
+func demoRPC(service IOrderService) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Listening for the RPC server:", err)
+		return
+	}
+	server := grpc.NewServer()
+	orderspb.RegisterOrderServiceServer(server, NewOrderRPCServer(service, 5*time.Second))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fmt.Println("Dialing the RPC server:", err)
+		return
+	}
+	defer conn.Close()
+	client := orderspb.NewOrderServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := client.CreateOrder(ctx, &orderspb.CreateOrderRequest{UserId: 8, Items: []*orderspb.OrderLineRequest{{Sku: "item2", Qty: 2}}})
+	if err != nil {
+		fmt.Println("CreateOrder:", err)
+		return
+	}
+	fmt.Printf("CreateOrder: %s is %s, total %s\n", reply.OrderId, reply.OrderStatus, Money(reply.TotalMinor))
+
+	streamCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	stream, err := client.WatchOrder(streamCtx, &orderspb.WatchOrderRequest{OrderId: reply.OrderId})
+	if err != nil {
+		fmt.Println("WatchOrder:", err)
+		return
+	}
+	// The first reply is the order as it is, once it's in the watch is subscribed
+	first, err := stream.Recv()
+	if err != nil {
+		fmt.Println("WatchOrder:", err)
+		return
+	}
+	fmt.Printf("WatchOrder: %s is %s\n", first.OrderId, first.OrderStatus)
+	go func() {
+		for _, status := range []OrderStatus{StatusFulfilling, StatusShipped, StatusDelivered} {
+			if _, err := client.UpdateOrderStatus(context.Background(), &orderspb.UpdateOrderStatusRequest{OrderId: reply.OrderId, Status: string(status)}); err != nil {
+				fmt.Println("UpdateOrderStatus:", err)
+			}
+		}
+	}()
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			fmt.Println("WatchOrder:", err)
+			break
+		}
+		fmt.Printf("WatchOrder: %s is %s\n", update.OrderId, update.OrderStatus)
+		if update.OrderStatus == string(StatusDelivered) {
+			// Delivered can still be refunded, so the stream stays open until the client leaves
+			stopWatching()
+			_, err := stream.Recv()
+			fmt.Println("WatchOrder ended:", status.Code(err))
+			break
+		}
+	}
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	if _, err := client.GetOrder(expired, &orderspb.GetOrderRequest{OrderId: reply.OrderId}); err != nil {
+		fmt.Println("GetOrder past its deadline:", status.Code(err))
+	}
+	if _, err := client.UpdateOrderStatus(context.Background(), &orderspb.UpdateOrderStatusRequest{OrderId: reply.OrderId, Status: "Cancelled"}); err != nil {
+		fmt.Println("UpdateOrderStatus:", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	orderspb "orderprocessing/proto"
+)
+
+// newRPCClient serves service over an in-memory listener and returns a client of it
+func newRPCClient(t *testing.T, service IOrderService, defaultTimeout time.Duration) orderspb.OrderServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	orderspb.RegisterOrderServiceServer(server, NewOrderRPCServer(service, defaultTimeout))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///orders",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return orderspb.NewOrderServiceClient(conn)
+}
+
+// newRPCService is a service wired like main's, served over RPC
+func newRPCService(t *testing.T) (*OrderService, orderspb.OrderServiceClient) {
+	t.Helper()
+	factory := &ServiceFactory{}
+	service := factory.CreateOrderService(t.Context()).(*OrderService)
+	t.Cleanup(func() { factory.Close(context.Background()) })
+	return service, newRPCClient(t, service, time.Minute)
+}
+
+// failingOrderService fails every call with err and keeps the deadline of the last call's context
+type failingOrderService struct {
+	IOrderService
+	err         error
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func (s *failingOrderService) fail(ctx context.Context) error {
+	s.deadline, s.hasDeadline = ctx.Deadline()
+	return s.err
+}
+
+func (s *failingOrderService) CreateOrder(ctx context.Context, request OrderRequest) (Order, error) {
+	return Order{}, s.fail(ctx)
+}
+
+func (s *failingOrderService) GetOrder(ctx context.Context, orderID string) (Order, error) {
+	return Order{}, s.fail(ctx)
+}
+
+func (s *failingOrderService) ListOrders(ctx context.Context, userID int) ([]Order, error) {
+	return nil, s.fail(ctx)
+}
+
+func (s *failingOrderService) UpdateOrder(ctx context.Context, orderID string, status OrderStatus) (Order, error) {
+	return Order{}, s.fail(ctx)
+}
+
+func (s *failingOrderService) CancelOrder(ctx context.Context, orderID string) error {
+	return s.fail(ctx)
+}
+
+func (s *failingOrderService) WatchOrder(ctx context.Context, orderID string) (<-chan Order, error) {
+	return nil, s.fail(ctx)
+}
+
+// callEveryRPC makes each RPC once and returns their errors by name
+func callEveryRPC(ctx context.Context, client orderspb.OrderServiceClient) map[string]error {
+	errs := make(map[string]error)
+	_, errs["CreateOrder"] = client.CreateOrder(ctx, &orderspb.CreateOrderRequest{UserId: 1, Items: []*orderspb.OrderLineRequest{{Sku: "item1", Qty: 1}}})
+	_, errs["GetOrder"] = client.GetOrder(ctx, &orderspb.GetOrderRequest{OrderId: "o1"})
+	_, errs["ListOrders"] = client.ListOrders(ctx, &orderspb.ListOrdersRequest{UserId: 1})
+	_, errs["UpdateOrderStatus"] = client.UpdateOrderStatus(ctx, &orderspb.UpdateOrderStatusRequest{OrderId: "o1", Status: string(StatusShipped)})
+	_, errs["CancelOrder"] = client.CancelOrder(ctx, &orderspb.CancelOrderRequest{OrderId: "o1"})
+	if stream, err := client.WatchOrder(ctx, &orderspb.WatchOrderRequest{OrderId: "o1"}); err != nil {
+		errs["WatchOrder"] = err
+	} else {
+		_, errs["WatchOrder"] = stream.Recv()
+	}
+	return errs
+}
+
+func TestRPCStatusCodes(t *testing.T) {
+	cases := []struct {
+		err  error
+		code codes.Code
+	}{
+		{ErrOrderNotFound, codes.NotFound},
+		{&TransitionError{OrderID: "o1", From: StatusCreated, To: StatusShipped}, codes.FailedPrecondition},
+		{&VersionConflictError{OrderID: "o1", Expected: 2, Actual: 3}, codes.Aborted},
+		{ErrStaleVersion, codes.FailedPrecondition},
+		{&StockError{Products: []string{"item1"}}, codes.FailedPrecondition},
+		{ErrRequestInProgress, codes.Aborted},
+		{errors.New("disk full"), codes.Internal},
+	}
+	for _, c := range cases {
+		client := newRPCClient(t, &failingOrderService{err: c.err}, time.Minute)
+		for rpc, err := range callEveryRPC(t.Context(), client) {
+			if status.Code(err) != c.code {
+				t.Errorf("%s failing with %v: %v, want %s", rpc, c.err, err, c.code)
+			}
+		}
+	}
+}
+
+func TestRPCServiceErrors(t *testing.T) {
+	_, client := newRPCService(t)
+	ctx := t.Context()
+
+	if _, err := client.GetOrder(ctx, &orderspb.GetOrderRequest{OrderId: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetOrder of a missing order: %v, want NotFound", err)
+	}
+	if _, err := client.CreateOrder(ctx, &orderspb.CreateOrderRequest{UserId: 1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateOrder without items: %v, want InvalidArgument", err)
+	}
+	order, err := client.CreateOrder(ctx, &orderspb.CreateOrderRequest{UserId: 1, Items: []*orderspb.OrderLineRequest{{Sku: "item1", Qty: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.UpdateOrderStatus(ctx, &orderspb.UpdateOrderStatusRequest{OrderId: order.OrderId, Status: string(StatusDelivered)})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UpdateOrderStatus from %s to Delivered: %v, want FailedPrecondition", order.OrderStatus, err)
+	}
+}
+
+func TestRPCFailedOrderComesBackCancelled(t *testing.T) {
+	_, client := newRPCService(t)
+	// five chairs are over the demo payment limit, so the payment is declined
+	_, err := client.CreateOrder(t.Context(), &orderspb.CreateOrderRequest{UserId: 1, Items: []*orderspb.OrderLineRequest{{Sku: "item3", Qty: 5}}})
+	st := status.Convert(err)
+	if st.Code() != codes.FailedPrecondition {
+		t.Fatalf("CreateOrder over the payment limit: %v, want FailedPrecondition", err)
+	}
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("status details %v, want the order", details)
+	}
+	order, ok := details[0].(*orderspb.OrderReply)
+	if !ok || order.OrderId == "" || order.OrderStatus != string(StatusCancelled) {
+		t.Fatalf("status details %v, want the Cancelled order", details[0])
+	}
+	if stored, err := client.GetOrder(t.Context(), &orderspb.GetOrderRequest{OrderId: order.OrderId}); err != nil || stored.OrderStatus != string(StatusCancelled) {
+		t.Errorf("GetOrder of the failed order: %v, %v, want it Cancelled", stored, err)
+	}
+}
+
+func TestRPCDeadlineReachesTheService(t *testing.T) {
+	service := &failingOrderService{err: ErrOrderNotFound}
+	client := newRPCClient(t, service, time.Minute)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 3*time.Second)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	client.GetOrder(ctx, &orderspb.GetOrderRequest{OrderId: "o1"})
+	// the deadline travels as a timeout, so it arrives within a little of where it was set
+	if diff := service.deadline.Sub(want).Abs(); !service.hasDeadline || diff > 100*time.Millisecond {
+		t.Errorf("service deadline %v, want the client's %v", service.deadline, want)
+	}
+
+	// without one the call gets the server's default
+	client.GetOrder(t.Context(), &orderspb.GetOrderRequest{OrderId: "o1"})
+	if remaining := time.Until(service.deadline); !service.hasDeadline || remaining <= 50*time.Second || remaining > time.Minute {
+		t.Errorf("service deadline in %s without a client deadline, want the default minute", remaining)
+	}
+}
+
+func TestRPCWatchOrder(t *testing.T) {
+	_, client := newRPCService(t)
+	ctx := t.Context()
+	order, err := client.CreateOrder(ctx, &orderspb.CreateOrderRequest{UserId: 8, Items: []*orderspb.OrderLineRequest{{Sku: "item2", Qty: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := client.WatchOrder(ctx, &orderspb.WatchOrderRequest{OrderId: order.OrderId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.OrderStatus != string(StatusPaid) {
+		t.Fatalf("first reply %v, %v, want the order as it is, Paid", first, err)
+	}
+
+	if _, err := client.UpdateOrderStatus(ctx, &orderspb.UpdateOrderStatusRequest{OrderId: order.OrderId, Status: string(StatusFulfilling)}); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := stream.Recv(); err != nil || reply.OrderStatus != string(StatusFulfilling) {
+		t.Fatalf("reply %v, %v, want Fulfilling", reply, err)
+	}
+	if _, err := client.CancelOrder(ctx, &orderspb.CancelOrderRequest{OrderId: order.OrderId}); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := stream.Recv(); err != nil || reply.OrderStatus != string(StatusCancelled) {
+		t.Fatalf("reply %v, %v, want Cancelled", reply, err)
+	}
+	// Cancelled is terminal, the stream ends there
+	if reply, err := stream.Recv(); err != io.EOF {
+		t.Errorf("after Cancelled: %v, %v, want the end of the stream", reply, err)
+	}
+}
+
+// watchers is how many watchers the broadcaster has for orderID
+func watchers(b *OrderBroadcaster, orderID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.watchers[orderID])
+}
+
+func TestRPCWatchOrderUnsubscribesWhenCancelled(t *testing.T) {
+	service, client := newRPCService(t)
+	order, err := client.CreateOrder(t.Context(), &orderspb.CreateOrderRequest{UserId: 8, Items: []*orderspb.OrderLineRequest{{Sku: "item2", Qty: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stream, err := client.WatchOrder(ctx, &orderspb.WatchOrderRequest{OrderId: order.OrderId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if n := watchers(service.broadcaster, order.OrderId); n != 1 {
+		t.Fatalf("%d watchers while the stream is open, want 1", n)
+	}
+
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("Recv after cancelling: %v, want Canceled", err)
+	}
+	for deadline := time.Now().Add(time.Second); watchers(service.broadcaster, order.OrderId) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the cancelled stream is still subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	service.broadcaster.mu.Lock()
+	defer service.broadcaster.mu.Unlock()
+	if _, exists := service.broadcaster.watchers[order.OrderId]; exists {
+		t.Error("the order's entry is kept after its last watcher left")
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// orderMigrations are applied in order and never edited once released, a schema change is a new entry.
+// The SQL is plain enough for SQLite, PostgreSQL and MySQL; placeholders are written as ? and
+// rebound for drivers that number them.
+var orderMigrations = []string{
+	// 1: orders, amounts are in cents
+	`CREATE TABLE orders (
+		order_id       VARCHAR(64) PRIMARY KEY,
+		user_id        INTEGER NOT NULL,
+		order_status   VARCHAR(32) NOT NULL,
+		subtotal_minor BIGINT NOT NULL,
+		discount_minor BIGINT NOT NULL,
+		tax_minor      BIGINT NOT NULL,
+		total_minor    BIGINT NOT NULL,
+		created_at     VARCHAR(40) NOT NULL,
+		updated_at     VARCHAR(40) NOT NULL,
+		version        INTEGER NOT NULL
+	)`,
+	// 2: line items, one row per product in the order
+	`CREATE TABLE order_items (
+		order_id         VARCHAR(64) NOT NULL REFERENCES orders (order_id),
+		position         INTEGER NOT NULL,
+		sku              VARCHAR(128) NOT NULL,
+		qty              INTEGER NOT NULL,
+		unit_price_minor BIGINT NOT NULL,
+		PRIMARY KEY (order_id, position)
+	)`,
+	// 3: orders by user
+	`CREATE INDEX orders_user_id ON orders (user_id, created_at)`,
+	// 4: the outbox, events are JSON and kept after publishing with published_at set. A failed
+	// event waits until retry_at or, once parked, until it is unparked.
+	`CREATE TABLE order_outbox (
+		event_id     VARCHAR(96) PRIMARY KEY,
+		order_id     VARCHAR(64) NOT NULL,
+		version      INTEGER NOT NULL,
+		occurred_at  VARCHAR(40) NOT NULL,
+		payload      TEXT NOT NULL,
+		published_at VARCHAR(40),
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		retry_at     VARCHAR(40),
+		parked_at    VARCHAR(40)
+	)`,
+	// 5: pending events
+	`CREATE INDEX order_outbox_pending ON order_outbox (published_at, occurred_at)`,
+	// 6: pending events by order, to find the orders a failed event holds
+	`CREATE INDEX order_outbox_order ON order_outbox (order_id, published_at)`,
+}
+
+// MigrateOrders brings the schema up to date, each migration runs in its own transaction
+// and is recorded in schema_migrations
+func MigrateOrders(ctx context.Context, db *sql.DB, numbered bool) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at VARCHAR(40) NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for version := current + 1; version <= len(orderMigrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, orderMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		record := rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, numbered)
+		if _, err := tx.ExecContext(ctx, record, version, formatTime(time.Now())); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// rebind turns ? placeholders into $1, $2, ... for drivers like PostgreSQL's
+func rebind(query string, numbered bool) string {
+	if !numbered {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&out, "$%d", n)
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// storedTime is RFC 3339 in UTC with all nine fraction digits, every driver round-trips text
+// and the fixed width makes it sort by time
+const storedTime = "2006-01-02T15:04:05.000000000Z07:00"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(storedTime)
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(storedTime, s)
+}
+
+// SQLOrderRepository stores orders with database/sql, the line items in order_items. Amounts
+// are in cents in the *_minor columns.
+// The driver is whatever the binary links in, e.g. modernc.org/sqlite or github.com/lib/pq.
+type SQLOrderRepository struct {
+	db       *sql.DB
+	numbered bool
+}
+
+// NewSQLOrderRepository migrates db and returns the repository, numbered is for drivers that
+// want $1 placeholders instead of ?
+func NewSQLOrderRepository(ctx context.Context, db *sql.DB, numbered bool) (*SQLOrderRepository, error) {
+	if err := MigrateOrders(ctx, db, numbered); err != nil {
+		return nil, err
+	}
+	return &SQLOrderRepository{db: db, numbered: numbered}, nil
+}
+
+func (repo *SQLOrderRepository) q(query string) string {
+	return rebind(query, repo.numbered)
+}
+
+// inTx runs fn in a transaction and commits if it returns nil
+func (repo *SQLOrderRepository) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *SQLOrderRepository) insertItems(ctx context.Context, tx *sql.Tx, order *Order) error {
+	for position, item := range order.Items {
+		if _, err := tx.ExecContext(ctx, repo.q(`INSERT INTO order_items (order_id, position, sku, qty, unit_price_minor)
+			VALUES (?, ?, ?, ?, ?)`),
+			order.OrderID, position, item.SKU, item.Qty, int64(item.UnitPrice)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *SQLOrderRepository) insertEvents(ctx context.Context, tx *sql.Tx, events []OrderEvent) error {
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, repo.q(`INSERT INTO order_outbox (event_id, order_id, version, occurred_at, payload)
+			VALUES (?, ?, ?, ?, ?)`),
+			event.EventID, event.OrderID, event.Version, formatTime(event.OccurredAt), string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *SQLOrderRepository) Save(ctx context.Context, order *Order, events ...OrderEvent) error {
+	return repo.inTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, repo.q(`SELECT 1 FROM orders WHERE order_id = ?`), order.OrderID).Scan(&exists)
+		if err == nil {
+			return fmt.Errorf("order %s: %w", order.OrderID, ErrDuplicateOrder)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, repo.q(`INSERT INTO orders
+			(order_id, user_id, order_status, subtotal_minor, discount_minor, tax_minor, total_minor,
+				created_at, updated_at, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`),
+			order.OrderID, order.UserID, string(order.OrderStatus),
+			int64(order.Subtotal), int64(order.Discount), int64(order.Tax), int64(order.TotalPrice),
+			formatTime(order.CreatedAt), formatTime(order.UpdatedAt)); err != nil {
+			return err
+		}
+		if err := repo.insertItems(ctx, tx, order); err != nil {
+			return err
+		}
+		if err := repo.insertEvents(ctx, tx, events); err != nil {
+			return err
+		}
+		order.Version = 1
+		return nil
+	})
+}
+
+const selectOrders = `SELECT order_id, user_id, order_status, subtotal_minor, discount_minor, tax_minor, total_minor,
+	created_at, updated_at, version FROM orders`
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	var status, createdAt, updatedAt string
+	if err := row.Scan(&order.OrderID, &order.UserID, &status, &order.Subtotal, &order.Discount, &order.Tax, &order.TotalPrice,
+		&createdAt, &updatedAt, &order.Version); err != nil {
+		return Order{}, err
+	}
+	order.OrderStatus = OrderStatus(status)
+	var err error
+	if order.CreatedAt, err = parseTime(createdAt); err != nil {
+		return Order{}, err
+	}
+	if order.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (repo *SQLOrderRepository) FindByID(ctx context.Context, orderID string) (Order, error) {
+	order, err := scanOrder(repo.db.QueryRowContext(ctx, repo.q(selectOrders+` WHERE order_id = ?`), orderID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	orders := []Order{order}
+	if err := repo.loadItems(ctx, orders); err != nil {
+		return Order{}, err
+	}
+	return orders[0], nil
+}
+
+func (repo *SQLOrderRepository) FindByUser(ctx context.Context, userID int) ([]Order, error) {
+	rows, err := repo.db.QueryContext(ctx, repo.q(selectOrders+` WHERE user_id = ? ORDER BY created_at, order_id`), userID)
+	if err != nil {
+		return nil, err
+	}
+	var orders []Order
+	index := make(map[string]int)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[order.OrderID] = len(orders)
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// All line items in one query rather than one per order
+	items, err := repo.db.QueryContext(ctx, repo.q(`SELECT i.order_id, i.sku, i.qty, i.unit_price_minor FROM order_items i
+		JOIN orders o ON o.order_id = i.order_id
+		WHERE o.user_id = ? ORDER BY i.order_id, i.position`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+	for items.Next() {
+		var orderID string
+		var item LineItem
+		if err := items.Scan(&orderID, &item.SKU, &item.Qty, &item.UnitPrice); err != nil {
+			return nil, err
+		}
+		if i, exists := index[orderID]; exists {
+			orders[i].Items = append(orders[i].Items, item)
+		}
+	}
+	return orders, items.Err()
+}
+
+// Update writes the order if its version is still order.Version, the line items are replaced
+func (repo *SQLOrderRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
+	return repo.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repo.q(`UPDATE orders
+			SET user_id = ?, order_status = ?, subtotal_minor = ?, discount_minor = ?, tax_minor = ?,
+				total_minor = ?, created_at = ?, updated_at = ?, version = version + 1
+			WHERE order_id = ? AND version = ?`),
+			order.UserID, string(order.OrderStatus),
+			int64(order.Subtotal), int64(order.Discount), int64(order.Tax), int64(order.TotalPrice),
+			formatTime(order.CreatedAt), formatTime(order.UpdatedAt), order.OrderID, order.Version)
+		if err != nil {
+			return err
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			var actual int
+			err := tx.QueryRowContext(ctx, repo.q(`SELECT version FROM orders WHERE order_id = ?`), order.OrderID).Scan(&actual)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrOrderNotFound
+			}
+			if err != nil {
+				return err
+			}
+			return &VersionConflictError{OrderID: order.OrderID, Expected: order.Version, Actual: actual}
+		}
+
+		if _, err := tx.ExecContext(ctx, repo.q(`DELETE FROM order_items WHERE order_id = ?`), order.OrderID); err != nil {
+			return err
+		}
+		if err := repo.insertItems(ctx, tx, order); err != nil {
+			return err
+		}
+		if err := repo.insertEvents(ctx, tx, events); err != nil {
+			return err
+		}
+		order.Version++
+		return nil
+	})
+}
+
+func (repo *SQLOrderRepository) Delete(ctx context.Context, orderID string) error {
+	return repo.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, repo.q(`DELETE FROM order_items WHERE order_id = ?`), orderID); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, repo.q(`DELETE FROM orders WHERE order_id = ?`), orderID)
+		if err != nil {
+			return err
+		}
+		if deleted, err := result.RowsAffected(); err != nil {
+			return err
+		} else if deleted == 0 {
+			return ErrOrderNotFound
+		}
+		return nil
+	})
+}
+
+func (repo *SQLOrderRepository) Count(ctx context.Context) (int, error) {
+	var count int
+	err := repo.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders`).Scan(&count)
+	return count, err
+}
+
+// PendingEvents leaves out every event of an order that has an unpublished event waiting for a
+// retry or parked
+func (repo *SQLOrderRepository) PendingEvents(ctx context.Context, limit int) ([]OrderEvent, error) {
+	return repo.outboxEvents(ctx, fmt.Sprintf(`SELECT payload, attempts FROM order_outbox o WHERE published_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM order_outbox held WHERE held.order_id = o.order_id AND held.published_at IS NULL
+			AND (held.parked_at IS NOT NULL OR held.retry_at > ?))
+		ORDER BY occurred_at, order_id, version LIMIT %d`, max(limit, 0)), formatTime(time.Now()))
+}
+
+func (repo *SQLOrderRepository) ParkedEvents(ctx context.Context) ([]OrderEvent, error) {
+	return repo.outboxEvents(ctx, `SELECT payload, attempts FROM order_outbox WHERE published_at IS NULL AND parked_at IS NOT NULL
+		ORDER BY occurred_at, order_id, version`)
+}
+
+// outboxEvents reads the events a query of payload and attempts returns
+func (repo *SQLOrderRepository) outboxEvents(ctx context.Context, query string, args ...interface{}) ([]OrderEvent, error) {
+	rows, err := repo.db.QueryContext(ctx, repo.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []OrderEvent
+	for rows.Next() {
+		var payload string
+		var attempts int
+		if err := rows.Scan(&payload, &attempts); err != nil {
+			return nil, err
+		}
+		var event OrderEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return nil, err
+		}
+		event.Attempts = attempts
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (repo *SQLOrderRepository) MarkPublished(ctx context.Context, eventIDs ...string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	args := []interface{}{formatTime(time.Now())}
+	for _, eventID := range eventIDs {
+		args = append(args, eventID)
+	}
+	_, err := repo.db.ExecContext(ctx, repo.q(`UPDATE order_outbox SET published_at = ?
+		WHERE published_at IS NULL AND event_id IN (?`+strings.Repeat(", ?", len(eventIDs)-1)+`)`), args...)
+	return err
+}
+
+func (repo *SQLOrderRepository) MarkFailed(ctx context.Context, eventID string, retryAt time.Time, park bool) error {
+	var parkedAt interface{}
+	if park {
+		parkedAt = formatTime(time.Now())
+	}
+	_, err := repo.db.ExecContext(ctx, repo.q(`UPDATE order_outbox SET attempts = attempts + 1, retry_at = ?, parked_at = ?
+		WHERE published_at IS NULL AND event_id = ?`), formatTime(retryAt), parkedAt, eventID)
+	return err
+}
+
+func (repo *SQLOrderRepository) Unpark(ctx context.Context, eventIDs ...string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		args = append(args, eventID)
+	}
+	_, err := repo.db.ExecContext(ctx, repo.q(`UPDATE order_outbox SET attempts = 0, retry_at = NULL, parked_at = NULL
+		WHERE published_at IS NULL AND parked_at IS NOT NULL AND event_id IN (?`+strings.Repeat(", ?", len(eventIDs)-1)+`)`), args...)
+	return err
+}
+
+// List pages with a keyset condition on (sort column, order_id), so deep pages cost the same as the first
+func (repo *SQLOrderRepository) List(ctx context.Context, filter OrderFilter, cursor string, limit int) (OrderPage, error) {
+	if err := filter.validate(); err != nil {
+		return OrderPage{}, err
+	}
+	after, err := filter.decodeCursor(cursor)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	limit = pageSize(limit)
+
+	column, direction, past := "created_at", "ASC", ">"
+	if filter.sortField() == SortByUpdatedAt {
+		column = "updated_at"
+	}
+	if filter.Descending {
+		direction, past = "DESC", "<"
+	}
+
+	var where []string
+	var args []interface{}
+	if filter.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if len(filter.Statuses) > 0 {
+		where = append(where, "order_status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, string(status))
+		}
+	}
+	for _, bound := range []struct {
+		column, op string
+		at         time.Time
+	}{
+		{"created_at", ">=", filter.CreatedFrom},
+		{"created_at", "<", filter.CreatedUntil},
+		{"updated_at", ">=", filter.UpdatedFrom},
+		{"updated_at", "<", filter.UpdatedUntil},
+	} {
+		if !bound.at.IsZero() {
+			where = append(where, bound.column+" "+bound.op+" ?")
+			args = append(args, formatTime(bound.at))
+		}
+	}
+	if after != nil {
+		at := formatTime(after.At)
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND order_id %s ?))", column, past, column, past))
+		args = append(args, at, at, after.OrderID)
+	}
+
+	query := selectOrders
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, order_id %s LIMIT %d", column, direction, direction, limit+1)
+
+	rows, err := repo.db.QueryContext(ctx, repo.q(query), args...)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	var orders []Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			rows.Close()
+			return OrderPage{}, err
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return OrderPage{}, err
+	}
+
+	page := filter.page(orders, limit)
+	if err := repo.loadItems(ctx, page.Orders); err != nil {
+		return OrderPage{}, err
+	}
+	return page, nil
+}
+
+// loadItems fills in the line items of orders with one query
+func (repo *SQLOrderRepository) loadItems(ctx context.Context, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	index := make(map[string]int, len(orders))
+	args := make([]interface{}, len(orders))
+	for i, order := range orders {
+		index[order.OrderID] = i
+		args[i] = order.OrderID
+	}
+	rows, err := repo.db.QueryContext(ctx, repo.q(`SELECT order_id, sku, qty, unit_price_minor FROM order_items
+		WHERE order_id IN (?`+strings.Repeat(", ?", len(orders)-1)+`) ORDER BY order_id, position`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderID string
+		var item LineItem
+		if err := rows.Scan(&orderID, &item.SKU, &item.Qty, &item.UnitPrice); err != nil {
+			return err
+		}
+		orders[index[orderID]].Items = append(orders[index[orderID]].Items, item)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SagaStep is one step of the create order saga
+type SagaStep string
+
+const (
+	StepReserveInventory SagaStep = "ReserveInventory"
+	StepProcessPayment   SagaStep = "ProcessPayment"
+	StepConfirmOrder     SagaStep = "ConfirmOrder"
+)
+
+// createOrderSteps run in this order, compensations run in reverse for the completed ones
+var createOrderSteps = []SagaStep{StepReserveInventory, StepProcessPayment, StepConfirmOrder}
+
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "Running"
+	SagaCompensating SagaStatus = "Compensating"
+	SagaCompleted    SagaStatus = "Completed"
+	SagaAborted      SagaStatus = "Aborted" // failed and fully compensated
+)
+
+// SagaState is everything needed to continue a saga after a crash, it is saved after every step
+type SagaState struct {
+	OrderID string       `json:"orderId"`
+	Request OrderRequest `json:"request"`
+	// Items and Amount are what the order was priced at, a resumed saga doesn't price it again
+	Items     []LineItem `json:"items"`
+	Amount    Money      `json:"amount"`
+	Status    SagaStatus `json:"status"`
+	Completed []SagaStep `json:"completed"`
+	Failure   string     `json:"failure,omitempty"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+func (state *SagaState) done(step SagaStep) bool {
+	for _, completed := range state.Completed {
+		if completed == step {
+			return true
+		}
+	}
+	return false
+}
+
+// SagaStore persists saga state
+type SagaStore interface {
+	Save(state SagaState) error
+	Load(orderID string) (SagaState, bool, error)
+	// Unfinished returns the sagas that are still running or compensating
+	Unfinished() ([]SagaState, error)
+}
+
+// InMemorySagaStore keeps sagas for the lifetime of the process
+type InMemorySagaStore struct {
+	mu    sync.Mutex
+	sagas map[string]SagaState
+}
+
+func NewInMemorySagaStore() *InMemorySagaStore {
+	return &InMemorySagaStore{
+		sagas: make(map[string]SagaState),
+	}
+}
+
+func (store *InMemorySagaStore) Save(state SagaState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state.Completed = append([]SagaStep(nil), state.Completed...)
+	store.sagas[state.OrderID] = state
+	return nil
+}
+
+func (store *InMemorySagaStore) Load(orderID string) (SagaState, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state, exists := store.sagas[orderID]
+	return state, exists, nil
+}
+
+func (store *InMemorySagaStore) Unfinished() ([]SagaState, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var unfinished []SagaState
+	for _, state := range store.sagas {
+		if state.Status == SagaRunning || state.Status == SagaCompensating {
+			unfinished = append(unfinished, state)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].OrderID < unfinished[j].OrderID })
+	return unfinished, nil
+}
+
+// FileSagaStore keeps one JSON file per saga in a directory, so sagas survive a restart
+type FileSagaStore struct {
+	dir string
+}
+
+func NewFileSagaStore(dir string) (*FileSagaStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSagaStore{dir: dir}, nil
+}
+
+func (store *FileSagaStore) path(orderID string) string {
+	return filepath.Join(store.dir, fmt.Sprintf("saga-%s.json", orderID))
+}
+
+// Save writes to a temporary file and renames it, so a crash never leaves half a file behind
+func (store *FileSagaStore) Save(state SagaState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := store.path(state.OrderID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path(state.OrderID))
+}
+
+func (store *FileSagaStore) Load(orderID string) (SagaState, bool, error) {
+	data, err := os.ReadFile(store.path(orderID))
+	if errors.Is(err, os.ErrNotExist) {
+		return SagaState{}, false, nil
+	}
+	if err != nil {
+		return SagaState{}, false, err
+	}
+	var state SagaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return SagaState{}, false, err
+	}
+	return state, true, nil
+}
+
+func (store *FileSagaStore) Unfinished() ([]SagaState, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var unfinished []SagaState
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "saga-") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(store.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var state SagaState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if state.Status == SagaRunning || state.Status == SagaCompensating {
+			unfinished = append(unfinished, state)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].OrderID < unfinished[j].OrderID })
+	return unfinished, nil
+}
+
+// CreateOrderSaga orchestrates reserve inventory -> process payment -> confirm order, the user
+// hears about the order from its OrderCreated event. When a step fails the completed steps are compensated in reverse: the payment is voided,
+// the stock released and the order cancelled. Steps are keyed by order ID so that repeating one
+// after a crash, before its completion was saved, is harmless. A failed compensation leaves the
+// saga Compensating, the next Resume tries again.
+type CreateOrderSaga struct {
+	store        SagaStore
+	repo         IOrderRepository
+	paymentSvc   IPaymentService
+	inventorySvc IInventoryService
+	logger       *slog.Logger
+}
+
+func NewCreateOrderSaga(store SagaStore, repo IOrderRepository, paymentSvc IPaymentService, inventorySvc IInventoryService) *CreateOrderSaga {
+	return &CreateOrderSaga{
+		store:        store,
+		repo:         repo,
+		paymentSvc:   paymentSvc,
+		inventorySvc: inventorySvc,
+		logger:       slog.Default(),
+	}
+}
+
+// SetLogger logs the saga states that can't be saved
+func (saga *CreateOrderSaga) SetLogger(logger *slog.Logger) {
+	saga.logger = logger
+}
+
+// Begin saves the saga of an order before the order itself is saved with status Created. A crash
+// in between leaves a saga without an order, which Resume aborts, instead of an order no saga
+// would ever finish.
+func (saga *CreateOrderSaga) Begin(order Order, request OrderRequest) (SagaState, error) {
+	state := SagaState{
+		OrderID:   order.OrderID,
+		Request:   request,
+		Items:     order.Items,
+		Amount:    order.TotalPrice,
+		Status:    SagaRunning,
+		UpdatedAt: time.Now(),
+	}
+	if err := saga.store.Save(state); err != nil {
+		return SagaState{}, fmt.Errorf("saving saga: %w", err)
+	}
+	return state, nil
+}
+
+// Run runs a saga from Begin once its order is saved, the error is the one that failed the saga
+func (saga *CreateOrderSaga) Run(ctx context.Context, state *SagaState) error {
+	return saga.run(ctx, state)
+}
+
+// Abort ends a saga from Begin whose order couldn't be saved, none of its steps has run
+func (saga *CreateOrderSaga) Abort(state *SagaState, cause error) {
+	state.Status = SagaAborted
+	state.Failure = cause.Error()
+	saga.save(state)
+}
+
+// Resume continues every saga that was interrupted, call it on startup
+func (saga *CreateOrderSaga) Resume(ctx context.Context) ([]SagaState, error) {
+	unfinished, err := saga.store.Unfinished()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for i := range unfinished {
+		state := &unfinished[i]
+		if state.Status == SagaRunning && len(state.Completed) == 0 {
+			if _, err := saga.repo.FindByID(ctx, state.OrderID); errors.Is(err, ErrOrderNotFound) {
+				// The process stopped between Begin and saving the order
+				saga.Abort(state, err)
+				continue
+			}
+		}
+		if err := saga.run(ctx, state); err != nil {
+			errs = append(errs, fmt.Errorf("order %s: %w", state.OrderID, err))
+		}
+	}
+	return unfinished, errors.Join(errs...)
+}
+
+func (saga *CreateOrderSaga) save(state *SagaState) {
+	state.UpdatedAt = time.Now()
+	if err := saga.store.Save(*state); err != nil {
+		// The step has happened either way, resuming would only repeat it
+		saga.logger.Error("saving a saga failed", "order", state.OrderID, "status", state.Status, "error", err)
+	}
+}
+
+func (saga *CreateOrderSaga) run(ctx context.Context, state *SagaState) error {
+	var failure error
+	if state.Status == SagaRunning {
+		for _, step := range createOrderSteps {
+			if state.done(step) {
+				continue
+			}
+			if err := saga.execute(ctx, step, state); err != nil {
+				failure = fmt.Errorf("%s: %w", step, err)
+				state.Status = SagaCompensating
+				state.Failure = failure.Error()
+				saga.save(state)
+				break
+			}
+			state.Completed = append(state.Completed, step)
+			saga.save(state)
+		}
+		if state.Status == SagaRunning {
+			state.Status = SagaCompleted
+			saga.save(state)
+			return nil
+		}
+	}
+	if failure == nil {
+		failure = errors.New(state.Failure)
+	}
+
+	if state.Status == SagaCompensating {
+		// Compensations run even when ctx is what failed the saga
+		ctx = context.WithoutCancel(ctx)
+		for len(state.Completed) > 0 {
+			step := state.Completed[len(state.Completed)-1]
+			if err := saga.compensate(ctx, step, state); err != nil {
+				return errors.Join(failure, fmt.Errorf("compensating %s: %w", step, err))
+			}
+			state.Completed = state.Completed[:len(state.Completed)-1]
+			saga.save(state)
+		}
+		if err := saga.updateOrder(ctx, state.OrderID, StatusCancelled); err != nil && !errors.Is(err, ErrOrderNotFound) {
+			return errors.Join(failure, fmt.Errorf("cancelling order: %w", err))
+		}
+		state.Status = SagaAborted
+		saga.save(state)
+	}
+	return failure
+}
+
+func (saga *CreateOrderSaga) inventoryRequest(state *SagaState) InventoryRequest {
+	return InventoryRequest{
+		OrderID: state.OrderID,
+		Items:   itemsFor(state.Items),
+	}
+}
+
+func (saga *CreateOrderSaga) paymentRequest(state *SagaState) PaymentRequest {
+	return PaymentRequest{
+		OrderID: state.OrderID,
+		Amount:  state.Amount,
+	}
+}
+
+func (saga *CreateOrderSaga) execute(ctx context.Context, step SagaStep, state *SagaState) error {
+	switch step {
+	case StepReserveInventory:
+		return saga.inventorySvc.ReserveStock(ctx, saga.inventoryRequest(state))
+	case StepProcessPayment:
+		if err := saga.updateOrder(ctx, state.OrderID, StatusPaymentPending); err != nil {
+			return err
+		}
+		return saga.paymentSvc.AuthorizePayment(ctx, saga.paymentRequest(state))
+	case StepConfirmOrder:
+		// An expired reservation fails here, and the payment is voided
+		if err := saga.inventorySvc.CommitStock(ctx, saga.inventoryRequest(state)); err != nil {
+			return err
+		}
+		return saga.updateOrder(ctx, state.OrderID, StatusPaid)
+	}
+	return nil
+}
+
+// compensate undoes a completed step, the order itself is cancelled once all are undone
+func (saga *CreateOrderSaga) compensate(ctx context.Context, step SagaStep, state *SagaState) error {
+	switch step {
+	case StepReserveInventory:
+		return saga.inventorySvc.ReleaseStock(ctx, saga.inventoryRequest(state))
+	case StepProcessPayment:
+		return saga.paymentSvc.VoidPayment(ctx, state.OrderID)
+	}
+	return nil
+}
+
+// maxUpdateAttempts bounds the retries of a status change that keeps losing to concurrent writes
+const maxUpdateAttempts = 3
+
+// updateOrder moves the order to status, being there already counts as done so steps can be repeated
+func (saga *CreateOrderSaga) updateOrder(ctx context.Context, orderID string, status OrderStatus) error {
+	var err error
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var order Order
+		order, err = saga.repo.FindByID(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if order.OrderStatus == status {
+			return nil
+		}
+		if err := order.transition(status); err != nil {
+			return err
+		}
+		order.UpdatedAt = time.Now()
+		if err = saga.repo.Update(ctx, &order); !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+	}
+	return err
+}
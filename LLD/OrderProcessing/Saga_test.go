@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errCrash is what crashingSagaStore panics with to stop a saga like a crash would
+var errCrash = errors.New("crash")
+
+// crashingSagaStore saves to a FileSagaStore and panics right after saving a state crashAfter matches
+type crashingSagaStore struct {
+	*FileSagaStore
+	crashAfter func(SagaState) bool
+}
+
+func (store *crashingSagaStore) Save(state SagaState) error {
+	if err := store.FileSagaStore.Save(state); err != nil {
+		return err
+	}
+	if store.crashAfter(state) {
+		panic(errCrash)
+	}
+	return nil
+}
+
+// failingCommit is an inventory whose CommitStock fails, so the saga compensates at ConfirmOrder
+type failingCommit struct {
+	IInventoryService
+}
+
+func (failingCommit) CommitStock(ctx context.Context, request InventoryRequest) error {
+	return ErrReservationNotFound
+}
+
+// sagaWorld is what outlives a crash of the order service: orders, stock, payments and saga files
+type sagaWorld struct {
+	repo      *OrderRepository
+	inventory *InventoryService
+	payments  *PaymentService
+	sagas     *FileSagaStore
+	dir       string
+}
+
+func newSagaWorld(t *testing.T) *sagaWorld {
+	t.Helper()
+	dir := t.TempDir()
+	sagas, err := NewFileSagaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewFakePaymentProvider(FakePaymentConfig{DeclineOver: demoPaymentLimit})
+	payments := NewPaymentService(provider)
+	provider.OnWebhook(payments.HandleWebhook)
+	return &sagaWorld{
+		repo:      NewOrderRepository(),
+		inventory: newStockedInventory(t, time.Minute, 10, "item1"),
+		payments:  payments,
+		sagas:     sagas,
+		dir:       dir,
+	}
+}
+
+// restart opens the saga directory again, so only what was written to it is left
+func (w *sagaWorld) restart(t *testing.T) {
+	t.Helper()
+	sagas, err := NewFileSagaStore(w.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.sagas = sagas
+}
+
+func (w *sagaWorld) service(inventory IInventoryService, store SagaStore) *OrderService {
+	return NewOrderService(w.repo, NewULIDGenerator(), newDemoPricer(), w.payments, inventory, NewNotificationService(), store, nil)
+}
+
+// crashes reports whether fn stopped with errCrash
+func crashes(fn func()) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errCrash {
+				panic(r)
+			}
+			crashed = true
+		}
+	}()
+	fn()
+	return false
+}
+
+func TestResumeSagas(t *testing.T) {
+	request := OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 2}}}
+	cases := []struct {
+		name       string
+		inventory  func(*InventoryService) IInventoryService
+		crashAfter func(SagaState) bool
+		// what the order, its payment and the stock of item1 end up as after resuming
+		status    OrderStatus
+		payment   PaymentStatus
+		available int
+		saga      SagaStatus
+	}{
+		{
+			name:       "crash after reserving finishes the saga",
+			inventory:  func(i *InventoryService) IInventoryService { return i },
+			crashAfter: func(state SagaState) bool { return len(state.Completed) == 1 },
+			status:     StatusPaid,
+			payment:    PaymentAuthorized,
+			available:  8,
+			saga:       SagaCompleted,
+		},
+		{
+			name:      "crash while compensating voids the payment and releases the stock",
+			inventory: func(i *InventoryService) IInventoryService { return failingCommit{i} },
+			crashAfter: func(state SagaState) bool {
+				return state.Status == SagaCompensating && len(state.Completed) == 2
+			},
+			status:    StatusCancelled,
+			payment:   PaymentVoided,
+			available: 10,
+			saga:      SagaAborted,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := newSagaWorld(t)
+			store := &crashingSagaStore{FileSagaStore: w.sagas, crashAfter: c.crashAfter}
+			if !crashes(func() { w.service(c.inventory(w.inventory), store).CreateOrder(t.Context(), request) }) {
+				t.Fatal("the saga finished without crashing")
+			}
+			w.restart(t)
+			unfinished, err := w.sagas.Unfinished()
+			if err != nil || len(unfinished) != 1 {
+				t.Fatalf("%d unfinished sagas after the crash, error %v, want 1", len(unfinished), err)
+			}
+			orderID := unfinished[0].OrderID
+
+			// restarted with an inventory that works
+			resumed, _ := w.service(w.inventory, w.sagas).ResumeSagas(t.Context())
+			if len(resumed) != 1 || resumed[0].Status != c.saga {
+				t.Fatalf("resumed %+v, want one %s saga", resumed, c.saga)
+			}
+			if order, err := w.repo.FindByID(t.Context(), orderID); err != nil || order.OrderStatus != c.status {
+				t.Errorf("order %+v, error %v, want %s", order, err, c.status)
+			}
+			if payment, err := w.payments.Payment(t.Context(), orderID); err != nil || payment.Status != c.payment {
+				t.Errorf("payment %+v, error %v, want %s", payment, err, c.payment)
+			}
+			if available := w.inventory.Available("item1"); available != c.available {
+				t.Errorf("%d of item1 available, want %d", available, c.available)
+			}
+			if unfinished, _ := w.sagas.Unfinished(); len(unfinished) != 0 {
+				t.Errorf("sagas %+v still unfinished after resuming", unfinished)
+			}
+		})
+	}
+}
+
+func TestResumeSagaWithoutOrder(t *testing.T) {
+	w := newSagaWorld(t)
+	// crashes in Begin, after the saga is saved and before the order is
+	store := &crashingSagaStore{FileSagaStore: w.sagas, crashAfter: func(SagaState) bool { return true }}
+	request := OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 2}}}
+	if !crashes(func() { w.service(w.inventory, store).CreateOrder(t.Context(), request) }) {
+		t.Fatal("the saga finished without crashing")
+	}
+
+	w.restart(t)
+	var logs bytes.Buffer
+	service := w.service(w.inventory, w.sagas)
+	service.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	resumed, err := service.ResumeSagas(t.Context())
+	if err != nil || len(resumed) != 1 || resumed[0].Status != SagaAborted {
+		t.Fatalf("resumed %+v, error %v, want one aborted saga", resumed, err)
+	}
+	if !strings.Contains(logs.String(), `msg="resumed interrupted sagas" count=1`) {
+		t.Errorf("logged %q, want the resumed saga counted", logs.String())
+	}
+	if _, err := w.repo.FindByID(t.Context(), resumed[0].OrderID); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("finding the order = %v, want ErrOrderNotFound", err)
+	}
+	if available := w.inventory.Available("item1"); available != 10 {
+		t.Errorf("%d of item1 available, want all 10", available)
+	}
+}
+
+func TestFileSagaStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSagaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	saga := func(orderID string, status SagaStatus, completed ...SagaStep) SagaState {
+		return SagaState{
+			OrderID:   orderID,
+			Request:   OrderRequest{UserID: 1, Items: []OrderItem{{SKU: "item1", Qty: 2}}, IdempotencyKey: "cart-" + orderID},
+			Items:     []LineItem{{SKU: "item1", Qty: 2, UnitPrice: 19_99}},
+			Amount:    39_98,
+			Status:    status,
+			Completed: completed,
+			UpdatedAt: updatedAt,
+		}
+	}
+	compensating := saga("order-2", SagaCompensating, StepReserveInventory, StepProcessPayment)
+	compensating.Failure = "confirming the order: reservation not found"
+	sagas := []SagaState{
+		saga("order-1", SagaRunning, StepReserveInventory),
+		compensating,
+		saga("order-3", SagaCompleted, createOrderSteps...),
+	}
+	for _, state := range sagas {
+		if err := store.Save(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := NewFileSagaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range sagas {
+		if state, exists, err := reopened.Load(want.OrderID); err != nil || !exists || !reflect.DeepEqual(state, want) {
+			t.Errorf("Load(%s) after reopening = %+v, %v, %v, want %+v", want.OrderID, state, exists, err, want)
+		}
+	}
+	if _, exists, err := reopened.Load("order-4"); exists || err != nil {
+		t.Errorf("Load of a saga never saved = %v, %v, want it missing", exists, err)
+	}
+	if unfinished, err := reopened.Unfinished(); err != nil || !reflect.DeepEqual(unfinished, sagas[:2]) {
+		t.Errorf("Unfinished after reopening = %+v, %v, want the running and the compensating saga", unfinished, err)
+	}
+}
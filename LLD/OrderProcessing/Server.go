@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRequestBody is far more than any order request needs
+const maxRequestBody = 1 << 20
+
+// Validate checks what the order service can't, before anything is saved
+func (request OrderRequest) Validate() error {
+	if request.UserID <= 0 {
+		return fmt.Errorf("%w: userId must be positive", ErrInvalidRequest)
+	}
+	if len(request.Items) == 0 {
+		return fmt.Errorf("%w: items is empty", ErrInvalidRequest)
+	}
+	for _, item := range request.Items {
+		if strings.TrimSpace(item.SKU) == "" {
+			return fmt.Errorf("%w: items has an empty sku", ErrInvalidRequest)
+		}
+		if item.Qty <= 0 {
+			return fmt.Errorf("%w: qty of %s must be positive", ErrInvalidRequest, item.SKU)
+		}
+	}
+	for _, code := range request.CouponCodes {
+		if strings.TrimSpace(code) == "" {
+			return fmt.Errorf("%w: couponCodes has an empty code", ErrInvalidRequest)
+		}
+	}
+	if len(request.IdempotencyKey) > maxIdempotencyKeyLength {
+		return fmt.Errorf("%w: idempotencyKey is longer than %d bytes", ErrInvalidRequest, maxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+type statusUpdate struct {
+	Status OrderStatus `json:"status"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	// Order is set when a create failed after the order was saved, it is then Cancelled
+	Order *Order `json:"order,omitempty"`
+}
+
+// OrderHandler serves IOrderService as JSON over HTTP:
+//
+//	POST  /orders               create, 201 with the order. An Idempotency-Key header, or the
+//	                            idempotencyKey field, makes retries return the first order.
+//	GET   /orders/{id}          fetch
+//	PATCH /orders/{id}/status   {"status": "Shipped"}
+//	POST  /orders/{id}/cancel   cancel, 200 with the cancelled order
+//
+// Single orders come with their version as ETag. An If-Match with it makes the status change
+// and cancel conditional, they answer 412 once the order has moved on.
+//
+//	GET   /orders               query, oldest first, filtered by userId, status, createdFrom,
+//	                            createdUntil, updatedFrom and updatedUntil, with sort=updatedAt,
+//	                            order=desc and limit. When there are more, the Next-Cursor header
+//	                            holds the cursor parameter for the next page.
+type OrderHandler struct {
+	service IOrderService
+	mux     *http.ServeMux
+}
+
+func NewOrderHandler(service IOrderService) *OrderHandler {
+	handler := &OrderHandler{
+		service: service,
+		mux:     http.NewServeMux(),
+	}
+	handler.mux.HandleFunc("POST /orders", handler.createOrder)
+	handler.mux.HandleFunc("GET /orders", handler.listOrders)
+	handler.mux.HandleFunc("GET /orders/{id}", handler.getOrder)
+	handler.mux.HandleFunc("PATCH /orders/{id}/status", handler.updateStatus)
+	handler.mux.HandleFunc("POST /orders/{id}/cancel", handler.cancelOrder)
+	return handler
+}
+
+func (h *OrderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *OrderHandler) createOrder(w http.ResponseWriter, r *http.Request) {
+	var request OrderRequest
+	if err := decodeJSON(w, r, &request); err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if request.IdempotencyKey != "" && request.IdempotencyKey != key {
+			writeError(w, fmt.Errorf("%w: the Idempotency-Key header and idempotencyKey differ", ErrInvalidRequest), nil)
+			return
+		}
+		request.IdempotencyKey = key
+	}
+	if err := request.Validate(); err != nil {
+		writeError(w, err, nil)
+		return
+	}
+
+	order, err := h.service.CreateOrder(r.Context(), request)
+	if err != nil {
+		if order.OrderID != "" {
+			writeError(w, err, &order)
+		} else {
+			writeError(w, err, nil)
+		}
+		return
+	}
+	w.Header().Set("Location", "/orders/"+order.OrderID)
+	writeOrder(w, http.StatusCreated, order)
+}
+
+func (h *OrderHandler) getOrder(w http.ResponseWriter, r *http.Request) {
+	order, err := h.service.GetOrder(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	writeOrder(w, http.StatusOK, order)
+}
+
+func (h *OrderHandler) listOrders(w http.ResponseWriter, r *http.Request) {
+	filter, limit, err := parseOrderQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	page, err := h.service.QueryOrders(r.Context(), filter, r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	if page.NextCursor != "" {
+		w.Header().Set("Next-Cursor", page.NextCursor)
+	}
+	if page.Orders == nil {
+		page.Orders = []Order{}
+	}
+	writeJSON(w, http.StatusOK, page.Orders)
+}
+
+// parseOrderQuery reads the filter of GET /orders, times are RFC 3339 and status is a comma separated list
+func parseOrderQuery(query url.Values) (OrderFilter, int, error) {
+	var filter OrderFilter
+	if value := query.Get("userId"); value != "" {
+		userID, err := strconv.Atoi(value)
+		if err != nil || userID <= 0 {
+			return filter, 0, fmt.Errorf("%w: userId must be a positive number", ErrInvalidRequest)
+		}
+		filter.UserID = userID
+	}
+	if value := query.Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			filter.Statuses = append(filter.Statuses, OrderStatus(strings.TrimSpace(status)))
+		}
+	}
+	for name, at := range map[string]*time.Time{
+		"createdFrom":  &filter.CreatedFrom,
+		"createdUntil": &filter.CreatedUntil,
+		"updatedFrom":  &filter.UpdatedFrom,
+		"updatedUntil": &filter.UpdatedUntil,
+	} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return filter, 0, fmt.Errorf("%w: %s must be an RFC 3339 time", ErrInvalidRequest, name)
+			}
+			*at = parsed
+		}
+	}
+	filter.SortBy = OrderSortField(query.Get("sort"))
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, 0, fmt.Errorf("%w: order must be asc or desc", ErrInvalidRequest)
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return filter, 0, fmt.Errorf("%w: limit must be a positive number", ErrInvalidRequest)
+		}
+	}
+	return filter, limit, nil
+}
+
+func (h *OrderHandler) updateStatus(w http.ResponseWriter, r *http.Request) {
+	var update statusUpdate
+	if err := decodeJSON(w, r, &update); err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	if !update.Status.Valid() {
+		writeError(w, fmt.Errorf("%w: %q", ErrUnknownStatus, update.Status), nil)
+		return
+	}
+	ctx, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+
+	order, err := h.service.UpdateOrder(ctx, r.PathValue("id"), update.Status)
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	writeOrder(w, http.StatusOK, order)
+}
+
+func (h *OrderHandler) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("id")
+	ctx, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	if err := h.service.CancelOrder(ctx, orderID); err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	order, err := h.service.GetOrder(r.Context(), orderID)
+	if err != nil {
+		writeError(w, err, nil)
+		return
+	}
+	writeOrder(w, http.StatusOK, order)
+}
+
+// ifMatch returns the request's context, expecting the order version of its If-Match header if it has one
+func ifMatch(r *http.Request) (context.Context, error) {
+	value := r.Header.Get("If-Match")
+	if value == "" {
+		return r.Context(), nil
+	}
+	version, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil {
+		return nil, fmt.Errorf("%w: If-Match must be the ETag of the order", ErrInvalidRequest)
+	}
+	return WithExpectedVersion(r.Context(), version), nil
+}
+
+// decodeJSON reads exactly one JSON value with no unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: more than one JSON value", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// statusCode maps the service errors to HTTP
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrUnknownStatus):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrStaleVersion):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrOutOfStock), errors.Is(err, ErrVersionConflict),
+		errors.Is(err, ErrRequestInProgress), errors.Is(err, ErrPaymentState):
+		return http.StatusConflict
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrPaymentDeclined):
+		return http.StatusPaymentRequired
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPaymentTimeout):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, err error, order *Order) {
+	writeJSON(w, statusCode(err), errorResponse{Error: err.Error(), Order: order})
+}
+
+// writeOrder writes order with its version as ETag
+func writeOrder(w http.ResponseWriter, code int, order Order) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(order.Version)))
+	writeJSON(w, code, order)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves a service wired like main's: the demo catalog, stock and payment limit
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	factory := &ServiceFactory{}
+	service := factory.CreateOrderService(t.Context())
+	server := httptest.NewServer(NewOrderHandler(service))
+	t.Cleanup(func() {
+		server.Close()
+		factory.Close(t.Context())
+	})
+	return server
+}
+
+// send makes a request, headers are name, value pairs
+func send(t *testing.T, server *httptest.Server, method, path, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(data)
+}
+
+// decode parses a response body into v
+func decode(t *testing.T, body string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+}
+
+// etag is the ETag of an order at version
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// createOrder creates an order that gets paid and returns it
+func createOrder(t *testing.T, server *httptest.Server, body string) Order {
+	t.Helper()
+	response, data := send(t, server, "POST", "/orders", body)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /orders: %d %s", response.StatusCode, data)
+	}
+	var order Order
+	decode(t, data, &order)
+	return order
+}
+
+func TestCreateOrder(t *testing.T) {
+	server := newTestServer(t)
+
+	response, data := send(t, server, "POST", "/orders", `{"userId": 7, "items": [{"sku": "item1", "qty": 1}, {"sku": "item3", "qty": 1}], "couponCodes": ["SAVE10"]}`)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d, want 201: %s", response.StatusCode, data)
+	}
+	var order Order
+	decode(t, data, &order)
+	if got, want := response.Header.Get("Location"), "/orders/"+order.OrderID; got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+	if got, want := response.Header.Get("ETag"), etag(order.Version); got != want {
+		t.Errorf("ETag %s, want %s", got, want)
+	}
+	if order.UserID != 7 || order.OrderStatus != StatusPaid || len(order.Items) != 2 {
+		t.Errorf("got %+v, want a paid order of user 7 with 2 items", order)
+	}
+	// 148.99, 10% off each line and 8.25% tax on what is left
+	if order.Subtotal != 148_99 || order.Discount != 14_90 || order.Tax != 11_06 || order.TotalPrice != 145_15 {
+		t.Errorf("priced %s - %s + %s = %s, want 148.99 - 14.90 + 11.06 = 145.15", order.Subtotal, order.Discount, order.Tax, order.TotalPrice)
+	}
+}
+
+func TestCreateOrderErrors(t *testing.T) {
+	server := newTestServer(t)
+
+	cases := []struct {
+		name    string
+		body    string
+		headers []string
+		code    int
+		error   string
+		// cancelled is set for the failures that happen after the order was saved
+		cancelled bool
+	}{
+		{name: "malformed JSON", body: `{"userId": 7,`, code: http.StatusBadRequest, error: "invalid request"},
+		{name: "unknown field", body: `{"userId": 7, "items": [{"sku": "item1", "qty": 1}], "price": 1}`, code: http.StatusBadRequest, error: `unknown field "price"`},
+		{name: "no user", body: `{"items": [{"sku": "item1", "qty": 1}]}`, code: http.StatusBadRequest, error: "userId must be positive"},
+		{name: "no items", body: `{"userId": 7, "items": []}`, code: http.StatusBadRequest, error: "items is empty"},
+		{name: "zero quantity", body: `{"userId": 7, "items": [{"sku": "item1", "qty": 0}]}`, code: http.StatusBadRequest, error: "qty of item1 must be positive"},
+		{name: "unknown product", body: `{"userId": 7, "items": [{"sku": "item9", "qty": 1}]}`, code: http.StatusBadRequest, error: `unknown product "item9"`},
+		{name: "unknown coupon", body: `{"userId": 7, "items": [{"sku": "item1", "qty": 1}], "couponCodes": ["FREE"]}`, code: http.StatusBadRequest, error: `unknown coupon "FREE"`},
+		{
+			name:    "idempotency keys differ",
+			body:    `{"userId": 7, "items": [{"sku": "item1", "qty": 1}], "idempotencyKey": "a"}`,
+			headers: []string{"Idempotency-Key", "b"},
+			code:    http.StatusBadRequest,
+			error:   "the Idempotency-Key header and idempotencyKey differ",
+		},
+		{name: "out of stock", body: `{"userId": 7, "items": [{"sku": "item4", "qty": 1}]}`, code: http.StatusConflict, error: "out of stock: item4", cancelled: true},
+		{name: "payment declined", body: `{"userId": 7, "items": [{"sku": "item3", "qty": 4}]}`, code: http.StatusPaymentRequired, error: "declined", cancelled: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response, data := send(t, server, "POST", "/orders", c.body, c.headers...)
+			if response.StatusCode != c.code {
+				t.Fatalf("status %d, want %d: %s", response.StatusCode, c.code, data)
+			}
+			var body errorResponse
+			decode(t, data, &body)
+			if !strings.Contains(body.Error, c.error) {
+				t.Errorf("error %q, want it to contain %q", body.Error, c.error)
+			}
+			if c.cancelled != (body.Order != nil) {
+				t.Fatalf("order %+v, want one only for a failure after saving", body.Order)
+			}
+			if c.cancelled && body.Order.OrderStatus != StatusCancelled {
+				t.Errorf("order is %s, want Cancelled", body.Order.OrderStatus)
+			}
+		})
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	server := newTestServer(t)
+	created := createOrder(t, server, `{"userId": 7, "items": [{"sku": "item1", "qty": 2}]}`)
+
+	response, data := send(t, server, "GET", "/orders/"+created.OrderID, "")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", response.StatusCode, data)
+	}
+	var order Order
+	decode(t, data, &order)
+	if order.OrderID != created.OrderID || order.Version != created.Version || order.TotalPrice != created.TotalPrice {
+		t.Errorf("got %+v, want %+v", order, created)
+	}
+
+	response, data = send(t, server, "GET", "/orders/missing", "")
+	if response.StatusCode != http.StatusNotFound || !strings.Contains(data, "order not found") {
+		t.Errorf("missing order: %d %s, want 404 order not found", response.StatusCode, data)
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	server := newTestServer(t)
+	order := createOrder(t, server, `{"userId": 7, "items": [{"sku": "item1", "qty": 1}]}`)
+	path := "/orders/" + order.OrderID + "/status"
+	stale, current := etag(order.Version-1), etag(order.Version)
+
+	cases := []struct {
+		name    string
+		path    string
+		body    string
+		headers []string
+		code    int
+		error   string
+		status  OrderStatus
+	}{
+		{name: "unknown status", path: path, body: `{"status": "Lost"}`, code: http.StatusBadRequest, error: `unknown order status: "Lost"`},
+		{name: "malformed If-Match", path: path, body: `{"status": "Fulfilling"}`, headers: []string{"If-Match", "latest"}, code: http.StatusBadRequest, error: "If-Match"},
+		{name: "illegal transition", path: path, body: `{"status": "Delivered"}`, code: http.StatusConflict, error: "can't go from Paid to Delivered"},
+		{name: "missing order", path: "/orders/missing/status", body: `{"status": "Fulfilling"}`, code: http.StatusNotFound, error: "order not found"},
+		{name: "stale If-Match", path: path, body: `{"status": "Fulfilling"}`, headers: []string{"If-Match", stale}, code: http.StatusPreconditionFailed, error: "not at the expected version"},
+		{name: "matching If-Match", path: path, body: `{"status": "Fulfilling"}`, headers: []string{"If-Match", current}, code: http.StatusOK, status: StatusFulfilling},
+		{name: "without If-Match", path: path, body: `{"status": "Shipped"}`, code: http.StatusOK, status: StatusShipped},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response, data := send(t, server, "PATCH", c.path, c.body, c.headers...)
+			if response.StatusCode != c.code {
+				t.Fatalf("status %d, want %d: %s", response.StatusCode, c.code, data)
+			}
+			if c.code != http.StatusOK {
+				var body errorResponse
+				decode(t, data, &body)
+				if !strings.Contains(body.Error, c.error) {
+					t.Errorf("error %q, want it to contain %q", body.Error, c.error)
+				}
+				return
+			}
+			var updated Order
+			decode(t, data, &updated)
+			if updated.OrderStatus != c.status {
+				t.Errorf("order is %s, want %s", updated.OrderStatus, c.status)
+			}
+			if got, want := response.Header.Get("ETag"), etag(updated.Version); got != want {
+				t.Errorf("ETag %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	server := newTestServer(t)
+	order := createOrder(t, server, `{"userId": 7, "items": [{"sku": "item1", "qty": 1}]}`)
+	path := "/orders/" + order.OrderID + "/cancel"
+
+	response, data := send(t, server, "POST", path, "", "If-Match", etag(order.Version-1))
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("stale cancel: %d %s, want 412", response.StatusCode, data)
+	}
+	response, data = send(t, server, "POST", path, "", "If-Match", etag(order.Version))
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: %d %s, want 200", response.StatusCode, data)
+	}
+	var cancelled Order
+	decode(t, data, &cancelled)
+	if cancelled.OrderStatus != StatusCancelled || cancelled.Version != order.Version+1 {
+		t.Errorf("got %s at version %d, want Cancelled at %d", cancelled.OrderStatus, cancelled.Version, order.Version+1)
+	}
+
+	// a repeated cancel writes nothing, it only settles what the first left
+	response, data = send(t, server, "POST", path, "")
+	var again Order
+	decode(t, data, &again)
+	if response.StatusCode != http.StatusOK || again.OrderStatus != StatusCancelled || again.Version != cancelled.Version {
+		t.Errorf("second cancel: %d %s, want 200 at version %d", response.StatusCode, data, cancelled.Version)
+	}
+	response, data = send(t, server, "POST", "/orders/missing/cancel", "")
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing order: %d %s, want 404", response.StatusCode, data)
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	server := newTestServer(t)
+	first := createOrder(t, server, `{"userId": 7, "items": [{"sku": "item1", "qty": 1}]}`)
+	second := createOrder(t, server, `{"userId": 7, "items": [{"sku": "item2", "qty": 3}]}`)
+	createOrder(t, server, `{"userId": 8, "items": [{"sku": "item2", "qty": 1}]}`)
+	send(t, server, "POST", "/orders/"+first.OrderID+"/cancel", "")
+
+	response, data := send(t, server, "GET", "/orders?userId=7&status=Paid,Cancelled&sort=updatedAt&order=desc&limit=1", "")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", response.StatusCode, data)
+	}
+	var page []Order
+	decode(t, data, &page)
+	cursor := response.Header.Get("Next-Cursor")
+	if len(page) != 1 || page[0].OrderID != first.OrderID || cursor == "" {
+		t.Fatalf("first page %+v, cursor %q, want the cancelled order and a cursor", page, cursor)
+	}
+
+	response, data = send(t, server, "GET", "/orders?userId=7&status=Paid,Cancelled&sort=updatedAt&order=desc&limit=1&cursor="+cursor, "")
+	decode(t, data, &page)
+	if response.StatusCode != http.StatusOK || len(page) != 1 || page[0].OrderID != second.OrderID || response.Header.Get("Next-Cursor") != "" {
+		t.Fatalf("second page: %d %s, want the paid order and no cursor", response.StatusCode, data)
+	}
+
+	response, data = send(t, server, "GET", "/orders?userId=9", "")
+	if response.StatusCode != http.StatusOK || strings.TrimSpace(data) != "[]" {
+		t.Errorf("user without orders: %d %s, want 200 []", response.StatusCode, data)
+	}
+
+	for _, query := range []string{
+		"userId=seven",
+		"limit=0",
+		"order=sideways",
+		"createdFrom=yesterday",
+		"status=Lost",
+		// A cursor only continues the query it came from
+		"userId=7&limit=1&cursor=" + cursor,
+	} {
+		response, data := send(t, server, "GET", "/orders?"+query, "")
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /orders?%s: %d %s, want 400", query, response.StatusCode, data)
+		}
+	}
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	server := newTestServer(t)
+	body := `{"userId": 8, "items": [{"sku": "item2", "qty": 1}]}`
+
+	response, data := send(t, server, "POST", "/orders", body, "Idempotency-Key", "cart-8")
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("first request: %d %s, want 201", response.StatusCode, data)
+	}
+	var first Order
+	decode(t, data, &first)
+
+	response, data = send(t, server, "POST", "/orders", body, "Idempotency-Key", "cart-8")
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("retry: %d %s, want 201", response.StatusCode, data)
+	}
+	var retried Order
+	decode(t, data, &retried)
+	if retried.OrderID != first.OrderID {
+		t.Errorf("retry created order %s, want %s again", retried.OrderID, first.OrderID)
+	}
+
+	response, data = send(t, server, "POST", "/orders", `{"userId": 8, "items": [{"sku": "item2", "qty": 2}]}`, "Idempotency-Key", "cart-8")
+	if response.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(data, "idempotency key was already used") {
+		t.Errorf("other payload under the key: %d %s, want 422", response.StatusCode, data)
+	}
+
+	// The same cart with its items in another order is a retry
+	cart := `{"userId": 8, "items": [{"sku": "item1", "qty": 1}, {"sku": "item2", "qty": 2}]}`
+	reordered := `{"userId": 8, "items": [{"sku": "item2", "qty": 2}, {"sku": "item1", "qty": 1}]}`
+	response, data = send(t, server, "POST", "/orders", cart, "Idempotency-Key", "cart-8b")
+	decode(t, data, &first)
+	response, data = send(t, server, "POST", "/orders", reordered, "Idempotency-Key", "cart-8b")
+	decode(t, data, &retried)
+	if response.StatusCode != http.StatusCreated || retried.OrderID != first.OrderID {
+		t.Errorf("reordered items: %d %s, want 201 with order %s", response.StatusCode, data, first.OrderID)
+	}
+
+	response, data = send(t, server, "GET", "/orders?userId=8", "")
+	var orders []Order
+	decode(t, data, &orders)
+	if len(orders) != 2 {
+		t.Errorf("user 8 has %d orders, want 2", len(orders))
+	}
+}
+
+func TestIdempotencyReplayOfFailedOrder(t *testing.T) {
+	server := newTestServer(t)
+	body := `{"userId": 9, "items": [{"sku": "item4", "qty": 1}]}`
+
+	response, data := send(t, server, "POST", "/orders", body, "Idempotency-Key", "cart-9")
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("first request: %d %s, want 409", response.StatusCode, data)
+	}
+	var first errorResponse
+	decode(t, data, &first)
+
+	// A retry gets the same outcome, not a 201 with the cancelled order
+	response, data = send(t, server, "POST", "/orders", body, "Idempotency-Key", "cart-9")
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("retry: %d %s, want 409", response.StatusCode, data)
+	}
+	var retried errorResponse
+	decode(t, data, &retried)
+	if retried.Error != first.Error {
+		t.Errorf("retry error %q, want %q", retried.Error, first.Error)
+	}
+	if retried.Order == nil || retried.Order.OrderID != first.Order.OrderID || retried.Order.OrderStatus != StatusCancelled {
+		t.Errorf("retry order %+v, want the cancelled order %s", retried.Order, first.Order.OrderID)
+	}
+}
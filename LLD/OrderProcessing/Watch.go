@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// watchBuffer is how many updates a slow watcher may fall behind before older ones are dropped
+const watchBuffer = 16
+
+// OrderBroadcaster fans status changes out to the watchers of an order. A watcher that doesn't
+// keep up loses the oldest updates, never the newest, and its channel is closed once the order
+// reaches a terminal status.
+type OrderBroadcaster struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan Order]struct{}
+}
+
+func NewOrderBroadcaster() *OrderBroadcaster {
+	return &OrderBroadcaster{
+		watchers: make(map[string]map[chan Order]struct{}),
+	}
+}
+
+// Subscribe starts watching orderID, call cancel when done
+func (b *OrderBroadcaster) Subscribe(orderID string) (updates <-chan Order, cancel func()) {
+	ch := make(chan Order, watchBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watchers[orderID] == nil {
+		b.watchers[orderID] = make(map[chan Order]struct{})
+	}
+	b.watchers[orderID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, exists := b.watchers[orderID][ch]; exists {
+			b.remove(orderID, ch)
+		}
+	}
+}
+
+// remove closes ch, callers hold mu
+func (b *OrderBroadcaster) remove(orderID string, ch chan Order) {
+	delete(b.watchers[orderID], ch)
+	if len(b.watchers[orderID]) == 0 {
+		delete(b.watchers, orderID)
+	}
+	close(ch)
+}
+
+// Publish sends order to its watchers
+func (b *OrderBroadcaster) Publish(order Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.watchers[order.OrderID] {
+		for sent := false; !sent; {
+			select {
+			case ch <- order:
+				sent = true
+			default:
+				// Full, make room by dropping the oldest update
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+		if order.OrderStatus.Terminal() {
+			b.remove(order.OrderID, ch)
+		}
+	}
+}
+
+// broadcastingRepository publishes every status change that goes through the repository,
+// whether the service or the saga made it
+type broadcastingRepository struct {
+	IOrderRepository
+	broadcaster *OrderBroadcaster
+}
+
+func (repo *broadcastingRepository) Update(ctx context.Context, order *Order, events ...OrderEvent) error {
+	previous, err := repo.IOrderRepository.FindByID(ctx, order.OrderID)
+	if err != nil {
+		return err
+	}
+	if err := repo.IOrderRepository.Update(ctx, order, events...); err != nil {
+		return err
+	}
+	if previous.OrderStatus != order.OrderStatus {
+		repo.broadcaster.Publish(*order)
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// repositoryContract is the behaviour every IOrderRepository must have, each check gets a fresh,
+// empty repository
+var repositoryContract = []struct {
+	name  string
+	check func(ctx context.Context, repo IOrderRepository) error
+}{
+	{"save and find", contractSaveAndFind},
+	{"duplicate save", contractDuplicateSave},
+	{"missing order", contractMissing},
+	{"update bumps version", contractUpdate},
+	{"stale update conflicts", contractStaleUpdate},
+	{"concurrent updates, one wins", contractConcurrentUpdates},
+	{"find by user", contractFindByUser},
+	{"list pages in order", contractListPages},
+	{"list filters", contractListFilters},
+	{"list rejects foreign cursors", contractListCursor},
+	{"events are written with the order", contractEvents},
+	{"failed events hold only their order", contractFailedEvents},
+	{"delete and count", contractDeleteAndCount},
+	{"returned orders are copies", contractCopies},
+}
+
+func TestRepositoryContract(t *testing.T) {
+	repositories := []struct {
+		name    string
+		newRepo func(t *testing.T) IOrderRepository
+	}{
+		{"in-memory", func(t *testing.T) IOrderRepository { return NewOrderRepository() }},
+		// Snapshots every 2 events, so the contract loads from them too
+		{"event-sourced", func(t *testing.T) IOrderRepository {
+			return NewEventSourcedOrderRepository(NewInMemoryEventStore(), NewInMemorySnapshotStore(), 2)
+		}},
+		{"sqlite", newSQLiteRepository},
+	}
+	for _, r := range repositories {
+		t.Run(r.name, func(t *testing.T) {
+			for _, c := range repositoryContract {
+				t.Run(c.name, func(t *testing.T) {
+					if err := c.check(t.Context(), r.newRepo(t)); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// newSQLiteRepository migrates a new database file in the test's temporary directory
+func newSQLiteRepository(t *testing.T) IOrderRepository {
+	dsn := "file:" + filepath.Join(t.TempDir(), "orders.db") + "?_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	repo, err := NewSQLOrderRepository(t.Context(), db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// contractTime has nanoseconds, so a store that truncates them fails
+var contractTime = time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC)
+
+func contractOrder(orderID string, userID int, created time.Time) Order {
+	return Order{
+		OrderID: orderID,
+		UserID:  userID,
+		Items: []LineItem{
+			{SKU: "item1", Qty: 2, UnitPrice: 19_99},
+			{SKU: "item2", Qty: 1, UnitPrice: 5_49},
+			{SKU: "item1", Qty: 1, UnitPrice: 19_99},
+		},
+		OrderStatus: StatusCreated,
+		Subtotal:    65_46,
+		Discount:    6_55,
+		Tax:         4_86,
+		TotalPrice:  63_77,
+		CreatedAt:   created,
+		UpdatedAt:   created,
+	}
+}
+
+// sameOrder compares everything but the monotonic clock and location of the timestamps
+func sameOrder(got, want Order) error {
+	if !got.CreatedAt.Equal(want.CreatedAt) || !got.UpdatedAt.Equal(want.UpdatedAt) {
+		return fmt.Errorf("timestamps %v/%v, want %v/%v", got.CreatedAt, got.UpdatedAt, want.CreatedAt, want.UpdatedAt)
+	}
+	got.CreatedAt, got.UpdatedAt = want.CreatedAt, want.UpdatedAt
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("got %+v, want %+v", got, want)
+	}
+	return nil
+}
+
+func contractSaveAndFind(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+	if order.Version != 1 {
+		return fmt.Errorf("saved at version %d, want 1", order.Version)
+	}
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	return sameOrder(found, order)
+}
+
+func contractDuplicateSave(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+	again := contractOrder("order-1", 2, contractTime)
+	if err := repo.Save(ctx, &again); !errors.Is(err, ErrDuplicateOrder) {
+		return fmt.Errorf("second save returned %v, want ErrDuplicateOrder", err)
+	}
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	return sameOrder(found, order)
+}
+
+func contractMissing(ctx context.Context, repo IOrderRepository) error {
+	if _, err := repo.FindByID(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("FindByID returned %v, want ErrNotFound", err)
+	}
+	order := contractOrder("missing", 1, contractTime)
+	order.Version = 1
+	if err := repo.Update(ctx, &order); !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("Update returned %v, want ErrNotFound", err)
+	}
+	if err := repo.Delete(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("Delete returned %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func contractUpdate(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+	order.OrderStatus = StatusPaymentPending
+	order.Items = []LineItem{{SKU: "item3", Qty: 1, UnitPrice: 129_00}}
+	order.UpdatedAt = contractTime.Add(time.Minute)
+	if err := repo.Update(ctx, &order); err != nil {
+		return err
+	}
+	if order.Version != 2 {
+		return fmt.Errorf("updated to version %d, want 2", order.Version)
+	}
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	return sameOrder(found, order)
+}
+
+func contractStaleUpdate(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+	stale := order
+	order.OrderStatus = StatusPaymentPending
+	if err := repo.Update(ctx, &order); err != nil {
+		return err
+	}
+
+	stale.OrderStatus = StatusCancelled
+	err := repo.Update(ctx, &stale)
+	if !errors.Is(err, ErrVersionConflict) {
+		return fmt.Errorf("stale update returned %v, want ErrVersionConflict", err)
+	}
+	if stale.Version != 1 {
+		return fmt.Errorf("a failed update changed the version to %d", stale.Version)
+	}
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	return sameOrder(found, order)
+}
+
+func contractConcurrentUpdates(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mine := order
+			mine.TotalPrice = Money(i)
+			errs[i] = repo.Update(ctx, &mine)
+		}()
+	}
+	wg.Wait()
+
+	won := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrVersionConflict):
+			return err
+		}
+	}
+	if won != 1 {
+		return fmt.Errorf("%d of %d updates from the same version succeeded, want 1", won, writers)
+	}
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	if found.Version != 2 {
+		return fmt.Errorf("version %d after one successful update, want 2", found.Version)
+	}
+	return nil
+}
+
+func contractFindByUser(ctx context.Context, repo IOrderRepository) error {
+	orders := []Order{
+		contractOrder("b", 1, contractTime.Add(time.Second)),
+		contractOrder("a", 1, contractTime.Add(time.Second)),
+		contractOrder("c", 1, contractTime),
+		contractOrder("d", 2, contractTime),
+	}
+	orders[2].Items = []LineItem{{SKU: "item9", Qty: 3, UnitPrice: 1}}
+	for i := range orders {
+		if err := repo.Save(ctx, &orders[i]); err != nil {
+			return err
+		}
+	}
+
+	found, err := repo.FindByUser(ctx, 1)
+	if err != nil {
+		return err
+	}
+	// Oldest first, ties by order ID
+	want := []Order{orders[2], orders[1], orders[0]}
+	if len(found) != len(want) {
+		return fmt.Errorf("found %d orders, want %d", len(found), len(want))
+	}
+	for i := range want {
+		if err := sameOrder(found[i], want[i]); err != nil {
+			return fmt.Errorf("order %d: %w", i, err)
+		}
+	}
+
+	none, err := repo.FindByUser(ctx, 3)
+	if err != nil {
+		return err
+	}
+	if len(none) != 0 {
+		return fmt.Errorf("found %d orders for a user without any", len(none))
+	}
+	return nil
+}
+
+func pendingIDs(ctx context.Context, repo IOrderRepository, limit int) ([]string, error) {
+	events, err := repo.PendingEvents(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.EventID)
+	}
+	return ids, nil
+}
+
+func contractEvents(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order, newOrderEvent(OrderCreated, order, 1, "")); err != nil {
+		return err
+	}
+	stale := order
+	order.OrderStatus = StatusPaymentPending
+	order.UpdatedAt = contractTime.Add(time.Second)
+	if err := repo.Update(ctx, &order, newOrderEvent(OrderStatusChanged, order, 2, StatusCreated)); err != nil {
+		return err
+	}
+	// Neither a failed update nor a duplicate save may leave an event behind
+	stale.OrderStatus = StatusCancelled
+	if err := repo.Update(ctx, &stale, newOrderEvent(OrderCancelled, stale, 2, StatusCreated)); !errors.Is(err, ErrVersionConflict) {
+		return fmt.Errorf("stale update returned %v, want ErrVersionConflict", err)
+	}
+	again := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &again, newOrderEvent(OrderCreated, again, 1, "")); !errors.Is(err, ErrDuplicateOrder) {
+		return fmt.Errorf("duplicate save returned %v, want ErrDuplicateOrder", err)
+	}
+
+	events, err := repo.PendingEvents(ctx, 10)
+	if err != nil {
+		return err
+	}
+	if len(events) != 2 {
+		return fmt.Errorf("%d pending events, want 2", len(events))
+	}
+	changed := events[1]
+	if changed.EventID != "order-1/2" || changed.Type != OrderStatusChanged || changed.From != StatusCreated ||
+		!changed.OccurredAt.Equal(order.UpdatedAt) {
+		return fmt.Errorf("second event %+v", changed)
+	}
+	if err := sameOrder(changed.Order, order); err != nil {
+		return fmt.Errorf("order of the event: %w", err)
+	}
+
+	if ids, err := pendingIDs(ctx, repo, 1); err != nil || !reflect.DeepEqual(ids, []string{"order-1/1"}) {
+		return fmt.Errorf("first pending event %v, %v", ids, err)
+	}
+	if err := repo.MarkPublished(ctx, "order-1/1"); err != nil {
+		return err
+	}
+	if ids, err := pendingIDs(ctx, repo, 10); err != nil || !reflect.DeepEqual(ids, []string{"order-1/2"}) {
+		return fmt.Errorf("pending after publishing the first %v, %v", ids, err)
+	}
+	if err := repo.MarkPublished(ctx, "order-1/2", "order-1/1"); err != nil {
+		return err
+	}
+	if ids, err := pendingIDs(ctx, repo, 10); err != nil || len(ids) != 0 {
+		return fmt.Errorf("pending after publishing all %v, %v", ids, err)
+	}
+	return nil
+}
+
+func contractFailedEvents(ctx context.Context, repo IOrderRepository) error {
+	first := contractOrder("order-1", 1, contractTime)
+	second := contractOrder("order-2", 1, contractTime.Add(time.Second))
+	for _, order := range []*Order{&first, &second} {
+		if err := repo.Save(ctx, order, newOrderEvent(OrderCreated, *order, 1, "")); err != nil {
+			return err
+		}
+	}
+	first.OrderStatus = StatusPaymentPending
+	first.UpdatedAt = contractTime.Add(2 * time.Second)
+	if err := repo.Update(ctx, &first, newOrderEvent(OrderStatusChanged, first, 2, StatusCreated)); err != nil {
+		return err
+	}
+
+	if err := repo.MarkFailed(ctx, "order-1/1", time.Now().Add(time.Hour), false); err != nil {
+		return err
+	}
+	if ids, err := pendingIDs(ctx, repo, 10); err != nil || !reflect.DeepEqual(ids, []string{"order-2/1"}) {
+		return fmt.Errorf("pending while order-1/1 waits %v, %v, want only order-2/1", ids, err)
+	}
+	if err := repo.MarkFailed(ctx, "order-1/1", time.Now().Add(-time.Second), false); err != nil {
+		return err
+	}
+	events, err := repo.PendingEvents(ctx, 10)
+	if err != nil {
+		return err
+	}
+	if len(events) != 3 || events[0].EventID != "order-1/1" || events[0].Attempts != 2 || events[2].EventID != "order-1/2" {
+		return fmt.Errorf("pending once order-1/1 is due %+v, want it first with 2 attempts", events)
+	}
+
+	if err := repo.MarkFailed(ctx, "order-1/1", time.Now(), true); err != nil {
+		return err
+	}
+	if ids, err := pendingIDs(ctx, repo, 10); err != nil || !reflect.DeepEqual(ids, []string{"order-2/1"}) {
+		return fmt.Errorf("pending while order-1/1 is parked %v, %v, want only order-2/1", ids, err)
+	}
+	parked, err := repo.ParkedEvents(ctx)
+	if err != nil || len(parked) != 1 || parked[0].EventID != "order-1/1" || parked[0].Attempts != 3 {
+		return fmt.Errorf("parked %+v, %v, want order-1/1 with 3 attempts", parked, err)
+	}
+
+	if err := repo.Unpark(ctx, "order-1/1"); err != nil {
+		return err
+	}
+	if ids, err := pendingIDs(ctx, repo, 10); err != nil || !reflect.DeepEqual(ids, []string{"order-1/1", "order-2/1", "order-1/2"}) {
+		return fmt.Errorf("pending after unparking %v, %v", ids, err)
+	}
+	if parked, err := repo.ParkedEvents(ctx); err != nil || len(parked) != 0 {
+		return fmt.Errorf("parked after unparking %v, %v", parked, err)
+	}
+	return nil
+}
+
+func contractDeleteAndCount(ctx context.Context, repo IOrderRepository) error {
+	for _, orderID := range []string{"order-1", "order-2"} {
+		order := contractOrder(orderID, 1, contractTime)
+		if err := repo.Save(ctx, &order); err != nil {
+			return err
+		}
+	}
+	if count, err := repo.Count(ctx); err != nil || count != 2 {
+		return fmt.Errorf("count %d, %v, want 2", count, err)
+	}
+	if err := repo.Delete(ctx, "order-1"); err != nil {
+		return err
+	}
+	if _, err := repo.FindByID(ctx, "order-1"); !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("deleted order: %v, want ErrNotFound", err)
+	}
+	if count, err := repo.Count(ctx); err != nil || count != 1 {
+		return fmt.Errorf("count %d, %v, want 1", count, err)
+	}
+	// The ID is free again
+	order := contractOrder("order-1", 1, contractTime)
+	return repo.Save(ctx, &order)
+}
+
+func contractCopies(ctx context.Context, repo IOrderRepository) error {
+	order := contractOrder("order-1", 1, contractTime)
+	if err := repo.Save(ctx, &order); err != nil {
+		return err
+	}
+	order.Items[0].SKU = "changed after save"
+
+	found, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	if found.Items[0].SKU != "item1" {
+		return fmt.Errorf("changing the saved order changed the stored one")
+	}
+	found.Items[0].SKU = "changed after find"
+	again, err := repo.FindByID(ctx, "order-1")
+	if err != nil {
+		return err
+	}
+	if again.Items[0].SKU != "item1" {
+		return fmt.Errorf("changing a found order changed the stored one")
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LimitAlgorithm computes the next concurrency limit after a request completes
+type LimitAlgorithm interface {
+	Update(limit float64, inflight int, latency time.Duration, failed bool) float64
+}
+
+// AIMDLimit grows the limit by Increase per limit's worth of successes and multiplies it by Backoff
+// on a failure, a request slower than Timeout counts as a failure
+type AIMDLimit struct {
+	Increase     float64
+	Backoff      float64
+	Timeout      time.Duration
+	backedOff    bool
+	sinceBackoff int
+}
+
+func NewAIMDLimit(timeout time.Duration) *AIMDLimit {
+	return &AIMDLimit{Increase: 1, Backoff: 0.9, Timeout: timeout}
+}
+
+func (a *AIMDLimit) Update(limit float64, inflight int, latency time.Duration, failed bool) float64 {
+	a.sinceBackoff++
+	if failed || (a.Timeout > 0 && latency > a.Timeout) {
+		// Requests sent before the last backoff complete afterwards, they mustn't back off again
+		if a.backedOff && a.sinceBackoff < int(limit) {
+			return limit
+		}
+		a.backedOff = true
+		a.sinceBackoff = 0
+		return limit * a.Backoff
+	}
+	// Only grow when the limit is actually being used, otherwise idle periods inflate it
+	if float64(inflight) >= limit/2 {
+		return limit + a.Increase/limit
+	}
+	return limit
+}
+
+// GradientLimit is the Vegas style variant: the ratio of the best latency seen to the current
+// latency tells how much of the latency is queueing, and the limit follows that gradient
+type GradientLimit struct {
+	Smoothing float64 // how much of the new estimate is taken per limit's worth of samples, 0..1
+	Backoff   float64
+	minRTT    time.Duration
+}
+
+func NewGradientLimit() *GradientLimit {
+	return &GradientLimit{Smoothing: 0.2, Backoff: 0.9}
+}
+
+func (g *GradientLimit) Update(limit float64, inflight int, latency time.Duration, failed bool) float64 {
+	if failed {
+		return limit * g.Backoff
+	}
+	if latency <= 0 {
+		return limit
+	}
+	if g.minRTT == 0 || latency < g.minRTT {
+		g.minRTT = latency
+	}
+
+	gradient := math.Max(0.5, math.Min(1, float64(g.minRTT)/float64(latency)))
+	// sqrt(limit) leaves some room for queueing so the limit can still probe upwards
+	estimate := limit*gradient + math.Sqrt(limit)
+	weight := g.Smoothing / math.Max(1, limit)
+	return limit*(1-weight) + estimate*weight
+}
+
+var (
+	ErrConcurrencyLimited = errors.New("concurrency limit exceeded")
+	// ErrHandlerFailed is the sample ConcurrencyLimitMiddleware releases a failed request with
+	ErrHandlerFailed = errors.New("handler failed")
+)
+
+// AdaptiveConcurrencyLimiter limits requests in flight and adjusts the limit from observed latency.
+// Every successful Acquire must be paired with a Release. Do and ConcurrencyLimitMiddleware
+// release for you. It isn't a RateLimiter, whose callers never give a slot back.
+type AdaptiveConcurrencyLimiter struct {
+	mu        sync.Mutex
+	algorithm LimitAlgorithm
+	limit     float64
+	minLimit  float64
+	maxLimit  float64
+	inflight  int
+}
+
+// NewAdaptiveConcurrencyLimiter needs minLimit >= 1, with a limit of 0 nothing would be admitted and
+// without releases the limit could never grow back
+func NewAdaptiveConcurrencyLimiter(algorithm LimitAlgorithm, initialLimit, minLimit, maxLimit int) (*AdaptiveConcurrencyLimiter, error) {
+	if minLimit < 1 || initialLimit < minLimit || maxLimit < initialLimit {
+		return nil, fmt.Errorf("%w: limits must satisfy 1 <= min %d <= initial %d <= max %d",
+			ErrInvalidLimit, minLimit, initialLimit, maxLimit)
+	}
+	return &AdaptiveConcurrencyLimiter{
+		algorithm: algorithm,
+		limit:     float64(initialLimit),
+		minLimit:  float64(minLimit),
+		maxLimit:  float64(maxLimit),
+	}, nil
+}
+
+// Acquire takes an in-flight slot if the current limit allows it
+func (al *AdaptiveConcurrencyLimiter) Acquire() bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.inflight >= int(al.limit) {
+		return false
+	}
+	al.inflight++
+	return true
+}
+
+// Release frees the slot and feeds the request's latency and outcome to the algorithm
+func (al *AdaptiveConcurrencyLimiter) Release(latency time.Duration, err error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	inflight := al.inflight
+	if al.inflight > 0 {
+		al.inflight--
+	}
+	limit := al.algorithm.Update(al.limit, inflight, latency, err != nil)
+	al.limit = math.Max(al.minLimit, math.Min(al.maxLimit, limit))
+}
+
+// Do runs fn in a slot and releases it with fn's latency and error
+func (al *AdaptiveConcurrencyLimiter) Do(fn func() error) error {
+	if !al.Acquire() {
+		return ErrConcurrencyLimited
+	}
+	start := time.Now()
+	err := fn()
+	al.Release(time.Since(start), err)
+	return err
+}
+
+// Limit is the current concurrency limit
+func (al *AdaptiveConcurrencyLimiter) Limit() int {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return int(al.limit)
+}
+
+func (al *AdaptiveConcurrencyLimiter) Status() LimitStatus {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	status := LimitStatus{Limit: int(al.limit), Remaining: int(al.limit) - al.inflight, Reset: time.Now()}
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	return status
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// ConcurrencyLimitMiddleware sheds requests over the limit with 503 Service Unavailable. An admitted
+// request releases its slot with its latency when the handler returns, a 5xx counts as a failure.
+func ConcurrencyLimitMiddleware(limiter *AdaptiveConcurrencyLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Acquire() {
+				setRateLimitHeaders(w.Header(), limiter.Status())
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			failed := true
+			// A panicking handler still gives its slot back
+			defer func() {
+				var err error
+				if failed || recorder.status >= http.StatusInternalServerError {
+					err = ErrHandlerFailed
+				}
+				limiter.Release(time.Since(start), err)
+			}()
+			next.ServeHTTP(recorder, r)
+			failed = false
+		})
+	}
+}
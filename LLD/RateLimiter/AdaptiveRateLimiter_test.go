@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// simulate drives the limiter against a downstream that can work on capacity requests at once and
+// queues the rest, so latency grows with load past capacity. Every round the client sends as much
+// as the limiter admits, and the limit after each round is returned.
+func simulate(limiter *AdaptiveConcurrencyLimiter, capacity int, baseLatency time.Duration, rounds int) []int {
+	limits := make([]int, 0, rounds)
+	for round := 0; round < rounds; round++ {
+		admitted := 0
+		for limiter.Acquire() {
+			admitted++
+		}
+
+		latency := baseLatency
+		if admitted > capacity {
+			latency = time.Duration(float64(baseLatency) * float64(admitted) / float64(capacity))
+		}
+		for i := 0; i < admitted; i++ {
+			limiter.Release(latency, nil)
+		}
+		limits = append(limits, limiter.Limit())
+	}
+	return limits
+}
+
+func TestAdaptiveLimitConverges(t *testing.T) {
+	const capacity = 20
+	const baseLatency = 10 * time.Millisecond
+
+	algorithms := []struct {
+		name      string
+		algorithm LimitAlgorithm
+	}{
+		// Requests over 1.5 times the base latency are failures, that is 30 in flight
+		{"AIMD", NewAIMDLimit(baseLatency * 3 / 2)},
+		{"Gradient", NewGradientLimit()},
+	}
+	for _, a := range algorithms {
+		t.Run(a.name, func(t *testing.T) {
+			limiter, err := NewAdaptiveConcurrencyLimiter(a.algorithm, 5, 1, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limits := simulate(limiter, capacity, baseLatency, 200)
+			// After warming up the limit uses the capacity without queueing more than half of it again
+			for round, limit := range limits[100:] {
+				if limit < capacity || limit > capacity*3/2+1 {
+					t.Fatalf("round %d: limit %d, want it between %d and %d: %v", round+100, limit, capacity, capacity*3/2+1, limits)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimitBacksOff(t *testing.T) {
+	limiter, err := NewAdaptiveConcurrencyLimiter(NewAIMDLimit(0), 10, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if !limiter.Acquire() {
+			t.Fatalf("request %d was rejected under the limit", i)
+		}
+	}
+	if limiter.Acquire() {
+		t.Fatal("request over the limit was admitted")
+	}
+	limiter.Release(time.Millisecond, errors.New("downstream failed"))
+	if got := limiter.Limit(); got != 9 {
+		t.Errorf("limit %d after a failure, want 9", got)
+	}
+}
+
+func TestAdaptiveLimitValidation(t *testing.T) {
+	for _, limits := range [][3]int{{1, 0, 10}, {0, 1, 10}, {11, 1, 10}, {5, 6, 10}} {
+		if _, err := NewAdaptiveConcurrencyLimiter(NewAIMDLimit(0), limits[0], limits[1], limits[2]); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("initial %d, min %d, max %d: got %v, want ErrInvalidLimit", limits[0], limits[1], limits[2], err)
+		}
+	}
+}
+
+func TestAdaptiveLimitRecoversFromItsMinimum(t *testing.T) {
+	limiter, err := NewAdaptiveConcurrencyLimiter(NewAIMDLimit(0), 2, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if !limiter.Acquire() {
+			t.Fatalf("request %d rejected, the limit may not drop below 1", i)
+		}
+		limiter.Release(time.Millisecond, ErrHandlerFailed)
+	}
+	if got := limiter.Limit(); got != 1 {
+		t.Fatalf("limit %d after failures, want the minimum 1", got)
+	}
+	for i := 0; i < 5; i++ {
+		if !limiter.Acquire() {
+			t.Fatalf("request %d rejected at the minimum", i)
+		}
+		limiter.Release(time.Millisecond, nil)
+	}
+	if got := limiter.Limit(); got <= 1 {
+		t.Errorf("limit %d after successes, want it to grow back", got)
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	limiter, err := NewAdaptiveConcurrencyLimiter(NewAIMDLimit(0), 1, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	handler := ConcurrencyLimitMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-unblock
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/slow", nil))
+		done <- recorder.Code
+	}()
+	<-entered
+
+	// The only slot is taken, the next request is shed
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("second request: %d %v, want 503 with Retry-After", recorder.Code, recorder.Header())
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("first request: %d, want 200", code)
+	}
+	// The slot came back when the handler returned
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("request after the release: %d, want 200", recorder.Code)
+	}
+	if status := limiter.Status(); status.Remaining != status.Limit {
+		t.Errorf("%d of %d slots free after all requests, want all", status.Remaining, status.Limit)
+	}
+
+	// A 5xx is released as a failure and backs the limit off
+	limiter, err = NewAdaptiveConcurrencyLimiter(NewAIMDLimit(0), 10, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = ConcurrencyLimitMiddleware(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	if got := limiter.Limit(); got != 9 {
+		t.Errorf("limit %d after a 502, want 9", got)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level is one limit of a composite, e.g. {"user", ...}, {"tenant", ...}, {"global", ...}
+type Level struct {
+	Name    string
+	Limiter RateLimiter
+}
+
+// ErrIrreversibleLevels is a composite with more than one level that can't give capacity back
+var ErrIrreversibleLevels = errors.New("more than one level can't give capacity back")
+
+// CompositeRateLimiter allows a request only if every level allows it, and only then consumes from all of them.
+// A level that can't give capacity back is checked last, so nothing after it can reject the request
+// it consumed from. That works for one such level, which is why a composite can have only one.
+//
+// Decisions don't wait for each other, a request a later level rejects holds capacity of the earlier
+// levels until it is given back and a concurrent request can find it taken. Give the most specific
+// level first, e.g. user before global: it rejects most requests, and those never touch the shared
+// levels.
+type CompositeRateLimiter struct {
+	levels []Level
+}
+
+// NewCompositeRateLimiter fails with ErrIrreversibleLevels when more than one level can't give
+// capacity back. A level whose strategy is swapped to such a one later is still checked last.
+func NewCompositeRateLimiter(levels ...Level) (*CompositeRateLimiter, error) {
+	if err := checkIrreversible(levels); err != nil {
+		return nil, err
+	}
+	return &CompositeRateLimiter{
+		levels: levels,
+	}, nil
+}
+
+// reversible reports whether limiter can give back what it consumed, a RateLimiterContext
+// can if the strategy it wraps can
+func reversible(limiter RateLimiter) bool {
+	switch l := limiter.(type) {
+	case *RateLimiterContext:
+		return reversible(l.Strategy())
+	case *CompositeRateLimiter:
+		for _, level := range l.levels {
+			if !reversible(level.Limiter) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := limiter.(ReservableRateLimiter)
+	return ok
+}
+
+func checkIrreversible(levels []Level) error {
+	var irreversible []string
+	for _, level := range levels {
+		if !reversible(level.Limiter) {
+			irreversible = append(irreversible, level.Name)
+		}
+	}
+	if len(irreversible) > 1 {
+		return fmt.Errorf("%w: %v", ErrIrreversibleLevels, irreversible)
+	}
+	return nil
+}
+
+// Check evaluates the levels in order, irreversible last, and returns the name of the level that rejected the request
+func (c *CompositeRateLimiter) Check() (rejectedBy string, ok bool) {
+	_, rejectedBy, ok = reserveLevels(c.levels)
+	return rejectedBy, ok
+}
+
+func (c *CompositeRateLimiter) Allow() bool {
+	_, ok := c.Check()
+	return ok
+}
+
+// Reserve makes composites nestable, cancel gives the capacity back to every level
+func (c *CompositeRateLimiter) Reserve() (func(), bool) {
+	cancel, _, ok := reserveLevels(c.levels)
+	return cancel, ok
+}
+
+// reserveLevels reserves from the reversible levels in order and then from the others, which
+// are decided by their current strategy
+func reserveLevels(levels []Level) (func(), string, bool) {
+	ordered := make([]Level, 0, len(levels))
+	var irreversible []Level
+	for _, level := range levels {
+		if reversible(level.Limiter) {
+			ordered = append(ordered, level)
+		} else {
+			irreversible = append(irreversible, level)
+		}
+	}
+	ordered = append(ordered, irreversible...)
+
+	cancels := make([]func(), 0, len(ordered))
+	cancelAll := func() {
+		for i := len(cancels) - 1; i >= 0; i-- {
+			cancels[i]()
+		}
+	}
+
+	for _, level := range ordered {
+		reservable, isReservable := level.Limiter.(ReservableRateLimiter)
+		if !isReservable {
+			if !level.Limiter.Allow() {
+				cancelAll()
+				return nil, level.Name, false
+			}
+			continue
+		}
+
+		cancel, ok := reservable.Reserve()
+		if !ok {
+			cancelAll()
+			return nil, level.Name, false
+		}
+		cancels = append(cancels, cancel)
+	}
+	return cancelAll, "", true
+}
+
+// HierarchicalLevel is a keyed level of a HierarchicalRateLimiter
+type HierarchicalLevel struct {
+	Name     string
+	Limiters *KeyedRateLimiter
+}
+
+// HierarchicalRateLimiter enforces nested keyed limits, like 10 rps per user, 200 rps per tenant
+// and 5000 rps global, as one all-or-nothing decision. Like in CompositeRateLimiter the most specific
+// level goes first, so a user over their limit is rejected before taking tenant or global capacity.
+type HierarchicalRateLimiter struct {
+	levels []HierarchicalLevel
+}
+
+// NewHierarchicalRateLimiter fails with ErrIrreversibleLevels when the strategies of more than
+// one level can't give capacity back
+func NewHierarchicalRateLimiter(levels ...HierarchicalLevel) (*HierarchicalRateLimiter, error) {
+	samples := make([]Level, len(levels))
+	for i, level := range levels {
+		samples[i] = Level{Name: level.Name, Limiter: level.Limiters.newStrategy()}
+	}
+	if err := checkIrreversible(samples); err != nil {
+		return nil, err
+	}
+	return &HierarchicalRateLimiter{
+		levels: levels,
+	}, nil
+}
+
+// Allow takes one key per level, in the order the levels were given, e.g. Allow(userID, tenantID, "")
+func (h *HierarchicalRateLimiter) Allow(keys ...string) (rejectedBy string, ok bool) {
+	levels := make([]Level, len(h.levels))
+	for i, level := range h.levels {
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+		levels[i] = Level{Name: level.Name, Limiter: level.Limiters.Get(key)}
+	}
+	_, rejectedBy, ok = reserveLevels(levels)
+	return rejectedBy, ok
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingLimiter allows limit requests and can't give them back, like a priority class
+type countingLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	allowed int
+}
+
+func (c *countingLimiter) Allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.allowed >= c.limit {
+		return false
+	}
+	c.allowed++
+	return true
+}
+
+func (c *countingLimiter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allowed
+}
+
+// remaining is what a limiter that reports its status has left
+func remaining(t *testing.T, limiter RateLimiter) int {
+	t.Helper()
+	status, ok := statusOf(limiter)
+	if ctx, isContext := limiter.(*RateLimiterContext); isContext {
+		status, ok = ctx.Status()
+	}
+	if !ok {
+		t.Fatalf("%T doesn't report its status", limiter)
+	}
+	return status.Remaining
+}
+
+func TestCompositeRejectionConsumesNothing(t *testing.T) {
+	user := NewRateLimiterContext(NewTokenBucketRateLimiter(5, 1))
+	priority := &countingLimiter{limit: 2}
+	// wrapped in a context, which is always reservable, and given before the global level
+	class := NewRateLimiterContext(priority)
+	global := NewRateLimiterContext(NewFixedWindowRateLimiter(1, time.Hour))
+	composite, err := NewCompositeRateLimiter(
+		Level{Name: "user", Limiter: user},
+		Level{Name: "class", Limiter: class},
+		Level{Name: "global", Limiter: global},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rejectedBy, ok := composite.Check(); !ok {
+		t.Fatalf("first request rejected by %q", rejectedBy)
+	}
+	if rejectedBy, ok := composite.Check(); ok || rejectedBy != "global" {
+		t.Fatalf("second request: rejected by %q, ok %v, want rejected by global", rejectedBy, ok)
+	}
+	if n := remaining(t, user); n != 4 {
+		t.Errorf("user has %d left after a rejection, want 4", n)
+	}
+	if n := priority.count(); n != 1 {
+		t.Errorf("class consumed %d times, want 1: it must be checked after global", n)
+	}
+
+	// the class rejects once it is used up, and the user level gets its token back
+	priority.limit = 1
+	if err := global.SetStrategy(NewFixedWindowRateLimiter(100, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if rejectedBy, ok := composite.Check(); ok || rejectedBy != "class" {
+		t.Fatalf("rejected by %q, ok %v, want rejected by class", rejectedBy, ok)
+	}
+	if n := remaining(t, user); n != 4 {
+		t.Errorf("user has %d left after the class rejected, want 4", n)
+	}
+}
+
+func TestCompositeRejectsTwoIrreversibleLevels(t *testing.T) {
+	levels := []Level{
+		{Name: "bulk", Limiter: NewRateLimiterContext(&countingLimiter{limit: 1})},
+		{Name: "user", Limiter: NewTokenBucketRateLimiter(5, 1)},
+		{Name: "interactive", Limiter: &countingLimiter{limit: 1}},
+	}
+	if _, err := NewCompositeRateLimiter(levels...); !errors.Is(err, ErrIrreversibleLevels) {
+		t.Errorf("two irreversible levels: got %v, want ErrIrreversibleLevels", err)
+	}
+	if _, err := NewCompositeRateLimiter(levels[:2]...); err != nil {
+		t.Errorf("one irreversible level: %v", err)
+	}
+
+	newCounter := func() RateLimiter { return &countingLimiter{limit: 1} }
+	_, err := NewHierarchicalRateLimiter(
+		HierarchicalLevel{Name: "user", Limiters: NewKeyedRateLimiter(newCounter)},
+		HierarchicalLevel{Name: "global", Limiters: NewKeyedRateLimiter(newCounter)},
+	)
+	if !errors.Is(err, ErrIrreversibleLevels) {
+		t.Errorf("two irreversible hierarchical levels: got %v, want ErrIrreversibleLevels", err)
+	}
+}
+
+func TestHierarchicalRejectionConsumesNothing(t *testing.T) {
+	users := NewKeyedRateLimiter(func() RateLimiter { return NewTokenBucketRateLimiter(2, 1) })
+	tenants := NewKeyedRateLimiter(func() RateLimiter { return NewFixedWindowRateLimiter(3, time.Hour) })
+	global := &countingLimiter{limit: 100}
+	globals := NewKeyedRateLimiter(func() RateLimiter { return global })
+	hierarchical, err := NewHierarchicalRateLimiter(
+		HierarchicalLevel{Name: "global", Limiters: globals},
+		HierarchicalLevel{Name: "user", Limiters: users},
+		HierarchicalLevel{Name: "tenant", Limiters: tenants},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"alice", "alice", "bob"} {
+		if rejectedBy, ok := hierarchical.Allow("", user, "acme"); !ok {
+			t.Fatalf("%s rejected by %q", user, rejectedBy)
+		}
+	}
+	if rejectedBy, ok := hierarchical.Allow("", "bob", "acme"); ok || rejectedBy != "tenant" {
+		t.Fatalf("bob's second request: rejected by %q, ok %v, want rejected by tenant", rejectedBy, ok)
+	}
+	if n := remaining(t, users.Get("bob")); n != 1 {
+		t.Errorf("bob has %d left after the tenant rejected, want 1", n)
+	}
+	if n := global.count(); n != 3 {
+		t.Errorf("global consumed %d times for 3 allowed requests, want 3", n)
+	}
+
+	if _, ok := hierarchical.Allow("", "carol", "beta"); !ok {
+		t.Fatal("carol rejected")
+	}
+	if rejectedBy, ok := hierarchical.Allow("", "alice", "beta"); ok || rejectedBy != "user" {
+		t.Fatalf("alice's third request: rejected by %q, ok %v, want rejected by user", rejectedBy, ok)
+	}
+	if n := remaining(t, tenants.Get("beta")); n != 2 {
+		t.Errorf("tenant beta has %d left after alice was rejected, want 2", n)
+	}
+}
+
+func TestHierarchicalUserOverLimitDoesntRejectOthers(t *testing.T) {
+	users := NewKeyedRateLimiter(func() RateLimiter { return NewFixedWindowRateLimiter(1, time.Hour) })
+	globals := NewKeyedRateLimiter(func() RateLimiter { return NewFixedWindowRateLimiter(10, time.Hour) })
+	hierarchical, err := NewHierarchicalRateLimiter(
+		HierarchicalLevel{Name: "user", Limiters: users},
+		HierarchicalLevel{Name: "global", Limiters: globals},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hierarchical.Allow("hog", ""); !ok {
+		t.Fatal("hog's first request rejected")
+	}
+
+	// hog's user level rejects its requests before they reserve global capacity, the 9 other
+	// users must get the 9 global requests left
+	stop := make(chan struct{})
+	var hogs sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		hogs.Add(1)
+		go func() {
+			defer hogs.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					hierarchical.Allow("hog", "")
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	rejected := make(chan string, 9)
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if rejectedBy, ok := hierarchical.Allow(user, ""); !ok {
+				rejected <- user + " by " + rejectedBy
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	close(stop)
+	hogs.Wait()
+	close(rejected)
+
+	for r := range rejected {
+		t.Errorf("%s rejected while global had capacity left", r)
+	}
+	if n := remaining(t, globals.Get("")); n != 0 {
+		t.Errorf("global has %d left after 10 allowed requests, want 0", n)
+	}
+}
+
+// slowStore takes delay for every call, like a store across the network
+type slowStore struct {
+	*InMemoryLimiterStore
+	delay time.Duration
+}
+
+func (s slowStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	time.Sleep(s.delay)
+	return s.InMemoryLimiterStore.Increment(key, delta, ttl)
+}
+
+func (s slowStore) Get(key string) (string, bool, error) {
+	time.Sleep(s.delay)
+	return s.InMemoryLimiterStore.Get(key)
+}
+
+func (s slowStore) CompareAndSet(key, old, next string, ttl time.Duration) (bool, error) {
+	time.Sleep(s.delay)
+	return s.InMemoryLimiterStore.CompareAndSet(key, old, next, ttl)
+}
+
+func TestCompositeDecisionsDontWaitForEachOther(t *testing.T) {
+	const delay, requests = 20 * time.Millisecond, 20
+	store := slowStore{NewInMemoryLimiterStore(), delay}
+	composite, err := NewCompositeRateLimiter(
+		Level{Name: "user", Limiter: NewDistributedFixedWindowRateLimiter(store, "user", 15, time.Hour)},
+		Level{Name: "global", Limiter: NewDistributedFixedWindowRateLimiter(store, "global", 10, time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if composite.Allow() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a decision takes two or three store round trips, one at a time the requests would take
+	// at least 40 of them
+	if elapsed := time.Since(start); elapsed > 10*delay {
+		t.Errorf("%d requests took %s with a %s store, want them decided concurrently", requests, elapsed, delay)
+	}
+	// the requests global rejects give their user capacity back, global still admits exactly 10
+	if n := allowed.Load(); n != 10 {
+		t.Errorf("%d requests allowed, want 10", n)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storeBacked holds what the store backed strategies have in common.
+// A store error denies the request unless failOpen is set, so an outage never disables limiting silently.
+// Store errors are counted and the latest one is kept, so an outage is visible either way.
+type storeBacked struct {
+	store       LimiterStore
+	key         string
+	failOpen    atomic.Bool
+	storeErrors int64
+	mu          sync.Mutex
+	lastError   error
+}
+
+// SetFailOpen makes the limiter allow requests while the store is unreachable
+func (sb *storeBacked) SetFailOpen(failOpen bool) {
+	sb.failOpen.Store(failOpen)
+}
+
+// StoreErrors returns how many decisions failed on the store, it can be registered as a gauge:
+// metrics.RegisterGauge("api_store_errors", limiter.StoreErrors)
+func (sb *storeBacked) StoreErrors() int64 {
+	return atomic.LoadInt64(&sb.storeErrors)
+}
+
+// LastStoreError returns the latest store error, nil if there was none
+func (sb *storeBacked) LastStoreError() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.lastError
+}
+
+func (sb *storeBacked) onError(err error) bool {
+	atomic.AddInt64(&sb.storeErrors, 1)
+	sb.mu.Lock()
+	sb.lastError = fmt.Errorf("limiter store %q: %w", sb.key, err)
+	sb.mu.Unlock()
+	return sb.failOpen.Load()
+}
+
+// reserveError is the result of a Reserve that failed on err, a reservation made by failing open
+// took nothing from the store, so its cancel has nothing to give back
+func (sb *storeBacked) reserveError(err error) (func(), bool) {
+	if sb.onError(err) {
+		return func() {}, true
+	}
+	return nil, false
+}
+
+// DistributedFixedWindowRateLimiter strategy implementation, one counter per window in the store
+type DistributedFixedWindowRateLimiter struct {
+	storeBacked
+	limit  int
+	window time.Duration
+}
+
+func NewDistributedFixedWindowRateLimiter(store LimiterStore, key string, limit int, window time.Duration) *DistributedFixedWindowRateLimiter {
+	return &DistributedFixedWindowRateLimiter{
+		storeBacked: storeBacked{store: store, key: key + ":fw"},
+		limit:       limit,
+		window:      window,
+	}
+}
+
+func (rl *DistributedFixedWindowRateLimiter) validate() error {
+	return validateWindow(rl.limit, rl.window)
+}
+
+// windowKey aligns windows to the epoch so every replica agrees on where a window starts.
+// Counters are written with a TTL of one window: the time until reset can be zero right at the
+// boundary, which the store takes as never expiring, and a window's key is never reused anyway.
+func (rl *DistributedFixedWindowRateLimiter) windowKey(now time.Time) (string, time.Time) {
+	start := now.Truncate(rl.window)
+	return fmt.Sprintf("%s:%d", rl.key, start.UnixNano()), start.Add(rl.window)
+}
+
+func (rl *DistributedFixedWindowRateLimiter) Allow() bool {
+	key, _ := rl.windowKey(time.Now())
+	count, err := rl.store.Increment(key, 1, rl.window)
+	if err != nil {
+		return rl.onError(err)
+	}
+	return count <= int64(rl.limit)
+}
+
+func (rl *DistributedFixedWindowRateLimiter) Reserve() (func(), bool) {
+	key, _ := rl.windowKey(time.Now())
+	count, err := rl.store.Increment(key, 1, rl.window)
+	if err != nil {
+		return rl.reserveError(err)
+	}
+	if count > int64(rl.limit) {
+		return nil, false
+	}
+	return func() {
+		rl.store.Increment(key, -1, rl.window)
+	}, true
+}
+
+func (rl *DistributedFixedWindowRateLimiter) Status() LimitStatus {
+	now := time.Now()
+	key, reset := rl.windowKey(now)
+	status := LimitStatus{Limit: rl.limit, Remaining: rl.limit, Reset: reset}
+
+	value, found, err := rl.store.Get(key)
+	if err != nil || !found {
+		return status
+	}
+	count, _ := strconv.Atoi(value)
+	status.Remaining = rl.limit - count
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		status.RetryAfter = reset.Sub(now)
+	}
+	return status
+}
+
+// DistributedSlidingWindowRateLimiter strategy implementation, the request log is stored as
+// comma separated unix nanos and updated with compare-and-set
+type DistributedSlidingWindowRateLimiter struct {
+	storeBacked
+	limit  int
+	window time.Duration
+}
+
+func NewDistributedSlidingWindowRateLimiter(store LimiterStore, key string, limit int, window time.Duration) *DistributedSlidingWindowRateLimiter {
+	return &DistributedSlidingWindowRateLimiter{
+		storeBacked: storeBacked{store: store, key: key + ":sw"},
+		limit:       limit,
+		window:      window,
+	}
+}
+
+func (rl *DistributedSlidingWindowRateLimiter) validate() error {
+	return validateWindow(rl.limit, rl.window)
+}
+
+func parseRequestLog(value string, windowStart time.Time) []int64 {
+	requests := []int64{}
+	if value == "" {
+		return requests
+	}
+	for _, field := range strings.Split(value, ",") {
+		t, err := strconv.ParseInt(field, 10, 64)
+		if err == nil && t > windowStart.UnixNano() {
+			requests = append(requests, t)
+		}
+	}
+	return requests
+}
+
+func formatRequestLog(requests []int64) string {
+	fields := make([]string, len(requests))
+	for i, t := range requests {
+		fields[i] = strconv.FormatInt(t, 10)
+	}
+	return strings.Join(fields, ",")
+}
+
+func (rl *DistributedSlidingWindowRateLimiter) Allow() bool {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, _, err := rl.store.Get(rl.key)
+		if err != nil {
+			return rl.onError(err)
+		}
+
+		now := time.Now()
+		requests := parseRequestLog(old, now.Add(-rl.window))
+		if len(requests) >= rl.limit {
+			return false
+		}
+
+		requests = append(requests, now.UnixNano())
+		swapped, err := rl.store.CompareAndSet(rl.key, old, formatRequestLog(requests), rl.window)
+		if err != nil {
+			return rl.onError(err)
+		}
+		if swapped {
+			return true
+		}
+	}
+	return rl.onError(ErrStoreConflict)
+}
+
+func (rl *DistributedSlidingWindowRateLimiter) Reserve() (func(), bool) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, _, err := rl.store.Get(rl.key)
+		if err != nil {
+			return rl.reserveError(err)
+		}
+
+		now := time.Now()
+		requests := parseRequestLog(old, now.Add(-rl.window))
+		if len(requests) >= rl.limit {
+			return nil, false
+		}
+
+		stamp := now.UnixNano()
+		requests = append(requests, stamp)
+		swapped, err := rl.store.CompareAndSet(rl.key, old, formatRequestLog(requests), rl.window)
+		if err != nil {
+			return rl.reserveError(err)
+		}
+		if swapped {
+			return func() { rl.remove(stamp) }, true
+		}
+	}
+	return rl.reserveError(ErrStoreConflict)
+}
+
+// remove takes a reserved request back out of the log, best effort
+func (rl *DistributedSlidingWindowRateLimiter) remove(stamp int64) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, found, err := rl.store.Get(rl.key)
+		if err != nil || !found {
+			return
+		}
+
+		requests := parseRequestLog(old, time.Now().Add(-rl.window))
+		kept := requests[:0]
+		for _, t := range requests {
+			if t != stamp {
+				kept = append(kept, t)
+			}
+		}
+		swapped, err := rl.store.CompareAndSet(rl.key, old, formatRequestLog(kept), rl.window)
+		if err != nil || swapped {
+			return
+		}
+	}
+}
+
+func (rl *DistributedSlidingWindowRateLimiter) Status() LimitStatus {
+	now := time.Now()
+	status := LimitStatus{Limit: rl.limit, Remaining: rl.limit, Reset: now}
+
+	value, _, err := rl.store.Get(rl.key)
+	if err != nil {
+		return status
+	}
+	requests := parseRequestLog(value, now.Add(-rl.window))
+	status.Remaining = rl.limit - len(requests)
+	if len(requests) > 0 {
+		status.Reset = time.Unix(0, requests[len(requests)-1]).Add(rl.window)
+	}
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		if rl.limit > 0 {
+			status.RetryAfter = time.Unix(0, requests[len(requests)-rl.limit]).Add(rl.window).Sub(now)
+		}
+	}
+	return status
+}
+
+// DistributedTokenBucketRateLimiter strategy implementation, the bucket is stored as
+// "tokens:lastCheckNanos" and refills like TokenBucketRateLimiter, one token per interval
+type DistributedTokenBucketRateLimiter struct {
+	storeBacked
+	capacity int
+	interval time.Duration
+}
+
+func NewDistributedTokenBucketRateLimiter(store LimiterStore, key string, capacity, rate int) *DistributedTokenBucketRateLimiter {
+	return NewDistributedTokenBucketRateLimiterEvery(store, key, capacity, perSecond(rate))
+}
+
+// NewDistributedTokenBucketRateLimiterEvery adds one token per interval, for rates that aren't whole tokens per second
+func NewDistributedTokenBucketRateLimiterEvery(store LimiterStore, key string, capacity int, interval time.Duration) *DistributedTokenBucketRateLimiter {
+	return &DistributedTokenBucketRateLimiter{
+		storeBacked: storeBacked{store: store, key: key + ":tb"},
+		capacity:    capacity,
+		interval:    interval,
+	}
+}
+
+func (tb *DistributedTokenBucketRateLimiter) validate() error {
+	return validateInterval(tb.capacity, tb.interval)
+}
+
+// refill returns the tokens available at now and the time they were counted up to, a missing
+// bucket is full. Like TokenBucketRateLimiter.refill it keeps the fraction of a token earned since.
+func (tb *DistributedTokenBucketRateLimiter) refill(value string, found bool, now time.Time) (int, time.Time) {
+	if !found {
+		return tb.capacity, now
+	}
+
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return tb.capacity, now
+	}
+	tokens, err1 := strconv.Atoi(parts[0])
+	last, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return tb.capacity, now
+	}
+
+	lastCheck := time.Unix(0, last)
+	if tb.interval <= 0 {
+		return tokens, lastCheck
+	}
+	if added := int(now.Sub(lastCheck) / tb.interval); added > 0 {
+		tokens += added
+		lastCheck = lastCheck.Add(time.Duration(added) * tb.interval)
+	}
+	if tokens >= tb.capacity {
+		return tb.capacity, now
+	}
+	return tokens, lastCheck
+}
+
+func formatBucket(tokens int, lastCheck time.Time) string {
+	return strconv.Itoa(tokens) + ":" + strconv.FormatInt(lastCheck.UnixNano(), 10)
+}
+
+// fullAfter is how long an untouched bucket takes to refill, after that the key can expire
+func (tb *DistributedTokenBucketRateLimiter) fullAfter() time.Duration {
+	return time.Duration(tb.capacity)*tb.interval + time.Second
+}
+
+func (tb *DistributedTokenBucketRateLimiter) Allow() bool {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, found, err := tb.store.Get(tb.key)
+		if err != nil {
+			return tb.onError(err)
+		}
+
+		tokens, lastCheck := tb.refill(old, found, time.Now())
+		if tokens < 1 {
+			return false
+		}
+
+		next := formatBucket(tokens-1, lastCheck)
+		if !found {
+			old = ""
+		}
+		swapped, err := tb.store.CompareAndSet(tb.key, old, next, tb.fullAfter())
+		if err != nil {
+			return tb.onError(err)
+		}
+		if swapped {
+			return true
+		}
+	}
+	return tb.onError(ErrStoreConflict)
+}
+
+func (tb *DistributedTokenBucketRateLimiter) Reserve() (func(), bool) {
+	if !tb.Allow() {
+		return nil, false
+	}
+	return func() { tb.add(1) }, true
+}
+
+// add puts tokens back in the bucket, best effort
+func (tb *DistributedTokenBucketRateLimiter) add(n int) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, found, err := tb.store.Get(tb.key)
+		if err != nil || !found {
+			// A missing bucket is already full
+			return
+		}
+
+		tokens, lastCheck := tb.refill(old, found, time.Now())
+		next := formatBucket(min(tokens+n, tb.capacity), lastCheck)
+		swapped, err := tb.store.CompareAndSet(tb.key, old, next, tb.fullAfter())
+		if err != nil || swapped {
+			return
+		}
+	}
+}
+
+func (tb *DistributedTokenBucketRateLimiter) Status() LimitStatus {
+	now := time.Now()
+	status := LimitStatus{Limit: tb.capacity, Remaining: tb.capacity, Reset: now}
+
+	value, found, err := tb.store.Get(tb.key)
+	if err != nil {
+		return status
+	}
+	tokens, lastCheck := tb.refill(value, found, now)
+	status.Remaining = tokens
+	status.Reset = now.Add(time.Duration(tb.capacity-tokens) * tb.interval)
+	if tokens <= 0 {
+		status.RetryAfter = lastCheck.Add(tb.interval).Sub(now)
+	}
+	return status
+}
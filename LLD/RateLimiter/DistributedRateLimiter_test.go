@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingStore remembers the TTLs it is given and fails every call while down is set
+type recordingStore struct {
+	*InMemoryLimiterStore
+	mu   sync.Mutex
+	ttls []time.Duration
+	down bool
+}
+
+var errStoreDown = errors.New("store is down")
+
+func (s *recordingStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	s.ttls = append(s.ttls, ttl)
+	down := s.down
+	s.mu.Unlock()
+	if down {
+		return 0, errStoreDown
+	}
+	return s.InMemoryLimiterStore.Increment(key, delta, ttl)
+}
+
+func (s *recordingStore) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+func (s *recordingStore) Get(key string) (string, bool, error) {
+	if s.isDown() {
+		return "", false, errStoreDown
+	}
+	return s.InMemoryLimiterStore.Get(key)
+}
+
+func (s *recordingStore) CompareAndSet(key, old, next string, ttl time.Duration) (bool, error) {
+	if s.isDown() {
+		return false, errStoreDown
+	}
+	return s.InMemoryLimiterStore.CompareAndSet(key, old, next, ttl)
+}
+
+func TestDistributedFixedWindowTTL(t *testing.T) {
+	store := &recordingStore{InMemoryLimiterStore: NewInMemoryLimiterStore()}
+	limiter := NewDistributedFixedWindowRateLimiter(store, "api", 100, time.Millisecond)
+
+	// many of these land right at a window boundary, where the time until reset is about zero
+	for i := 0; i < 1000; i++ {
+		limiter.Allow()
+	}
+	for _, ttl := range store.ttls {
+		if ttl < time.Millisecond {
+			t.Fatalf("counter written with TTL %s, want at least one window", ttl)
+		}
+	}
+}
+
+func TestDistributedStoreErrors(t *testing.T) {
+	store := &recordingStore{InMemoryLimiterStore: NewInMemoryLimiterStore(), down: true}
+	limiter := NewDistributedFixedWindowRateLimiter(store, "api", 10, time.Minute)
+
+	if limiter.Allow() {
+		t.Error("allowed while the store is down and the limiter fails closed")
+	}
+	limiter.SetFailOpen(true)
+	if !limiter.Allow() {
+		t.Error("rejected while the store is down and the limiter fails open")
+	}
+
+	if n := limiter.StoreErrors(); n != 2 {
+		t.Errorf("%d store errors counted, want 2", n)
+	}
+	if err := limiter.LastStoreError(); !errors.Is(err, errStoreDown) {
+		t.Errorf("last store error %v, want %v", err, errStoreDown)
+	}
+
+	metrics := NewRateLimiterMetrics()
+	metrics.RegisterGauge("api_store_errors", limiter.StoreErrors)
+	if _, gauges := metrics.Snapshot(); gauges["api_store_errors"] != 2 {
+		t.Errorf("store error gauge %d, want 2", gauges["api_store_errors"])
+	}
+}
+
+func TestReserveWhileTheStoreIsDown(t *testing.T) {
+	store := &recordingStore{InMemoryLimiterStore: NewInMemoryLimiterStore(), down: true}
+	limiters := map[string]interface {
+		ReservableRateLimiter
+		SetFailOpen(bool)
+	}{
+		"fixed window":   NewDistributedFixedWindowRateLimiter(store, "api", 10, time.Minute),
+		"sliding window": NewDistributedSlidingWindowRateLimiter(store, "api", 10, time.Minute),
+		"token bucket":   NewDistributedTokenBucketRateLimiter(store, "api", 10, 1),
+		"gcra":           NewDistributedGCRARateLimiter(store, "api", 10, 1),
+	}
+	for name, limiter := range limiters {
+		if cancel, ok := limiter.Reserve(); ok || cancel != nil {
+			t.Errorf("%s failing closed: ok %v, cancel %v, want a rejection without a cancel", name, ok, cancel != nil)
+		}
+		limiter.SetFailOpen(true)
+		if cancel, ok := limiter.Reserve(); !ok || cancel == nil {
+			t.Errorf("%s failing open: ok %v, cancel %v, want a reservation", name, ok, cancel != nil)
+		} else {
+			cancel()
+		}
+	}
+}
+
+func TestSetFailOpenWhileAllowing(t *testing.T) {
+	store := &recordingStore{InMemoryLimiterStore: NewInMemoryLimiterStore(), down: true}
+	limiter := NewDistributedFixedWindowRateLimiter(store, "api", 10, time.Minute)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				limiter.Allow()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		limiter.SetFailOpen(i%2 == 0)
+	}
+	wg.Wait()
+	if n := limiter.StoreErrors(); n != 400 {
+		t.Errorf("%d store errors counted, want 400", n)
+	}
+}
+
+// newReplicas returns two stores that reach one in-memory store through a loopback
+// LimiterStoreServer, like two replicas of a service sharing a limit
+func newReplicas(t *testing.T) (*RemoteLimiterStore, *RemoteLimiterStore) {
+	t.Helper()
+	server := NewLimiterStoreServer(NewInMemoryLimiterStore())
+	addr, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := NewRemoteLimiterStore(addr, time.Second), NewRemoteLimiterStore(addr, time.Second)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+		server.Close()
+	})
+	return a, b
+}
+
+func TestReplicasShareOneLimit(t *testing.T) {
+	strategies := map[string]func(store LimiterStore) RateLimiter{
+		"fixed window": func(store LimiterStore) RateLimiter {
+			return NewDistributedFixedWindowRateLimiter(store, "api", 10, time.Hour)
+		},
+		"sliding window": func(store LimiterStore) RateLimiter {
+			return NewDistributedSlidingWindowRateLimiter(store, "api", 10, time.Hour)
+		},
+		// these refill one a second, the requests take a few milliseconds
+		"token bucket": func(store LimiterStore) RateLimiter {
+			return NewDistributedTokenBucketRateLimiter(store, "api", 10, 1)
+		},
+		"gcra": func(store LimiterStore) RateLimiter {
+			return NewDistributedGCRARateLimiter(store, "api", 10, 1)
+		},
+	}
+	for name, newStrategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			storeA, storeB := newReplicas(t)
+			replicas := []RateLimiter{newStrategy(storeA), newStrategy(storeB)}
+
+			allowed := []int{0, 0}
+			for i := 0; i < 30; i++ {
+				if replicas[i%2].Allow() {
+					allowed[i%2]++
+				}
+			}
+			if allowed[0]+allowed[1] != 10 {
+				t.Errorf("replicas allowed %d and %d, want 10 together", allowed[0], allowed[1])
+			}
+			if allowed[0] == 0 || allowed[1] == 0 {
+				t.Errorf("replicas allowed %d and %d, want both to get some", allowed[0], allowed[1])
+			}
+		})
+	}
+
+	t.Run("concurrently", func(t *testing.T) {
+		storeA, storeB := newReplicas(t)
+		var allowed atomic.Int64
+		var wg sync.WaitGroup
+		for _, store := range []LimiterStore{storeA, storeB} {
+			replica := strategies["fixed window"](store)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					if replica.Allow() {
+						allowed.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n := allowed.Load(); n != 10 {
+			t.Errorf("replicas allowed %d of 100 concurrent requests, want 10", n)
+		}
+	})
+}
+
+func TestDistributedTokenBucketSubSecondInterval(t *testing.T) {
+	// 20/s isn't a whole rate per second of a 1s window, like a policy of 1 per 50ms
+	limiter := NewDistributedTokenBucketRateLimiterEvery(NewInMemoryLimiterStore(), "api", 3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("request %d of a bucket of 3 rejected", i)
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("fourth request of a bucket of 3 allowed")
+	}
+	status := limiter.Status()
+	if status.Remaining != 0 || status.RetryAfter <= 0 || status.RetryAfter > 50*time.Millisecond {
+		t.Errorf("status %+v of an empty bucket, want a retry within the 50ms interval", status)
+	}
+
+	time.Sleep(status.RetryAfter + 5*time.Millisecond)
+	if !limiter.Allow() {
+		t.Error("rejected after the retry, one token every 50ms")
+	}
+}
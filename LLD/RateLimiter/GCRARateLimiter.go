@@ -0,0 +1,253 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// gcraAt is the GCRA decision for n units at now given the theoretical arrival time (TAT) of the
+// next unit. It returns the new TAT and, if the units don't fit, how long until they would.
+func gcraAt(tat, now time.Time, n, burst int, interval time.Duration) (newTat time.Time, retryAfter time.Duration, ok bool) {
+	if tat.Before(now) {
+		tat = now
+	}
+	if n > burst {
+		return tat, 0, false
+	}
+	newTat = tat.Add(time.Duration(n) * interval)
+	// The burst lets TAT run ahead of now by at most burst intervals
+	allowAt := newTat.Add(-time.Duration(burst) * interval)
+	if now.Before(allowAt) {
+		return tat, allowAt.Sub(now), false
+	}
+	return newTat, 0, true
+}
+
+// gcraStatus describes capacity for one more unit
+func gcraStatus(tat, now time.Time, burst int, interval time.Duration) LimitStatus {
+	if tat.Before(now) {
+		tat = now
+	}
+	status := LimitStatus{Limit: burst, Reset: tat}
+	if interval <= 0 {
+		status.Remaining = burst
+		return status
+	}
+	status.Remaining = int(now.Sub(tat.Add(-time.Duration(burst)*interval)) / interval)
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		status.RetryAfter = tat.Add(-time.Duration(burst-1) * interval).Sub(now)
+	}
+	return status
+}
+
+// GCRARateLimiter strategy implementation, the Generic Cell Rate Algorithm gives token bucket
+// behaviour (rate per second, bursts of up to burst) while storing only one timestamp
+type GCRARateLimiter struct {
+	burst    int
+	interval time.Duration
+	tat      time.Time
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+// NewGCRARateLimiter allows rate requests per second
+func NewGCRARateLimiter(burst, rate int) *GCRARateLimiter {
+	return NewGCRARateLimiterEvery(burst, perSecond(rate))
+}
+
+// NewGCRARateLimiterEvery allows one request per interval
+func NewGCRARateLimiterEvery(burst int, interval time.Duration) *GCRARateLimiter {
+	return &GCRARateLimiter{
+		burst:    burst,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// SetClock replaces time.Now, e.g. with a simulated clock, and makes the full burst available
+func (g *GCRARateLimiter) SetClock(now func() time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.now = now
+	g.tat = time.Time{}
+}
+
+func (g *GCRARateLimiter) Allow() bool {
+	ok, _ := g.AllowN(1)
+	return ok
+}
+
+// AllowN takes n units at once, when they don't fit retryAfter is exactly when they would.
+// More than burst units never fit, that is reported with a zero retryAfter.
+func (g *GCRARateLimiter) AllowN(n int) (ok bool, retryAfter time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tat, retryAfter, ok := gcraAt(g.tat, g.now(), n, g.burst, g.interval)
+	g.tat = tat
+	return ok, retryAfter
+}
+
+func (g *GCRARateLimiter) Reserve() (func(), bool) {
+	if ok, _ := g.AllowN(1); !ok {
+		return nil, false
+	}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.tat = g.tat.Add(-g.interval)
+	}, true
+}
+
+// AllowStatus decides and reports the status right after the decision under one lock
+func (g *GCRARateLimiter) AllowStatus() (bool, LimitStatus) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	tat, _, ok := gcraAt(g.tat, now, 1, g.burst, g.interval)
+	g.tat = tat
+	return ok, gcraStatus(g.tat, now, g.burst, g.interval)
+}
+
+func (g *GCRARateLimiter) Status() LimitStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return gcraStatus(g.tat, g.now(), g.burst, g.interval)
+}
+
+// Update changes burst and rate in place, the units in use are carried over at the new rate
+func (g *GCRARateLimiter) Update(burst, rate int) error {
+	if err := validateRate(burst, rate); err != nil {
+		return err
+	}
+	interval := perSecond(rate)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if g.tat.After(now) && g.interval > 0 {
+		used := float64(g.tat.Sub(now)) / float64(g.interval)
+		g.tat = now.Add(time.Duration(used * float64(interval)))
+	}
+	g.burst = burst
+	g.interval = interval
+	return nil
+}
+
+func (g *GCRARateLimiter) validate() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return validateInterval(g.burst, g.interval)
+}
+
+func (g *GCRARateLimiter) consume(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(time.Duration(n) * g.interval)
+}
+
+// DistributedGCRARateLimiter strategy implementation, the TAT is stored as unix nanos
+type DistributedGCRARateLimiter struct {
+	storeBacked
+	burst    int
+	interval time.Duration
+}
+
+func NewDistributedGCRARateLimiter(store LimiterStore, key string, burst, rate int) *DistributedGCRARateLimiter {
+	return &DistributedGCRARateLimiter{
+		storeBacked: storeBacked{store: store, key: key + ":gcra"},
+		burst:       burst,
+		interval:    perSecond(rate),
+	}
+}
+
+func (g *DistributedGCRARateLimiter) validate() error {
+	return validateInterval(g.burst, g.interval)
+}
+
+func parseTAT(value string, found bool) time.Time {
+	if !found {
+		return time.Time{}
+	}
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// tatTTL expires the key once TAT is in the past, from then on it means nothing.
+// A ttl of zero would never expire, so it is at least a millisecond.
+func tatTTL(tat time.Time) time.Duration {
+	ttl := time.Until(tat)
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return ttl
+}
+
+func (g *DistributedGCRARateLimiter) Allow() bool {
+	ok, _ := g.AllowN(1)
+	return ok
+}
+
+func (g *DistributedGCRARateLimiter) AllowN(n int) (ok bool, retryAfter time.Duration) {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		old, found, err := g.store.Get(g.key)
+		if err != nil {
+			return g.onError(err), 0
+		}
+
+		now := time.Now()
+		tat, retryAfter, ok := gcraAt(parseTAT(old, found), now, n, g.burst, g.interval)
+		if !ok {
+			return false, retryAfter
+		}
+
+		if !found {
+			old = ""
+		}
+		swapped, err := g.store.CompareAndSet(g.key, old, strconv.FormatInt(tat.UnixNano(), 10), tatTTL(tat))
+		if err != nil {
+			return g.onError(err), 0
+		}
+		if swapped {
+			return true, 0
+		}
+	}
+	return g.onError(ErrStoreConflict), 0
+}
+
+func (g *DistributedGCRARateLimiter) Reserve() (func(), bool) {
+	if ok, _ := g.AllowN(1); !ok {
+		return nil, false
+	}
+	return func() {
+		for attempt := 0; attempt < maxCASAttempts; attempt++ {
+			old, found, err := g.store.Get(g.key)
+			if err != nil || !found {
+				return
+			}
+			tat := parseTAT(old, found).Add(-g.interval)
+			swapped, err := g.store.CompareAndSet(g.key, old, strconv.FormatInt(tat.UnixNano(), 10), tatTTL(tat))
+			if err != nil || swapped {
+				return
+			}
+		}
+	}, true
+}
+
+func (g *DistributedGCRARateLimiter) Status() LimitStatus {
+	value, found, err := g.store.Get(g.key)
+	if err != nil {
+		found = false
+	}
+	return gcraStatus(parseTAT(value, found), time.Now(), g.burst, g.interval)
+}
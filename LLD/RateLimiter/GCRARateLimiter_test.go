@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newSimulatedGCRA allows burst requests at once and one per 100ms after that
+func newSimulatedGCRA(t *testing.T, burst int) (*GCRARateLimiter, *SimulatedClock) {
+	t.Helper()
+	clock := NewSimulatedClock()
+	limiter := NewGCRARateLimiter(burst, 10)
+	limiter.SetClock(clock.Now)
+	return limiter, clock
+}
+
+func TestGCRAAllowN(t *testing.T) {
+	limiter, clock := newSimulatedGCRA(t, 3)
+	start := clock.Now()
+
+	if ok, _ := limiter.AllowN(2); !ok {
+		t.Fatal("AllowN(2) of a burst of 3 rejected")
+	}
+	// one unit is left, two more fit once one interval has passed
+	if ok, retryAfter := limiter.AllowN(2); ok || retryAfter != 100*time.Millisecond {
+		t.Errorf("AllowN(2) with one unit left = %v, %s, want a 100ms retry", ok, retryAfter)
+	}
+	// more than the burst never fits, so there is no time to come back at
+	if ok, retryAfter := limiter.AllowN(4); ok || retryAfter != 0 {
+		t.Errorf("AllowN(4) over a burst of 3 = %v, %s, want a rejection with no retry", ok, retryAfter)
+	}
+
+	clock.Set(start.Add(100 * time.Millisecond))
+	if ok, retryAfter := limiter.AllowN(2); !ok {
+		t.Fatalf("AllowN(2) after its retryAfter rejected, retry %s", retryAfter)
+	}
+	status := limiter.Status()
+	if status.Remaining != 0 || status.RetryAfter != 100*time.Millisecond || !status.Reset.Equal(start.Add(400*time.Millisecond)) {
+		t.Errorf("status %+v with the burst used, want 0 remaining, a 100ms retry and a reset at 400ms", status)
+	}
+}
+
+func TestGCRAReserveCancel(t *testing.T) {
+	limiter, _ := newSimulatedGCRA(t, 3)
+
+	var cancels []func()
+	for i := 0; i < 3; i++ {
+		cancel, ok := limiter.Reserve()
+		if !ok {
+			t.Fatalf("reservation %d of a burst of 3 rejected", i)
+		}
+		cancels = append(cancels, cancel)
+	}
+	if _, ok := limiter.Reserve(); ok {
+		t.Fatal("fourth reservation of a burst of 3 allowed")
+	}
+
+	cancels[1]()
+	if !limiter.Allow() {
+		t.Error("the unit of a cancelled reservation wasn't given back")
+	}
+	if limiter.Allow() {
+		t.Error("a cancel gave back more than one unit")
+	}
+}
+
+func TestGCRAAllowStatus(t *testing.T) {
+	limiter, clock := newSimulatedGCRA(t, 3)
+	start := clock.Now()
+
+	cases := []struct {
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{allowed: true, remaining: 2, reset: 100 * time.Millisecond},
+		{allowed: true, remaining: 1, reset: 200 * time.Millisecond},
+		{allowed: true, remaining: 0, reset: 300 * time.Millisecond, retryAfter: 100 * time.Millisecond},
+		{allowed: false, remaining: 0, reset: 300 * time.Millisecond, retryAfter: 100 * time.Millisecond},
+	}
+	for i, c := range cases {
+		allowed, status := limiter.AllowStatus()
+		if allowed != c.allowed || status.Limit != 3 || status.Remaining != c.remaining ||
+			!status.Reset.Equal(start.Add(c.reset)) || status.RetryAfter != c.retryAfter {
+			t.Errorf("request %d: %v, %+v, want %v with %d remaining, reset at %s and retry %s",
+				i, allowed, status, c.allowed, c.remaining, c.reset, c.retryAfter)
+		}
+	}
+}
+
+func TestGCRAUpdateCarriesUsedCapacity(t *testing.T) {
+	limiter, clock := newSimulatedGCRA(t, 10)
+	for i := 0; i < 4; i++ {
+		limiter.Allow()
+	}
+
+	// 4 of 10 used at 100ms each, at 50ms each they are paid off in 200ms
+	if err := limiter.Update(10, 20); err != nil {
+		t.Fatal(err)
+	}
+	status := limiter.Status()
+	if status.Remaining != 6 || !status.Reset.Equal(clock.Now().Add(200*time.Millisecond)) {
+		t.Errorf("status %+v after the update, want 6 remaining and a reset in 200ms", status)
+	}
+
+	allowed := 0
+	for limiter.Allow() {
+		allowed++
+	}
+	if allowed != 6 {
+		t.Errorf("%d requests allowed after the update, want the 6 left", allowed)
+	}
+}
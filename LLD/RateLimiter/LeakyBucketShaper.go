@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrShaperQueueFull = errors.New("shaper queue is full")
+	ErrShaperClosed    = errors.New("shaper is closed")
+)
+
+const (
+	jobQueued int32 = iota
+	jobReleased
+	jobCancelled
+)
+
+type shapedJob struct {
+	state    int32
+	released chan error
+}
+
+// LeakyBucketShaper is a true leaky bucket: instead of rejecting, it queues jobs in a bounded FIFO
+// and a worker goroutine releases them at a constant rate. Only a full queue drops jobs. A job whose
+// submitter gives up keeps its slot until the worker reaches it, it just doesn't use up an interval,
+// so a burst of abandoned jobs can fill the queue for as long as it takes to skip over them.
+type LeakyBucketShaper struct {
+	mu       sync.Mutex
+	closed   bool
+	queue    chan *shapedJob
+	interval time.Duration
+	abort    chan struct{}
+	done     chan struct{}
+}
+
+// NewLeakyBucketShaper queues up to capacity jobs and runs rate jobs per second
+func NewLeakyBucketShaper(capacity, rate int) *LeakyBucketShaper {
+	shaper := &LeakyBucketShaper{
+		queue:    make(chan *shapedJob, capacity),
+		interval: perSecond(rate),
+		abort:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go shaper.run()
+	return shaper
+}
+
+func (s *LeakyBucketShaper) run() {
+	defer close(s.done)
+
+	var last time.Time
+	for job := range s.queue {
+		if atomic.LoadInt32(&job.state) == jobCancelled {
+			// The submitter gave up, the slot goes to the next job
+			continue
+		}
+
+		if wait := time.Until(last.Add(s.interval)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.abort:
+				timer.Stop()
+				s.cancel(job)
+				continue
+			}
+		}
+
+		select {
+		case <-s.abort:
+			s.cancel(job)
+			continue
+		default:
+		}
+
+		if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobReleased) {
+			job.released <- nil
+			last = time.Now()
+		}
+	}
+}
+
+func (s *LeakyBucketShaper) cancel(job *shapedJob) {
+	if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobCancelled) {
+		job.released <- ErrShaperClosed
+	}
+}
+
+// Submit queues fn and runs it on the caller's goroutine once the shaper releases it, so a slow fn
+// never slows the rate down. It returns ErrShaperQueueFull straight away if the queue is full,
+// ctx.Err() if ctx ends while queued and ErrShaperClosed if Close cancels the job.
+func (s *LeakyBucketShaper) Submit(ctx context.Context, fn func()) error {
+	job := &shapedJob{released: make(chan error, 1)}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrShaperClosed
+	}
+	select {
+	case s.queue <- job:
+	default:
+		s.mu.Unlock()
+		return ErrShaperQueueFull
+	}
+	s.mu.Unlock()
+
+	select {
+	case err := <-job.released:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&job.state, jobQueued, jobCancelled) {
+			return ctx.Err()
+		}
+		// Released at the same moment, the job runs
+		if err := <-job.released; err != nil {
+			return err
+		}
+	}
+
+	fn()
+	return nil
+}
+
+// QueueDepth is the number of jobs waiting, including ones whose submitter already gave up
+func (s *LeakyBucketShaper) QueueDepth() int {
+	return len(s.queue)
+}
+
+// Close stops accepting jobs and keeps releasing the queued ones at the normal rate until the queue
+// is empty or ctx ends, then the remaining jobs get ErrShaperClosed
+func (s *LeakyBucketShaper) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-s.abort:
+		default:
+			close(s.abort)
+		}
+		s.mu.Unlock()
+		<-s.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shaperInterval is long enough for a test to queue jobs while the worker waits to release one
+const shaperInterval = 200 * time.Millisecond
+
+// heldShaper returns a shaper whose worker has released one job and holds the next until
+// shaperInterval after it, so jobs submitted now stay queued; held is that job's result
+func heldShaper(t *testing.T, capacity int) (shaper *LeakyBucketShaper, held <-chan error) {
+	t.Helper()
+	shaper = NewLeakyBucketShaper(capacity, int(time.Second/shaperInterval))
+	t.Cleanup(func() { shaper.Close(context.Background()) })
+
+	if err := shaper.Submit(t.Context(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+	held = submitAsync(shaper, t.Context(), func() {})
+	// the worker takes the job off the queue straight away and then waits
+	time.Sleep(shaperInterval / 10)
+	waitForDepth(t, shaper, 0)
+	return shaper, held
+}
+
+func submitAsync(shaper *LeakyBucketShaper, ctx context.Context, fn func()) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- shaper.Submit(ctx, fn) }()
+	return result
+}
+
+func waitForDepth(t *testing.T, shaper *LeakyBucketShaper, depth int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); shaper.QueueDepth() != depth; {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth %d, want %d", shaper.QueueDepth(), depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShaperReleasesInOrderAtItsRate(t *testing.T) {
+	shaper, held := heldShaper(t, 10)
+
+	var mu sync.Mutex
+	var order []int
+	var times []time.Time
+	results := make([]<-chan error, 4)
+	for i := range results {
+		results[i] = submitAsync(shaper, t.Context(), func() {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+			times = append(times, time.Now())
+		})
+		waitForDepth(t, shaper, i+1)
+	}
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if err := <-result; err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range order {
+		if order[i] != i {
+			t.Fatalf("jobs ran in order %v, want the order they were queued in", order)
+		}
+	}
+	// the jobs are released an interval apart, when they run on their goroutines can vary a little
+	if spread := times[len(times)-1].Sub(times[0]); spread < 3*shaperInterval-shaperInterval/4 {
+		t.Errorf("4 jobs ran within %s, want about 3 intervals of %s", spread, shaperInterval)
+	}
+}
+
+func TestShaperQueueFull(t *testing.T) {
+	shaper, _ := heldShaper(t, 2)
+	submitAsync(shaper, t.Context(), func() {})
+	submitAsync(shaper, t.Context(), func() {})
+	waitForDepth(t, shaper, 2)
+
+	start := time.Now()
+	if err := shaper.Submit(t.Context(), func() { t.Error("a job was run from a full queue") }); !errors.Is(err, ErrShaperQueueFull) {
+		t.Errorf("Submit to a full queue = %v, want ErrShaperQueueFull", err)
+	}
+	if waited := time.Since(start); waited > shaperInterval/2 {
+		t.Errorf("Submit to a full queue waited %s, want it to fail straight away", waited)
+	}
+}
+
+func TestShaperCancelledWhileQueued(t *testing.T) {
+	shaper, held := heldShaper(t, 10)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancelled := submitAsync(shaper, ctx, func() { t.Error("a cancelled job was run") })
+	waitForDepth(t, shaper, 1)
+	next := submitAsync(shaper, t.Context(), func() {})
+	waitForDepth(t, shaper, 2)
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled job = %v, want context.Canceled", err)
+	}
+	// the cancelled job keeps its slot until the worker gets to it
+	if depth := shaper.QueueDepth(); depth != 2 {
+		t.Errorf("queue depth %d after cancelling a job, want 2", depth)
+	}
+
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := <-next; err != nil {
+		t.Fatal(err)
+	}
+	// the cancelled job is skipped without using up an interval
+	if waited := time.Since(start); waited > shaperInterval+shaperInterval/2 {
+		t.Errorf("the job after a cancelled one waited %s, want about one interval of %s", waited, shaperInterval)
+	}
+}
+
+func TestShaperCloseDrainsTheQueue(t *testing.T) {
+	shaper, held := heldShaper(t, 10)
+	ran := make(chan int, 3)
+	var results []<-chan error
+	for i := 0; i < 3; i++ {
+		results = append(results, submitAsync(shaper, t.Context(), func() { ran <- i }))
+		waitForDepth(t, shaper, i+1)
+	}
+
+	if err := shaper.Close(t.Context()); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	for i, result := range append(results, held) {
+		if err := <-result; err != nil {
+			t.Errorf("job %d: %v, want it to run before Close returned", i, err)
+		}
+	}
+	if len(ran) != 3 {
+		t.Errorf("%d of 3 queued jobs ran", len(ran))
+	}
+	if err := shaper.Submit(t.Context(), func() {}); !errors.Is(err, ErrShaperClosed) {
+		t.Errorf("Submit after Close = %v, want ErrShaperClosed", err)
+	}
+}
+
+func TestShaperCloseWithExpiredContextCancelsTheRest(t *testing.T) {
+	shaper, held := heldShaper(t, 10)
+	var results []<-chan error
+	for i := 0; i < 3; i++ {
+		results = append(results, submitAsync(shaper, t.Context(), func() { t.Error("a job ran after Close gave up") }))
+		waitForDepth(t, shaper, i+1)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), shaperInterval/4)
+	defer cancel()
+	if err := shaper.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want context.DeadlineExceeded", err)
+	}
+	for i, result := range append(results, held) {
+		if err := <-result; !errors.Is(err, ErrShaperClosed) {
+			t.Errorf("job %d: %v, want ErrShaperClosed", i, err)
+		}
+	}
+}
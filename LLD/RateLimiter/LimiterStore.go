@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimiterStore is shared state for limiters running in several processes.
+// Keys that are absent or expired read as not found, an empty value is never stored.
+type LimiterStore interface {
+	// Increment atomically adds delta to the counter at key and returns the new value.
+	// The expiry is only set when the key is created, so a window can't be extended by traffic.
+	Increment(key string, delta int64, ttl time.Duration) (int64, error)
+	Get(key string) (value string, found bool, err error)
+	// CompareAndSet stores next only if the current value is old, old == "" means the key must be absent
+	CompareAndSet(key, old, next string, ttl time.Duration) (bool, error)
+}
+
+// ErrStoreConflict is the LastStoreError of a store backed strategy whose key other processes kept
+// changing for maxCASAttempts read-modify-write rounds, it counts as a store error
+var ErrStoreConflict = errors.New("limiter store: too many concurrent updates")
+
+// maxCASAttempts bounds the read-modify-write loops of the store backed strategies
+const maxCASAttempts = 16
+
+// InMemoryLimiterStore is a LimiterStore for a single process, and the backing store of LimiterStoreServer
+type InMemoryLimiterStore struct {
+	mu      sync.Mutex
+	entries map[string]storeEntry
+}
+
+type storeEntry struct {
+	value   string
+	expires time.Time
+}
+
+func NewInMemoryLimiterStore() *InMemoryLimiterStore {
+	return &InMemoryLimiterStore{
+		entries: make(map[string]storeEntry),
+	}
+}
+
+// lookup must be called with the lock held, it drops the entry if it has expired
+func (s *InMemoryLimiterStore) lookup(key string, now time.Time) (storeEntry, bool) {
+	entry, exists := s.entries[key]
+	if exists && !entry.expires.IsZero() && !now.Before(entry.expires) {
+		delete(s.entries, key)
+		return storeEntry{}, false
+	}
+	return entry, exists
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (s *InMemoryLimiterStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := s.lookup(key, now)
+	if !exists {
+		entry = storeEntry{value: "0", expires: expiry(now, ttl)}
+	}
+
+	current, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("limiter store: %q is not a counter", key)
+	}
+	current += delta
+	entry.value = strconv.FormatInt(current, 10)
+	s.entries[key] = entry
+	return current, nil
+}
+
+func (s *InMemoryLimiterStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.lookup(key, time.Now())
+	return entry.value, exists, nil
+}
+
+func (s *InMemoryLimiterStore) CompareAndSet(key, old, next string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := s.lookup(key, now)
+	if (old == "" && exists) || (old != "" && (!exists || entry.value != old)) {
+		return false, nil
+	}
+
+	if next == "" {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = storeEntry{value: next, expires: expiry(now, ttl)}
+	}
+	return true, nil
+}
+
+// TCP store server, one JSON request and response per line
+
+type storeRequest struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Delta int64  `json:"delta,omitempty"`
+	TTL   int64  `json:"ttlMs,omitempty"`
+	Old   string `json:"old,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
+
+type storeResponse struct {
+	Counter int64  `json:"counter,omitempty"`
+	Value   string `json:"value,omitempty"`
+	OK      bool   `json:"ok,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// LimiterStoreServer shares a LimiterStore with other processes over TCP
+type LimiterStoreServer struct {
+	store    LimiterStore
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+func NewLimiterStoreServer(store LimiterStore) *LimiterStoreServer {
+	return &LimiterStoreServer{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen starts serving on addr (e.g. "127.0.0.1:7070") in the background and returns the bound address
+func (srv *LimiterStoreServer) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	srv.mu.Lock()
+	srv.listener = listener
+	srv.mu.Unlock()
+
+	go srv.serve(listener)
+	return listener.Addr().String(), nil
+}
+
+func (srv *LimiterStoreServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.mu.Lock()
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+
+		go srv.handle(conn)
+	}
+}
+
+func (srv *LimiterStoreServer) handle(conn net.Conn) {
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		var request storeRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if err := encoder.Encode(srv.apply(request)); err != nil {
+			return
+		}
+	}
+}
+
+func (srv *LimiterStoreServer) apply(request storeRequest) storeResponse {
+	ttl := time.Duration(request.TTL) * time.Millisecond
+	var response storeResponse
+	var err error
+
+	switch request.Op {
+	case "incr":
+		response.Counter, err = srv.store.Increment(request.Key, request.Delta, ttl)
+	case "get":
+		response.Value, response.OK, err = srv.store.Get(request.Key)
+	case "cas":
+		response.OK, err = srv.store.CompareAndSet(request.Key, request.Old, request.Next, ttl)
+	default:
+		err = fmt.Errorf("unknown op %q", request.Op)
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+// Close stops accepting connections and drops the open ones
+func (srv *LimiterStoreServer) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Close()
+}
+
+// RemoteLimiterStore is the client of LimiterStoreServer, it redials after a connection error
+type RemoteLimiterStore struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func NewRemoteLimiterStore(addr string, timeout time.Duration) *RemoteLimiterStore {
+	return &RemoteLimiterStore{
+		addr:    addr,
+		timeout: timeout,
+	}
+}
+
+func (s *RemoteLimiterStore) call(request storeRequest) (storeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+		if err != nil {
+			return storeResponse{}, err
+		}
+		s.conn = conn
+		s.encoder = json.NewEncoder(conn)
+		s.decoder = json.NewDecoder(bufio.NewReader(conn))
+	}
+
+	var response storeResponse
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	err := s.encoder.Encode(request)
+	if err == nil {
+		err = s.decoder.Decode(&response)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return storeResponse{}, err
+	}
+
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// ttlMillis rounds up, a sub-millisecond ttl must not turn into "never expires"
+func ttlMillis(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (s *RemoteLimiterStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	response, err := s.call(storeRequest{Op: "incr", Key: key, Delta: delta, TTL: ttlMillis(ttl)})
+	return response.Counter, err
+}
+
+func (s *RemoteLimiterStore) Get(key string) (string, bool, error) {
+	response, err := s.call(storeRequest{Op: "get", Key: key})
+	return response.Value, response.OK, err
+}
+
+func (s *RemoteLimiterStore) CompareAndSet(key, old, next string, ttl time.Duration) (bool, error) {
+	response, err := s.call(storeRequest{Op: "cas", Key: key, Old: old, Next: next, TTL: ttlMillis(ttl)})
+	return response.OK, err
+}
+
+func (s *RemoteLimiterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
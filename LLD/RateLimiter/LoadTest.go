@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SimulatedClock only moves when the load test advances it, so a minute of traffic runs instantly
+type SimulatedClock struct {
+	now time.Time
+}
+
+func NewSimulatedClock() *SimulatedClock {
+	return &SimulatedClock{now: time.Unix(0, 0)}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	return c.now
+}
+
+func (c *SimulatedClock) Set(t time.Time) {
+	c.now = t
+}
+
+// clockSetter is implemented by the in-memory strategies
+type clockSetter interface {
+	SetClock(now func() time.Time)
+}
+
+// arrivalPattern returns the request times (offsets from the start) of one client sending rate requests per second
+type arrivalPattern func(rng *rand.Rand, rate float64, duration time.Duration) []time.Duration
+
+var arrivalPatterns = map[string]arrivalPattern{
+	"constant": constantArrivals,
+	"poisson":  poissonArrivals,
+	"bursty":   burstyArrivals,
+	"diurnal":  diurnalArrivals,
+}
+
+func constantArrivals(rng *rand.Rand, rate float64, duration time.Duration) []time.Duration {
+	interval := time.Duration(float64(time.Second) / rate)
+	// A random phase keeps several constant clients from arriving in lockstep
+	var arrivals []time.Duration
+	for t := time.Duration(rng.Int63n(int64(interval))); t < duration; t += interval {
+		arrivals = append(arrivals, t)
+	}
+	return arrivals
+}
+
+func poissonArrivals(rng *rand.Rand, rate float64, duration time.Duration) []time.Duration {
+	var arrivals []time.Duration
+	for t := time.Duration(0); ; {
+		t += time.Duration(rng.ExpFloat64() / rate * float64(time.Second))
+		if t >= duration {
+			return arrivals
+		}
+		arrivals = append(arrivals, t)
+	}
+}
+
+// burstyArrivals sends the whole of every 5 seconds' traffic within 250ms
+func burstyArrivals(rng *rand.Rand, rate float64, duration time.Duration) []time.Duration {
+	const period = 5 * time.Second
+	const burstLength = 250 * time.Millisecond
+
+	perBurst := int(rate * period.Seconds())
+	var arrivals []time.Duration
+	for start := time.Duration(rng.Int63n(int64(period))); start < duration; start += period {
+		for i := 0; i < perBurst; i++ {
+			if t := start + time.Duration(rng.Int63n(int64(burstLength))); t < duration {
+				arrivals = append(arrivals, t)
+			}
+		}
+	}
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i] < arrivals[j] })
+	return arrivals
+}
+
+// diurnalArrivals is a Poisson process whose rate swings between 10% and 190% of rate over the run,
+// like a compressed day, generated by thinning a Poisson process at the peak rate
+func diurnalArrivals(rng *rand.Rand, rate float64, duration time.Duration) []time.Duration {
+	peak := rate * 1.9
+	var arrivals []time.Duration
+	for _, t := range poissonArrivals(rng, peak, duration) {
+		phase := 2 * math.Pi * t.Seconds() / duration.Seconds()
+		current := rate * (1 - 0.9*math.Cos(phase))
+		if rng.Float64() < current/peak {
+			arrivals = append(arrivals, t)
+		}
+	}
+	return arrivals
+}
+
+type arrival struct {
+	at     time.Duration
+	client int
+}
+
+// LoadTestResult is what one algorithm did with the traffic
+type LoadTestResult struct {
+	Algorithm        string
+	Accepted         []int // per second
+	Rejected         []int // per second
+	PerClient        []int // accepted per client
+	PeakPerSecond    int
+	PeakPer100ms     int
+	JainFairness     float64
+	TotalAccepted    int
+	TotalRejected    int
+	ConfiguredPerSec float64
+}
+
+// RunLoadTest drives the strategy of rule with the arrivals on a simulated clock
+func RunLoadTest(rule PolicyRule, arrivals []arrival, clients int, duration time.Duration) (LoadTestResult, error) {
+	newStrategy, err := rule.newStrategy()
+	if err != nil {
+		return LoadTestResult{}, err
+	}
+	strategy := newStrategy()
+	settable, ok := strategy.(clockSetter)
+	if !ok {
+		return LoadTestResult{}, fmt.Errorf("%s can't run on a simulated clock", rule.Algorithm)
+	}
+
+	clock := NewSimulatedClock()
+	start := clock.Now()
+	settable.SetClock(clock.Now)
+
+	seconds := int(math.Ceil(duration.Seconds()))
+	result := LoadTestResult{
+		Algorithm:        rule.Algorithm,
+		Accepted:         make([]int, seconds),
+		Rejected:         make([]int, seconds),
+		PerClient:        make([]int, clients),
+		ConfiguredPerSec: float64(rule.Limit) / time.Duration(rule.Window).Seconds(),
+	}
+	per100ms := make([]int, seconds*10)
+
+	for _, a := range arrivals {
+		clock.Set(start.Add(a.at))
+		second := int(a.at / time.Second)
+		if strategy.Allow() {
+			result.Accepted[second]++
+			result.PerClient[a.client]++
+			per100ms[int(a.at/(100*time.Millisecond))]++
+			result.TotalAccepted++
+		} else {
+			result.Rejected[second]++
+			result.TotalRejected++
+		}
+	}
+
+	for _, n := range result.Accepted {
+		result.PeakPerSecond = max(result.PeakPerSecond, n)
+	}
+	for _, n := range per100ms {
+		result.PeakPer100ms = max(result.PeakPer100ms, n)
+	}
+	result.JainFairness = jainFairness(result.PerClient)
+	return result, nil
+}
+
+// jainFairness is 1 when every client got the same share and 1/n when one client got everything
+func jainFairness(values []int) float64 {
+	var sum, squares float64
+	for _, v := range values {
+		sum += float64(v)
+		squares += float64(v) * float64(v)
+	}
+	if squares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(values)) * squares)
+}
+
+func writeLoadTestCSV(w io.Writer, results []LoadTestResult) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"algorithm", "second", "accepted", "rejected"})
+	for _, result := range results {
+		for second := range result.Accepted {
+			out.Write([]string{
+				result.Algorithm,
+				strconv.Itoa(second),
+				strconv.Itoa(result.Accepted[second]),
+				strconv.Itoa(result.Rejected[second]),
+			})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func printLoadTestSummary(w io.Writer, results []LoadTestResult) {
+	fmt.Fprintf(w, "%-16s %9s %9s %10s %12s %9s\n", "algorithm", "accepted", "rejected", "peak/sec", "peak/100ms", "fairness")
+	for _, r := range results {
+		fmt.Fprintf(w, "%-16s %9d %9d %10d %12d %9.3f\n",
+			r.Algorithm, r.TotalAccepted, r.TotalRejected, r.PeakPerSecond, r.PeakPer100ms, r.JainFairness)
+	}
+	if len(results) > 0 {
+		fmt.Fprintf(w, "configured rate %.2f/s; peak/sec and peak/100ms above it show how much burst an algorithm lets through\n", results[0].ConfiguredPerSec)
+	}
+}
+
+// runLoadTest is the loadtest command, e.g. go run . loadtest -algorithm all -pattern bursty
+func runLoadTest(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	algorithm := flags.String("algorithm", "all", "fixed_window, sliding_window, token_bucket, leaky_bucket, gcra or all")
+	limit := flags.Int("limit", 10, "requests allowed per window")
+	window := flags.Duration("window", time.Second, "window, for the buckets limit/window is the rate")
+	burst := flags.Int("burst", 0, "bucket size for the bucket algorithms, defaults to limit")
+	pattern := flags.String("pattern", "poisson", "constant, poisson, bursty or diurnal")
+	rate := flags.Float64("rate", 5, "requests per second sent by each client")
+	clients := flags.Int("clients", 4, "number of clients sharing the limiter")
+	duration := flags.Duration("duration", time.Minute, "simulated duration")
+	seed := flags.Int64("seed", 1, "random seed")
+	csvPath := flags.String("csv", "", "write per second counts to this file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	generate, ok := arrivalPatterns[*pattern]
+	if !ok {
+		return fmt.Errorf("unknown pattern %q", *pattern)
+	}
+	if *rate <= 0 || *clients <= 0 || *duration <= 0 {
+		return fmt.Errorf("rate, clients and duration must be positive")
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	var arrivals []arrival
+	for client := 0; client < *clients; client++ {
+		for _, at := range generate(rng, *rate, *duration) {
+			arrivals = append(arrivals, arrival{at: at, client: client})
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].at < arrivals[j].at })
+
+	algorithms := []string{*algorithm}
+	if *algorithm == "all" {
+		algorithms = []string{"fixed_window", "sliding_window", "token_bucket", "leaky_bucket", "gcra"}
+	}
+
+	var results []LoadTestResult
+	for _, name := range algorithms {
+		rule := PolicyRule{Name: name, Algorithm: name, Limit: *limit, Window: Duration(*window), Burst: *burst}
+		result, err := RunLoadTest(rule, arrivals, *clients, *duration)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		results = append(results, result)
+	}
+
+	switch *csvPath {
+	case "":
+	case "-":
+		if err := writeLoadTestCSV(os.Stdout, results); err != nil {
+			return err
+		}
+	default:
+		file, err := os.Create(*csvPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := writeLoadTestCSV(file, results); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%d clients, %s traffic at %.2f/s each for %s\n", *clients, *pattern, *rate, *duration)
+	fmt.Println(strings.Repeat("-", 70))
+	printLoadTestSummary(os.Stdout, results)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestArrivalPatterns(t *testing.T) {
+	const rate = 5
+	const duration = 100 * time.Second
+	// how far each pattern may be from rate*duration arrivals, the random ones are within a few deviations
+	tolerance := map[string]float64{"constant": 0.01, "poisson": 0.1, "bursty": 0.05, "diurnal": 0.15}
+
+	for name, generate := range arrivalPatterns {
+		arrivals := generate(rand.New(rand.NewSource(1)), rate, duration)
+		if !sort.SliceIsSorted(arrivals, func(i, j int) bool { return arrivals[i] < arrivals[j] }) {
+			t.Errorf("%s: arrivals out of order", name)
+		}
+		if len(arrivals) > 0 && (arrivals[0] < 0 || arrivals[len(arrivals)-1] >= duration) {
+			t.Errorf("%s: arrivals from %s to %s, want them within [0, %s)", name, arrivals[0], arrivals[len(arrivals)-1], duration)
+		}
+		want := rate * duration.Seconds()
+		if got := float64(len(arrivals)); math.Abs(got-want) > want*tolerance[name] {
+			t.Errorf("%s: %v arrivals in %s at %d/s, want about %v", name, got, duration, rate, want)
+		}
+	}
+}
+
+func TestRunLoadTestCountsEveryArrival(t *testing.T) {
+	const clients = 3
+	const duration = 10 * time.Second
+	rng := rand.New(rand.NewSource(1))
+	var arrivals []arrival
+	for client := 0; client < clients; client++ {
+		for _, at := range burstyArrivals(rng, 5, duration) {
+			arrivals = append(arrivals, arrival{at: at, client: client})
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].at < arrivals[j].at })
+
+	for _, algorithm := range []string{"fixed_window", "sliding_window", "token_bucket", "leaky_bucket", "gcra"} {
+		rule := PolicyRule{Name: algorithm, Algorithm: algorithm, Limit: 10, Window: Duration(time.Second)}
+		result, err := RunLoadTest(rule, arrivals, clients, duration)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if result.TotalAccepted+result.TotalRejected != len(arrivals) {
+			t.Errorf("%s: %d accepted and %d rejected of %d arrivals", algorithm, result.TotalAccepted, result.TotalRejected, len(arrivals))
+		}
+		accepted, rejected, perClient := 0, 0, 0
+		for second := range result.Accepted {
+			accepted += result.Accepted[second]
+			rejected += result.Rejected[second]
+		}
+		for _, n := range result.PerClient {
+			perClient += n
+		}
+		if accepted != result.TotalAccepted || rejected != result.TotalRejected || perClient != result.TotalAccepted {
+			t.Errorf("%s: per second %d/%d and per client %d don't add up to the totals %d/%d",
+				algorithm, accepted, rejected, perClient, result.TotalAccepted, result.TotalRejected)
+		}
+		if result.TotalRejected == 0 {
+			t.Errorf("%s: nothing rejected of bursts at 3 times the limit", algorithm)
+		}
+	}
+}
+
+func TestJainFairness(t *testing.T) {
+	cases := []struct {
+		values []int
+		want   float64
+	}{
+		{[]int{7, 7, 7, 7}, 1},
+		{[]int{12, 0, 0, 0}, 0.25},
+		{[]int{0, 0}, 1},
+		{[]int{3, 1}, 0.8},
+	}
+	for _, c := range cases {
+		if got := jainFairness(c.values); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("jainFairness(%v) = %v, want %v", c.values, got, c.want)
+		}
+	}
+}
+
+func TestLoadTestCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loadtest.csv")
+	if err := runLoadTest([]string{"-duration", "3s", "-pattern", "constant", "-csv", path}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a header, then a row for every second of every algorithm
+	if len(rows) == 0 || rows[0][0] != "algorithm" {
+		t.Fatalf("rows %v, want a header first", rows)
+	}
+	perAlgorithm := map[string]int{}
+	for _, row := range rows[1:] {
+		perAlgorithm[row[0]]++
+	}
+	if len(perAlgorithm) != 5 {
+		t.Errorf("rows for %v, want all 5 algorithms", perAlgorithm)
+	}
+	for algorithm, n := range perAlgorithm {
+		if n != 3 {
+			t.Errorf("%s has %d rows, want one per second of 3", algorithm, n)
+		}
+	}
+}
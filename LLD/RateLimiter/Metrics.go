@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Decision is one Allow or Reserve call on a RateLimiterContext, or a reservation given back
+type Decision struct {
+	Time      time.Time `json:"time"`
+	Limiter   string    `json:"limiter,omitempty"` // the policy rule or level, see WithName
+	Key       string    `json:"key"`
+	Strategy  string    `json:"strategy"`
+	Allowed   bool      `json:"allowed"`
+	Cancelled bool      `json:"cancelled,omitempty"` // a reservation was given back, Allowed is false
+	Limit     int       `json:"limit"`               // -1 if the strategy can't report its status
+	Remaining int       `json:"remaining"`           // -1 if the strategy can't report its status
+}
+
+// DecisionSink receives every decision of the contexts it is attached to
+type DecisionSink interface {
+	Record(decision Decision)
+}
+
+// JSONDecisionLog writes one JSON object per decision
+type JSONDecisionLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONDecisionLog(w io.Writer) *JSONDecisionLog {
+	return &JSONDecisionLog{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (l *JSONDecisionLog) Record(decision Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.encoder.Encode(decision)
+}
+
+// StrategyName is how a strategy shows up in metrics and decision logs
+func StrategyName(strategy RateLimiter) string {
+	switch s := strategy.(type) {
+	case *FixedWindowRateLimiter:
+		return "fixed_window"
+	case *SlidingWindowRateLimiter:
+		return "sliding_window"
+	case *TokenBucketRateLimiter:
+		return "token_bucket"
+	case *LeakyBucketRateLimiter:
+		return "leaky_bucket"
+	case *GCRARateLimiter:
+		return "gcra"
+	case *DistributedFixedWindowRateLimiter:
+		return "distributed_fixed_window"
+	case *DistributedSlidingWindowRateLimiter:
+		return "distributed_sliding_window"
+	case *DistributedTokenBucketRateLimiter:
+		return "distributed_token_bucket"
+	case *DistributedGCRARateLimiter:
+		return "distributed_gcra"
+	case *priorityClassLimiter:
+		return "priority_token_bucket"
+	case *CompositeRateLimiter:
+		return "composite"
+	case *RateLimiterContext:
+		return StrategyName(s.Strategy())
+	default:
+		return fmt.Sprintf("%T", strategy)
+	}
+}
+
+// limiterLabels identify one set of counters, keys aren't a label since clients choose them
+type limiterLabels struct {
+	limiter  string
+	strategy string
+}
+
+type limiterCounters struct {
+	allowed   int64
+	rejected  int64
+	cancelled int64
+	exhausted int64
+}
+
+// LimiterMetrics is a snapshot of the counters of one limiter and strategy
+type LimiterMetrics struct {
+	Limiter   string
+	Strategy  string
+	Allowed   int64
+	Rejected  int64
+	Cancelled int64 // reservations given back after they were allowed
+	// Exhausted counts decisions that left their key without capacity, how often clients of the
+	// limiter run into it
+	Exhausted int64
+}
+
+// RateLimiterMetrics counts decisions per limiter and strategy, gauges the capacity left per
+// limiter and holds other gauges like a shaper's queue depth
+type RateLimiterMetrics struct {
+	mu        sync.Mutex
+	limiters  map[limiterLabels]*limiterCounters
+	remaining map[string]func() int64
+	gauges    map[string]func() int64
+}
+
+func NewRateLimiterMetrics() *RateLimiterMetrics {
+	return &RateLimiterMetrics{
+		limiters:  make(map[limiterLabels]*limiterCounters),
+		remaining: make(map[string]func() int64),
+		gauges:    make(map[string]func() int64),
+	}
+}
+
+func (m *RateLimiterMetrics) counters(labels limiterLabels) *limiterCounters {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters, exists := m.limiters[labels]
+	if !exists {
+		counters = &limiterCounters{}
+		m.limiters[labels] = counters
+	}
+	return counters
+}
+
+// Record implements DecisionSink, so metrics can also be fed from a decision stream
+func (m *RateLimiterMetrics) Record(decision Decision) {
+	counters := m.counters(limiterLabels{limiter: decision.Limiter, strategy: decision.Strategy})
+	switch {
+	case decision.Cancelled:
+		atomic.AddInt64(&counters.cancelled, 1)
+		return
+	case decision.Allowed:
+		atomic.AddInt64(&counters.allowed, 1)
+	default:
+		atomic.AddInt64(&counters.rejected, 1)
+	}
+	if decision.Remaining == 0 {
+		atomic.AddInt64(&counters.exhausted, 1)
+	}
+}
+
+// RegisterGauge adds a value that is read on every snapshot, e.g. a LeakyBucketShaper's queue depth:
+// metrics.RegisterGauge("jobs_queued", func() int64 { return int64(shaper.QueueDepth()) })
+func (m *RateLimiterMetrics) RegisterGauge(name string, read func() int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = read
+}
+
+// RegisterRemaining gauges the capacity left of limiter, read returns -1 when it isn't known.
+// Named contexts and keyed limiters with metrics register themselves, a later limiter with the
+// same name replaces the earlier one.
+func (m *RateLimiterMetrics) RegisterRemaining(limiter string, read func() int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remaining[limiter] = read
+}
+
+// Remaining returns the capacity left per limiter, limiters that can't report it are left out
+func (m *RateLimiterMetrics) Remaining() map[string]int64 {
+	m.mu.Lock()
+	reads := make(map[string]func() int64, len(m.remaining))
+	for limiter, read := range m.remaining {
+		reads[limiter] = read
+	}
+	m.mu.Unlock()
+
+	// read outside the lock, the limiters take their own locks
+	remaining := make(map[string]int64, len(reads))
+	for limiter, read := range reads {
+		if n := read(); n >= 0 {
+			remaining[limiter] = n
+		}
+	}
+	return remaining
+}
+
+// Snapshot returns the limiters sorted by name and strategy, and the current gauge values
+func (m *RateLimiterMetrics) Snapshot() ([]LimiterMetrics, map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limiters := make([]LimiterMetrics, 0, len(m.limiters))
+	for labels, counters := range m.limiters {
+		limiters = append(limiters, LimiterMetrics{
+			Limiter:   labels.limiter,
+			Strategy:  labels.strategy,
+			Allowed:   atomic.LoadInt64(&counters.allowed),
+			Rejected:  atomic.LoadInt64(&counters.rejected),
+			Cancelled: atomic.LoadInt64(&counters.cancelled),
+			Exhausted: atomic.LoadInt64(&counters.exhausted),
+		})
+	}
+	sort.Slice(limiters, func(i, j int) bool {
+		if limiters[i].Limiter != limiters[j].Limiter {
+			return limiters[i].Limiter < limiters[j].Limiter
+		}
+		return limiters[i].Strategy < limiters[j].Strategy
+	})
+
+	gauges := make(map[string]int64, len(m.gauges))
+	for name, read := range m.gauges {
+		gauges[name] = read()
+	}
+	return limiters, gauges
+}
+
+// ServeHTTP exposes the metrics in the Prometheus text format
+func (m *RateLimiterMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limiters, gauges := m.Snapshot()
+	remaining := m.Remaining()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, l := range limiters {
+		labels := fmt.Sprintf("limiter=%q,strategy=%q", l.Limiter, l.Strategy)
+		fmt.Fprintf(w, "ratelimiter_requests_total{%s,decision=\"allowed\"} %d\n", labels, l.Allowed)
+		fmt.Fprintf(w, "ratelimiter_requests_total{%s,decision=\"rejected\"} %d\n", labels, l.Rejected)
+		fmt.Fprintf(w, "ratelimiter_requests_total{%s,decision=\"cancelled\"} %d\n", labels, l.Cancelled)
+		fmt.Fprintf(w, "ratelimiter_exhausted_total{%s} %d\n", labels, l.Exhausted)
+	}
+
+	names := make([]string, 0, len(remaining))
+	for name := range remaining {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "ratelimiter_remaining{limiter=%q} %d\n", name, remaining[name])
+	}
+
+	names = make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "ratelimiter_gauge{name=%q} %d\n", name, gauges[name])
+	}
+}
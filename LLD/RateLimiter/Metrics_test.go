@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decisionLog keeps the decisions it is given
+type decisionLog struct {
+	decisions []Decision
+}
+
+func (l *decisionLog) Record(decision Decision) {
+	l.decisions = append(l.decisions, decision)
+}
+
+func TestMetricsPerLimiter(t *testing.T) {
+	metrics := NewRateLimiterMetrics()
+	newWindow := func() RateLimiter { return NewFixedWindowRateLimiter(1, time.Hour) }
+	login := NewKeyedRateLimiter(newWindow, WithName("login"), WithMetrics(metrics))
+	api := NewKeyedRateLimiter(newWindow, WithName("api"), WithMetrics(metrics))
+
+	login.Allow("1.2.3.4")
+	login.Allow("1.2.3.4")
+	api.Allow("1.2.3.4")
+	api.Allow("5.6.7.8")
+
+	limiters, _ := metrics.Snapshot()
+	want := []LimiterMetrics{
+		{Limiter: "api", Strategy: "fixed_window", Allowed: 2, Exhausted: 2},
+		{Limiter: "login", Strategy: "fixed_window", Allowed: 1, Rejected: 1, Exhausted: 2},
+	}
+	if len(limiters) != len(want) {
+		t.Fatalf("metrics %+v, want %+v", limiters, want)
+	}
+	for i := range want {
+		if limiters[i] != want[i] {
+			t.Errorf("metrics %+v, want %+v", limiters[i], want[i])
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	line := `ratelimiter_requests_total{limiter="login",strategy="fixed_window",decision="rejected"} 1`
+	if !strings.Contains(recorder.Body.String(), line) {
+		t.Errorf("metrics output without %s:\n%s", line, recorder.Body.String())
+	}
+}
+
+func TestReserveIsRecorded(t *testing.T) {
+	metrics := NewRateLimiterMetrics()
+	log := &decisionLog{}
+	user := NewRateLimiterContext(NewTokenBucketRateLimiter(5, 1),
+		WithName("user"), WithKey("alice"), WithMetrics(metrics), WithDecisionSink(log))
+	global := NewRateLimiterContext(NewFixedWindowRateLimiter(1, time.Hour),
+		WithName("global"), WithMetrics(metrics), WithDecisionSink(log))
+	composite, err := NewCompositeRateLimiter(Level{Name: "user", Limiter: user}, Level{Name: "global", Limiter: global})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	composite.Allow()
+	if rejectedBy, ok := composite.Check(); ok || rejectedBy != "global" {
+		t.Fatalf("second request: rejected by %q, ok %v, want rejected by global", rejectedBy, ok)
+	}
+
+	limiters, _ := metrics.Snapshot()
+	want := []LimiterMetrics{
+		{Limiter: "global", Strategy: "fixed_window", Allowed: 1, Rejected: 1, Exhausted: 2},
+		{Limiter: "user", Strategy: "token_bucket", Allowed: 2, Cancelled: 1},
+	}
+	if len(limiters) != len(want) {
+		t.Fatalf("metrics %+v, want %+v", limiters, want)
+	}
+	for i := range want {
+		if limiters[i] != want[i] {
+			t.Errorf("metrics %+v, want %+v", limiters[i], want[i])
+		}
+	}
+
+	last := log.decisions[len(log.decisions)-1]
+	if !last.Cancelled || last.Limiter != "user" || last.Key != "alice" || last.Remaining != 4 {
+		t.Errorf("last decision %+v, want alice's cancelled reservation with 4 tokens left", last)
+	}
+}
+
+func TestRemainingGauge(t *testing.T) {
+	metrics := NewRateLimiterMetrics()
+	newWindow := func() RateLimiter { return NewFixedWindowRateLimiter(3, time.Hour) }
+	global := NewRateLimiterContext(newWindow(), WithName("global"), WithMetrics(metrics))
+	api := NewKeyedRateLimiter(newWindow, WithName("api"), WithMetrics(metrics))
+	NewRateLimiterContext(newWindow(), WithMetrics(metrics)) // without a name there is nothing to gauge
+
+	global.Allow()
+	api.Allow("1.2.3.4")
+	api.Allow("1.2.3.4")
+	api.Allow("5.6.7.8")
+
+	// a keyed limiter reports the key closest to its limit
+	remaining := metrics.Remaining()
+	if len(remaining) != 2 || remaining["global"] != 2 || remaining["api"] != 1 {
+		t.Errorf("remaining %v, want 2 for global and 1 for api", remaining)
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	line := `ratelimiter_remaining{limiter="api"} 1`
+	if !strings.Contains(recorder.Body.String(), line) {
+		t.Errorf("metrics output without %s:\n%s", line, recorder.Body.String())
+	}
+}
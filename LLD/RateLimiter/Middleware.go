@@ -0,0 +1,242 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is how many keys a KeyedRateLimiter tracks before it evicts the least recently used
+const DefaultMaxKeys = 10000
+
+// KeyedRateLimiter keeps one RateLimiterContext per key (client IP, API key, route, ...). Keys come
+// from clients, so only the maxKeys most recently used are kept.
+type KeyedRateLimiter struct {
+	mu          sync.Mutex
+	limiters    map[string]*list.Element // values are *keyedLimiter
+	recent      *list.List               // most recently used first
+	maxKeys     int
+	newStrategy func() RateLimiter
+	opts        []ContextOption
+}
+
+type keyedLimiter struct {
+	key     string
+	limiter *RateLimiterContext
+}
+
+// NewKeyedRateLimiter creates a keyed limiter, newStrategy is called the first time a key is seen.
+// Every context is created with opts and its key. With a name and metrics the lowest capacity
+// left of any key is gauged under the name.
+func NewKeyedRateLimiter(newStrategy func() RateLimiter, opts ...ContextOption) *KeyedRateLimiter {
+	k := &KeyedRateLimiter{
+		limiters:    make(map[string]*list.Element),
+		recent:      list.New(),
+		maxKeys:     DefaultMaxKeys,
+		newStrategy: newStrategy,
+		opts:        opts,
+	}
+	var settings RateLimiterContext
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	if settings.metrics != nil && settings.name != "" {
+		settings.metrics.RegisterRemaining(settings.name, k.lowestRemaining)
+	}
+	return k
+}
+
+// SetMaxKeys changes how many keys are kept (at least one), the least recently used are evicted
+// down to maxKeys. An evicted key starts over with a fresh limiter the next time it is seen.
+func (k *KeyedRateLimiter) SetMaxKeys(maxKeys int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.maxKeys = max(maxKeys, 1)
+	k.evict()
+}
+
+// Len returns how many keys are tracked
+func (k *KeyedRateLimiter) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.limiters)
+}
+
+// Get returns the limiter for key, creating it if needed
+func (k *KeyedRateLimiter) Get(key string) *RateLimiterContext {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if element, exists := k.limiters[key]; exists {
+		k.recent.MoveToFront(element)
+		return element.Value.(*keyedLimiter).limiter
+	}
+
+	opts := append([]ContextOption{WithKey(key)}, k.opts...)
+	limiter := NewRateLimiterContext(k.newStrategy(), opts...)
+	k.limiters[key] = k.recent.PushFront(&keyedLimiter{key: key, limiter: limiter})
+	k.evict()
+	return limiter
+}
+
+// evict must be called with the lock held
+func (k *KeyedRateLimiter) evict() {
+	for len(k.limiters) > k.maxKeys {
+		oldest := k.recent.Back()
+		k.recent.Remove(oldest)
+		delete(k.limiters, oldest.Value.(*keyedLimiter).key)
+	}
+}
+
+// lowestRemaining is the capacity left of the key closest to its limit, -1 if no key can report it
+func (k *KeyedRateLimiter) lowestRemaining() int64 {
+	k.mu.Lock()
+	limiters := make([]*RateLimiterContext, 0, len(k.limiters))
+	for _, element := range k.limiters {
+		limiters = append(limiters, element.Value.(*keyedLimiter).limiter)
+	}
+	k.mu.Unlock()
+
+	lowest := int64(-1)
+	for _, limiter := range limiters {
+		if n := limiter.remaining(); n >= 0 && (lowest < 0 || n < lowest) {
+			lowest = n
+		}
+	}
+	return lowest
+}
+
+// Allow checks the limiter for key
+func (k *KeyedRateLimiter) Allow(key string) bool {
+	return k.Get(key).Allow()
+}
+
+// RateLimitError is returned by the RPC interceptor when a request is rejected
+type RateLimitError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %q, retry after %s", e.Key, e.RetryAfter)
+}
+
+// ErrRateLimited can be matched with errors.Is against any *RateLimitError
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// HTTP middleware
+
+// KeyFunc extracts the rate limit key from a request
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP uses the client IP, ignoring the port
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader uses the value of the given header, e.g. an API key
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// KeyByRoute uses the method and path, so every route gets its own limit
+func KeyByRoute(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// RateLimitMiddleware rejects requests over the limit with 429 Too Many Requests
+func RateLimitMiddleware(limiters *KeyedRateLimiter, keyFunc KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveLimited(w, r, limiters.Get(keyFunc(r)), next)
+		})
+	}
+}
+
+// serveLimited calls next if limiter allows the request, otherwise it answers 429
+func serveLimited(w http.ResponseWriter, r *http.Request, limiter *RateLimiterContext, next http.Handler) {
+	allowed, status, hasStatus := limiter.AllowStatus()
+	if hasStatus {
+		setRateLimitHeaders(w.Header(), status)
+	}
+
+	if !allowed {
+		retryAfter := time.Second
+		if hasStatus && status.RetryAfter > 0 {
+			retryAfter = status.RetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+func setRateLimitHeaders(header http.Header, status LimitStatus) {
+	header.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(status.Reset.Unix(), 10))
+}
+
+// ceilSeconds rounds up so clients never retry before the limiter has capacity again
+func ceilSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// RPC interceptor, same shape as grpc.UnaryServerInterceptor so it can be adapted directly
+
+// UnaryServerInfo describes the RPC being called
+type UnaryServerInfo struct {
+	FullMethod string
+}
+
+// UnaryHandler is the RPC handler being wrapped
+type UnaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// UnaryServerInterceptor wraps a UnaryHandler
+type UnaryServerInterceptor func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error)
+
+// RPCKeyFunc extracts the rate limit key from an RPC call
+type RPCKeyFunc func(ctx context.Context, info *UnaryServerInfo) string
+
+// KeyByMethod gives every RPC method its own limit
+func KeyByMethod(ctx context.Context, info *UnaryServerInfo) string {
+	return info.FullMethod
+}
+
+// RateLimitUnaryInterceptor rejects calls over the limit with a *RateLimitError without calling the handler
+func RateLimitUnaryInterceptor(limiters *KeyedRateLimiter, keyFunc RPCKeyFunc) UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		key := keyFunc(ctx, info)
+		limiter := limiters.Get(key)
+		if allowed, status, ok := limiter.AllowStatus(); !allowed {
+			err := &RateLimitError{Key: key, RetryAfter: time.Second}
+			if ok && status.RetryAfter > 0 {
+				err.RetryAfter = status.RetryAfter
+			}
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	keyed := NewKeyedRateLimiter(func() RateLimiter { return NewFixedWindowRateLimiter(1, time.Hour) })
+	keyed.SetMaxKeys(2)
+
+	keyed.Allow("a")
+	keyed.Allow("b")
+	keyed.Get("a") // b is now the least recently used
+	keyed.Allow("c")
+
+	if n := keyed.Len(); n != 2 {
+		t.Fatalf("%d keys tracked, want 2", n)
+	}
+	if keyed.Allow("a") {
+		t.Error("a was evicted although it was used after b")
+	}
+	if !keyed.Allow("b") {
+		t.Error("b wasn't evicted, it kept its used up window")
+	}
+
+	for i := 0; i < 100; i++ {
+		keyed.Allow(fmt.Sprintf("client-%d", i))
+	}
+	if n := keyed.Len(); n != 2 {
+		t.Errorf("%d keys tracked after 100 new clients, want 2", n)
+	}
+}
+
+// newSimulatedWindows gives every key a window of limit per 90s on clock, which starts at 1000s
+func newSimulatedWindows(limit int) (*KeyedRateLimiter, *SimulatedClock) {
+	clock := NewSimulatedClock()
+	clock.Set(time.Unix(1000, 0))
+	return NewKeyedRateLimiter(func() RateLimiter {
+		window := NewFixedWindowRateLimiter(limit, 90*time.Second)
+		window.SetClock(clock.Now)
+		return window
+	}), clock
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiters, clock := newSimulatedWindows(2)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	handler := RateLimitMiddleware(limiters, KeyByIP)(ok)
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = ip + ":1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	cases := []struct {
+		ip         string
+		advance    time.Duration
+		code       int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{ip: "1.1.1.1", code: http.StatusNoContent, remaining: "1", reset: "1090"},
+		{ip: "1.1.1.1", code: http.StatusNoContent, remaining: "0", reset: "1090"},
+		{ip: "1.1.1.1", code: http.StatusTooManyRequests, remaining: "0", reset: "1090", retryAfter: "90"},
+		// rounded up, so the client doesn't come back half a second early
+		{ip: "1.1.1.1", advance: 30*time.Second + time.Second/2, code: http.StatusTooManyRequests, remaining: "0", reset: "1090", retryAfter: "60"},
+		// another client's window starts with its own first request
+		{ip: "2.2.2.2", code: http.StatusNoContent, remaining: "1", reset: "1120"},
+	}
+	for i, c := range cases {
+		clock.Set(clock.Now().Add(c.advance))
+		response := serve(c.ip)
+		header := response.Header()
+		if response.Code != c.code {
+			t.Errorf("request %d: status %d, want %d", i, response.Code, c.code)
+		}
+		if header.Get("X-RateLimit-Limit") != "2" || header.Get("X-RateLimit-Remaining") != c.remaining {
+			t.Errorf("request %d: limit %q, remaining %q, want 2 and %s", i,
+				header.Get("X-RateLimit-Limit"), header.Get("X-RateLimit-Remaining"), c.remaining)
+		}
+		if reset := header.Get("X-RateLimit-Reset"); reset != c.reset {
+			t.Errorf("request %d: reset %q, want the end of the window at %s", i, reset, c.reset)
+		}
+		if got := header.Get("Retry-After"); got != c.retryAfter {
+			t.Errorf("request %d: Retry-After %q, want %q", i, got, c.retryAfter)
+		}
+	}
+}
+
+func TestRemainingIsFromTheSameDecision(t *testing.T) {
+	const limit = 50
+	limiters := NewKeyedRateLimiter(func() RateLimiter { return NewFixedWindowRateLimiter(limit, time.Hour) })
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := RateLimitMiddleware(limiters, KeyByRoute)(ok)
+
+	var mu sync.Mutex
+	var remaining []int
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+			n, _ := strconv.Atoi(recorder.Header().Get("X-RateLimit-Remaining"))
+			mu.Lock()
+			remaining = append(remaining, n)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// every allowed request saw the count its own decision left, none saw another's
+	sort.Ints(remaining)
+	for i, n := range remaining {
+		if n != i {
+			t.Fatalf("concurrent requests saw remaining %v, want each of 0 to %d once", remaining, limit-1)
+		}
+	}
+}
+
+func TestRateLimitUnaryInterceptor(t *testing.T) {
+	limiters, clock := newSimulatedWindows(1)
+	interceptor := RateLimitUnaryInterceptor(limiters, KeyByMethod)
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return "pong", nil
+	}
+	call := func(method string) (interface{}, error) {
+		return interceptor(t.Context(), "ping", &UnaryServerInfo{FullMethod: method}, handler)
+	}
+
+	if response, err := call("/Echo/Ping"); err != nil || response != "pong" {
+		t.Fatalf("first call = %v, %v", response, err)
+	}
+	clock.Set(clock.Now().Add(30 * time.Second))
+	_, err := call("/Echo/Ping")
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("second call = %v, want a *RateLimitError", err)
+	}
+	if limited.Key != "/Echo/Ping" || limited.RetryAfter != 60*time.Second {
+		t.Errorf("rejected %q with retry after %s, want /Echo/Ping and 60s", limited.Key, limited.RetryAfter)
+	}
+	if _, err := call("/Echo/Status"); err != nil {
+		t.Errorf("another method = %v, want its own limit", err)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2: not for the rejected call", calls)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration reads "1m", "500ms", ... from the policy file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// PolicyRule describes which requests a limit applies to and how it is enforced.
+// For the bucket algorithms one request is refilled every window/limit and burst is the bucket size
+// (defaults to limit).
+type PolicyRule struct {
+	Name      string   `json:"name"`
+	Route     string   `json:"route,omitempty"`     // path prefix, empty matches every path
+	Method    string   `json:"method,omitempty"`    // empty matches every method
+	Key       string   `json:"key,omitempty"`       // "ip" (default), "route" or "header:<Name>"
+	KeyPrefix string   `json:"keyPrefix,omitempty"` // only keys starting with this, e.g. "free_" API keys
+	Algorithm string   `json:"algorithm"`           // fixed_window, sliding_window, token_bucket, leaky_bucket or gcra
+	Limit     int      `json:"limit"`
+	Window    Duration `json:"window"`
+	Burst     int      `json:"burst,omitempty"`
+	MaxKeys   int      `json:"maxKeys,omitempty"` // keys tracked before the least recently used is evicted, DefaultMaxKeys if 0
+}
+
+// PolicyConfig is the policy file, rules are matched in order and the first match wins
+type PolicyConfig struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// ParsePolicyConfig reads a JSON or YAML policy, both use the field names of the json tags
+func ParsePolicyConfig(data []byte) (PolicyConfig, error) {
+	if !json.Valid(data) {
+		converted, err := yamlToJSON(data)
+		if err != nil {
+			return PolicyConfig{}, fmt.Errorf("parse policy: %w", err)
+		}
+		data = converted
+	}
+
+	var config PolicyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return PolicyConfig{}, fmt.Errorf("parse policy: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return PolicyConfig{}, fmt.Errorf("policy rule without a name")
+		}
+		if names[rule.Name] {
+			return PolicyConfig{}, fmt.Errorf("duplicate policy rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if _, err := rule.newStrategy(); err != nil {
+			return PolicyConfig{}, fmt.Errorf("policy rule %q: %w", rule.Name, err)
+		}
+		if _, err := rule.keyFunc(); err != nil {
+			return PolicyConfig{}, fmt.Errorf("policy rule %q: %w", rule.Name, err)
+		}
+	}
+	return config, nil
+}
+
+// yamlToJSON lets a YAML policy go through the same json tags and Duration parsing as a JSON one
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document any
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// newStrategy builds the limiter for one key of the rule
+func (rule PolicyRule) newStrategy() (func() RateLimiter, error) {
+	window := time.Duration(rule.Window)
+	if err := validateWindow(rule.Limit, window); err != nil {
+		return nil, err
+	}
+
+	burst := rule.Burst
+	if burst <= 0 {
+		burst = rule.Limit
+	}
+	// the buckets emit one request every window/limit, so "90 per 1m" is one every 667ms
+	interval := window / time.Duration(rule.Limit)
+
+	switch rule.Algorithm {
+	case "fixed_window":
+		return func() RateLimiter { return NewFixedWindowRateLimiter(rule.Limit, window) }, nil
+	case "sliding_window":
+		return func() RateLimiter { return NewSlidingWindowRateLimiter(rule.Limit, window) }, nil
+	case "token_bucket", "leaky_bucket", "gcra":
+		if err := validateInterval(burst, interval); err != nil {
+			return nil, err
+		}
+		switch rule.Algorithm {
+		case "token_bucket":
+			return func() RateLimiter { return NewTokenBucketRateLimiterEvery(burst, interval) }, nil
+		case "leaky_bucket":
+			return func() RateLimiter { return NewLeakyBucketRateLimiterEvery(burst, interval) }, nil
+		default:
+			return func() RateLimiter { return NewGCRARateLimiterEvery(burst, interval) }, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", rule.Algorithm)
+	}
+}
+
+func (rule PolicyRule) keyFunc() (KeyFunc, error) {
+	switch {
+	case rule.Key == "" || rule.Key == "ip":
+		return KeyByIP, nil
+	case rule.Key == "route":
+		return KeyByRoute, nil
+	case strings.HasPrefix(rule.Key, "header:"):
+		return KeyByHeader(strings.TrimPrefix(rule.Key, "header:")), nil
+	default:
+		return nil, fmt.Errorf("unknown key %q", rule.Key)
+	}
+}
+
+// policyLimit is a rule with its live limiters
+type policyLimit struct {
+	rule     PolicyRule
+	keyFunc  KeyFunc
+	limiters *KeyedRateLimiter
+}
+
+// Policy is an immutable set of compiled rules
+type Policy struct {
+	limits []*policyLimit
+}
+
+// NewPolicy compiles config, limiters of rules that are unchanged from previous are carried over.
+// opts are applied to the limiter of every key.
+func NewPolicy(config PolicyConfig, previous *Policy, opts ...ContextOption) (*Policy, error) {
+	existing := make(map[string]*policyLimit)
+	if previous != nil {
+		for _, limit := range previous.limits {
+			existing[limit.rule.Name] = limit
+		}
+	}
+
+	policy := &Policy{}
+	for _, rule := range config.Rules {
+		if old, ok := existing[rule.Name]; ok && old.rule == rule {
+			policy.limits = append(policy.limits, old)
+			continue
+		}
+
+		newStrategy, err := rule.newStrategy()
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %q: %w", rule.Name, err)
+		}
+		keyFunc, err := rule.keyFunc()
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %q: %w", rule.Name, err)
+		}
+		limiters := NewKeyedRateLimiter(newStrategy, append([]ContextOption{WithName(rule.Name)}, opts...)...)
+		if rule.MaxKeys > 0 {
+			limiters.SetMaxKeys(rule.MaxKeys)
+		}
+		policy.limits = append(policy.limits, &policyLimit{
+			rule:     rule,
+			keyFunc:  keyFunc,
+			limiters: limiters,
+		})
+	}
+	return policy, nil
+}
+
+// Match returns the first rule matching the request, with the limiter for its key
+func (p *Policy) Match(r *http.Request) (rule PolicyRule, limiter *RateLimiterContext, ok bool) {
+	for _, limit := range p.limits {
+		if limit.rule.Method != "" && !strings.EqualFold(limit.rule.Method, r.Method) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, limit.rule.Route) {
+			continue
+		}
+		key := limit.keyFunc(r)
+		if !strings.HasPrefix(key, limit.rule.KeyPrefix) {
+			continue
+		}
+		return limit.rule, limit.limiters.Get(key), true
+	}
+	return PolicyRule{}, nil, false
+}
+
+// PolicyManager owns the current policy and reloads it when the file changes
+type PolicyManager struct {
+	path    string
+	opts    []ContextOption
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+	lastErr error
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// LoadPolicyFile reads and compiles the policy at path, opts are applied to the limiter of every key
+func LoadPolicyFile(path string, opts ...ContextOption) (*PolicyManager, error) {
+	manager := &PolicyManager{
+		path: path,
+		opts: opts,
+		stop: make(chan struct{}),
+	}
+	if err := manager.Reload(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+func (m *PolicyManager) Policy() *Policy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.policy
+}
+
+// Reload re-reads the file; on error the current policy stays in force
+func (m *PolicyManager) Reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return m.fail(err)
+	}
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m.fail(err)
+	}
+	config, err := ParsePolicyConfig(data)
+	if err != nil {
+		return m.fail(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	policy, err := NewPolicy(config, m.policy, m.opts...)
+	if err != nil {
+		m.lastErr = err
+		return err
+	}
+	m.policy = policy
+	m.modTime = info.ModTime()
+	m.lastErr = nil
+	return nil
+}
+
+func (m *PolicyManager) fail(err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastErr = err
+	return err
+}
+
+// Err is the error of the last failed reload, nil once a reload succeeds
+func (m *PolicyManager) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastErr
+}
+
+// Watch polls the file every interval and reloads it when its modification time changes
+func (m *PolicyManager) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(m.path)
+				if err != nil {
+					m.fail(err)
+					continue
+				}
+				m.mu.RLock()
+				changed := !info.ModTime().Equal(m.modTime)
+				m.mu.RUnlock()
+				if changed {
+					m.Reload()
+				}
+			}
+		}
+	}()
+}
+
+// Close stops watching the file
+func (m *PolicyManager) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+// PolicyMiddleware limits requests with the first matching rule, unmatched requests pass through
+func PolicyMiddleware(manager *PolicyManager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, limiter, ok := manager.Policy().Match(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			serveLimited(w, r, limiter, next)
+		})
+	}
+}
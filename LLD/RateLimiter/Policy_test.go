@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// allowedOver sends a request every step for duration to a limiter built from rule
+func allowedOver(t *testing.T, rule PolicyRule, step, duration time.Duration) int {
+	t.Helper()
+	newStrategy, err := rule.newStrategy()
+	if err != nil {
+		t.Fatalf("%s: %v", rule.Name, err)
+	}
+	strategy := newStrategy()
+	clock := NewSimulatedClock()
+	strategy.(clockSetter).SetClock(clock.Now)
+
+	allowed := 0
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		if strategy.Allow() {
+			allowed++
+		}
+		clock.Set(clock.Now().Add(step))
+	}
+	return allowed
+}
+
+func TestPolicyRatesArentTruncated(t *testing.T) {
+	for _, algorithm := range []string{"token_bucket", "leaky_bucket", "gcra"} {
+		// 90 per minute used to become 1/s. Requests come twice per interval, so the burst of one
+		// and the 900 refills of 10 minutes are all used.
+		rule := PolicyRule{Name: algorithm, Algorithm: algorithm, Limit: 90, Window: Duration(time.Minute), Burst: 1}
+		if allowed := allowedOver(t, rule, time.Minute/180, 10*time.Minute); allowed != 901 {
+			t.Errorf("%s allowed %d in 10m at 90/m, want 901", algorithm, allowed)
+		}
+
+		// slower than 1/s used to be rejected
+		rule = PolicyRule{Name: algorithm, Algorithm: algorithm, Limit: 2, Window: Duration(time.Hour)}
+		if allowed := allowedOver(t, rule, time.Second, 2*time.Hour); allowed != 5 {
+			t.Errorf("%s allowed %d in 2h at 2/h with a burst of 2, want 5", algorithm, allowed)
+		}
+	}
+}
+
+func TestParsePolicyYAML(t *testing.T) {
+	jsonData, err := os.ReadFile("policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlData, err := os.ReadFile("policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromJSON, err := ParsePolicyConfig(jsonData)
+	if err != nil {
+		t.Fatalf("policy.json: %v", err)
+	}
+	fromYAML, err := ParsePolicyConfig(yamlData)
+	if err != nil {
+		t.Fatalf("policy.yaml: %v", err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("policy.yaml = %+v, want the rules of policy.json %+v", fromYAML, fromJSON)
+	}
+
+	if _, err := ParsePolicyConfig([]byte("rules:\n  - name: bad\n    algorithm: gcra\n    limit: 5\n    window: 60\n")); err == nil {
+		t.Error("a window without a unit was accepted")
+	}
+}
+
+const reloadPolicy = `rules:
+  - name: login
+    route: /login
+    algorithm: fixed_window
+    limit: 5
+    window: 1h
+  - name: api
+    route: /api/
+    algorithm: fixed_window
+    limit: %d
+    window: 1h
+`
+
+// writePolicy writes the policy with the api limit and a modification time Watch can't miss
+func writePolicy(t *testing.T, path string, apiLimit int, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, fmt.Appendf(nil, reloadPolicy, apiLimit), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsUnchangedRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, path, 3, start)
+	manager, err := LoadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	limiterFor := func(path string) *RateLimiterContext {
+		t.Helper()
+		request := httptest.NewRequest("POST", path, nil)
+		_, limiter, ok := manager.Policy().Match(request)
+		if !ok {
+			t.Fatalf("no rule for %s", path)
+		}
+		return limiter
+	}
+	remaining := func(limiter *RateLimiterContext) int {
+		status, _ := limiter.Status()
+		return status.Remaining
+	}
+	login, api := limiterFor("/login"), limiterFor("/api/orders")
+	login.Allow()
+	login.Allow()
+	for i := 0; i < 3; i++ {
+		api.Allow()
+	}
+
+	old := manager.Policy()
+	manager.Watch(time.Millisecond)
+	writePolicy(t, path, 10, start.Add(time.Minute))
+	for deadline := time.Now().Add(time.Second); manager.Policy() == old; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the changed file wasn't reloaded: %v", manager.Err())
+		}
+	}
+
+	if reloaded := limiterFor("/login"); reloaded != login || remaining(reloaded) != 3 {
+		t.Errorf("login has %d left after reloading, want its 3 kept", remaining(reloaded))
+	}
+	if reloaded := limiterFor("/api/orders"); remaining(reloaded) != 10 {
+		t.Errorf("api has %d left after its limit changed to 10, want a new limiter with 10", remaining(reloaded))
+	}
+
+	// a broken file keeps the policy in force
+	current := manager.Policy()
+	if err := os.WriteFile(path, []byte("rules: [{name: api, algorithm: nope}]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Reload(); err == nil || manager.Err() == nil {
+		t.Fatal("a broken policy was loaded")
+	}
+	if manager.Policy() != current || remaining(limiterFor("/login")) != 3 {
+		t.Error("a failed reload replaced the policy")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PriorityClass is a class of traffic with a guaranteed share (in percent) of capacity and rate
+type PriorityClass struct {
+	Name  string
+	Share int
+}
+
+// PriorityRateLimiter splits a token bucket between priority classes. Every class has its own bucket
+// for its guaranteed share, the unreserved rest is a shared pool, and a class whose bucket is empty
+// may borrow from the pool and then from lower classes, lowest first. Lower classes never borrow
+// from higher ones, so health checks keep working while batch traffic is being rejected.
+type PriorityRateLimiter struct {
+	classes []PriorityClass
+	buckets []*TokenBucketRateLimiter
+	pool    *TokenBucketRateLimiter
+	index   map[string]int
+}
+
+// NewPriorityRateLimiter takes classes most important first, their shares must add up to at most 100
+func NewPriorityRateLimiter(capacity, rate int, classes ...PriorityClass) (*PriorityRateLimiter, error) {
+	if err := validateRate(capacity, rate); err != nil {
+		return nil, err
+	}
+	if len(classes) == 0 {
+		return nil, fmt.Errorf("at least one priority class is needed")
+	}
+	limiter := &PriorityRateLimiter{
+		classes: classes,
+		index:   make(map[string]int),
+	}
+
+	reserved := 0
+	for i, class := range classes {
+		if _, exists := limiter.index[class.Name]; exists {
+			return nil, fmt.Errorf("duplicate priority class %q", class.Name)
+		}
+		if class.Share <= 0 {
+			return nil, fmt.Errorf("priority class %q: share %d%% must be positive", class.Name, class.Share)
+		}
+		classCapacity, classInterval := shareOf(capacity, rate, class.Share)
+		if classCapacity < 1 {
+			return nil, fmt.Errorf("priority class %q: a %d%% share of capacity %d is less than one token", class.Name, class.Share, capacity)
+		}
+		if err := validateInterval(classCapacity, classInterval); err != nil {
+			return nil, fmt.Errorf("priority class %q: %w", class.Name, err)
+		}
+		reserved += class.Share
+		limiter.index[class.Name] = i
+		limiter.buckets = append(limiter.buckets, NewTokenBucketRateLimiterEvery(classCapacity, classInterval))
+	}
+	if reserved > 100 {
+		return nil, fmt.Errorf("priority class shares add up to %d%%", reserved)
+	}
+
+	if reserved < 100 {
+		if poolCapacity, poolInterval := shareOf(capacity, rate, 100-reserved); poolCapacity > 0 {
+			if err := validateInterval(poolCapacity, poolInterval); err != nil {
+				return nil, fmt.Errorf("priority pool: %w", err)
+			}
+			limiter.pool = NewTokenBucketRateLimiterEvery(poolCapacity, poolInterval)
+		}
+	}
+	return limiter, nil
+}
+
+// shareOf is percent of capacity, rounded down, and the interval between tokens at percent of
+// rate, which isn't rounded to whole tokens per second: 15% of 10/s is a token every 666ms
+func shareOf(capacity, rate, percent int) (int, time.Duration) {
+	return capacity * percent / 100, 100 * time.Second / time.Duration(rate*percent)
+}
+
+// SetClock replaces time.Now in every bucket, e.g. with a simulated clock, and refills them
+func (p *PriorityRateLimiter) SetClock(now func() time.Time) {
+	for _, bucket := range p.buckets {
+		bucket.SetClock(now)
+	}
+	if p.pool != nil {
+		p.pool.SetClock(now)
+	}
+}
+
+// sources are the buckets a class may take from, in the order it takes from them
+func (p *PriorityRateLimiter) sources(class int) []*TokenBucketRateLimiter {
+	sources := []*TokenBucketRateLimiter{p.buckets[class]}
+	if p.pool != nil {
+		sources = append(sources, p.pool)
+	}
+	for lower := len(p.buckets) - 1; lower > class; lower-- {
+		sources = append(sources, p.buckets[lower])
+	}
+	return sources
+}
+
+// AllowClass checks a request of the named class, unknown classes are treated as the lowest one
+func (p *PriorityRateLimiter) AllowClass(name string) bool {
+	return p.Class(name).Allow()
+}
+
+func (p *PriorityRateLimiter) classIndex(name string) int {
+	if i, exists := p.index[name]; exists {
+		return i
+	}
+	return len(p.classes) - 1
+}
+
+// Class returns a RateLimiter for one class, so it can be used with RateLimiterContext
+func (p *PriorityRateLimiter) Class(name string) RateLimiter {
+	return &priorityClassLimiter{limiter: p, class: p.classIndex(name)}
+}
+
+type priorityClassLimiter struct {
+	limiter *PriorityRateLimiter
+	class   int
+}
+
+func (c *priorityClassLimiter) Allow() bool {
+	for _, bucket := range c.limiter.sources(c.class) {
+		if bucket.Allow() {
+			return true
+		}
+	}
+	return false
+}
+
+// Status adds up everything the class can draw from
+func (c *priorityClassLimiter) Status() LimitStatus {
+	total := LimitStatus{Reset: time.Now()}
+	for _, bucket := range c.limiter.sources(c.class) {
+		status := bucket.Status()
+		total.Limit += status.Limit
+		total.Remaining += status.Remaining
+		if status.Reset.After(total.Reset) {
+			total.Reset = status.Reset
+		}
+		if status.Remaining == 0 && (total.RetryAfter == 0 || status.RetryAfter < total.RetryAfter) {
+			total.RetryAfter = status.RetryAfter
+		}
+	}
+	if total.Remaining > 0 {
+		total.RetryAfter = 0
+	}
+	return total
+}
+
+// PriorityMiddleware limits requests by the class classify puts them in
+func PriorityMiddleware(limiter *PriorityRateLimiter, classify func(r *http.Request) string) func(http.Handler) http.Handler {
+	contexts := make(map[string]*RateLimiterContext)
+	for _, class := range limiter.classes {
+		contexts[class.Name] = NewRateLimiterContext(limiter.Class(class.Name), WithKey(class.Name))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, exists := contexts[classify(r)]
+			if !exists {
+				ctx = contexts[limiter.classes[len(limiter.classes)-1].Name]
+			}
+			serveLimited(w, r, ctx, next)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newSimulatedPriority gives 15% of 10/s to critical and 50% to batch, the other 35% are the pool
+func newSimulatedPriority(t *testing.T) (*PriorityRateLimiter, *SimulatedClock) {
+	t.Helper()
+	limiter, err := NewPriorityRateLimiter(10, 10, PriorityClass{Name: "critical", Share: 15}, PriorityClass{Name: "batch", Share: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewSimulatedClock()
+	limiter.SetClock(clock.Now)
+	return limiter, clock
+}
+
+// flood sends perStep requests of every class in classes every 10ms for a minute and counts
+// what each class was allowed
+func flood(limiter *PriorityRateLimiter, clock *SimulatedClock, perStep map[string]int, classes ...string) map[string]int {
+	allowed := make(map[string]int)
+	for elapsed := time.Duration(0); elapsed < time.Minute; elapsed += 10 * time.Millisecond {
+		for _, class := range classes {
+			for i := 0; i < perStep[class]; i++ {
+				if limiter.AllowClass(class) {
+					allowed[class]++
+				}
+			}
+		}
+		clock.Set(clock.Now().Add(10 * time.Millisecond))
+	}
+	return allowed
+}
+
+func TestPriorityKeepsItsShareUnderOverload(t *testing.T) {
+	limiter, clock := newSimulatedPriority(t)
+
+	// batch asks for 1000/s first, it takes its own 50% and the 35% pool but never critical's 15%
+	allowed := flood(limiter, clock, map[string]int{"batch": 10, "critical": 1}, "batch", "critical")
+	// a burst of 1 and a token every 666ms, which used to be truncated to 1/s
+	if allowed["critical"] != 90 {
+		t.Errorf("critical allowed %d in a minute under overload, want its 15%% of 10/s: 90", allowed["critical"])
+	}
+	// bursts of 5 and 3, and tokens every 200ms and 285ms
+	if allowed["batch"] != 516 {
+		t.Errorf("batch allowed %d in a minute, want its 50%% and the 35%% pool: 516", allowed["batch"])
+	}
+}
+
+func TestPriorityBorrowsFromLowerClasses(t *testing.T) {
+	limiter, clock := newSimulatedPriority(t)
+
+	// critical alone gets everything: its share, the pool and batch's share
+	allowed := flood(limiter, clock, map[string]int{"critical": 10}, "critical")
+	if allowed["critical"] != 606 {
+		t.Errorf("critical allowed %d in a minute on its own, want all of 10/s: 606", allowed["critical"])
+	}
+
+	// batch alone can't borrow from critical
+	limiter, clock = newSimulatedPriority(t)
+	allowed = flood(limiter, clock, map[string]int{"batch": 10}, "batch")
+	if allowed["batch"] != 516 {
+		t.Errorf("batch allowed %d in a minute on its own, want 516 without critical's share", allowed["batch"])
+	}
+	if !limiter.AllowClass("critical") {
+		t.Error("critical rejected after batch ran alone, batch borrowed its share")
+	}
+}
+
+func TestPriorityBorrowingOrder(t *testing.T) {
+	// 1 token for critical, 3 each for standard, batch and the pool, none of them refill
+	limiter, err := NewPriorityRateLimiter(10, 10,
+		PriorityClass{Name: "critical", Share: 10}, PriorityClass{Name: "standard", Share: 30}, PriorityClass{Name: "batch", Share: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.SetClock(NewSimulatedClock().Now)
+	critical := limiter.Class("critical")
+	// what is left in the bucket of one class, a class's own Status adds up all it can draw from
+	remaining := func(class int) int { return limiter.buckets[class].Status().Remaining }
+	const standard, batch = 1, 2
+
+	if status := critical.(StatusReporter).Status(); status.Limit != 10 || status.Remaining != 10 {
+		t.Fatalf("critical status %+v, want all 10 tokens to draw from", status)
+	}
+	// its own token and the pool come first, standard and batch still have theirs
+	for i := 0; i < 4; i++ {
+		critical.Allow()
+	}
+	if remaining(standard) != 3 || remaining(batch) != 3 {
+		t.Errorf("standard %d and batch %d left after critical used its own and the pool, want 3 each",
+			remaining(standard), remaining(batch))
+	}
+	// then the lowest class
+	for i := 0; i < 3; i++ {
+		critical.Allow()
+	}
+	if remaining(standard) != 3 || remaining(batch) != 0 {
+		t.Errorf("standard %d and batch %d left after critical borrowed 3 more, want batch's taken first",
+			remaining(standard), remaining(batch))
+	}
+	for i := 0; i < 3; i++ {
+		critical.Allow()
+	}
+	if critical.Allow() {
+		t.Error("critical allowed an 11th request of 10")
+	}
+	status := critical.(StatusReporter).Status()
+	if status.Remaining != 0 || status.RetryAfter <= 0 {
+		t.Errorf("critical status %+v with everything used, want a retry", status)
+	}
+}
+
+func TestPriorityNeverBorrowsUpward(t *testing.T) {
+	limiter, _ := newSimulatedPriority(t)
+	batch := limiter.Class("batch")
+
+	// batch has its 5 and the pool's 3, critical's token stays reserved
+	allowed := 0
+	for batch.Allow() {
+		allowed++
+	}
+	if allowed != 8 {
+		t.Errorf("batch allowed %d, want its 5 and the pool's 3", allowed)
+	}
+	if got := limiter.Class("critical").(StatusReporter).Status().Remaining; got != 1 {
+		t.Errorf("critical has %d left after batch ran dry, want its reserved 1", got)
+	}
+	if !limiter.AllowClass("critical") {
+		t.Error("critical rejected after batch ran dry")
+	}
+}
+
+func TestPriorityMiddleware(t *testing.T) {
+	limiter, _ := newSimulatedPriority(t)
+	handler := PriorityMiddleware(limiter, func(r *http.Request) string { return r.Header.Get("X-Priority") })(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(priority string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("X-Priority", priority)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// batch's 5 and the pool's 3, a class the limiter doesn't know counts as batch
+	for i := 0; i < 8; i++ {
+		priority := "batch"
+		if i%2 == 1 {
+			priority = "unknown"
+		}
+		if code := serve(priority).Code; code != http.StatusOK {
+			t.Fatalf("%s request %d: %d, want 200", priority, i, code)
+		}
+	}
+	if response := serve("batch"); response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+		t.Errorf("batch request over its share: %d %v, want 429 with Retry-After", response.Code, response.Header())
+	}
+	response := serve("critical")
+	if response.Code != http.StatusOK || response.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("critical request: %d with %q remaining, want 200 on its reserved token",
+			response.Code, response.Header().Get("X-RateLimit-Remaining"))
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -11,6 +15,78 @@ type RateLimiter interface {
 	Allow() bool
 }
 
+// LimitStatus is a snapshot of a limiter's capacity, used to build rate limit headers
+type LimitStatus struct {
+	Limit      int
+	Remaining  int
+	Reset      time.Time     // when the limiter is back to full capacity
+	RetryAfter time.Duration // how long until the next request can be allowed, zero if one can be allowed now
+}
+
+// StatusReporter is implemented by strategies that can describe their remaining capacity
+type StatusReporter interface {
+	Status() LimitStatus
+}
+
+// capacityConsumer is implemented by strategies that can start out with part of their capacity
+// already used, which is how SetStrategy carries state over to a new strategy
+type capacityConsumer interface {
+	consume(n int)
+}
+
+// StatusAllower reports the status of the decision it just made, with no other request
+// changing it in between
+type StatusAllower interface {
+	RateLimiter
+	AllowStatus() (allowed bool, status LimitStatus)
+}
+
+// ReservableRateLimiter can take capacity tentatively and give it back with cancel,
+// which lets several limiters be consumed all-or-nothing
+type ReservableRateLimiter interface {
+	RateLimiter
+	Reserve() (cancel func(), ok bool)
+}
+
+// ErrInvalidLimit is a limit, window, capacity or rate that isn't positive
+var ErrInvalidLimit = errors.New("invalid limit")
+
+func validateWindow(limit int, window time.Duration) error {
+	if limit <= 0 || window <= 0 {
+		return fmt.Errorf("%w: limit %d and window %s must be positive", ErrInvalidLimit, limit, window)
+	}
+	return nil
+}
+
+func validateRate(capacity, rate int) error {
+	if capacity <= 0 || perSecond(rate) <= 0 {
+		return fmt.Errorf("%w: capacity %d must be positive and rate %d between 1 and 1e9 per second", ErrInvalidLimit, capacity, rate)
+	}
+	return nil
+}
+
+func validateInterval(capacity int, interval time.Duration) error {
+	if capacity <= 0 || interval <= 0 {
+		return fmt.Errorf("%w: capacity %d and interval %s must be positive", ErrInvalidLimit, capacity, interval)
+	}
+	return nil
+}
+
+// perSecond is the time between tokens at rate per second. It is zero for rates that aren't
+// positive or are faster than one per nanosecond, and a bucket with a zero interval never refills.
+func perSecond(rate int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(rate)
+}
+
+// validator is a strategy that can tell whether its limits make sense, SetStrategy refuses the
+// ones that don't
+type validator interface {
+	validate() error
+}
+
 // FixedWindowRateLimiter strategy implementation
 type FixedWindowRateLimiter struct {
 	requests int
@@ -18,6 +94,7 @@ type FixedWindowRateLimiter struct {
 	reset    time.Time
 	mu       sync.Mutex
 	window   time.Duration
+	now      func() time.Time
 }
 
 func NewFixedWindowRateLimiter(limit int, window time.Duration) *FixedWindowRateLimiter {
@@ -25,16 +102,30 @@ func NewFixedWindowRateLimiter(limit int, window time.Duration) *FixedWindowRate
 		limit:  limit,
 		window: window,
 		reset:  time.Now().Add(window),
+		now:    time.Now,
 	}
 }
 
+// SetClock replaces time.Now, e.g. with a simulated clock, and starts a new window
+func (rl *FixedWindowRateLimiter) SetClock(now func() time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.now = now
+	rl.requests = 0
+	rl.reset = now().Add(rl.window)
+}
+
 func (rl *FixedWindowRateLimiter) Allow() bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
+	return rl.allowLocked()
+}
 
-	if time.Now().After(rl.reset) {
+// allowLocked must be called with the lock held
+func (rl *FixedWindowRateLimiter) allowLocked() bool {
+	if rl.now().After(rl.reset) {
 		rl.requests = 0
-		rl.reset = time.Now().Add(rl.window)
+		rl.reset = rl.now().Add(rl.window)
 	}
 
 	if rl.requests < rl.limit {
@@ -44,26 +135,127 @@ func (rl *FixedWindowRateLimiter) Allow() bool {
 	return false
 }
 
+func (rl *FixedWindowRateLimiter) Reserve() (func(), bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.now().After(rl.reset) {
+		rl.requests = 0
+		rl.reset = rl.now().Add(rl.window)
+	}
+	if rl.requests >= rl.limit {
+		return nil, false
+	}
+
+	rl.requests++
+	window := rl.reset
+	return func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		// Nothing to give back once the window the request counted in is over
+		if rl.reset.Equal(window) && rl.requests > 0 {
+			rl.requests--
+		}
+	}, true
+}
+
+// AllowStatus decides and reports the status right after the decision under one lock
+func (rl *FixedWindowRateLimiter) AllowStatus() (bool, LimitStatus) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	allowed := rl.allowLocked()
+	return allowed, rl.statusLocked()
+}
+
+func (rl *FixedWindowRateLimiter) Status() LimitStatus {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.statusLocked()
+}
+
+// statusLocked must be called with the lock held
+func (rl *FixedWindowRateLimiter) statusLocked() LimitStatus {
+	now := rl.now()
+	if now.After(rl.reset) {
+		return LimitStatus{Limit: rl.limit, Remaining: rl.limit, Reset: now}
+	}
+
+	status := LimitStatus{Limit: rl.limit, Remaining: rl.limit - rl.requests, Reset: rl.reset}
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		status.RetryAfter = rl.reset.Sub(now)
+	}
+	return status
+}
+
+// Update changes the limit and window in place, requests counted in the current window still count.
+// A shorter window also ends the current window sooner.
+func (rl *FixedWindowRateLimiter) Update(limit int, window time.Duration) error {
+	if err := validateWindow(limit, window); err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limit = limit
+	rl.window = window
+	if end := rl.now().Add(window); end.Before(rl.reset) {
+		rl.reset = end
+	}
+	return nil
+}
+
+func (rl *FixedWindowRateLimiter) validate() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return validateWindow(rl.limit, rl.window)
+}
+
+func (rl *FixedWindowRateLimiter) consume(n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.now().After(rl.reset) {
+		rl.requests = 0
+		rl.reset = rl.now().Add(rl.window)
+	}
+	rl.requests += n
+}
+
 // SlidingWindowRateLimiter strategy implementation
 type SlidingWindowRateLimiter struct {
 	requests []time.Time
 	limit    int
 	mu       sync.Mutex
 	window   time.Duration
+	now      func() time.Time
 }
 
 func NewSlidingWindowRateLimiter(limit int, window time.Duration) *SlidingWindowRateLimiter {
 	return &SlidingWindowRateLimiter{
 		limit:  limit,
 		window: window,
+		now:    time.Now,
 	}
 }
 
+// SetClock replaces time.Now, e.g. with a simulated clock, and forgets earlier requests
+func (rl *SlidingWindowRateLimiter) SetClock(now func() time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.now = now
+	rl.requests = nil
+}
+
 func (rl *SlidingWindowRateLimiter) Allow() bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	return rl.allowAt(rl.now())
+}
+
+// allowAt must be called with the lock held
+func (rl *SlidingWindowRateLimiter) allowAt(now time.Time) bool {
 	windowStart := now.Add(-rl.window)
 	newRequests := []time.Time{}
 
@@ -82,36 +274,138 @@ func (rl *SlidingWindowRateLimiter) Allow() bool {
 	return false
 }
 
+func (rl *SlidingWindowRateLimiter) Reserve() (func(), bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if !rl.allowAt(now) {
+		return nil, false
+	}
+	return func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		for i := len(rl.requests) - 1; i >= 0; i-- {
+			if rl.requests[i].Equal(now) {
+				rl.requests = append(rl.requests[:i], rl.requests[i+1:]...)
+				return
+			}
+		}
+	}, true
+}
+
+// AllowStatus decides and reports the status right after the decision under one lock
+func (rl *SlidingWindowRateLimiter) AllowStatus() (bool, LimitStatus) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	allowed := rl.allowAt(rl.now())
+	return allowed, rl.statusLocked()
+}
+
+func (rl *SlidingWindowRateLimiter) Status() LimitStatus {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.statusLocked()
+}
+
+// statusLocked must be called with the lock held
+func (rl *SlidingWindowRateLimiter) statusLocked() LimitStatus {
+	now := rl.now()
+	windowStart := now.Add(-rl.window)
+	active := []time.Time{}
+	for _, t := range rl.requests {
+		if t.After(windowStart) {
+			active = append(active, t)
+		}
+	}
+
+	status := LimitStatus{Limit: rl.limit, Remaining: rl.limit - len(active), Reset: now}
+	if len(active) > 0 {
+		status.Reset = active[len(active)-1].Add(rl.window)
+	}
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		if rl.limit > 0 {
+			// A slot frees up when the oldest request that still counts leaves the window
+			status.RetryAfter = active[len(active)-rl.limit].Add(rl.window).Sub(now)
+		}
+	}
+	return status
+}
+
+// Update changes the limit and window in place, the request log is kept and judged by the new window
+func (rl *SlidingWindowRateLimiter) Update(limit int, window time.Duration) error {
+	if err := validateWindow(limit, window); err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limit = limit
+	rl.window = window
+	return nil
+}
+
+func (rl *SlidingWindowRateLimiter) validate() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return validateWindow(rl.limit, rl.window)
+}
+
+func (rl *SlidingWindowRateLimiter) consume(n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	for i := 0; i < n; i++ {
+		rl.requests = append(rl.requests, now)
+	}
+}
+
 // TokenBucketRateLimiter strategy implementation
 type TokenBucketRateLimiter struct {
 	capacity  int
 	tokens    int
-	rate      int
+	interval  time.Duration // one token is added per interval
 	lastCheck time.Time
 	mu        sync.Mutex
+	now       func() time.Time
 }
 
+// NewTokenBucketRateLimiter adds rate tokens per second
 func NewTokenBucketRateLimiter(capacity, rate int) *TokenBucketRateLimiter {
+	return NewTokenBucketRateLimiterEvery(capacity, perSecond(rate))
+}
+
+// NewTokenBucketRateLimiterEvery adds one token per interval, for rates that aren't whole tokens per second
+func NewTokenBucketRateLimiterEvery(capacity int, interval time.Duration) *TokenBucketRateLimiter {
 	return &TokenBucketRateLimiter{
 		capacity:  capacity,
 		tokens:    capacity,
-		rate:      rate,
+		interval:  interval,
 		lastCheck: time.Now(),
+		now:       time.Now,
 	}
 }
 
-func (tb *TokenBucketRateLimiter) Allow() bool {
+// SetClock replaces time.Now, e.g. with a simulated clock, and refills the bucket
+func (tb *TokenBucketRateLimiter) SetClock(now func() time.Time) {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
+	tb.now = now
+	tb.tokens = tb.capacity
+	tb.lastCheck = now()
+}
 
-	now := time.Now()
-	elapsed := now.Sub(tb.lastCheck).Seconds()
-	tb.lastCheck = now
+func (tb *TokenBucketRateLimiter) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.allowLocked()
+}
 
-	tb.tokens += int(elapsed * float64(tb.rate))
-	if tb.tokens > tb.capacity {
-		tb.tokens = tb.capacity
-	}
+// allowLocked must be called with the lock held
+func (tb *TokenBucketRateLimiter) allowLocked() bool {
+	tb.refill(tb.now())
 
 	if tb.tokens > 0 {
 		tb.tokens--
@@ -121,35 +415,146 @@ func (tb *TokenBucketRateLimiter) Allow() bool {
 	return false
 }
 
+// refill must be called with the lock held. lastCheck only moves forward by the time that whole
+// tokens were earned for, so frequent calls don't throw away the fraction of a token.
+func (tb *TokenBucketRateLimiter) refill(now time.Time) {
+	if tb.interval <= 0 {
+		return
+	}
+	added := int(now.Sub(tb.lastCheck) / tb.interval)
+	if added > 0 {
+		tb.tokens += added
+		tb.lastCheck = tb.lastCheck.Add(time.Duration(added) * tb.interval)
+	}
+	if tb.tokens >= tb.capacity {
+		tb.tokens = tb.capacity
+		tb.lastCheck = now
+	}
+}
+
+func (tb *TokenBucketRateLimiter) Reserve() (func(), bool) {
+	if !tb.Allow() {
+		return nil, false
+	}
+	return func() {
+		tb.mu.Lock()
+		defer tb.mu.Unlock()
+		if tb.tokens < tb.capacity {
+			tb.tokens++
+		}
+	}, true
+}
+
+// AllowStatus decides and reports the status right after the decision under one lock
+func (tb *TokenBucketRateLimiter) AllowStatus() (bool, LimitStatus) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	allowed := tb.allowLocked()
+	return allowed, tb.statusLocked()
+}
+
+func (tb *TokenBucketRateLimiter) Status() LimitStatus {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.statusLocked()
+}
+
+// statusLocked must be called with the lock held
+func (tb *TokenBucketRateLimiter) statusLocked() LimitStatus {
+	now := tb.now()
+	tb.refill(now)
+
+	status := LimitStatus{
+		Limit:     tb.capacity,
+		Remaining: tb.tokens,
+		Reset:     now.Add(time.Duration(tb.capacity-tb.tokens) * tb.interval),
+	}
+	if tb.tokens <= 0 {
+		status.RetryAfter = tb.lastCheck.Add(tb.interval).Sub(now)
+	}
+	return status
+}
+
+// Update changes capacity and rate in place. Tokens earned so far are credited at the old rate and
+// the tokens already consumed stay consumed, so a bigger bucket doesn't hand out a free burst.
+func (tb *TokenBucketRateLimiter) Update(capacity, rate int) error {
+	if err := validateRate(capacity, rate); err != nil {
+		return err
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(tb.now())
+	consumed := tb.capacity - tb.tokens
+	tb.capacity = capacity
+	tb.interval = perSecond(rate)
+	tb.tokens = capacity - consumed
+	if tb.tokens < 0 {
+		tb.tokens = 0
+	}
+	return nil
+}
+
+func (tb *TokenBucketRateLimiter) validate() error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return validateInterval(tb.capacity, tb.interval)
+}
+
+func (tb *TokenBucketRateLimiter) consume(n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(tb.now())
+	tb.tokens -= n
+	if tb.tokens < 0 {
+		tb.tokens = 0
+	}
+}
+
 // LeakyBucketRateLimiter strategy implementation
 type LeakyBucketRateLimiter struct {
 	capacity  int
 	queue     int
-	rate      int
+	interval  time.Duration // one request leaks out per interval
 	lastCheck time.Time
 	mu        sync.Mutex
+	now       func() time.Time
 }
 
+// NewLeakyBucketRateLimiter leaks rate requests per second
 func NewLeakyBucketRateLimiter(capacity, rate int) *LeakyBucketRateLimiter {
+	return NewLeakyBucketRateLimiterEvery(capacity, perSecond(rate))
+}
+
+// NewLeakyBucketRateLimiterEvery leaks one request per interval
+func NewLeakyBucketRateLimiterEvery(capacity int, interval time.Duration) *LeakyBucketRateLimiter {
 	return &LeakyBucketRateLimiter{
 		capacity:  capacity,
-		rate:      rate,
+		interval:  interval,
 		lastCheck: time.Now(),
+		now:       time.Now,
 	}
 }
 
-func (lb *LeakyBucketRateLimiter) Allow() bool {
+// SetClock replaces time.Now, e.g. with a simulated clock, and empties the bucket
+func (lb *LeakyBucketRateLimiter) SetClock(now func() time.Time) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
+	lb.now = now
+	lb.queue = 0
+	lb.lastCheck = now()
+}
 
-	now := time.Now()
-	elapsed := now.Sub(lb.lastCheck).Seconds()
-	lb.lastCheck = now
+func (lb *LeakyBucketRateLimiter) Allow() bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.allowLocked()
+}
 
-	lb.queue -= int(elapsed * float64(lb.rate))
-	if lb.queue < 0 {
-		lb.queue = 0
-	}
+// allowLocked must be called with the lock held
+func (lb *LeakyBucketRateLimiter) allowLocked() bool {
+	lb.leak(lb.now())
 
 	if lb.queue < lb.capacity {
 		lb.queue++
@@ -159,27 +564,359 @@ func (lb *LeakyBucketRateLimiter) Allow() bool {
 	return false
 }
 
+// leak must be called with the lock held, like TokenBucketRateLimiter.refill it keeps the
+// fraction of a request that has leaked since lastCheck
+func (lb *LeakyBucketRateLimiter) leak(now time.Time) {
+	if lb.interval <= 0 {
+		return
+	}
+	leaked := int(now.Sub(lb.lastCheck) / lb.interval)
+	if leaked > 0 {
+		lb.queue -= leaked
+		lb.lastCheck = lb.lastCheck.Add(time.Duration(leaked) * lb.interval)
+	}
+	if lb.queue <= 0 {
+		lb.queue = 0
+		lb.lastCheck = now
+	}
+}
+
+func (lb *LeakyBucketRateLimiter) Reserve() (func(), bool) {
+	if !lb.Allow() {
+		return nil, false
+	}
+	return func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.queue > 0 {
+			lb.queue--
+		}
+	}, true
+}
+
+// AllowStatus decides and reports the status right after the decision under one lock
+func (lb *LeakyBucketRateLimiter) AllowStatus() (bool, LimitStatus) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	allowed := lb.allowLocked()
+	return allowed, lb.statusLocked()
+}
+
+func (lb *LeakyBucketRateLimiter) Status() LimitStatus {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.statusLocked()
+}
+
+// statusLocked must be called with the lock held
+func (lb *LeakyBucketRateLimiter) statusLocked() LimitStatus {
+	now := lb.now()
+	lb.leak(now)
+
+	status := LimitStatus{
+		Limit:     lb.capacity,
+		Remaining: lb.capacity - lb.queue,
+		Reset:     now.Add(time.Duration(lb.queue) * lb.interval),
+	}
+	if status.Remaining <= 0 {
+		status.Remaining = 0
+		status.RetryAfter = lb.lastCheck.Add(lb.interval).Sub(now)
+	}
+	return status
+}
+
+// Update changes capacity and rate in place, what leaked so far leaked at the old rate and the
+// queued requests stay queued
+func (lb *LeakyBucketRateLimiter) Update(capacity, rate int) error {
+	if err := validateRate(capacity, rate); err != nil {
+		return err
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.leak(lb.now())
+	lb.capacity = capacity
+	lb.interval = perSecond(rate)
+	return nil
+}
+
+func (lb *LeakyBucketRateLimiter) validate() error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return validateInterval(lb.capacity, lb.interval)
+}
+
+func (lb *LeakyBucketRateLimiter) consume(n int) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.leak(lb.now())
+	lb.queue += n
+	if lb.queue > lb.capacity {
+		lb.queue = lb.capacity
+	}
+}
+
 // Context for using rate limiting strategies
 type RateLimiterContext struct {
+	mu       sync.RWMutex
 	strategy RateLimiter
+	name     string
+	key      string
+	metrics  *RateLimiterMetrics
+	sink     DecisionSink
 }
 
-func NewRateLimiterContext(strategy RateLimiter) *RateLimiterContext {
-	return &RateLimiterContext{
+// ContextOption configures a RateLimiterContext
+type ContextOption func(ctx *RateLimiterContext)
+
+// WithName names the limit the context belongs to, like a policy rule, in metrics and decision logs
+func WithName(name string) ContextOption {
+	return func(ctx *RateLimiterContext) {
+		ctx.name = name
+	}
+}
+
+// WithKey names what the context limits (client IP, API key, ...) in metrics and decision logs
+func WithKey(key string) ContextOption {
+	return func(ctx *RateLimiterContext) {
+		ctx.key = key
+	}
+}
+
+// WithMetrics counts every decision in metrics
+func WithMetrics(metrics *RateLimiterMetrics) ContextOption {
+	return func(ctx *RateLimiterContext) {
+		ctx.metrics = metrics
+	}
+}
+
+// WithDecisionSink records every decision to sink
+func WithDecisionSink(sink DecisionSink) ContextOption {
+	return func(ctx *RateLimiterContext) {
+		ctx.sink = sink
+	}
+}
+
+func NewRateLimiterContext(strategy RateLimiter, opts ...ContextOption) *RateLimiterContext {
+	ctx := &RateLimiterContext{
 		strategy: strategy,
 	}
+	for _, opt := range opts {
+		opt(ctx)
+	}
+	// A context with a key is one of many under its name, its KeyedRateLimiter registers the name
+	if ctx.metrics != nil && ctx.name != "" && ctx.key == "" {
+		ctx.metrics.RegisterRemaining(ctx.name, ctx.remaining)
+	}
+	return ctx
 }
 
 func (ctx *RateLimiterContext) Allow() bool {
-	return ctx.strategy.Allow()
+	allowed, _, _ := ctx.decide(ctx.metrics != nil || ctx.sink != nil)
+	return allowed
+}
+
+// AllowStatus is Allow that also returns the status after the decision, ok is false if the
+// strategy can't report it. For a StatusAllower it is the status of this very decision.
+func (ctx *RateLimiterContext) AllowStatus() (allowed bool, status LimitStatus, ok bool) {
+	return ctx.decide(true)
+}
+
+func (ctx *RateLimiterContext) decide(withStatus bool) (allowed bool, status LimitStatus, hasStatus bool) {
+	// The read lock is held while the strategy decides, so SetStrategy and the Update methods
+	// see every decision that was made before they migrate state
+	ctx.mu.RLock()
+	strategy := ctx.strategy
+	if allower, ok := strategy.(StatusAllower); ok && withStatus {
+		allowed, status = allower.AllowStatus()
+		hasStatus = true
+	} else {
+		allowed = strategy.Allow()
+		if withStatus {
+			status, hasStatus = statusOf(strategy)
+		}
+	}
+	ctx.mu.RUnlock()
+
+	if ctx.metrics != nil || ctx.sink != nil {
+		ctx.observe(strategy, allowed, false, status, hasStatus)
+	}
+	return allowed, status, hasStatus
+}
+
+// observe records a decision, cancelled is a reservation that was given back
+func (ctx *RateLimiterContext) observe(strategy RateLimiter, allowed, cancelled bool, status LimitStatus, hasStatus bool) {
+	decision := Decision{
+		Time:      time.Now(),
+		Limiter:   ctx.name,
+		Key:       ctx.key,
+		Strategy:  StrategyName(strategy),
+		Allowed:   allowed,
+		Cancelled: cancelled,
+		Limit:     -1,
+		Remaining: -1,
+	}
+	if hasStatus {
+		decision.Limit = status.Limit
+		decision.Remaining = status.Remaining
+	}
+
+	if ctx.metrics != nil {
+		ctx.metrics.Record(decision)
+	}
+	if ctx.sink != nil {
+		ctx.sink.Record(decision)
+	}
+}
+
+// Reserve delegates to the strategy; a strategy that can't give capacity back is consumed
+// with Allow and its cancel is a no-op. The reservation is recorded like an Allow decision, and
+// cancelling it is recorded as a cancelled decision.
+func (ctx *RateLimiterContext) Reserve() (cancel func(), ok bool) {
+	ctx.mu.RLock()
+	strategy := ctx.strategy
+	release := func() {}
+	if reservable, isReservable := strategy.(ReservableRateLimiter); isReservable {
+		release, ok = reservable.Reserve()
+	} else {
+		ok = strategy.Allow()
+	}
+	observed := ctx.metrics != nil || ctx.sink != nil
+	var status LimitStatus
+	hasStatus := false
+	if observed {
+		status, hasStatus = statusOf(strategy)
+	}
+	ctx.mu.RUnlock()
+
+	if observed {
+		ctx.observe(strategy, ok, false, status, hasStatus)
+	}
+	if !ok {
+		return nil, false
+	}
+	if !observed {
+		return release, true
+	}
+	return func() {
+		release()
+		status, hasStatus := statusOf(strategy)
+		ctx.observe(strategy, false, true, status, hasStatus)
+	}, true
+}
+
+// Status reports the strategy's remaining capacity, ok is false if the strategy can't report it
+func (ctx *RateLimiterContext) Status() (status LimitStatus, ok bool) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return statusOf(ctx.strategy)
 }
 
+// remaining is the capacity left for metrics, -1 if the strategy can't report it
+func (ctx *RateLimiterContext) remaining() int64 {
+	status, ok := ctx.Status()
+	if !ok {
+		return -1
+	}
+	return int64(status.Remaining)
+}
+
+func statusOf(strategy RateLimiter) (LimitStatus, bool) {
+	reporter, ok := strategy.(StatusReporter)
+	if !ok {
+		return LimitStatus{}, false
+	}
+	return reporter.Status(), true
+}
+
+// Strategy returns the strategy currently in use
+func (ctx *RateLimiterContext) Strategy() RateLimiter {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return ctx.strategy
+}
+
+// SetStrategy swaps the strategy at runtime. Requests already consumed from the old strategy are
+// charged to the new one, so a swap can't be used to get a fresh allowance. A strategy built with a
+// limit, window, capacity or rate that isn't positive is refused with ErrInvalidLimit.
+func (ctx *RateLimiterContext) SetStrategy(strategy RateLimiter) error {
+	if v, ok := strategy.(validator); ok {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if status, ok := statusOf(ctx.strategy); ok {
+		if consumer, isConsumer := strategy.(capacityConsumer); isConsumer {
+			consumer.consume(status.Limit - status.Remaining)
+		}
+	}
+	ctx.strategy = strategy
+	return nil
+}
+
+// ErrNotReconfigurable is returned when the strategy doesn't support the requested update
+var ErrNotReconfigurable = errors.New("strategy can't be reconfigured this way")
+
+// UpdateWindow changes the limit and window of a fixed or sliding window strategy in place
+func (ctx *RateLimiterContext) UpdateWindow(limit int, window time.Duration) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	updater, ok := ctx.strategy.(interface {
+		Update(limit int, window time.Duration) error
+	})
+	if !ok {
+		return ErrNotReconfigurable
+	}
+	return updater.Update(limit, window)
+}
+
+// UpdateRate changes the capacity and rate of a bucket strategy in place
+func (ctx *RateLimiterContext) UpdateRate(capacity, rate int) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	updater, ok := ctx.strategy.(interface {
+		Update(capacity, rate int) error
+	})
+	if !ok {
+		return ErrNotReconfigurable
+	}
+	return updater.Update(capacity, rate)
+}
+
+// The limiter is split across files in this directory, run it with: go run .
+// or serve HTTP with limits from a JSON or YAML policy file: go run . -policy policy.json
+// or compare the algorithms on simulated traffic: go run . loadtest -pattern bursty
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := runLoadTest(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	policyPath := flag.String("policy", "", "serve HTTP limited by this policy file")
+	addr := flag.String("addr", ":8080", "address to serve on with -policy")
+	logDecisions := flag.Bool("log-decisions", false, "log every decision as JSON with -policy")
+	flag.Parse()
+
+	if *policyPath != "" {
+		servePolicy(*policyPath, *addr, *logDecisions)
+		return
+	}
+
 	// Example usage
 	rl := NewRateLimiterContext(NewFixedWindowRateLimiter(10, time.Minute))
 	// rl := NewRateLimiterContext(NewSlidingWindowRateLimiter(10, time.Minute))
 	// rl := NewRateLimiterContext(NewTokenBucketRateLimiter(10, 1))
 	// rl := NewRateLimiterContext(NewLeakyBucketRateLimiter(10, 1))
+	// rl := NewRateLimiterContext(NewGCRARateLimiter(10, 1))
 
 	for i := 0; i < 15; i++ {
 		if rl.Allow() {
@@ -190,3 +927,30 @@ func main() {
 		time.Sleep(2 * time.Second) // simulate time between requests
 	}
 }
+
+func servePolicy(path, addr string, logDecisions bool) {
+	metrics := NewRateLimiterMetrics()
+	opts := []ContextOption{WithMetrics(metrics)}
+	if logDecisions {
+		opts = append(opts, WithDecisionSink(NewJSONDecisionLog(os.Stdout)))
+	}
+
+	manager, err := LoadPolicyFile(path, opts...)
+	if err != nil {
+		fmt.Println("Failed to load policy:", err)
+		os.Exit(1)
+	}
+	manager.Watch(time.Second)
+	defer manager.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/", PolicyMiddleware(manager)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Request allowed")
+	})))
+
+	fmt.Println("Serving on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidLimits(t *testing.T) {
+	store := NewInMemoryLimiterStore()
+	strategies := []struct {
+		name     string
+		strategy RateLimiter
+	}{
+		{"fixed window without a limit", NewFixedWindowRateLimiter(0, time.Minute)},
+		{"fixed window without a window", NewFixedWindowRateLimiter(10, 0)},
+		{"sliding window with a negative window", NewSlidingWindowRateLimiter(10, -time.Second)},
+		{"token bucket without a rate", NewTokenBucketRateLimiter(10, 0)},
+		{"leaky bucket without a capacity", NewLeakyBucketRateLimiter(0, 1)},
+		{"gcra without a rate", NewGCRARateLimiter(10, 0)},
+		// faster than one per nanosecond, the interval between requests would be zero
+		{"token bucket too fast", NewTokenBucketRateLimiter(10, 2e9)},
+		{"leaky bucket too fast", NewLeakyBucketRateLimiter(10, 2e9)},
+		{"gcra too fast", NewGCRARateLimiter(10, 2e9)},
+		{"distributed fixed window", NewDistributedFixedWindowRateLimiter(store, "k", 10, 0)},
+		{"distributed sliding window", NewDistributedSlidingWindowRateLimiter(store, "k", 0, time.Minute)},
+		{"distributed token bucket", NewDistributedTokenBucketRateLimiter(store, "k", 10, 0)},
+		{"distributed gcra", NewDistributedGCRARateLimiter(store, "k", 10, 0)},
+	}
+	rl := NewRateLimiterContext(NewFixedWindowRateLimiter(1, time.Hour))
+	for _, c := range strategies {
+		if err := rl.SetStrategy(c.strategy); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("%s: got %v, want ErrInvalidLimit", c.name, err)
+		}
+		// used without a context they mustn't panic
+		c.strategy.Allow()
+	}
+	if !rl.Allow() || rl.Allow() {
+		t.Error("the refused strategies replaced the one in use")
+	}
+	if err := rl.SetStrategy(NewTokenBucketRateLimiter(10, 1)); err != nil {
+		t.Errorf("valid strategy refused: %v", err)
+	}
+}
+
+func TestInvalidUpdate(t *testing.T) {
+	rl := NewRateLimiterContext(NewGCRARateLimiter(10, 5))
+	if err := rl.UpdateRate(10, 0); !errors.Is(err, ErrInvalidLimit) {
+		t.Fatalf("UpdateRate(10, 0) = %v, want ErrInvalidLimit", err)
+	}
+	for _, rate := range []int{2e9, 1e12} {
+		for _, bucket := range []*RateLimiterContext{rl,
+			NewRateLimiterContext(NewTokenBucketRateLimiter(10, 5)),
+			NewRateLimiterContext(NewLeakyBucketRateLimiter(10, 5))} {
+			if err := bucket.UpdateRate(10, rate); !errors.Is(err, ErrInvalidLimit) {
+				t.Fatalf("%s: UpdateRate(10, %d) = %v, want ErrInvalidLimit", StrategyName(bucket.Strategy()), rate, err)
+			}
+		}
+	}
+	status, _ := statusOf(rl.Strategy())
+	if status.Limit != 10 {
+		t.Errorf("limit %d after a rejected update, want 10", status.Limit)
+	}
+	if !rl.Allow() {
+		t.Error("request rejected after a rejected update")
+	}
+
+	window := NewRateLimiterContext(NewSlidingWindowRateLimiter(10, time.Minute))
+	if err := window.UpdateWindow(10, 0); !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("UpdateWindow(10, 0) = %v, want ErrInvalidLimit", err)
+	}
+	if err := window.UpdateWindow(20, time.Second); err != nil {
+		t.Errorf("UpdateWindow(20, 1s) = %v", err)
+	}
+}
+
+func TestTokenBucketKeepsPartialTokens(t *testing.T) {
+	clock := NewSimulatedClock()
+	bucket := NewTokenBucketRateLimiter(1, 10)
+	bucket.SetClock(clock.Now)
+
+	// checked every 50ms, twice per token, for a second
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if bucket.Allow() {
+			allowed++
+		}
+		clock.Set(clock.Now().Add(50 * time.Millisecond))
+	}
+	if allowed != 10 {
+		t.Errorf("%d requests allowed in a second at 10/s, want 10", allowed)
+	}
+
+	bucket.Allow()
+	clock.Set(clock.Now().Add(30 * time.Millisecond))
+	if status := bucket.Status(); status.Remaining != 0 || status.RetryAfter != 70*time.Millisecond {
+		t.Errorf("status %+v 30ms into a 100ms token, want 0 remaining and a 70ms retry", status)
+	}
+}
+
+func TestLeakyBucketKeepsPartialLeaks(t *testing.T) {
+	clock := NewSimulatedClock()
+	bucket := NewLeakyBucketRateLimiter(1, 10)
+	bucket.SetClock(clock.Now)
+
+	// checked every 50ms, twice per leaked request, for a second
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if bucket.Allow() {
+			allowed++
+		}
+		clock.Set(clock.Now().Add(50 * time.Millisecond))
+	}
+	if allowed != 10 {
+		t.Errorf("%d requests allowed in a second at 10/s, want 10", allowed)
+	}
+
+	bucket.Allow()
+	clock.Set(clock.Now().Add(30 * time.Millisecond))
+	if status := bucket.Status(); status.Remaining != 0 || status.RetryAfter != 70*time.Millisecond {
+		t.Errorf("status %+v 30ms into a 100ms leak, want 0 remaining and a 70ms retry", status)
+	}
+}
+
+func TestSwappingStrategiesDoesntDoubleAllow(t *testing.T) {
+	// all allow 100 an hour, so nothing refills while the test runs
+	strategies := []func() RateLimiter{
+		func() RateLimiter { return NewFixedWindowRateLimiter(100, time.Hour) },
+		func() RateLimiter { return NewSlidingWindowRateLimiter(100, time.Hour) },
+		func() RateLimiter { return NewTokenBucketRateLimiterEvery(100, time.Hour) },
+		func() RateLimiter { return NewLeakyBucketRateLimiterEvery(100, time.Hour) },
+		func() RateLimiter { return NewGCRARateLimiterEvery(100, time.Hour) },
+	}
+	rl := NewRateLimiterContext(strategies[0]())
+
+	done := make(chan struct{})
+	swapping := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := rl.SetStrategy(strategies[i%len(strategies)]()); err != nil {
+				t.Error(err)
+			}
+			// only the windows can be updated in place, the others return ErrNotReconfigurable
+			rl.UpdateWindow(100, time.Hour)
+			if i == 1 {
+				close(swapping)
+			}
+			runtime.Gosched()
+		}
+	}()
+	<-swapping
+
+	var allowed atomic.Int64
+	var requests sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for i := 0; i < 200; i++ {
+				if rl.Allow() {
+					allowed.Add(1)
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	requests.Wait()
+	close(done)
+	<-swapped
+
+	if n := allowed.Load(); n > 100 {
+		t.Errorf("%d of 1600 requests allowed while swapping strategies, want at most 100", n)
+	}
+	if rl.Allow() {
+		t.Error("request allowed after the limit was used up")
+	}
+}
+
+func TestBucketsAtWholeRatesRefillAsBefore(t *testing.T) {
+	// rate per second, like before intervals: a drained bucket is back to rate requests after a
+	// second and to rate/2 after half of one
+	clock := NewSimulatedClock()
+	tokens := NewTokenBucketRateLimiter(10, 4)
+	tokens.SetClock(clock.Now)
+	leaky := NewLeakyBucketRateLimiter(10, 4)
+	leaky.SetClock(clock.Now)
+	buckets := map[string]RateLimiter{"token": tokens, "leaky": leaky}
+
+	drain := func() {
+		for _, bucket := range buckets {
+			for bucket.Allow() {
+			}
+		}
+	}
+	allowed := func(bucket RateLimiter) int {
+		n := 0
+		for bucket.Allow() {
+			n++
+		}
+		return n
+	}
+
+	drain()
+	for _, c := range []struct {
+		wait time.Duration
+		want int
+	}{
+		{time.Second, 4},
+		{500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+	} {
+		clock.Set(clock.Now().Add(c.wait))
+		for name, bucket := range buckets {
+			if n := allowed(bucket); n != c.want {
+				t.Errorf("%s bucket at 4/s: %d allowed %s after draining, want %d", name, n, c.wait, c.want)
+			}
+		}
+	}
+}
+
+func TestBucketsRefillEveryInterval(t *testing.T) {
+	// 90 per minute, which a whole rate per second can't express: one every 666.67ms
+	clock := NewSimulatedClock()
+	interval := time.Minute / 90
+	tokens := NewTokenBucketRateLimiterEvery(90, interval)
+	tokens.SetClock(clock.Now)
+	leaky := NewLeakyBucketRateLimiterEvery(90, interval)
+	leaky.SetClock(clock.Now)
+
+	for name, bucket := range map[string]RateLimiter{"token": tokens, "leaky": leaky} {
+		start := clock.Now()
+		for bucket.Allow() {
+		}
+		for _, c := range []struct {
+			at      time.Duration
+			allowed bool
+		}{
+			{interval - time.Millisecond, false},
+			{interval, true},
+			{2*interval - time.Millisecond, false},
+			{2 * interval, true},
+		} {
+			clock.Set(start.Add(c.at))
+			if allowed := bucket.Allow(); allowed != c.allowed {
+				t.Errorf("%s bucket: allowed %v %s after draining, want %v", name, allowed, c.at, c.allowed)
+			}
+		}
+		// half a minute later it has earned another 45
+		clock.Set(start.Add(2*interval + 30*time.Second))
+		allowed := 0
+		for bucket.Allow() {
+			allowed++
+		}
+		if allowed != 45 {
+			t.Errorf("%s bucket: %d allowed half a minute on at 90/min, want 45", name, allowed)
+		}
+	}
+}